@@ -0,0 +1,108 @@
+package agent
+
+import (
+	"errors"
+	"iLean/entity"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var errDeviceTimeout = errors.New("controller did not confirm the command in time")
+
+// reportFunc delivers the acks of a command back to where it came from.
+type reportFunc func(entity.Ack)
+
+// pendingAck is a frame written to the controller that waits for the
+// controller to send the same command back.
+type pendingAck struct {
+	id     string
+	report reportFunc
+	timer  *time.Timer
+}
+
+// ackKey identifies the frames one controller confirms in order.
+type ackKey struct {
+	address int32
+	command uint8
+}
+
+// ack reports the progress of a command, commands without an id are not
+// tracked.
+func ack(report reportFunc, id, status string, cause error) {
+	if id == "" {
+		return
+	}
+
+	ack := entity.Ack{ID: id, Status: status}
+	if cause != nil {
+		ack.Error = cause.Error()
+	}
+
+	report(ack)
+}
+
+// ackToServer sends the ack of a command received from the server.
+func (a *Agent) ackToServer(ack entity.Ack) {
+	command, err := entity.NewCommand(ack, typeCommand)
+	if err != nil {
+		logrus.WithError(err).Error("failed to build ack")
+		return
+	}
+
+	if err := a.sendToServer(command); err != nil {
+		logrus.WithError(err).WithField("ack", ack).Error("failed to send ack")
+	}
+}
+
+// expectDeviceAck queues a frame before it is written, the controller
+// confirms frames of one command in the order they were written.
+func (a *Agent) expectDeviceAck(key ackKey, id string, report reportFunc) *pendingAck {
+	pending := &pendingAck{id: id, report: report}
+
+	a.pendingMutex.Lock()
+	defer a.pendingMutex.Unlock()
+
+	pending.timer = time.AfterFunc(a.config().Device.AckTimeout, func() {
+		if a.dropPending(key, pending) {
+			ack(report, id, entity.AckFailed, errDeviceTimeout)
+		}
+	})
+	a.pending[key] = append(a.pending[key], pending)
+
+	return pending
+}
+
+// confirmDeviceAck resolves the oldest frame waiting for the command.
+func (a *Agent) confirmDeviceAck(key ackKey) {
+	a.pendingMutex.Lock()
+	queue := a.pending[key]
+	if len(queue) == 0 {
+		a.pendingMutex.Unlock()
+		logrus.WithFields(logrus.Fields{"command": key.command, "address": key.address}).
+			Warn("unexpected confirmation from device")
+		return
+	}
+
+	pending := queue[0]
+	a.pending[key] = queue[1:]
+	a.pendingMutex.Unlock()
+
+	pending.timer.Stop()
+	ack(pending.report, pending.id, entity.AckConfirmed, nil)
+}
+
+func (a *Agent) dropPending(key ackKey, pending *pendingAck) bool {
+	a.pendingMutex.Lock()
+	defer a.pendingMutex.Unlock()
+
+	queue := a.pending[key]
+	for i, p := range queue {
+		if p == pending {
+			a.pending[key] = append(queue[:i:i], queue[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,1168 +1,572 @@
 package agent
 
 import (
-	"bytes"
 	"context"
-	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"iLean/agent/capture"
+	"iLean/agent/local"
+	"iLean/agent/policy"
+	"iLean/agent/queue"
+	"iLean/agent/schedule"
+	"iLean/agent/update"
+	"iLean/agent/upstream"
+	"iLean/auth"
 	"iLean/config"
 	"iLean/entity"
+	"iLean/protocol"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/gorilla/websocket"
 	"github.com/jacobsa/go-serial/serial"
 	"github.com/sirupsen/logrus"
 )
 
 const (
-	preamOneByte      byte = 85
-	preamTwoByte      byte = 170
-	typeCommand       int  = 1
-	websocketURL           = "ws://185.27.192.21:63240/ws"
-	reconnectDelay         = 4 * time.Second
-	serialPortName         = "/dev/ttyAMA0"
-	serialBaudRate         = 115200
-	serialDataBits         = 8
-	serialStopBits         = 1
-	serialMinReadSize      = 2
+	typeCommand int = 1
+
+	// writeWait bounds how long a command waits for the serial line to come
+	// back.
+	writeWait = 10 * time.Second
+
+	// telemetryBuffer is how many commands read from the controllers may
+	// wait for the server link before the serial reader blocks.
+	telemetryBuffer = 256
 )
 
+var (
+	errOffline       = errors.New("server is not connected")
+	errDeviceOffline = errors.New("serial port is not connected")
+)
+
+// Agent bridges the controllers on the serial line and the server. Each
+// link has its own supervisor that reconnects it without touching the
+// other, they exchange commands over channels.
 type Agent struct {
-	connect *websocket.Conn
-	buffer  []byte
-	port    io.ReadWriteCloser
-	mutex   sync.Mutex
-	Config  config.Config
-	err     chan error
-	ctx     context.Context
-	cancel  context.CancelFunc
-	read    bool
+	// conf is replaced when the server pushes a config, read it with
+	// config().
+	confMutex sync.Mutex
+	conf      config.Config
+
+	// store holds the config file, nil if remote config is off.
+	store *config.Store
+
+	// connect and online are guarded by mutex, the socket supervisor owns
+	// the connection and everybody else only writes to it. The state of the
+	// serial port, the connection counts of both links, ready and
+	// restarting are guarded by it as well.
+	mutex          sync.Mutex
+	connect        upstream.Conn
+	online         bool
+	deviceUp       bool
+	socketConnects int
+	deviceConnects int
+	ready          bool
+	restarting     bool
+
+	// telemetry carries commands read from the controllers to the server,
+	// writes carries data to the serial line.
+	telemetry chan *entity.Command
+	writes    chan writeRequest
+
+	// queue keeps telemetry while the server is unreachable, nil if off.
+	queue *queue.Queue
+	// queueMutex makes publish decide between the queue and the server and
+	// act on it before the replay can take the last record from the queue.
+	queueMutex sync.Mutex
+
+	stats *stats
+
+	pendingMutex sync.Mutex
+	pending      map[ackKey][]*pendingAck
+
+	buses *busMap
+
+	// watchdog tells when a controller on the bus falls silent.
+	watchdog *watchdog
+
+	// modbus polls and writes the controllers that speak Modbus RTU.
+	modbus *modbusDriver
+
+	// local serves the api on the home network, nil if off.
+	local *local.Server
+
+	// capture records the serial traffic, nil if off.
+	capture *capture.Writer
+
+	// deviceProbe and forwardProbe are taken by the serial and forward
+	// loops while they are not stuck.
+	deviceProbe  probe
+	forwardProbe probe
+
+	// reopen makes the serial supervisor reopen the port with new settings.
+	reopen chan struct{}
+	trials chan trial
+
+	// key verifies the commands of the server, nonces rejects stale and
+	// replayed ones. Nil if commands are not signed.
+	key    auth.Key
+	nonces *auth.Replay
+
+	// policy bounds the settings commands, nil if off.
+	policy *policy.Policy
+
+	// schedule is followed while the server is lost, nil if off.
+	schedule *schedule.Store
+
+	// binary is the executable releases are installed over, nil if unknown.
+	binary   *update.Binary
+	releases chan entity.Release
+
+	// stop cancels Run.
+	stop context.CancelFunc
 }
 
-type Greet struct {
-	SerialNumber int    `json:"serial_number"`
-	TypeClient   string `json:"type_client"`
+// writeRequest is data for the serial supervisor, the result of the write
+// is sent back on result.
+type writeRequest struct {
+	data   []byte
+	result chan error
 }
 
-func NewAgent(conf *config.Config) (*Agent, error) {
+// NewAgent builds the agent, configs pushed by the server are written to
+// store. Without a store they are rejected.
+func NewAgent(conf *config.Config, store *config.Store) (*Agent, error) {
 	agent := new(Agent)
-	agent.Config = *conf
-	agent.mutex = sync.Mutex{}
-	agent.err = make(chan error)
-	agent.ctx, agent.cancel = context.WithCancel(context.TODO())
-
-	logrus.Info("connect to server via web-socket")
-	if err := agent.connectToSocket(); err != nil {
-		return nil, fmt.Errorf("failed to connect to socket: %w", err)
+	agent.conf = *conf
+	agent.store = store
+	agent.reopen = make(chan struct{}, 1)
+	agent.deviceProbe = make(probe)
+	agent.forwardProbe = make(probe)
+	agent.trials = make(chan trial, 1)
+	agent.releases = make(chan entity.Release, 1)
+	agent.telemetry = make(chan *entity.Command, telemetryBuffer)
+	agent.writes = make(chan writeRequest)
+	agent.pending = make(map[ackKey][]*pendingAck)
+	agent.buses = newBusMap(conf.Device)
+	agent.watchdog = newWatchdog()
+	agent.modbus = newModbusDriver(agent)
+	agent.stats = newStats()
+
+	if _, err := loadRegisterMaps(conf.Device); err != nil {
+		return nil, err
 	}
 
-	logrus.Info("connect to device")
-	if err := agent.connectToDevice(); err != nil {
-		return nil, fmt.Errorf("failed to connect to device: %w", err)
+	if conf.Buffer.Dir != "" {
+		q, err := queue.Open(conf.Buffer.Dir, int64(conf.Buffer.MaxSizeMB)<<20)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open telemetry buffer: %w", err)
+		}
+
+		agent.queue = q
 	}
 
-	go agent.Connector()
-	go agent.ProcessingStream()
+	if conf.Auth.Key != "" {
+		key, err := auth.ParseKey(conf.Auth.Key)
+		if err != nil {
+			return nil, err
+		}
 
-	return agent, nil
-}
+		agent.key = key
+		agent.nonces = auth.NewReplay(conf.Auth.Window)
+	} else {
+		logrus.Warn("auth.unsigned is set, commands of the server are not verified")
+	}
 
-func (a *Agent) Connector() {
-	// Начальная задержка для backoff
-	backoff := time.Second
-	maxBackoff := time.Minute
+	if conf.Policy.File != "" {
+		p, err := policy.Load(conf.Policy.File)
+		if err != nil {
+			return nil, err
+		}
 
-	for {
-		select {
-		case <-a.err:
-			a.mutex.Lock()
-			a.read = false
-			a.mutex.Unlock()
-
-			// Отменяем текущий контекст и создаем новый
-			if a.cancel != nil {
-				a.cancel()
-			}
-			a.ctx, a.cancel = context.WithCancel(context.Background())
-
-			a.Close()
-			logrus.Info("lost connection")
-
-			// Цикл переподключения
-			for {
-				logrus.Info("attempting to reconnect")
-
-				if err := a.connectToSocket(); err != nil {
-					logrus.WithError(err).Error("failed to reconnect to socket")
-					time.Sleep(backoff)
-					// Экспоненциальный backoff
-					backoff = time.Duration(float64(backoff) * 1.5)
-					if backoff > maxBackoff {
-						backoff = maxBackoff
-					}
-					continue
-				}
-
-				if err := a.connectToDevice(); err != nil {
-					logrus.WithError(err).Error("failed to reconnect to device")
-					time.Sleep(backoff)
-					continue
-				}
-
-				// Сброс задержки после успешного подключения
-				backoff = time.Second
-				break
-			}
-
-			logrus.Info("reconnection successful")
-
-			a.mutex.Lock()
-			a.read = true
-			a.mutex.Unlock()
-
-			// Запуск обработки в контексте
-			go a.ProcessingStream()
+		agent.policy = p
+	}
 
+	if conf.Schedule.File != "" {
+		s, err := schedule.Open(conf.Schedule.File)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open schedule: %w", err)
 		}
+
+		agent.schedule = s
 	}
+
+	binary, err := update.Open()
+	if err != nil {
+		logrus.WithError(err).Warn("binary of the agent is unknown, updates are off")
+	}
+	agent.binary = binary
+
+	if conf.Local.Listen != "" {
+		agent.local = local.New(conf.Local, conf.Serial, agent)
+	}
+
+	if conf.Capture.File != "" && conf.Replay.File == "" {
+		w, err := capture.Open(conf.Capture.File, int64(conf.Capture.MaxSizeMB)<<20, conf.Capture.Keep)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open capture: %w", err)
+		}
+
+		agent.capture = w
+	}
+
+	return agent, nil
 }
 
-func (a *Agent) connectToSocket() error {
-	for {
-		select {
-		case <-a.ctx.Done():
-			return fmt.Errorf("connection cancelled")
-		default:
-			success := false
-			// Установка соединения
-			var connect *websocket.Conn
-			defer func() {
-				if !success && connect != nil {
-					connect.Close()
-				}
-			}()
-
-			connect, _, err := websocket.DefaultDialer.Dial(websocketURL, nil)
-			if err != nil {
-				logrus.WithError(err).Error("failed to establish websocket connection")
-				time.Sleep(reconnectDelay)
-				continue
-			}
-
-			// Подготовка приветственного сообщения
-			greet := Greet{
-				SerialNumber: a.Config.Serial,
-				TypeClient:   "controller",
-			}
-
-			byteGreet, err := json.Marshal(greet)
-			if err != nil {
-				logrus.WithError(err).Error("failed to marshal greeting message")
-				time.Sleep(reconnectDelay)
-				continue
-			}
-
-			// Отправка приветствия
-			if err := connect.WriteMessage(websocket.TextMessage, byteGreet); err != nil {
-				logrus.WithError(err).Error("failed to send greeting message")
-				time.Sleep(reconnectDelay)
-				continue
-			}
-
-			// Чтение ответа
-			_, response, err := connect.ReadMessage()
-			if err != nil {
-				logrus.WithError(err).Error("failed to read server response")
-				time.Sleep(reconnectDelay)
-				continue
-			}
-
-			// Проверка ответа
-			if string(response) != "ok" {
-				logrus.WithField("response", string(response)).Error("unexpected server response")
-				time.Sleep(reconnectDelay)
-				continue
-			}
-
-			// Успешное подключение
-			logrus.Info("successfully connected to server")
-			a.connect = connect
-			success = true
-			return nil
+// Run starts the links and blocks until ctx is cancelled, then it closes
+// them and waits for every loop to finish. It returns ErrRestart when a
+// pushed config needs the agent to start over.
+func (a *Agent) Run(ctx context.Context) error {
+	ctx, a.stop = context.WithCancel(ctx)
+	defer a.stop()
+
+	if a.local != nil {
+		if err := a.local.Start(); err != nil {
+			return fmt.Errorf("failed to start local api: %w", err)
 		}
+
+		defer a.local.Close()
+	}
+
+	if a.queue != nil {
+		defer a.queue.Close()
+	}
+
+	if a.capture != nil {
+		defer a.capture.Close()
+	}
+
+	loops := []func(context.Context){
+		a.superviseDevice,
+		a.superviseSocket,
+		a.forward,
+		a.heartbeat,
+		a.watchTrials,
+		a.updater,
+		a.fallback,
+		a.watchDevices,
+		a.notifySystemd,
+	}
+
+	var wg sync.WaitGroup
+	for _, loop := range loops {
+		wg.Add(1)
+		go func(loop func(context.Context)) {
+			defer wg.Done()
+			loop(ctx)
+		}(loop)
+	}
+
+	wg.Wait()
+	logrus.Info("agent stopped")
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.restarting {
+		return ErrRestart
 	}
+
+	return nil
 }
 
-func (a *Agent) connectToDevice() error {
-	for {
-		select {
-		case <-a.ctx.Done():
-			return fmt.Errorf("connection cancelled")
-		default:
-			options := serial.OpenOptions{
-				PortName:        serialPortName,
-				BaudRate:        serialBaudRate,
-				DataBits:        serialDataBits,
-				StopBits:        serialStopBits,
-				MinimumReadSize: serialMinReadSize,
-			}
-
-			port, err := serial.Open(options)
-			if err != nil {
-				logrus.WithError(err).WithField("port", serialPortName).
-					Error("failed to connect to device")
-				time.Sleep(reconnectDelay)
-				continue
-			}
-
-			logrus.WithField("port", serialPortName).Info("successfully connected to device")
-			a.port = port
-			a.read = true
-			return nil
+func (a *Agent) connectToSocket(ctx context.Context) (upstream.Conn, error) {
+	conf := a.config()
+
+	return upstream.Dial(ctx, conf.Upstream, conf.Serial, a.key)
+}
+
+func (a *Agent) connectToDevice() (io.ReadWriteCloser, error) {
+	conf := a.config()
+
+	if conf.Replay.File != "" {
+		port, err := capture.OpenReplay(conf.Replay.File, conf.Replay.Speed)
+		if err != nil {
+			return nil, err
 		}
+
+		return countingPort{ReadWriteCloser: port, stats: a.stats}, nil
 	}
+
+	options := serial.OpenOptions{
+		PortName:        conf.Device.Port,
+		BaudRate:        conf.Device.BaudRate,
+		DataBits:        conf.Device.DataBits,
+		StopBits:        conf.Device.StopBits,
+		MinimumReadSize: conf.Device.MinReadSize,
+	}
+
+	port, err := serial.Open(options)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err = pollable(port)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up %s: %w", conf.Device.Port, err)
+	}
+
+	if a.capture != nil {
+		port = capture.NewPort(port, a.capture)
+	}
+
+	return countingPort{ReadWriteCloser: port, stats: a.stats}, nil
 }
 
-func (a *Agent) ProcessIncomingCommandsFromServer() {
+// ProcessIncomingCommandsFromServer executes commands read from the
+// connection until it fails.
+func (a *Agent) ProcessIncomingCommandsFromServer(conn upstream.Conn) error {
 
 	// команды прилетают с сервера и отправляются в малинку
 	for {
-		_, mes, err := a.connect.ReadMessage()
+		mes, err := conn.Receive()
+		if err != nil {
+			return err
+		}
 
 		logrus.Info("Received an income command")
 		logrus.Info(string(mes))
 
+		var signed auth.Signed
+		err = json.Unmarshal(mes, &signed)
 		if err != nil {
 			logrus.Error(err)
-			a.err <- err
 
-			return
+			continue
 		}
 
-		var commands entity.Command
-		err = json.Unmarshal(mes, &commands)
-		if err != nil {
-			logrus.Error(err)
+		commands := signed.Command
 
+		if err := a.verify(signed); err != nil {
+			logrus.WithError(err).WithField("command", commands.TypeCommand).Warn("command rejected")
+			ack(a.ackToServer, commands.ID, entity.AckFailed, err)
 			continue
 		}
 
 		logrus.Info("command: ", commands.TypeCommand)
 
-		buf := bytes.NewBuffer([]byte{})
-		if err := binary.Write(buf, binary.LittleEndian, []byte{preamOneByte, preamTwoByte, preamOneByte, preamTwoByte}); err != nil {
-			logrus.WithError(err).Error("failed to write preamble bytes")
-			return
-		}
-		commandToLength := map[int]int16{
-			1: 14,
-			2: 14,
-			3: 13,
-			4: 13,
-			5: 13,
-			6: 7,
-			9: 14,
-		}
-		lenDataBytes := commandToLength[commands.TypeCommand]
-		if err := binary.Write(buf, binary.LittleEndian, lenDataBytes); err != nil {
-			logrus.Error(err)
+		switch commands.TypeCommand {
+		case entity.CommandConfig:
+			a.applyConfig(commands.Data)
+			continue
+		case entity.CommandRelease:
+			a.announce(commands.Data)
+			continue
+		case entity.CommandSchedule:
+			a.applySchedule(commands.Data)
+			continue
 		}
 
-		var address int32 = 101
-		if err := binary.Write(buf, binary.LittleEndian, address); err != nil {
-			logrus.Error(err)
-		}
+		a.Execute(&commands, a.ackToServer)
+	}
+}
 
-		commandTypeToCommand := map[int]int8{
-			1: 2,
-			2: 2,
-			3: 4,
-			4: 4,
-			5: 5,
-			6: 6,
-			9: 2,
-		}
+// Execute writes a settings command to its controller. The progress of the
+// command is passed to report up to the confirmation by the controller.
+func (a *Agent) Execute(command *entity.Command, report func(entity.Ack)) {
+	ack(report, command.ID, entity.AckDelivered, nil)
 
-		command := commandTypeToCommand[commands.TypeCommand]
+	address, err := a.buses.target(command.BusAddress)
+	if err != nil {
+		logrus.WithError(err).Error("failed to route command")
+		ack(report, command.ID, entity.AckFailed, err)
+		return
+	}
 
-		if err := binary.Write(buf, binary.LittleEndian, command); err != nil {
-			logrus.Error(err)
-		}
-		logrus.Info("agent start switch")
-		switch commands.TypeCommand {
-		case 1:
-			var commandTemperature entity.CommandTemperature
-			if err := json.Unmarshal(commands.Data, &commandTemperature); err != nil {
-				logrus.WithError(err).Error("failed to unmarshal command temperature")
-				return
-			}
-
-			zone4Byte := int32(commandTemperature.Zone)
-			if err := binary.Write(buf, binary.LittleEndian, zone4Byte); err != nil {
-				logrus.Error(err)
-			}
-
-			temperature4Byte := commandTemperature.Temperature
-			if err := binary.Write(buf, binary.LittleEndian, temperature4Byte); err != nil {
-				logrus.Error(err)
-			}
-
-			types := uint8(0)
-			if err := binary.Write(buf, binary.LittleEndian, types); err != nil {
-				logrus.Error(err)
-			}
-		case 2:
-			var commandTemperatureBySensor entity.CommandTemperatureBySensor
-			if err := json.Unmarshal(commands.Data, &commandTemperatureBySensor); err != nil {
-				logrus.WithError(err).Error("failed to unmarshal command temperature by sensor")
-				return
-			}
-
-			var zone4Byte int32 = int32(commandTemperatureBySensor.Zone)
-			if err := binary.Write(buf, binary.LittleEndian, zone4Byte); err != nil {
-				logrus.Error(err)
-			}
-
-			var temperature4Byte float32 = float32(0)
-
-			if err := binary.Write(buf, binary.LittleEndian, temperature4Byte); err != nil {
-				logrus.Error(err)
-			}
-
-			var types uint8 = uint8(commandTemperatureBySensor.Type)
-
-			if err := binary.Write(buf, binary.LittleEndian, types); err != nil {
-				logrus.Error(err)
-			}
-		case 3:
-			var command entity.CommandDataVentModule
-			if err := json.Unmarshal(commands.Data, &command); err != nil {
-				logrus.WithError(err).Error("failed to unmarshal command data vent module")
-				return
-			}
-
-			var (
-				zone      int16 = command.Zone
-				ventSpeed int16 = command.VentSpeed
-			)
-
-			if command.ForAll {
-				zone = 0
-				ventSpeed = 0
-			}
-
-			if err := binary.Write(buf, binary.LittleEndian, zone); err != nil {
-				logrus.Error(err)
-			}
-
-			if err := binary.Write(buf, binary.LittleEndian, ventSpeed); err != nil {
-				logrus.Error(err)
-			}
-
-			if err := binary.Write(buf, binary.LittleEndian, command.Delta); err != nil {
-				logrus.Error(err)
-			}
-
-			if err := binary.Write(buf, binary.LittleEndian, command.TypeRegulation); err != nil {
-				logrus.Error(err)
-			}
-
-			if err := binary.Write(buf, binary.LittleEndian, command.IntervalTimeVentilationDampers); err != nil {
-				logrus.Error(err)
-			}
-
-			if err := binary.Write(buf, binary.LittleEndian, command.VentilationPeriodAfterCO2ReductionTime); err != nil {
-				logrus.Error(err)
-			}
-		case 4:
-			var command entity.CommandDataVentModule
-			err = json.Unmarshal(commands.Data, &command)
-
-			var (
-				zone      int16 = command.Zone
-				ventSpeed int16 = command.VentSpeed
-			)
-
-			if command.ForAll {
-				zone = 0
-				ventSpeed = 0
-			}
-
-			if err := binary.Write(buf, binary.LittleEndian, zone); err != nil {
-				logrus.Error(err)
-			}
-
-			if err := binary.Write(buf, binary.LittleEndian, ventSpeed); err != nil {
-				logrus.Error(err)
-			}
-
-			if err := binary.Write(buf, binary.LittleEndian, command.Delta); err != nil {
-				logrus.Error(err)
-			}
-
-			if err := binary.Write(buf, binary.LittleEndian, command.TypeRegulation); err != nil {
-				logrus.Error(err)
-			}
-
-			if err := binary.Write(buf, binary.LittleEndian, command.IntervalTimeVentilationDampers); err != nil {
-				logrus.Error(err)
-			}
-
-			if err := binary.Write(buf, binary.LittleEndian, command.VentilationPeriodAfterCO2ReductionTime); err != nil {
-				logrus.Error(err)
-			}
-			logrus.Info("agent command 4 success", err)
-		case 5:
-			var command entity.CommandDataVentModuleForAll
-			err = json.Unmarshal(commands.Data, &command)
-
-			var (
-				zone      int16
-				ventSpeed int16
-			)
-
-			if err := binary.Write(buf, binary.LittleEndian, zone); err != nil {
-				logrus.Error(err)
-			}
-
-			if err := binary.Write(buf, binary.LittleEndian, ventSpeed); err != nil {
-				logrus.Error(err)
-			}
-
-			if err := binary.Write(buf, binary.LittleEndian, command.Delta); err != nil {
-				logrus.Error(err)
-			}
-
-			if err := binary.Write(buf, binary.LittleEndian, command.TypeRegulation); err != nil {
-				logrus.Error(err)
-			}
-
-			if err := binary.Write(buf, binary.LittleEndian, command.IntervalTimeVentilationDampers); err != nil {
-				logrus.Error(err)
-			}
-
-			if err := binary.Write(buf, binary.LittleEndian, command.VentilationPeriodAfterCO2ReductionTime); err != nil {
-				logrus.Error(err)
-			}
-			logrus.Info("agent command 5 success", err)
-		case 6:
-			var command entity.CommandDataVentByZone
-			if err := json.Unmarshal(commands.Data, &command); err != nil {
-				logrus.WithError(err).Error("failed to unmarshal command data vent by zone")
-				return
-			}
-			var (
-				zone int16 = command.Zone
-			)
-
-			if err := binary.Write(buf, binary.LittleEndian, zone); err != nil {
-				logrus.Error(err)
-			}
-		case 9:
-			var commHysteresis entity.CommandHysteresisOnHumidityModule
-			logrus.Info(commands.Data)
-			if err := json.Unmarshal(commands.Data, &commHysteresis); err != nil {
-				logrus.WithError(err).Error("failed to unmarshal command hysteresis on humidity module")
-				return
-			}
-
-			if err := binary.Write(buf, binary.LittleEndian, commHysteresis.Zone); err != nil {
-				logrus.Error(err)
-			}
-
-			if err := binary.Write(buf, binary.LittleEndian, commHysteresis.Humidity); err != nil {
-				logrus.Error(err)
-			}
-
-			if err := binary.Write(buf, binary.LittleEndian, commHysteresis.Hysteresis); err != nil {
-				logrus.Error(err)
-			}
-		default:
-			logrus.Error("not found command for unmarshaling command")
-			continue
+	if a.policy != nil {
+		if err := a.policy.Check(command); err != nil {
+			logrus.WithError(err).WithField("command", command.TypeCommand).Warn("command rejected by policy")
+			ack(report, command.ID, entity.AckFailed, fmt.Errorf("policy: %w", err))
+			return
 		}
+	}
 
-		h := uint16(32767)
-		if err := binary.Write(buf, binary.LittleEndian, h); err != nil {
-			logrus.Error(err)
-		}
+	a.driver(address).execute(command, address, report)
+}
 
-		_, err = a.port.Write(buf.Bytes())
-		if err != nil {
-			logrus.WithError(err).Error("failed write to device")
-		}
-		logrus.Info("success write to device ", buf.Bytes())
+// verify checks that the server signed the command and it is not stale or
+// replayed. The agent runs without a key only with auth.unsigned.
+func (a *Agent) verify(signed auth.Signed) error {
+	if a.key == nil {
+		return nil
 	}
 
+	if err := auth.VerifyCommand(a.key, a.config().Serial, signed); err != nil {
+		return err
+	}
+
+	return a.nonces.Check(signed.Timestamp, signed.Nonce, time.Now())
+}
+
+// writeLine hands data to the serial supervisor, writes of concurrent
+// commands go on the line one after another.
+func (a *Agent) writeLine(ctx context.Context, data []byte) error {
+	request := writeRequest{data: data, result: make(chan error, 1)}
+
+	timer := time.NewTimer(writeWait)
+	defer timer.Stop()
+
+	select {
+	case a.writes <- request:
+		return <-request.result
+	case <-timer.C:
+		return errDeviceOffline
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-func (a *Agent) ProcessIncomingDataFromDevice() {
+// ProcessIncomingDataFromDevice passes frames read from the port on until
+// reading fails, answers of Modbus controllers go to their driver.
+func (a *Agent) ProcessIncomingDataFromDevice(port io.Reader) error {
 
-	preambles := Preambles{}
-	preambles.Init()
+	// команды прилетают с малинки и отправляются на сервер
+	decoder := protocol.NewDecoder(port)
+	decoder.Share(a.modbus.match, a.modbus.receive)
+
+	var seen protocol.DecoderStats
 
 	for {
-		// команды прилетают с малинки и отправляются на сервер
-		buf := make([]byte, 1)
+		frame, err := decoder.Decode()
+		a.stats.decoded(&seen, decoder.Stats())
 
-		if !a.read {
-			logrus.Info("return")
-			return
+		if crcErr, ok := err.(*protocol.CRCError); ok {
+			logrus.WithError(crcErr).WithField("crc_failures", atomic.LoadUint64(&a.stats.crcFailures)).Warn("drop frame")
+			continue
 		}
 
-		_, err := a.port.Read(buf)
+		if err != nil {
+			return err
+		}
 
+		command, err := serverCommand(frame)
 		if err != nil {
-			logrus.Println("Error reading from serial port: ", err)
-			if err != io.EOF {
-				logrus.Println("Error reading from serial port: ", err)
-			}
-
-		} else {
-			preamblesByteBuff := buf[0]
-
-			if preamblesByteBuff == preamOneByte || preambles.One {
-				preambles.One = true
-
-				if preamblesByteBuff == preamOneByte && !preambles.Two {
-					continue
-				}
-
-				if preamblesByteBuff == preamTwoByte || preambles.Two {
-					preambles.Two = true
-
-					if preamblesByteBuff == preamTwoByte && !preambles.Three {
-						continue
-					}
-
-					if preamblesByteBuff == preamOneByte || preambles.Three {
-						preambles.Three = true
-
-						if preamblesByteBuff == preamOneByte {
-							continue
-						}
-
-						if preamblesByteBuff == preamTwoByte || preambles.Four {
-							preambles.Four = true
-
-						} else {
-							preambles.Reset()
-						}
-					} else {
-						preambles.Reset()
-					}
-				} else {
-					preambles.Reset()
-				}
-
-			} else {
-				preambles.Reset()
-			}
-
-			if preambles.One && preambles.Two && preambles.Three && preambles.Four {
-				preambles.Reset()
-
-				lenDataBuf := make([]byte, 2)
-				_, err := a.port.Read(lenDataBuf)
-				if err != nil {
-					if err != io.EOF {
-						logrus.Println("Error reading from serial port: ", err)
-					}
-				}
-
-				var lenDataBytes int16
-				buf := bytes.NewReader(lenDataBuf)
-				err = binary.Read(buf, binary.LittleEndian, &lenDataBytes)
-				if err != nil {
-					logrus.Error("binary.Read failed:", err)
-				}
-
-				data := make([]byte, 5)
-				_, err = a.port.Read(data)
-				if err != nil {
-					if err != io.EOF {
-						logrus.Println("Error reading from serial port: ", err)
-					}
-				}
-
-				type DataAddresCommand struct {
-					Addres  int32 `json:"addres"`
-					Command uint8 `json:"command"`
-				}
-
-				var dataAddresCommand DataAddresCommand
-				bufReader := bytes.NewReader(data)
-				err = binary.Read(bufReader, binary.LittleEndian, &dataAddresCommand)
-				if err != nil {
-					logrus.Error("binary.Read failed:", err)
-					logrus.Info("datebase", dataAddresCommand)
-				}
-
-				switch dataAddresCommand.Command {
-				case 0:
-					var (
-						tempAir     float32
-						humidityAir float32
-						tempfloor   float32
-						co2         int32
-						crc         uint16
-					)
-
-					{
-						data = a.readOneByte(4)
-
-						buf := bytes.NewReader(data)
-						err = binary.Read(buf, binary.LittleEndian, &tempAir)
-						if err != nil {
-							logrus.Error("binary.Read failed:", err)
-						}
-					}
-
-					{
-						data = a.readOneByte(4)
-
-						buf = bytes.NewReader(data)
-						err = binary.Read(buf, binary.LittleEndian, &humidityAir)
-						if err != nil {
-							logrus.Error("binary.Read failed:", err)
-						}
-					}
-
-					{
-						data = a.readOneByte(4)
-						buf = bytes.NewReader(data)
-						err = binary.Read(buf, binary.LittleEndian, &tempfloor)
-						if err != nil {
-							logrus.Error("binary.Read failed:", err)
-						}
-					}
-
-					{
-						data = a.readOneByte(4)
-
-						buf = bytes.NewReader(data)
-						err = binary.Read(buf, binary.LittleEndian, &co2)
-						if err != nil {
-							logrus.Error("binary.Read failed:", err)
-						}
-					}
-
-					{
-						data = a.readOneByte(2)
-						buf = bytes.NewReader(data)
-						err = binary.Read(buf, binary.LittleEndian, &crc)
-						if err != nil {
-							logrus.Error("binary.Read failed:", err)
-						}
-
-					}
-
-					dataCommandTemperature := entity.DataCommandTemperature{
-						Zone:        dataAddresCommand.Addres,
-						TempAir:     tempAir,
-						HumidityAir: int(humidityAir),
-						Tempfloor:   tempfloor,
-						CO2:         float32(co2),
-					}
-
-					command, err := entity.NewCommand(dataCommandTemperature, typeCommand)
-					if err != nil {
-						logrus.WithError(err).Error("failed commnd 0")
-						continue
-					}
-
-					data, err := json.Marshal(command)
-					if err != nil {
-						logrus.WithError(err).Error("failed to marshal command 0")
-						continue
-					}
-
-					a.mutex.Lock()
-					err = a.connect.WriteMessage(websocket.TextMessage, data)
-					logrus.WithField("command 0", dataCommandTemperature).Info("send to messages")
-					a.mutex.Unlock()
-
-					if err != nil {
-						logrus.WithError(err).Error("connection to lost")
-						a.err <- err
-						return
-					}
-				case 1:
-					logBuff := make([]byte, 0)
-
-					dataSlice := make([]entity.DataCommandTemperatureBySensor, 0)
-
-					var crc uint16
-
-					for i := 0; i < 6; i++ {
-						var (
-							zone              int32
-							setpointValueTemp float32
-							typeRegulation    uint8
-						)
-
-						{
-							data = a.readOneByte(4)
-
-							buf = bytes.NewReader(data)
-							err = binary.Read(buf, binary.LittleEndian, &zone)
-							if err != nil {
-								logrus.Error("binary.Read failed:", err)
-							}
-
-							for _, item := range data {
-								logBuff = append(logBuff, item)
-							}
-
-						}
-
-						{
-							data = a.readOneByte(4)
-
-							buf = bytes.NewReader(data)
-							err = binary.Read(buf, binary.LittleEndian, &setpointValueTemp)
-							if err != nil {
-								logrus.Error("binary.Read failed:", err)
-							}
-
-							for _, item := range data {
-								logBuff = append(logBuff, item)
-							}
-
-						}
-
-						{
-							data = a.readOneByte(1)
-
-							buf = bytes.NewReader(data)
-							err = binary.Read(buf, binary.LittleEndian, &typeRegulation)
-							if err != nil {
-								logrus.Error("binary.Read failed:", err)
-							}
-							for _, item := range data {
-								logBuff = append(logBuff, item)
-							}
-
-							typeRegulation -= 1
-						}
-
-						dataSlice = append(dataSlice, entity.DataCommandTemperatureBySensor{
-							Zone:              zone,
-							SetpointValueTemp: setpointValueTemp,
-							TypeRegulation:    typeRegulation,
-						})
-
-					}
-
-					{
-						data = a.readOneByte(2)
-
-						buf = bytes.NewReader(data)
-						err = binary.Read(buf, binary.LittleEndian, &crc)
-						if err != nil {
-							logrus.Error("binary.Read failed:", err)
-						}
-
-						for _, item := range data {
-							logBuff = append(logBuff, item)
-						}
-					}
-
-					a.readOneByte(1)
-
-					command, err := entity.NewCommand(dataSlice, typeCommand)
-					if err != nil {
-						logrus.WithError(err).Error("failed commnd 1")
-						continue
-					}
-
-					dataBytes, err := json.Marshal(command)
-
-					a.mutex.Lock()
-					err = a.connect.WriteMessage(websocket.TextMessage, dataBytes)
-					logrus.WithField("command 1", dataSlice).Info("send to messages")
-					a.mutex.Unlock()
-
-					if err != nil {
-						logrus.WithError(err).Error("connection to lost")
-						a.err <- err
-						return
-					}
-				case 3:
-					logrus.Info("start 3 command")
-					logBuff := make([]byte, 0)
-
-					dataSlice := make([]entity.DataVent, 0)
-
-					var crc uint16
-
-					for i := 0; i < 9; i++ {
-
-						var (
-							zone      int16
-							ventSpeed int16
-						)
-
-						{
-							data = a.readOneByte(2)
-
-							buf = bytes.NewReader(data)
-							err = binary.Read(buf, binary.LittleEndian, &zone)
-							if err != nil {
-								logrus.Error("binary.Read failed:", err)
-							}
-
-							for _, item := range data {
-								logBuff = append(logBuff, item)
-							}
-
-						}
-
-						{
-							data = a.readOneByte(2)
-
-							buf = bytes.NewReader(data)
-							err = binary.Read(buf, binary.LittleEndian, &ventSpeed)
-							if err != nil {
-								logrus.Error("binary.Read failed:", err)
-							}
-
-							for _, item := range data {
-								logBuff = append(logBuff, item)
-							}
-
-						}
-
-						dataSlice = append(dataSlice, entity.DataVent{
-							Zone:      zone,
-							VentSpeed: ventSpeed,
-						})
-					}
-
-					logrus.Info(dataSlice)
-
-					{
-						data = a.readOneByte(2)
-
-						buf = bytes.NewReader(data)
-						err = binary.Read(buf, binary.LittleEndian, &crc)
-						if err != nil {
-							logrus.Error("binary.Read failed:", err)
-						}
-
-						for _, item := range data {
-							logBuff = append(logBuff, item)
-						}
-					}
-
-					a.readOneByte(1)
-
-					command, err := entity.NewCommand(dataSlice, typeCommand)
-					if err != nil {
-						logrus.WithError(err).Error("failed commnd 3")
-						continue
-					}
-
-					dataBytes, err := json.Marshal(command)
-
-					a.mutex.Lock()
-					err = a.connect.WriteMessage(websocket.TextMessage, dataBytes)
-					logrus.WithField("command 3", dataSlice).Info("send to messages")
-					a.mutex.Unlock()
-
-					if err != nil {
-						logrus.WithError(err).Error("connection to lost")
-						a.err <- err
-						return
-					}
-				case 2:
-					logrus.Info("start 2 command")
-				case 4:
-
-				case 5:
-					logrus.Info("start 5 command")
-				case 6:
-					logrus.Info("start 6 command")
-				case 7:
-
-					var (
-						zone                                   int16
-						ventSpeed                              int16
-						delta                                  uint8
-						typeRegulation                         uint8
-						intervalTimeVentilationDampers         uint8
-						ventilationPeriodAfterCO2ReductionTime uint8
-					)
-
-					{
-						data = a.readOneByte(2)
-
-						buf := bytes.NewReader(data)
-						err = binary.Read(buf, binary.LittleEndian, &zone)
-						if err != nil {
-							logrus.Error("binary.Read failed:", err)
-						}
-					}
-
-					{
-						data = a.readOneByte(2)
-
-						buf = bytes.NewReader(data)
-						err = binary.Read(buf, binary.LittleEndian, &ventSpeed)
-						if err != nil {
-							logrus.Error("binary.Read failed:", err)
-						}
-					}
-
-					{
-						data = a.readOneByte(1)
-
-						buf = bytes.NewReader(data)
-						err = binary.Read(buf, binary.LittleEndian, &delta)
-						if err != nil {
-							logrus.Error("binary.Read failed:", err)
-						}
-					}
-
-					{
-						data = a.readOneByte(1)
-
-						buf = bytes.NewReader(data)
-						err = binary.Read(buf, binary.LittleEndian, &typeRegulation)
-						if err != nil {
-							logrus.Error("binary.Read failed:", err)
-						}
-					}
-
-					{
-						data = a.readOneByte(1)
-						buf = bytes.NewReader(data)
-						err = binary.Read(buf, binary.LittleEndian, &intervalTimeVentilationDampers)
-						if err != nil {
-							logrus.Error("binary.Read failed:", err)
-						}
-					}
-
-					{
-						data = a.readOneByte(1)
-						buf = bytes.NewReader(data)
-						err = binary.Read(buf, binary.LittleEndian, &ventilationPeriodAfterCO2ReductionTime)
-						if err != nil {
-							logrus.Error("binary.Read failed:", err)
-						}
-
-					}
-
-					dataCommandVentModule := entity.DataVentModule{
-						Zone:                                   zone,
-						VentSpeed:                              ventSpeed,
-						Delta:                                  delta,
-						TypeRegulation:                         typeRegulation,
-						IntervalTimeVentilationDampers:         intervalTimeVentilationDampers,
-						VentilationPeriodAfterCO2ReductionTime: ventilationPeriodAfterCO2ReductionTime,
-					}
-
-					command, err := entity.NewCommand(dataCommandVentModule, typeCommand)
-					if err != nil {
-						logrus.WithError(err).Error("failed commnd 7")
-						continue
-					}
-
-					data, err := json.Marshal(command)
-
-					a.mutex.Lock()
-					err = a.connect.WriteMessage(websocket.TextMessage, data)
-					logrus.WithField("command 7", dataCommandVentModule).Info("send to messages")
-					a.mutex.Unlock()
-
-					if err != nil {
-						logrus.WithError(err).Error("connection to lost")
-						a.err <- err
-						return
-					}
-				case 8:
-					logBuff := make([]byte, 0)
-
-					dataSlice := make([]entity.DataCommandHumidityModule, 0)
-
-					var crc uint16
-
-					for i := 0; i < 6; i++ {
-						var (
-							zone       int32
-							setpoint   float32
-							hysteresis uint8
-						)
-
-						{
-							data = a.readOneByte(4)
-
-							buf = bytes.NewReader(data)
-							err = binary.Read(buf, binary.LittleEndian, &zone)
-							if err != nil {
-								logrus.Error("binary.Read failed:", err)
-							}
-
-							for _, item := range data {
-								logBuff = append(logBuff, item)
-							}
-
-						}
-
-						{
-							data = a.readOneByte(4)
-
-							buf = bytes.NewReader(data)
-							err = binary.Read(buf, binary.LittleEndian, &setpoint)
-							if err != nil {
-								logrus.Error("binary.Read failed:", err)
-							}
-
-							for _, item := range data {
-								logBuff = append(logBuff, item)
-							}
-
-						}
-
-						{
-							data = a.readOneByte(1)
-
-							buf = bytes.NewReader(data)
-							err = binary.Read(buf, binary.LittleEndian, &hysteresis)
-							if err != nil {
-								logrus.Error("binary.Read failed:", err)
-							}
-							for _, item := range data {
-								logBuff = append(logBuff, item)
-							}
-
-							hysteresis -= 1
-						}
-
-						dataSlice = append(dataSlice, entity.DataCommandHumidityModule{
-							Zone:       zone,
-							Setpoint:   setpoint,
-							Hysteresis: hysteresis,
-						})
-
-					}
-
-					{
-						data = a.readOneByte(2)
-
-						buf = bytes.NewReader(data)
-						err = binary.Read(buf, binary.LittleEndian, &crc)
-						if err != nil {
-							logrus.Error("binary.Read failed:", err)
-						}
-
-						for _, item := range data {
-							logBuff = append(logBuff, item)
-						}
-					}
-
-					a.readOneByte(1)
-
-					command, err := entity.NewCommand(dataSlice, typeCommand)
-					if err != nil {
-						logrus.WithError(err).Error("failed commnd 8")
-						continue
-					}
-
-					dataBytes, err := json.Marshal(command)
-
-					a.mutex.Lock()
-					err = a.connect.WriteMessage(websocket.TextMessage, dataBytes)
-					logrus.WithField("command 8", dataSlice).Info("send to messages")
-					a.mutex.Unlock()
-
-					if err != nil {
-						logrus.WithError(err).Error("connection to lost")
-						a.err <- err
-						return
-					}
-				}
-			}
+			logrus.WithError(err).WithField("frame", frame).Error("failed to decode frame")
+			continue
 		}
+
+		if command == nil {
+			logrus.Infof("start %d command", frame.Command)
+			a.watchdog.alive(frame.Address, time.Now())
+			a.confirmDeviceAck(ackKey{address: frame.Address, command: frame.Command})
+			continue
+		}
+
+		command.BusAddress = a.buses.source(frame)
+		if command.BusAddress != 0 {
+			a.watchdog.seen(command.BusAddress, command.TypeCommand, time.Now())
+		}
+
+		command.Timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+
+		a.telemetry <- command
+
+		logrus.WithField(fmt.Sprintf("command %d", frame.Command), string(command.Data)).
+			WithField("bus_address", command.BusAddress).Info("send to messages")
 	}
 }
 
-func (a *Agent) ProcessingStream() {
-	logrus.Info("start processing data")
+// publish sends telemetry to the server. While the server is unreachable or
+// older telemetry is still being replayed it goes to the buffer instead.
+func (a *Agent) publish(command *entity.Command) {
+	if a.local != nil {
+		a.local.Publish(command)
+	}
 
-	go a.ProcessIncomingCommandsFromServer()
+	if a.queue != nil {
+		a.queueMutex.Lock()
+		defer a.queueMutex.Unlock()
 
-	a.ProcessIncomingDataFromDevice()
+		if !a.isOnline() || a.queue.Size() > 0 {
+			a.buffer(command)
+			return
+		}
+	}
+
+	if err := a.sendToServer(command); err != nil {
+		logrus.WithError(err).Error("connection to lost")
+		a.buffer(command)
+	}
 }
 
-func (a *Agent) readOneByte(lenBuff int) []byte {
-	commonData := make([]byte, 0)
+func (a *Agent) buffer(command *entity.Command) {
+	if a.queue == nil {
+		logrus.WithField("command", command.TypeCommand).Warn("telemetry dropped, buffer is off")
+		return
+	}
 
-	for i := 0; i < lenBuff; i++ {
-		data := make([]byte, 1)
+	data, err := json.Marshal(command)
+	if err != nil {
+		logrus.WithError(err).Error("failed to marshal buffered command")
+		return
+	}
 
-		_, err := a.port.Read(data)
-		if err != nil {
-			if err != io.EOF {
-				logrus.Println("Error reading from serial port: ", err)
-			}
-		}
-		commonData = append(commonData, data[0])
+	if err := a.queue.Append(data); err != nil {
+		logrus.WithError(err).Error("failed to buffer telemetry")
+	}
+}
+
+// replay sends the buffered telemetry in the order it was read, the last
+// records under queueMutex so no record is left behind for publish.
+func (a *Agent) replay() {
+	if a.queue == nil || a.queue.Size() == 0 {
+		return
+	}
+
+	logrus.WithField("bytes", a.queue.Size()).Info("replay buffered telemetry")
+
+	if err := a.queue.Replay(a.sendRaw); err != nil {
+		logrus.WithError(err).Error("failed to replay buffered telemetry")
+		return
 	}
 
-	return commonData
+	// what publish buffered during the replay, it sends directly once the
+	// queue is empty
+	a.queueMutex.Lock()
+	err := a.queue.Replay(a.sendRaw)
+	a.queueMutex.Unlock()
+
+	if err != nil {
+		logrus.WithError(err).Error("failed to replay buffered telemetry")
+		return
+	}
+
+	logrus.WithField("dropped_bytes", a.queue.Dropped()).Info("buffered telemetry replayed")
 }
 
-func (a *Agent) Close() {
-	a.port.Close()
-	a.connect.Close()
+func (a *Agent) sendToServer(command *entity.Command) error {
+	data, err := json.Marshal(command)
+	if err != nil {
+		return fmt.Errorf("failed to marshal command %d: %w", command.TypeCommand, err)
+	}
+
+	return a.sendRaw(data)
+}
+
+func (a *Agent) sendRaw(data []byte) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if !a.online {
+		return errOffline
+	}
+
+	err := a.connect.Send(data)
+	if err != nil {
+		// the socket supervisor sees the read fail and redials
+		a.online = false
+		a.connect.Close()
+	}
+
+	return err
 }
 
-func test(b []byte, l int) {
-
-	//t := [256]uint16{
-	//0x0000, 0x1021, 0x2042, 0x3063, 0x4084, 0x50A5, 0x60C6, 0x70E7,
-	//0x8108, 0x9129, 0xA14A, 0xB16B, 0xC18C, 0xD1AD, 0xE1CE, 0xF1EF,
-	//0x1231, 0x0210, 0x3273, 0x2252, 0x52B5, 0x4294, 0x72F7, 0x62D6,
-	//0x9339, 0x8318, 0xB37B, 0xA35A, 0xD3BD, 0xC39C, 0xF3FF, 0xE3DE,
-	//0x2462, 0x3443, 0x0420, 0x1401, 0x64E6, 0x74C7, 0x44A4, 0x5485,
-	//0xA56A, 0xB54B, 0x8528, 0x9509, 0xE5EE, 0xF5CF, 0xC5AC, 0xD58D,
-	//0x3653, 0x2672, 0x1611, 0x0630, 0x76D7, 0x66F6, 0x5695, 0x46B4,
-	//0xB75B, 0xA77A, 0x9719, 0x8738, 0xF7DF, 0xE7FE, 0xD79D, 0xC7BC,
-	//0x48C4, 0x58E5, 0x6886, 0x78A7, 0x0840, 0x1861, 0x2802, 0x3823,
-	//0xC9CC, 0xD9ED, 0xE98E, 0xF9AF, 0x8948, 0x9969, 0xA90A, 0xB92B,
-	//0x5AF5, 0x4AD4, 0x7AB7, 0x6A96, 0x1A71, 0x0A50, 0x3A33, 0x2A12,
-	//0xDBFD, 0xCBDC, 0xFBBF, 0xEB9E, 0x9B79, 0x8B58, 0xBB3B, 0xAB1A,
-	//0x6CA6, 0x7C87, 0x4CE4, 0x5CC5, 0x2C22, 0x3C03, 0x0C60, 0x1C41,
-	//0xEDAE, 0xFD8F, 0xCDEC, 0xDDCD, 0xAD2A, 0xBD0B, 0x8D68, 0x9D49,
-	//0x7E97, 0x6EB6, 0x5ED5, 0x4EF4, 0x3E13, 0x2E32, 0x1E51, 0x0E70,
-	//0xFF9F, 0xEFBE, 0xDFDD, 0xCFFC, 0xBF1B, 0xAF3A, 0x9F59, 0x8F78,
-	//0x9188, 0x81A9, 0xB1CA, 0xA1EB, 0xD10C, 0xC12D, 0xF14E, 0xE16F,
-	//0x1080, 0x00A1, 0x30C2, 0x20E3, 0x5004, 0x4025, 0x7046, 0x6067,
-	//0x83B9, 0x9398, 0xA3FB, 0xB3DA, 0xC33D, 0xD31C, 0xE37F, 0xF35E,
-	//0x02B1, 0x1290, 0x22F3, 0x32D2, 0x4235, 0x5214, 0x6277, 0x7256,
-	//0xB5EA, 0xA5CB, 0x95A8, 0x8589, 0xF56E, 0xE54F, 0xD52C, 0xC50D,
-	//0x34E2, 0x24C3, 0x14A0, 0x0481, 0x7466, 0x6447, 0x5424, 0x4405,
-	//0xA7DB, 0xB7FA, 0x8799, 0x97B8, 0xE75F, 0xF77E, 0xC71D, 0xD73C,
-	//0x26D3, 0x36F2, 0x0691, 0x16B0, 0x6657, 0x7676, 0x4615, 0x5634,
-	//0xD94C, 0xC96D, 0xF90E, 0xE92F, 0x99C8, 0x89E9, 0xB98A, 0xA9AB,
-	//0x5844, 0x4865, 0x7806, 0x6827, 0x18C0, 0x08E1, 0x3882, 0x28A3,
-	//0xCB7D, 0xDB5C, 0xEB3F, 0xFB1E, 0x8BF9, 0x9BD8, 0xABBB, 0xBB9A,
-	//0x4A75, 0x5A54, 0x6A37, 0x7A16, 0x0AF1, 0x1AD0, 0x2AB3, 0x3A92,
-	//0xFD2E, 0xED0F, 0xDD6C, 0xCD4D, 0xBDAA, 0xAD8B, 0x9DE8, 0x8DC9,
-	//0x7C26, 0x6C07, 0x5C64, 0x4C45, 0x3CA2, 0x2C83, 0x1CE0, 0x0CC1,
-	//0xEF1F, 0xFF3E, 0xCF5D, 0xDF7C, 0xAF9B, 0xBFBA, 0x8FD9, 0x9FF8,
-	//0x6E17, 0x7E36, 0x4E55, 0x5E74, 0x2E93, 0x3EB2, 0x0ED1, 0x1EF0,
-	//}
-
-	//var i uint16 = 0xFFFF
-	//var crc16 uint16 = 0xFFFF
-	//
-	//for i := 0xFFFF; i < l; i++ {
-	//	crc16 = (crc16 << 8) ^ t[(crc16 >> 8) ^ &b[0]]
-	//}
+func (a *Agent) isOnline() bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
 
+	return a.online
 }
@@ -0,0 +1,42 @@
+package agent
+
+import (
+	"context"
+	"iLean/config"
+	"time"
+)
+
+// backoff yields growing delays between reconnect attempts.
+type backoff struct {
+	conf  config.BackoffConfig
+	delay time.Duration
+}
+
+func newBackoff(conf config.BackoffConfig) *backoff {
+	return &backoff{conf: conf, delay: conf.Initial}
+}
+
+// Next returns the delay before the next attempt.
+func (b *backoff) Next() time.Duration {
+	delay := b.delay
+
+	b.delay = time.Duration(float64(b.delay) * b.conf.Multiplier)
+	if b.delay > b.conf.Max {
+		b.delay = b.conf.Max
+	}
+
+	return delay
+}
+
+// sleep waits for d and reports false if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
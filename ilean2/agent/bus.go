@@ -0,0 +1,160 @@
+package agent
+
+import (
+	"fmt"
+	"iLean/config"
+	"iLean/protocol"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// busMap knows the controllers chained on the RS-485 line. Telemetry frames
+// carry the zone where other frames carry the bus address, so the source of
+// telemetry is looked up by zone in the tables the controllers report.
+type busMap struct {
+	mutex  sync.Mutex
+	conf   config.DeviceConfig
+	tables map[tableKey][]int32
+}
+
+// tableKey is a table of a controller, each controller reports its zones in
+// several tables.
+type tableKey struct {
+	address int32
+	command uint8
+}
+
+func newBusMap(conf config.DeviceConfig) *busMap {
+	return &busMap{conf: conf, tables: make(map[tableKey][]int32)}
+}
+
+// update switches to new bus settings, the zones are learned again.
+func (b *busMap) update(conf config.DeviceConfig) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.conf = conf
+	b.tables = make(map[tableKey][]int32)
+}
+
+// target returns the bus address a server command is written to.
+func (b *busMap) target(address int32) (int32, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if address == 0 {
+		return b.conf.Primary(), nil
+	}
+
+	if !b.conf.HasAddress(address) {
+		return 0, fmt.Errorf("unknown bus address %d", address)
+	}
+
+	return address, nil
+}
+
+// isModbus reports whether the controller at address speaks Modbus RTU.
+func (b *busMap) isModbus(address int32) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	bus, ok := b.conf.Bus(address)
+
+	return ok && bus.IsModbus()
+}
+
+// source returns the bus address of the controller that sent the frame or
+// 0 if it can not be told: telemetry of a zone no table lists or that
+// several controllers list, and frames from addresses not on the bus. With
+// a single controller on the bus every frame is its own.
+func (b *busMap) source(frame *protocol.Frame) int32 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if len(b.conf.Buses) == 1 {
+		return b.conf.Primary()
+	}
+
+	if frame.Command == protocol.CommandTelemetry {
+		return b.zoneAddress(frame.Address)
+	}
+
+	if !b.conf.HasAddress(frame.Address) {
+		logrus.WithField("bus_address", frame.Address).Warn("frame from an address not on the bus")
+		return 0
+	}
+
+	if zones, ok := tableZones(frame); ok {
+		b.tables[tableKey{address: frame.Address, command: frame.Command}] = zones
+	}
+
+	return frame.Address
+}
+
+// zoneAddress returns the only controller whose tables list the zone, 0 if
+// none or several do. The caller holds mutex.
+func (b *busMap) zoneAddress(zone int32) int32 {
+	var found int32
+
+	for key, zones := range b.tables {
+		if key.address == found || !hasZone(zones, zone) {
+			continue
+		}
+
+		if found != 0 {
+			logrus.WithField("zone", zone).Warn("zone is on several controllers, telemetry is unattributed")
+			return 0
+		}
+
+		found = key.address
+	}
+
+	return found
+}
+
+func hasZone(zones []int32, zone int32) bool {
+	for _, z := range zones {
+		if z == zone {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tableZones returns the zones listed in a table frame, empty rows are
+// skipped. ok is false for frames that are not tables or do not decode.
+func tableZones(frame *protocol.Frame) (zones []int32, ok bool) {
+	add := func(zone int32) {
+		if zone > 0 {
+			zones = append(zones, zone)
+		}
+	}
+
+	switch frame.Command {
+	case protocol.CommandSetpointTable:
+		rows := make([]protocol.SetpointRow, protocol.SetpointTableRows)
+		if ok = protocol.Unmarshal(frame.Payload, rows) == nil; ok {
+			for _, row := range rows {
+				add(row.Zone)
+			}
+		}
+	case protocol.CommandVentTable:
+		rows := make([]protocol.VentRow, protocol.VentTableRows)
+		if ok = protocol.Unmarshal(frame.Payload, rows) == nil; ok {
+			for _, row := range rows {
+				add(int32(row.Zone))
+			}
+		}
+	case protocol.CommandHumidityTable:
+		rows := make([]protocol.HumidityRow, protocol.HumidityTableRows)
+		if ok = protocol.Unmarshal(frame.Payload, rows) == nil; ok {
+			for _, row := range rows {
+				add(row.Zone)
+			}
+		}
+	}
+
+	return zones, ok
+}
@@ -0,0 +1,160 @@
+package agent
+
+import (
+	"iLean/config"
+	"iLean/protocol"
+	"testing"
+)
+
+func telemetryFrame(t *testing.T, zone int32) *protocol.Frame {
+	t.Helper()
+
+	payload, err := protocol.Marshal(protocol.Telemetry{TempAir: 21.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return protocol.NewFrame(zone, protocol.CommandTelemetry, payload)
+}
+
+func setpointTable(t *testing.T, address int32, zones ...int32) *protocol.Frame {
+	t.Helper()
+
+	rows := make([]protocol.SetpointRow, protocol.SetpointTableRows)
+	for i, zone := range zones {
+		rows[i] = protocol.SetpointRow{Zone: zone, Setpoint: 22, TypeRegulation: 1}
+	}
+
+	payload, err := protocol.Marshal(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return protocol.NewFrame(address, protocol.CommandSetpointTable, payload)
+}
+
+func ventTable(t *testing.T, address int32, zones ...int16) *protocol.Frame {
+	t.Helper()
+
+	rows := make([]protocol.VentRow, protocol.VentTableRows)
+	for i, zone := range zones {
+		rows[i] = protocol.VentRow{Zone: zone, VentSpeed: 2}
+	}
+
+	payload, err := protocol.Marshal(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return protocol.NewFrame(address, protocol.CommandVentTable, payload)
+}
+
+func TestBusMapSource(t *testing.T) {
+	two := config.DeviceConfig{Buses: []config.BusConfig{{Address: 101}, {Address: 102}}}
+
+	tests := []struct {
+		name   string
+		conf   config.DeviceConfig
+		tables func(t *testing.T) []*protocol.Frame
+		zone   int32
+		want   int32
+	}{
+		{
+			name: "single controller",
+			conf: config.DeviceConfig{Buses: []config.BusConfig{{Address: 101}}},
+			zone: 5,
+			want: 101,
+		},
+		{
+			name: "zone of one controller",
+			conf: two,
+			tables: func(t *testing.T) []*protocol.Frame {
+				return []*protocol.Frame{setpointTable(t, 101, 1, 2), setpointTable(t, 102, 3)}
+			},
+			zone: 3,
+			want: 102,
+		},
+		{
+			name: "shared zone",
+			conf: two,
+			tables: func(t *testing.T) []*protocol.Frame {
+				return []*protocol.Frame{setpointTable(t, 101, 1, 2), setpointTable(t, 102, 1, 3)}
+			},
+			zone: 1,
+			want: 0,
+		},
+		{
+			name: "shared through another table",
+			conf: two,
+			tables: func(t *testing.T) []*protocol.Frame {
+				return []*protocol.Frame{setpointTable(t, 101, 1), ventTable(t, 102, 1)}
+			},
+			zone: 1,
+			want: 0,
+		},
+		{
+			name: "zone in several tables of one controller",
+			conf: two,
+			tables: func(t *testing.T) []*protocol.Frame {
+				return []*protocol.Frame{setpointTable(t, 101, 1), ventTable(t, 101, 1)}
+			},
+			zone: 1,
+			want: 101,
+		},
+		{
+			name: "zone moved to another controller",
+			conf: two,
+			tables: func(t *testing.T) []*protocol.Frame {
+				return []*protocol.Frame{setpointTable(t, 101, 1), setpointTable(t, 102, 1), setpointTable(t, 101, 2)}
+			},
+			zone: 1,
+			want: 102,
+		},
+		{
+			name: "unknown zone",
+			conf: two,
+			tables: func(t *testing.T) []*protocol.Frame {
+				return []*protocol.Frame{setpointTable(t, 101, 1)}
+			},
+			zone: 7,
+			want: 0,
+		},
+		{
+			name: "table from an address not on the bus",
+			conf: two,
+			tables: func(t *testing.T) []*protocol.Frame {
+				return []*protocol.Frame{setpointTable(t, 103, 4)}
+			},
+			zone: 4,
+			want: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBusMap(tt.conf)
+
+			if tt.tables != nil {
+				for _, frame := range tt.tables(t) {
+					b.source(frame)
+				}
+			}
+
+			if got := b.source(telemetryFrame(t, tt.zone)); got != tt.want {
+				t.Errorf("source() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBusMapSourceTable(t *testing.T) {
+	b := newBusMap(config.DeviceConfig{Buses: []config.BusConfig{{Address: 101}, {Address: 102}}})
+
+	if got := b.source(setpointTable(t, 102, 1)); got != 102 {
+		t.Errorf("source() = %d, want 102", got)
+	}
+
+	if got := b.source(setpointTable(t, 103, 1)); got != 0 {
+		t.Errorf("source() of an address not on the bus = %d, want 0", got)
+	}
+}
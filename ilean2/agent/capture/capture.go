@@ -0,0 +1,114 @@
+package capture
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Direction tells whether bytes were read from or written to the port.
+type Direction string
+
+const (
+	RX Direction = "RX"
+	TX Direction = "TX"
+)
+
+// Writer records serial traffic as text lines "<time> <RX|TX> <hex>", one
+// line per read or write. The file is rotated when it grows past maxBytes
+// and keep rotated files are kept as file.1, file.2 and so on.
+type Writer struct {
+	path     string
+	maxBytes int64
+	keep     int
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+}
+
+// Open appends to the capture file at path, creating it if needed.
+func Open(path string, maxBytes int64, keep int) (*Writer, error) {
+	w := &Writer{path: path, maxBytes: maxBytes, keep: keep}
+
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Record appends a line for the bytes, empty reads are not recorded.
+func (w *Writer) Record(dir Direction, b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+
+	line := fmt.Sprintf("%s %s %s\n", time.Now().UTC().Format(time.RFC3339Nano), dir, hex.EncodeToString(b))
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.size > 0 && w.size+int64(len(line)) > w.maxBytes {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := w.file.WriteString(line)
+	w.size += int64(n)
+
+	return err
+}
+
+func (w *Writer) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.file.Close()
+}
+
+func (w *Writer) open() error {
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("open capture file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("stat capture file: %w", err)
+	}
+
+	w.file = file
+	w.size = info.Size()
+
+	return nil
+}
+
+// rotate shifts file.N to file.N+1, dropping the oldest one, and starts a
+// new file.
+func (w *Writer) rotate() error {
+	w.file.Close()
+
+	os.Remove(w.rotated(w.keep))
+	for i := w.keep - 1; i >= 1; i-- {
+		os.Rename(w.rotated(i), w.rotated(i+1))
+	}
+
+	if w.keep > 0 {
+		if err := os.Rename(w.path, w.rotated(1)); err != nil {
+			return fmt.Errorf("rotate capture file: %w", err)
+		}
+	} else {
+		os.Remove(w.path)
+	}
+
+	return w.open()
+}
+
+func (w *Writer) rotated(i int) string {
+	return fmt.Sprintf("%s.%d", w.path, i)
+}
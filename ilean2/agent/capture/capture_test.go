@@ -0,0 +1,244 @@
+package capture
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chunkPort returns one chunk per read and takes any write.
+type chunkPort struct {
+	chunks [][]byte
+}
+
+func (p *chunkPort) Read(b []byte) (int, error) {
+	if len(p.chunks) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(b, p.chunks[0])
+	p.chunks = p.chunks[1:]
+
+	return n, nil
+}
+
+func (p *chunkPort) Write(b []byte) (int, error) { return len(b), nil }
+
+func (p *chunkPort) Close() error { return nil }
+
+func tempDir(t *testing.T) (string, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestCaptureReplay(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	path := filepath.Join(dir, "serial.log")
+
+	writer, err := Open(path, 1<<20, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunks := [][]byte{{0xaa, 0x55, 0x01}, {0x02, 0x03}, {0x04}}
+	port := NewPort(&chunkPort{chunks: append([][]byte(nil), chunks...)}, writer)
+
+	buf := make([]byte, 16)
+	for i := range chunks {
+		if _, err := port.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+
+		// the agent writes between reads, writes are not replayed
+		if i == 0 {
+			if _, err := port.Write([]byte{0xff, 0xfe}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// the read at the end of the port records nothing
+	if _, err := port.Read(buf); err != io.EOF {
+		t.Fatalf("read past the end: %v", err)
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := strings.Count(string(raw), "\n"); lines != 4 {
+		t.Fatalf("captured %d lines, want 3 reads and a write:\n%s", lines, raw)
+	}
+
+	replay, err := OpenReplay(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []byte
+	for len(got) < 6 {
+		n, err := replay.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, buf[:n]...)
+	}
+
+	if want := bytes.Join(chunks, nil); !bytes.Equal(got, want) {
+		t.Errorf("replayed % x, want % x", got, want)
+	}
+
+	// after the last record reads block until the replay is closed
+	done := make(chan error, 1)
+	go func() {
+		_, err := replay.Read(buf)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("read after the last record returned %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	replay.Close()
+
+	if err := <-done; err != io.EOF {
+		t.Errorf("read after close = %v, want EOF", err)
+	}
+
+	if _, err := replay.Write([]byte{1}); err != errClosed {
+		t.Errorf("write after close = %v, want %v", err, errClosed)
+	}
+}
+
+func TestReplayPause(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	path := filepath.Join(dir, "serial.log")
+	at := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	capture := fmt.Sprintf("%s RX 01\n%s RX 02\n",
+		at.Format(time.RFC3339Nano), at.Add(time.Hour).Format(time.RFC3339Nano))
+
+	if err := ioutil.WriteFile(path, []byte(capture), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	replay, err := OpenReplay(path, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 4)
+	if _, err := replay.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// the second record is an hour later, closing ends the wait
+	done := make(chan error, 1)
+	go func() {
+		_, err := replay.Read(buf)
+		done <- err
+	}()
+
+	replay.Close()
+
+	select {
+	case err := <-done:
+		if err != errClosed {
+			t.Errorf("read during the pause = %v, want %v", err, errClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("close does not end the pause")
+	}
+}
+
+func TestReplayBadLine(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+	}{
+		{"fields", "2020-06-01T12:00:00Z RX"},
+		{"time", "yesterday RX 01"},
+		{"direction", "2020-06-01T12:00:00Z XX 01"},
+		{"hex", "2020-06-01T12:00:00Z RX 0g"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, cleanup := tempDir(t)
+			defer cleanup()
+
+			path := filepath.Join(dir, "serial.log")
+			if err := ioutil.WriteFile(path, []byte(tt.line+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			replay, err := OpenReplay(path, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer replay.Close()
+
+			_, err = replay.Read(make([]byte, 4))
+			if err == nil || !strings.Contains(err.Error(), "capture line 1") {
+				t.Errorf("read = %v, want an error about line 1", err)
+			}
+		})
+	}
+}
+
+func TestRotate(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	path := filepath.Join(dir, "serial.log")
+
+	// a line is about 50 bytes, each one rotates the file
+	writer, err := Open(path, 60, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	for i := 0; i < 5; i++ {
+		if err := writer.Record(RX, []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, name := range []string{path, path + ".1", path + ".2"} {
+		raw, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := fmt.Sprintf(" RX %02x\n", 4-i); !strings.HasSuffix(string(raw), want) {
+			t.Errorf("%s = %q, want the record %d", name, raw, 4-i)
+		}
+	}
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("more than 2 rotated files are kept: %v", err)
+	}
+}
@@ -0,0 +1,36 @@
+package capture
+
+import (
+	"io"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Port records everything read from and written to the wrapped port. A
+// failing capture is logged and never breaks the serial line.
+type Port struct {
+	io.ReadWriteCloser
+	writer *Writer
+}
+
+func NewPort(port io.ReadWriteCloser, writer *Writer) *Port {
+	return &Port{ReadWriteCloser: port, writer: writer}
+}
+
+func (p *Port) Read(b []byte) (int, error) {
+	n, err := p.ReadWriteCloser.Read(b)
+	p.record(RX, b[:n])
+	return n, err
+}
+
+func (p *Port) Write(b []byte) (int, error) {
+	n, err := p.ReadWriteCloser.Write(b)
+	p.record(TX, b[:n])
+	return n, err
+}
+
+func (p *Port) record(dir Direction, b []byte) {
+	if err := p.writer.Record(dir, b); err != nil {
+		logrus.WithError(err).Warn("failed to capture serial traffic")
+	}
+}
@@ -0,0 +1,156 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxLine fits the hex of the largest read go-serial returns.
+const maxLine = 1 << 20
+
+var errClosed = errors.New("replay is closed")
+
+// Replay is a port that reads the RX bytes of a capture file. Recorded
+// pauses are kept, scaled by speed, so the agent sees the traffic as the
+// controller sent it. Writes are dropped. After the last record Read
+// blocks until Close, so the capture is fed through the decoder once.
+type Replay struct {
+	file    *os.File
+	scanner *bufio.Scanner
+	speed   float64
+
+	pending []byte
+	last    time.Time
+	line    int
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// OpenReplay opens a capture written by Writer, speed 0 replays it without
+// pauses.
+func OpenReplay(path string, speed float64) (*Replay, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open capture: %w", err)
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), maxLine)
+
+	return &Replay{
+		file:    file,
+		scanner: scanner,
+		speed:   speed,
+		closed:  make(chan struct{}),
+	}, nil
+}
+
+func (r *Replay) Read(b []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, r.pending)
+	r.pending = r.pending[n:]
+
+	return n, nil
+}
+
+func (r *Replay) Write(b []byte) (int, error) {
+	select {
+	case <-r.closed:
+		return 0, errClosed
+	default:
+		return len(b), nil
+	}
+}
+
+func (r *Replay) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		close(r.closed)
+		err = r.file.Close()
+	})
+
+	return err
+}
+
+// next loads the following RX record into pending, waiting for the
+// recorded pause before it.
+func (r *Replay) next() error {
+	if !r.scanner.Scan() {
+		if err := r.scanner.Err(); err != nil {
+			return fmt.Errorf("read capture line %d: %w", r.line+1, err)
+		}
+
+		logrus.WithField("lines", r.line).Info("capture replayed")
+		<-r.closed
+
+		return io.EOF
+	}
+
+	r.line++
+
+	at, dir, data, err := parseLine(r.scanner.Text())
+	if err != nil {
+		return fmt.Errorf("capture line %d: %w", r.line, err)
+	}
+
+	if dir != RX {
+		return nil
+	}
+
+	if r.speed > 0 && !r.last.IsZero() {
+		pause := time.Duration(float64(at.Sub(r.last)) / r.speed)
+		if pause > 0 {
+			timer := time.NewTimer(pause)
+			select {
+			case <-timer.C:
+			case <-r.closed:
+				timer.Stop()
+				return errClosed
+			}
+		}
+	}
+
+	r.last = at
+	r.pending = data
+
+	return nil
+}
+
+func parseLine(line string) (time.Time, Direction, []byte, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return time.Time{}, "", nil, fmt.Errorf("want 3 fields, got %d", len(fields))
+	}
+
+	at, err := time.Parse(time.RFC3339Nano, fields[0])
+	if err != nil {
+		return time.Time{}, "", nil, err
+	}
+
+	dir := Direction(fields[1])
+	if dir != RX && dir != TX {
+		return time.Time{}, "", nil, fmt.Errorf("unknown direction %q", fields[1])
+	}
+
+	data, err := hex.DecodeString(fields[2])
+	if err != nil {
+		return time.Time{}, "", nil, err
+	}
+
+	return at, dir, data, nil
+}
@@ -0,0 +1,183 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"iLean/entity"
+	"iLean/protocol"
+)
+
+// deviceFrame converts a command received from the server into a frame for
+// the controller.
+func deviceFrame(command *entity.Command, address int32) (*protocol.Frame, error) {
+	var (
+		code    uint8
+		payload interface{}
+	)
+
+	switch command.TypeCommand {
+	case 1:
+		var data entity.CommandTemperature
+		if err := json.Unmarshal(command.Data, &data); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal command temperature: %w", err)
+		}
+
+		code = protocol.CommandSetTemperature
+		payload = protocol.Setpoint{Zone: int32(data.Zone), Value: data.Temperature}
+	case 2:
+		var data entity.CommandTemperatureBySensor
+		if err := json.Unmarshal(command.Data, &data); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal command temperature by sensor: %w", err)
+		}
+
+		code = protocol.CommandSetTemperature
+		payload = protocol.Setpoint{Zone: int32(data.Zone), Extra: uint8(data.Type)}
+	case 3, 4:
+		var data entity.CommandDataVentModule
+		if err := json.Unmarshal(command.Data, &data); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal command data vent module: %w", err)
+		}
+
+		module := protocol.VentModule{
+			Zone:                                   data.Zone,
+			VentSpeed:                              data.VentSpeed,
+			Delta:                                  data.Delta,
+			TypeRegulation:                         data.TypeRegulation,
+			IntervalTimeVentilationDampers:         data.IntervalTimeVentilationDampers,
+			VentilationPeriodAfterCO2ReductionTime: data.VentilationPeriodAfterCO2ReductionTime,
+		}
+
+		if data.ForAll {
+			module.Zone = 0
+			module.VentSpeed = 0
+		}
+
+		code = protocol.CommandSetVentModule
+		payload = module
+	case 5:
+		var data entity.CommandDataVentModuleForAll
+		if err := json.Unmarshal(command.Data, &data); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal command data vent module for all: %w", err)
+		}
+
+		code = protocol.CommandSetVentForAll
+		payload = protocol.VentModule{
+			Delta:                                  data.Delta,
+			TypeRegulation:                         data.TypeRegulation,
+			IntervalTimeVentilationDampers:         data.IntervalTimeVentilationDampers,
+			VentilationPeriodAfterCO2ReductionTime: data.VentilationPeriodAfterCO2ReductionTime,
+		}
+	case 6:
+		var data entity.CommandDataVentByZone
+		if err := json.Unmarshal(command.Data, &data); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal command data vent by zone: %w", err)
+		}
+
+		code = protocol.CommandSetVentByZone
+		payload = protocol.VentByZone{Zone: data.Zone}
+	case 9:
+		var data entity.CommandHysteresisOnHumidityModule
+		if err := json.Unmarshal(command.Data, &data); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal command hysteresis on humidity module: %w", err)
+		}
+
+		code = protocol.CommandSetTemperature
+		payload = protocol.Setpoint{Zone: data.Zone, Value: data.Humidity, Extra: data.Hysteresis}
+	default:
+		return nil, fmt.Errorf("not found command %d", command.TypeCommand)
+	}
+
+	raw, err := protocol.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return protocol.NewFrame(address, code, raw), nil
+}
+
+// serverCommand converts a frame received from the controller into a command
+// for the server. Frames that only confirm settings return nil.
+func serverCommand(frame *protocol.Frame) (*entity.Command, error) {
+	var msg interface{}
+
+	switch frame.Command {
+	case protocol.CommandTelemetry:
+		var data protocol.Telemetry
+		if err := protocol.Unmarshal(frame.Payload, &data); err != nil {
+			return nil, err
+		}
+
+		msg = entity.DataCommandTemperature{
+			Zone:        frame.Address,
+			TempAir:     data.TempAir,
+			HumidityAir: int(data.HumidityAir),
+			Tempfloor:   data.TempFloor,
+			CO2:         float32(data.CO2),
+		}
+	case protocol.CommandSetpointTable:
+		rows := make([]protocol.SetpointRow, protocol.SetpointTableRows)
+		if err := protocol.Unmarshal(frame.Payload, rows); err != nil {
+			return nil, err
+		}
+
+		data := make([]entity.DataCommandTemperatureBySensor, 0, len(rows))
+		for _, row := range rows {
+			data = append(data, entity.DataCommandTemperatureBySensor{
+				Zone:              row.Zone,
+				SetpointValueTemp: row.Setpoint,
+				TypeRegulation:    row.TypeRegulation - 1,
+			})
+		}
+
+		msg = data
+	case protocol.CommandVentTable:
+		rows := make([]protocol.VentRow, protocol.VentTableRows)
+		if err := protocol.Unmarshal(frame.Payload, rows); err != nil {
+			return nil, err
+		}
+
+		data := make([]entity.DataVent, 0, len(rows))
+		for _, row := range rows {
+			data = append(data, entity.DataVent{Zone: row.Zone, VentSpeed: row.VentSpeed})
+		}
+
+		msg = data
+	case protocol.CommandVentModule:
+		var data protocol.VentModule
+		if err := protocol.Unmarshal(frame.Payload, &data); err != nil {
+			return nil, err
+		}
+
+		msg = entity.DataVentModule{
+			Zone:                                   data.Zone,
+			VentSpeed:                              data.VentSpeed,
+			Delta:                                  data.Delta,
+			TypeRegulation:                         data.TypeRegulation,
+			IntervalTimeVentilationDampers:         data.IntervalTimeVentilationDampers,
+			VentilationPeriodAfterCO2ReductionTime: data.VentilationPeriodAfterCO2ReductionTime,
+		}
+	case protocol.CommandHumidityTable:
+		rows := make([]protocol.HumidityRow, protocol.HumidityTableRows)
+		if err := protocol.Unmarshal(frame.Payload, rows); err != nil {
+			return nil, err
+		}
+
+		data := make([]entity.DataCommandHumidityModule, 0, len(rows))
+		for _, row := range rows {
+			data = append(data, entity.DataCommandHumidityModule{
+				Zone:       row.Zone,
+				Setpoint:   row.Setpoint,
+				Hysteresis: row.Hysteresis - 1,
+			})
+		}
+
+		msg = data
+	case protocol.CommandSetTemperature, protocol.CommandSetVentModule,
+		protocol.CommandSetVentForAll, protocol.CommandSetVentByZone:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("not found command %d", frame.Command)
+	}
+
+	return entity.NewCommand(msg, typeCommand)
+}
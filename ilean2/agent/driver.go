@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"context"
+	"iLean/entity"
+
+	"github.com/sirupsen/logrus"
+)
+
+// driver speaks the wire protocol of the controllers at some bus addresses.
+// Whatever the protocol, the server gets the same commands and telemetry.
+type driver interface {
+	// execute writes a settings command to the controller at address and
+	// reports its progress up to the confirmation by the controller.
+	execute(command *entity.Command, address int32, report reportFunc)
+}
+
+// driver returns the driver of the controller at address.
+func (a *Agent) driver(address int32) driver {
+	if a.buses.isModbus(address) {
+		return a.modbus
+	}
+
+	return frameDriver{agent: a}
+}
+
+// frameDriver speaks the 55 AA framing. The controllers send telemetry on
+// their own and confirm a settings frame by sending it back.
+type frameDriver struct {
+	agent *Agent
+}
+
+func (d frameDriver) execute(command *entity.Command, address int32, report reportFunc) {
+	a := d.agent
+
+	frame, err := deviceFrame(command, address)
+	if err != nil {
+		logrus.WithError(err).Error("failed to build frame")
+		ack(report, command.ID, entity.AckFailed, err)
+		return
+	}
+
+	raw, err := frame.MarshalBinary()
+	if err != nil {
+		logrus.WithError(err).Error("failed to build frame")
+		ack(report, command.ID, entity.AckFailed, err)
+		return
+	}
+
+	key := ackKey{address: frame.Address, command: frame.Command}
+	pending := a.expectDeviceAck(key, command.ID, report)
+
+	if err := a.writeLine(context.Background(), raw); err != nil {
+		logrus.WithError(err).Error("failed write to device")
+		if a.dropPending(key, pending) {
+			pending.timer.Stop()
+			ack(report, command.ID, entity.AckFailed, err)
+		}
+		return
+	}
+
+	ack(report, command.ID, entity.AckWritten, nil)
+	logrus.Info("success write to device ", frame)
+}
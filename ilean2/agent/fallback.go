@@ -0,0 +1,221 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iLean/agent/schedule"
+	"iLean/entity"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// fallbackTick is how often the agent checks whether it has to follow the
+// schedule and which entries are due.
+const fallbackTick = 10 * time.Second
+
+// applySchedule stores a schedule synced by the server.
+func (a *Agent) applySchedule(data []byte) {
+	var next entity.Schedule
+	if err := json.Unmarshal(data, &next); err != nil {
+		a.reportScheduleStatus(0, entity.ScheduleRejected, err)
+		return
+	}
+
+	log := logrus.WithField("version", next.Version)
+
+	if err := a.checkSchedule(next); err != nil {
+		log.WithError(err).Error("schedule rejected")
+		a.reportScheduleStatus(next.Version, entity.ScheduleRejected, err)
+		return
+	}
+
+	if err := a.schedule.Set(next); err != nil {
+		log.WithError(err).Error("failed to save schedule")
+		a.reportScheduleStatus(next.Version, entity.ScheduleRejected, err)
+		return
+	}
+
+	log.WithField("entries", len(next.Entries)).Info("schedule saved")
+	a.reportScheduleStatus(next.Version, entity.ScheduleApplied, nil)
+}
+
+func (a *Agent) checkSchedule(next entity.Schedule) error {
+	if a.schedule == nil {
+		return errors.New("schedules are off")
+	}
+
+	if current := a.schedule.Schedule(); next.Version < current.Version {
+		return fmt.Errorf("version %d is older than %d", next.Version, current.Version)
+	}
+
+	for i, entry := range next.Entries {
+		if err := schedule.Check(entry); err != nil {
+			return fmt.Errorf("entries[%d]: %w", i, err)
+		}
+
+		if a.policy == nil {
+			continue
+		}
+
+		command := entity.Command{TypeCommand: entry.Command, Data: entry.Data}
+		if err := a.policy.Check(&command); err != nil {
+			return fmt.Errorf("entries[%d]: policy: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// fallback follows the schedule while the server is lost for longer than
+// schedule.after. Entries due since the server was lost are written when
+// the agent starts to follow it, the server learns about them once it is
+// back.
+func (a *Agent) fallback(ctx context.Context) {
+	if a.schedule == nil {
+		return
+	}
+
+	ticker := time.NewTicker(fallbackTick)
+	defer ticker.Stop()
+
+	// the agent counts as offline since the start
+	lastOnline := time.Now()
+	// ran is the time due entries were written up to, zero while the
+	// schedule is not followed
+	var ran time.Time
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		now := time.Now()
+
+		if a.isOnline() {
+			if !ran.IsZero() {
+				logrus.Info("server is back, stop following the schedule")
+			}
+
+			lastOnline = now
+			ran = time.Time{}
+			continue
+		}
+
+		after := a.config().Schedule.After
+		if now.Sub(lastOnline) < after {
+			continue
+		}
+
+		if ran.IsZero() {
+			logrus.WithField("offline", now.Sub(lastOnline).Round(time.Second)).Warn("server is lost, follow the schedule")
+			ran = lastOnline
+		}
+
+		for _, due := range schedule.Due(a.schedule.Schedule(), ran, now) {
+			a.runScheduled(due)
+		}
+
+		ran = now
+	}
+}
+
+// runScheduled writes an entry to its controller and records how the
+// controller took it.
+func (a *Agent) runScheduled(due schedule.Occurrence) {
+	log := logrus.WithFields(logrus.Fields{"command": due.Command, "day": due.Day, "at": due.Time})
+
+	action := entity.ScheduledAction{ScheduleEntry: due.ScheduleEntry, At: time.Now()}
+
+	var target entity.Target
+	if err := json.Unmarshal(due.Data, &target); err != nil {
+		log.WithError(err).Error("failed to read scheduled command")
+		a.recordAction(action, entity.Ack{Status: entity.AckFailed, Error: err.Error()})
+		return
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		log.WithError(err).Error("failed to generate command id")
+		return
+	}
+
+	command := entity.Command{
+		TypeCommand: due.Command,
+		ID:          id.String(),
+		BusAddress:  target.BusAddress,
+		Data:        due.Data,
+	}
+
+	log.Info("write scheduled command")
+
+	a.Execute(&command, func(ack entity.Ack) {
+		if ack.Final() {
+			a.recordAction(action, ack)
+		}
+	})
+}
+
+func (a *Agent) recordAction(action entity.ScheduledAction, ack entity.Ack) {
+	action.Status = ack.Status
+	action.Error = ack.Error
+
+	if err := a.schedule.Record(action); err != nil {
+		logrus.WithError(err).Error("failed to record scheduled action")
+	}
+}
+
+// reportSchedule tells the server which schedule the agent has and what it
+// did by it while the server was lost.
+func (a *Agent) reportSchedule() {
+	if a.schedule == nil {
+		return
+	}
+
+	current := a.schedule.Schedule()
+	a.reportScheduleStatus(current.Version, entity.ScheduleApplied, nil)
+
+	actions := a.schedule.Actions()
+	if len(actions) == 0 {
+		return
+	}
+
+	command, err := entity.NewCommand(entity.ScheduleReport{Version: current.Version, Actions: actions}, typeCommand)
+	if err != nil {
+		logrus.WithError(err).Error("failed to build schedule report")
+		return
+	}
+
+	if err := a.sendToServer(command); err != nil {
+		logrus.WithError(err).Warn("failed to send schedule report")
+		return
+	}
+
+	logrus.WithField("actions", len(actions)).Info("scheduled actions reported")
+
+	if err := a.schedule.Reported(len(actions)); err != nil {
+		logrus.WithError(err).Error("failed to drop reported actions")
+	}
+}
+
+func (a *Agent) reportScheduleStatus(version int, status string, cause error) {
+	report := entity.ScheduleStatus{Version: version, Status: status}
+	if cause != nil {
+		report.Error = cause.Error()
+	}
+
+	command, err := entity.NewCommand(report, typeCommand)
+	if err != nil {
+		logrus.WithError(err).Error("failed to build schedule status")
+		return
+	}
+
+	if err := a.sendToServer(command); err != nil {
+		logrus.WithError(err).WithField("status", report).Warn("failed to send schedule status")
+	}
+}
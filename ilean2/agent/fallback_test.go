@@ -0,0 +1,275 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"iLean/agent/schedule"
+	"iLean/config"
+	"iLean/entity"
+	"iLean/protocol"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestAgent returns an agent with the policy and a schedule in dir, no
+// link is started.
+func newTestAgent(t *testing.T, dir, policyYAML string) *Agent {
+	t.Helper()
+
+	conf := config.Default()
+	conf.Serial = 12345
+	conf.Auth.Unsigned = true
+	conf.Device.AckTimeout = time.Second
+	conf.Schedule.File = filepath.Join(dir, "schedule.json")
+
+	if policyYAML != "" {
+		conf.Policy.File = filepath.Join(dir, "policy.yaml")
+		if err := ioutil.WriteFile(conf.Policy.File, []byte(policyYAML), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a, err := NewAgent(&conf, nil)
+	if err != nil {
+		t.Fatalf("new agent: %v", err)
+	}
+
+	return a
+}
+
+// confirmWrites takes the writes to the line and confirms each frame as
+// the controller would, until done is closed.
+func confirmWrites(t *testing.T, a *Agent, written chan<- *protocol.Frame, done <-chan struct{}) {
+	for {
+		select {
+		case request := <-a.writes:
+			frame, err := protocol.NewDecoder(bytes.NewReader(request.data)).Decode()
+			request.result <- err
+			if err != nil {
+				t.Errorf("written frame: %v", err)
+				continue
+			}
+
+			written <- frame
+			a.confirmDeviceAck(ackKey{address: frame.Address, command: frame.Command})
+		case <-done:
+			return
+		}
+	}
+}
+
+func TestRunScheduled(t *testing.T) {
+	const policyYAML = "setpoint:\n  min: 5\n  max: 35\n"
+
+	tests := []struct {
+		name       string
+		policy     string
+		busAddress int32
+		setpoint   float32
+		// written is whether the frame goes on the line.
+		written bool
+		status  string
+		err     string
+	}{
+		{"within the policy", policyYAML, 0, 21, true, entity.AckConfirmed, ""},
+		{"without a policy", "", 0, 90, true, entity.AckConfirmed, ""},
+		{"out of the policy", policyYAML, 0, 90, false, entity.AckFailed, "policy"},
+		{"unknown bus", policyYAML, 7, 21, false, entity.AckFailed, "unknown bus address"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "agent")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			a := newTestAgent(t, dir, tt.policy)
+
+			written := make(chan *protocol.Frame, 1)
+			done := make(chan struct{})
+			defer close(done)
+			go confirmWrites(t, a, written, done)
+
+			data, err := json.Marshal(entity.CommandTemperature{
+				Target:      entity.Target{SerialNumber: 12345, BusAddress: tt.busAddress},
+				Zone:        1,
+				Temperature: tt.setpoint,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			a.runScheduled(schedule.Occurrence{ScheduleEntry: entity.ScheduleEntry{Day: 1, Time: "07:00", Command: 1, Data: data}})
+
+			select {
+			case frame := <-written:
+				if !tt.written {
+					t.Fatalf("frame %v written", frame)
+				}
+				if frame.Address != 101 {
+					t.Errorf("frame written to %d, want the primary controller 101", frame.Address)
+				}
+			case <-time.After(100 * time.Millisecond):
+				if tt.written {
+					t.Fatal("frame not written")
+				}
+			}
+
+			var actions []entity.ScheduledAction
+			for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+				if actions = a.schedule.Actions(); len(actions) > 0 {
+					break
+				}
+			}
+
+			if len(actions) != 1 {
+				t.Fatalf("recorded %d actions, want 1", len(actions))
+			}
+
+			if got := actions[0]; got.Status != tt.status || !strings.Contains(got.Error, tt.err) || got.Time != "07:00" {
+				t.Errorf("recorded %+v, want status %s with an error about %q", got, tt.status, tt.err)
+			}
+		})
+	}
+}
+
+// sentCommands returns the data of the commands of the type the agent sent.
+func sentCommands(t *testing.T, conn *fakeConn, typeCommand int) []json.RawMessage {
+	t.Helper()
+
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	var sent []json.RawMessage
+	for _, data := range conn.sent {
+		var command entity.Command
+		if err := json.Unmarshal(data, &command); err != nil {
+			t.Fatal(err)
+		}
+
+		if command.TypeCommand == typeCommand {
+			sent = append(sent, command.Data)
+		}
+	}
+
+	return sent
+}
+
+func TestApplySchedule(t *testing.T) {
+	const policyYAML = "setpoint:\n  min: 5\n  max: 35\n"
+
+	setpoint := func(value float32) json.RawMessage {
+		data, err := json.Marshal(entity.CommandTemperature{Zone: 1, Temperature: value})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	tests := []struct {
+		name     string
+		schedule entity.Schedule
+		status   string
+		err      string
+	}{
+		{"valid", entity.Schedule{Version: 2, Entries: []entity.ScheduleEntry{{Day: 1, Time: "07:00", Command: 1, Data: setpoint(21)}}}, entity.ScheduleApplied, ""},
+		{"older", entity.Schedule{Version: 0}, entity.ScheduleRejected, "older"},
+		{"bad entry", entity.Schedule{Version: 2, Entries: []entity.ScheduleEntry{{Day: 9, Time: "07:00", Command: 1, Data: setpoint(21)}}}, entity.ScheduleRejected, "entries[0]: day 9"},
+		{"out of the policy", entity.Schedule{Version: 2, Entries: []entity.ScheduleEntry{{Day: 1, Time: "07:00", Command: 1, Data: setpoint(90)}}}, entity.ScheduleRejected, "entries[0]: policy"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "agent")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			a := newTestAgent(t, dir, policyYAML)
+			if err := a.schedule.Set(entity.Schedule{Version: 1}); err != nil {
+				t.Fatal(err)
+			}
+
+			conn := newFakeConn()
+			a.connect, a.online = conn, true
+
+			data, err := json.Marshal(tt.schedule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a.applySchedule(data)
+
+			sent := sentCommands(t, conn, entity.CommandScheduleStatus)
+			if len(sent) != 1 {
+				t.Fatalf("sent %d schedule statuses, want 1", len(sent))
+			}
+
+			var status entity.ScheduleStatus
+			if err := json.Unmarshal(sent[0], &status); err != nil {
+				t.Fatal(err)
+			}
+
+			if status.Version != tt.schedule.Version || status.Status != tt.status || !strings.Contains(status.Error, tt.err) {
+				t.Errorf("status = %+v, want %s with an error about %q", status, tt.status, tt.err)
+			}
+
+			want := 1
+			if tt.status == entity.ScheduleApplied {
+				want = tt.schedule.Version
+			}
+			if v := a.schedule.Schedule().Version; v != want {
+				t.Errorf("following version %d, want %d", v, want)
+			}
+		})
+	}
+}
+
+func TestReportSchedule(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := newTestAgent(t, dir, "")
+
+	action := entity.ScheduledAction{ScheduleEntry: entity.ScheduleEntry{Day: 1, Time: "07:00", Command: 1}, Status: entity.AckConfirmed}
+	if err := a.schedule.Record(action); err != nil {
+		t.Fatal(err)
+	}
+
+	// offline the actions are kept for later
+	a.reportSchedule()
+	if n := len(a.schedule.Actions()); n != 1 {
+		t.Fatalf("%d actions kept offline, want 1", n)
+	}
+
+	conn := newFakeConn()
+	a.connect, a.online = conn, true
+	a.reportSchedule()
+
+	sent := sentCommands(t, conn, entity.CommandScheduleReport)
+	if len(sent) != 1 {
+		t.Fatalf("sent %d schedule reports, want 1", len(sent))
+	}
+
+	var report entity.ScheduleReport
+	if err := json.Unmarshal(sent[0], &report); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Actions) != 1 || report.Actions[0].Time != "07:00" {
+		t.Errorf("report = %+v", report)
+	}
+
+	if n := len(a.schedule.Actions()); n != 0 {
+		t.Errorf("%d actions left after the report", n)
+	}
+}
@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"iLean/entity"
+	"iLean/protocol"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Version is set at build time with -ldflags "-X iLean/agent.Version=...".
+var Version = "dev"
+
+// stats are the counters reported in the health message. The 64-bit fields
+// come first so they stay aligned for atomic access on the 32-bit Pi.
+type stats struct {
+	bytesRead        uint64
+	bytesWritten     uint64
+	frames           uint64
+	crcFailures      uint64
+	resyncs          uint64
+	socketReconnects uint64
+	deviceReconnects uint64
+	// lastFrame is the unix time in nanoseconds of the last decoded frame.
+	lastFrame int64
+
+	started time.Time
+}
+
+func newStats() *stats {
+	return &stats{started: time.Now()}
+}
+
+// decoded adds what the decoder counted since the previous call, seen holds
+// the decoder stats of that call.
+func (s *stats) decoded(seen *protocol.DecoderStats, current protocol.DecoderStats) {
+	atomic.AddUint64(&s.frames, current.Frames-seen.Frames)
+	atomic.AddUint64(&s.crcFailures, current.CRCErrors-seen.CRCErrors)
+	atomic.AddUint64(&s.resyncs, current.Resyncs-seen.Resyncs)
+
+	if current.Frames != seen.Frames {
+		atomic.StoreInt64(&s.lastFrame, time.Now().UnixNano())
+	}
+
+	*seen = current
+}
+
+func (s *stats) health() entity.Health {
+	health := entity.Health{
+		Version:           Version,
+		UptimeSec:         int64(time.Since(s.started) / time.Second),
+		BytesRead:         atomic.LoadUint64(&s.bytesRead),
+		BytesWritten:      atomic.LoadUint64(&s.bytesWritten),
+		Frames:            atomic.LoadUint64(&s.frames),
+		CRCFailures:       atomic.LoadUint64(&s.crcFailures),
+		Resyncs:           atomic.LoadUint64(&s.resyncs),
+		SocketReconnects:  atomic.LoadUint64(&s.socketReconnects),
+		DeviceReconnects:  atomic.LoadUint64(&s.deviceReconnects),
+		SinceLastFrameSec: -1,
+	}
+
+	if last := atomic.LoadInt64(&s.lastFrame); last != 0 {
+		health.SinceLastFrameSec = int64(time.Since(time.Unix(0, last)) / time.Second)
+	}
+
+	return health
+}
+
+// countingPort counts the bytes moved over the serial line.
+type countingPort struct {
+	io.ReadWriteCloser
+	stats *stats
+}
+
+func (p countingPort) Read(b []byte) (int, error) {
+	n, err := p.ReadWriteCloser.Read(b)
+	atomic.AddUint64(&p.stats.bytesRead, uint64(n))
+	return n, err
+}
+
+func (p countingPort) Write(b []byte) (int, error) {
+	n, err := p.ReadWriteCloser.Write(b)
+	atomic.AddUint64(&p.stats.bytesWritten, uint64(n))
+	return n, err
+}
+
+// heartbeat reports the health of the agent to the server while it is
+// connected, reports are not buffered as only the latest one matters.
+func (a *Agent) heartbeat(ctx context.Context) {
+	for {
+		// the interval changes with a pushed config
+		if !sleep(ctx, a.config().Health.Interval) {
+			return
+		}
+
+		if !a.isOnline() {
+			continue
+		}
+
+		if err := a.reportHealth(); err != nil {
+			logrus.WithError(err).Warn("failed to send health report")
+		}
+	}
+}
+
+func (a *Agent) reportHealth() error {
+	command, err := entity.NewCommand(a.stats.health(), typeCommand)
+	if err != nil {
+		return fmt.Errorf("failed to build health report: %w", err)
+	}
+
+	command.Timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+
+	return a.sendToServer(command)
+}
@@ -0,0 +1,86 @@
+package agent
+
+import (
+	"bytes"
+	"iLean/protocol"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// nopCloser is a port over a buffer.
+type nopCloser struct {
+	*bytes.Buffer
+}
+
+func (nopCloser) Close() error { return nil }
+
+func TestStatsDecoded(t *testing.T) {
+	s := newStats()
+
+	if health := s.health(); health.SinceLastFrameSec != -1 || health.Frames != 0 {
+		t.Errorf("health before any frame = %+v", health)
+	}
+
+	var seen protocol.DecoderStats
+	s.decoded(&seen, protocol.DecoderStats{Frames: 3, CRCErrors: 1, Resyncs: 2})
+	s.decoded(&seen, protocol.DecoderStats{Frames: 5, CRCErrors: 1, Resyncs: 4})
+
+	health := s.health()
+	if health.Frames != 5 || health.CRCFailures != 1 || health.Resyncs != 4 {
+		t.Errorf("counted %d frames, %d CRC failures and %d resyncs, want 5, 1 and 4",
+			health.Frames, health.CRCFailures, health.Resyncs)
+	}
+
+	if health.SinceLastFrameSec != 0 {
+		t.Errorf("since last frame = %ds, want 0", health.SinceLastFrameSec)
+	}
+
+	// a decoder of a reopened port counts from zero again
+	seen = protocol.DecoderStats{}
+	s.decoded(&seen, protocol.DecoderStats{Frames: 2})
+
+	if frames := s.health().Frames; frames != 7 {
+		t.Errorf("counted %d frames after reopen, want 7", frames)
+	}
+}
+
+func TestStatsSinceLastFrame(t *testing.T) {
+	s := newStats()
+	s.started = time.Now().Add(-time.Hour)
+
+	var seen protocol.DecoderStats
+	s.decoded(&seen, protocol.DecoderStats{Frames: 1})
+	s.lastFrame = time.Now().Add(-90 * time.Second).UnixNano()
+
+	health := s.health()
+	if health.SinceLastFrameSec != 90 {
+		t.Errorf("since last frame = %ds, want 90", health.SinceLastFrameSec)
+	}
+
+	if health.UptimeSec != 3600 {
+		t.Errorf("uptime = %ds, want 3600", health.UptimeSec)
+	}
+
+	if health.Version != Version {
+		t.Errorf("version = %q, want %q", health.Version, Version)
+	}
+}
+
+func TestCountingPort(t *testing.T) {
+	s := newStats()
+	port := countingPort{ReadWriteCloser: nopCloser{bytes.NewBufferString("abcdef")}, stats: s}
+
+	if _, err := ioutil.ReadAll(port); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := port.Write([]byte("xyz")); err != nil {
+		t.Fatal(err)
+	}
+
+	health := s.health()
+	if health.BytesRead != 6 || health.BytesWritten != 3 {
+		t.Errorf("counted %d bytes read and %d written, want 6 and 3", health.BytesRead, health.BytesWritten)
+	}
+}
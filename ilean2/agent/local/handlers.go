@@ -0,0 +1,187 @@
+package local
+
+import (
+	"crypto/subtle"
+	"errors"
+	"iLean/entity"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/gofrs/uuid"
+)
+
+const (
+	typeCommand = 2
+
+	// maxWait caps the ?wait= parameter of the command endpoint.
+	maxWait = time.Minute
+)
+
+// auth checks the bearer token, websocket clients that can not set headers
+// pass it as ?token=.
+func (s *Server) auth(c *gin.Context) {
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if token == "" {
+		token = c.Query("token")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.conf.Token)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, entity.Response{Status: http.StatusUnauthorized, Message: "Status Unauthorized"})
+		return
+	}
+
+	c.Next()
+}
+
+// Controller writes a settings command to the controller, it takes the same
+// body and ?wait= parameter as the command endpoint of the server.
+func (s *Server) Controller(c *gin.Context) {
+	commandNum, err := strconv.Atoi(c.Param("n"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: "Status Bad Request"})
+		return
+	}
+
+	req, ok := entity.NewRequest(commandNum)
+	if !ok {
+		c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: "Status Bad Request"})
+		return
+	}
+
+	if !bindCommand(c, req) {
+		return
+	}
+
+	if hysteresis, ok := req.(*entity.CommandHysteresisOnHumidityModule); ok {
+		hysteresis.SetDefaults()
+	}
+
+	target := req.GetTarget()
+	if target.SerialNumber != s.serial {
+		c.JSON(http.StatusNotFound, entity.Response{Status: http.StatusNotFound, Message: "unknown serial number"})
+		return
+	}
+
+	wait, err := waitParam(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: err.Error()})
+		return
+	}
+
+	mes, err := entity.NewCommand(req, typeCommand)
+	if err != nil {
+		s.log.Error(err)
+		c.JSON(http.StatusInternalServerError, entity.Response{Status: http.StatusInternalServerError, Message: "Status Internal Server Error"})
+		return
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		s.log.Error(err)
+		c.JSON(http.StatusInternalServerError, entity.Response{Status: http.StatusInternalServerError, Message: "Status Internal Server Error"})
+		return
+	}
+	mes.ID = id.String()
+	mes.BusAddress = target.BusAddress
+
+	// delivered, written and the final ack fit without blocking the agent
+	acks := make(chan entity.Ack, 4)
+	s.executor.Execute(mes, func(ack entity.Ack) {
+		select {
+		case acks <- ack:
+		default:
+		}
+	})
+
+	last := entity.Ack{ID: mes.ID, Status: entity.AckSent}
+
+	// Execute returns once the frame is written, without ?wait= the client
+	// gets how far the command got by then
+	if wait == 0 {
+		for len(acks) > 0 {
+			last = <-acks
+		}
+
+		respond(c, last)
+		return
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		select {
+		case ack := <-acks:
+			last = ack
+			if ack.Final() {
+				respond(c, ack)
+				return
+			}
+		case <-timer.C:
+			c.JSON(http.StatusGatewayTimeout, entity.Response{Status: http.StatusGatewayTimeout, Message: "command is not confirmed in time", Data: last})
+			return
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
+
+func respond(c *gin.Context, ack entity.Ack) {
+	if ack.Status == entity.AckFailed {
+		c.JSON(http.StatusBadGateway, entity.Response{Status: http.StatusBadGateway, Message: "command failed", Data: ack})
+		return
+	}
+
+	c.JSON(http.StatusOK, entity.Response{Status: http.StatusOK, Message: "ok", Data: ack})
+}
+
+// Telemetry upgrades the connection to a websocket that receives every
+// command read from the controllers.
+func (s *Server) Telemetry(c *gin.Context) {
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		s.log.WithError(err).Error("failed to upgrade")
+		return
+	}
+
+	s.stream.serve(conn)
+}
+
+// bindCommand decodes and validates the request body, on failure the
+// response is already written.
+func bindCommand(c *gin.Context, command interface{}) bool {
+	if err := c.ShouldBindJSON(command); err != nil {
+		c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: "Status Bad Request"})
+		return false
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(command); err != nil {
+		c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: "Status Bad Request"})
+		return false
+	}
+
+	return true
+}
+
+func waitParam(c *gin.Context) (time.Duration, error) {
+	raw := c.Query("wait")
+	if raw == "" {
+		return 0, nil
+	}
+
+	wait, err := time.ParseDuration(raw)
+	if err != nil || wait <= 0 {
+		return 0, errors.New("wait must be a positive duration like 5s")
+	}
+
+	if wait > maxWait {
+		wait = maxWait
+	}
+
+	return wait, nil
+}
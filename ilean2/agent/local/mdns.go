@@ -0,0 +1,247 @@
+package local
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	mdnsAddr = "224.0.0.251:5353"
+	mdnsPort = 5353
+
+	// serviceType is what the app browses for.
+	serviceType = "_ilean._tcp.local."
+
+	recordTTL = 120
+
+	// cacheFlush marks records only this agent answers for (RFC 6762 10.2).
+	cacheFlush = 1 << 15
+)
+
+// responder answers mDNS queries for the local API, it is enough for DNS-SD
+// browsing and does not probe for name conflicts: the instance name holds
+// the serial number, which is unique.
+type responder struct {
+	conn  *net.UDPConn
+	group *net.UDPAddr
+	log   *logrus.Entry
+
+	service  dnsmessage.Name
+	instance dnsmessage.Name
+	host     dnsmessage.Name
+	port     uint16
+	txt      []string
+}
+
+func newResponder(serial, port int) (*responder, error) {
+	group, err := net.ResolveUDPAddr("udp4", mdnsAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return nil, fmt.Errorf("listen mdns: %w", err)
+	}
+
+	name := fmt.Sprintf("ilean-%d", serial)
+
+	return &responder{
+		conn:     conn,
+		group:    group,
+		log:      logrus.WithField("subsystem", "mdns"),
+		service:  dnsmessage.MustNewName(serviceType),
+		instance: dnsmessage.MustNewName(name + "." + serviceType),
+		host:     dnsmessage.MustNewName(name + ".local."),
+		port:     uint16(port),
+		txt:      []string{fmt.Sprintf("serial=%d", serial), "path=/api/v1"},
+	}, nil
+}
+
+// run announces the service and answers queries until close.
+func (r *responder) run() {
+	r.announce(recordTTL)
+
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		r.handle(buf[:n], from)
+	}
+}
+
+// close tells the network the service is gone.
+func (r *responder) close() {
+	r.announce(0)
+	r.conn.Close()
+}
+
+func (r *responder) announce(ttl uint32) {
+	msg, err := r.message(dnsmessage.Header{Response: true, Authoritative: true}, nil, ttl)
+	if err != nil {
+		r.log.WithError(err).Error("failed to build announcement")
+		return
+	}
+
+	if _, err := r.conn.WriteToUDP(msg, r.group); err != nil {
+		r.log.WithError(err).Warn("failed to announce")
+	}
+}
+
+func (r *responder) handle(packet []byte, from *net.UDPAddr) {
+	var p dnsmessage.Parser
+
+	header, err := p.Start(packet)
+	if err != nil || header.Response {
+		return
+	}
+
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return
+	}
+
+	var (
+		matched bool
+		unicast bool
+	)
+
+	for _, q := range questions {
+		if r.matches(q) {
+			matched = true
+			unicast = unicast || q.Class&cacheFlush != 0
+		}
+	}
+
+	if !matched {
+		return
+	}
+
+	// legacy resolvers query from another port and expect a plain DNS reply
+	legacy := from.Port != mdnsPort
+
+	reply := dnsmessage.Header{Response: true, Authoritative: true}
+	var echo []dnsmessage.Question
+	if legacy {
+		reply.ID = header.ID
+		echo = questions
+	}
+
+	msg, err := r.message(reply, echo, recordTTL)
+	if err != nil {
+		r.log.WithError(err).Error("failed to build answer")
+		return
+	}
+
+	to := r.group
+	if legacy || unicast {
+		to = from
+	}
+
+	if _, err := r.conn.WriteToUDP(msg, to); err != nil {
+		r.log.WithError(err).Warn("failed to answer")
+	}
+}
+
+func (r *responder) matches(q dnsmessage.Question) bool {
+	name := strings.ToLower(q.Name.String())
+
+	switch q.Type {
+	case dnsmessage.TypePTR:
+		return name == strings.ToLower(r.service.String())
+	case dnsmessage.TypeSRV, dnsmessage.TypeTXT:
+		return name == strings.ToLower(r.instance.String())
+	case dnsmessage.TypeA:
+		return name == strings.ToLower(r.host.String())
+	case dnsmessage.TypeALL:
+		return name == strings.ToLower(r.service.String()) ||
+			name == strings.ToLower(r.instance.String()) ||
+			name == strings.ToLower(r.host.String())
+	}
+
+	return false
+}
+
+// message holds every record of the service, there are few enough of them
+// to always answer with all.
+func (r *responder) message(header dnsmessage.Header, questions []dnsmessage.Question, ttl uint32) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, header)
+	b.EnableCompression()
+
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+
+	for _, q := range questions {
+		if err := b.Question(q); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+
+	// cache flush is not understood by legacy resolvers
+	unique := dnsmessage.ClassINET
+	if questions == nil {
+		unique |= cacheFlush
+	}
+
+	resource := func(name dnsmessage.Name, class dnsmessage.Class) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Class: class, TTL: ttl}
+	}
+
+	if err := b.PTRResource(resource(r.service, dnsmessage.ClassINET), dnsmessage.PTRResource{PTR: r.instance}); err != nil {
+		return nil, err
+	}
+
+	if err := b.SRVResource(resource(r.instance, unique), dnsmessage.SRVResource{Target: r.host, Port: r.port}); err != nil {
+		return nil, err
+	}
+
+	if err := b.TXTResource(resource(r.instance, unique), dnsmessage.TXTResource{TXT: r.txt}); err != nil {
+		return nil, err
+	}
+
+	for _, ip := range localIPv4() {
+		var a dnsmessage.AResource
+		copy(a.A[:], ip)
+
+		if err := b.AResource(resource(r.host, unique), a); err != nil {
+			return nil, err
+		}
+	}
+
+	return b.Finish()
+}
+
+// localIPv4 returns the addresses the Pi is reachable at, they are looked up
+// on every answer as DHCP may change them.
+func localIPv4() []net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+
+	var ips []net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() {
+			continue
+		}
+
+		if ip := ipNet.IP.To4(); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+
+	return ips
+}
@@ -0,0 +1,114 @@
+package local
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"iLean/config"
+	"iLean/entity"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// Executor writes settings commands to the controllers, it is implemented by
+// the agent.
+type Executor interface {
+	Execute(command *entity.Command, report func(entity.Ack))
+}
+
+// Server is the API the agent serves on the home network. It accepts the
+// same commands as the cloud server and streams the telemetry read from the
+// controllers, so the app keeps working while the cloud is unreachable.
+type Server struct {
+	conf     config.LocalConfig
+	serial   int
+	executor Executor
+
+	log        *logrus.Entry
+	httpServer *http.Server
+	stream     *stream
+	mdns       *responder
+}
+
+func New(conf config.LocalConfig, serial int, executor Executor) *Server {
+	s := &Server{
+		conf:     conf,
+		serial:   serial,
+		executor: executor,
+		log:      logrus.WithField("subsystem", "local_api"),
+		stream:   newStream(),
+	}
+
+	router := gin.New()
+	router.Use(gin.Recovery())
+
+	r := router.Group("api/v1", s.auth)
+	{
+		r.POST("/controller/command/:n", s.Controller)
+		r.GET("/telemetry", s.Telemetry)
+	}
+
+	s.httpServer = &http.Server{Handler: router}
+
+	return s
+}
+
+// Start listens on the configured address and advertises it over mDNS.
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.conf.Listen)
+	if err != nil {
+		return fmt.Errorf("listen local api: %w", err)
+	}
+
+	go func() {
+		if err := s.httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			s.log.WithError(err).Error("failed to serve")
+		}
+	}()
+
+	s.log.WithField("addr", listener.Addr()).Info("started")
+
+	if !s.conf.MDNS {
+		return nil
+	}
+
+	mdns, err := newResponder(s.serial, listener.Addr().(*net.TCPAddr).Port)
+	if err != nil {
+		// the API still works for clients that know the address
+		s.log.WithError(err).Warn("failed to start mdns")
+		return nil
+	}
+
+	s.mdns = mdns
+	go s.mdns.run()
+
+	return nil
+}
+
+// Publish sends telemetry to the connected stream clients.
+func (s *Server) Publish(command *entity.Command) {
+	data, err := json.Marshal(command)
+	if err != nil {
+		s.log.WithError(err).Error("failed to marshal telemetry")
+		return
+	}
+
+	s.stream.broadcast(data)
+}
+
+func (s *Server) Close() error {
+	if s.mdns != nil {
+		s.mdns.close()
+	}
+
+	s.stream.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return s.httpServer.Shutdown(ctx)
+}
@@ -0,0 +1,136 @@
+package local
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Time allowed to write a message to the peer.
+	writeWait = 10 * time.Second
+
+	// Time allowed to read the next pong message from the peer.
+	pongWait = 60 * time.Second
+
+	// Send pings to peer with this period. Must be less than pongWait.
+	pingPeriod = (pongWait * 9) / 10
+
+	// sendBuffer is how many messages a slow client may fall behind before
+	// it is disconnected.
+	sendBuffer = 64
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// clients on the home network are authenticated by the token
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// stream fans telemetry out to the websocket clients.
+type stream struct {
+	mutex   sync.Mutex
+	clients map[*websocket.Conn]chan []byte
+	closed  bool
+}
+
+func newStream() *stream {
+	return &stream{clients: make(map[*websocket.Conn]chan []byte)}
+}
+
+func (s *stream) broadcast(data []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for conn, send := range s.clients {
+		select {
+		case send <- data:
+		default:
+			s.drop(conn)
+		}
+	}
+}
+
+// serve writes telemetry to the client until it disconnects.
+func (s *stream) serve(conn *websocket.Conn) {
+	send := make(chan []byte, sendBuffer)
+
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		conn.Close()
+		return
+	}
+	s.clients[conn] = send
+	s.mutex.Unlock()
+
+	// the reader only handles pongs and notices the client going away
+	go func() {
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(pongWait))
+		})
+
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				s.remove(conn)
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		s.remove(conn)
+		conn.Close()
+	}()
+
+	for {
+		select {
+		case data, ok := <-send:
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+
+			if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *stream) remove(conn *websocket.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.drop(conn)
+}
+
+// drop closes the send channel so the writer says goodbye and returns.
+func (s *stream) drop(conn *websocket.Conn) {
+	if send, ok := s.clients[conn]; ok {
+		delete(s.clients, conn)
+		close(send)
+	}
+}
+
+func (s *stream) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closed = true
+	for conn := range s.clients {
+		s.drop(conn)
+	}
+}
@@ -0,0 +1,499 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iLean/config"
+	"iLean/entity"
+	"iLean/protocol/modbus"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var errModbusTimeout = errors.New("controller did not answer in time")
+
+// modbusDriver speaks Modbus RTU. The agent is the master on the line: it
+// polls the registers of the controllers for telemetry and writes settings
+// to them, one request at a time. A controller confirms a write with its
+// answer.
+type modbusDriver struct {
+	agent *Agent
+
+	// jobs carries commands to the poller, it runs while the port is open.
+	jobs chan modbusJob
+
+	// request waits for its answer from the serial reader.
+	mutex     sync.Mutex
+	request   *modbus.Request
+	responses chan []byte
+}
+
+type modbusJob struct {
+	command *entity.Command
+	address int32
+	report  reportFunc
+}
+
+func newModbusDriver(agent *Agent) *modbusDriver {
+	return &modbusDriver{
+		agent:     agent,
+		jobs:      make(chan modbusJob),
+		responses: make(chan []byte, 1),
+	}
+}
+
+// loadRegisterMaps reads the register maps of the Modbus controllers by
+// their addresses.
+func loadRegisterMaps(conf config.DeviceConfig) (map[int32]*modbus.Map, error) {
+	maps := make(map[int32]*modbus.Map)
+
+	for _, bus := range conf.Buses {
+		if !bus.IsModbus() {
+			continue
+		}
+
+		m, err := modbus.LoadMap(bus.RegisterMap)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load register map of %d: %w", bus.Address, err)
+		}
+
+		maps[bus.Address] = m
+	}
+
+	return maps, nil
+}
+
+func (m *modbusDriver) execute(command *entity.Command, address int32, report reportFunc) {
+	timer := time.NewTimer(writeWait)
+	defer timer.Stop()
+
+	select {
+	case m.jobs <- modbusJob{command: command, address: address, report: report}:
+	case <-timer.C:
+		ack(report, command.ID, entity.AckFailed, errDeviceOffline)
+	}
+}
+
+// run polls the controllers and executes commands until ctx is done.
+func (m *modbusDriver) run(ctx context.Context, maps map[int32]*modbus.Map) {
+	next := make(map[int32]time.Time, len(maps))
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		for address, registers := range maps {
+			if now := time.Now(); !now.Before(next[address]) {
+				next[address] = now.Add(registers.Poll)
+				m.poll(ctx, address, registers)
+			}
+		}
+
+		select {
+		case job := <-m.jobs:
+			m.write(ctx, job, maps[job.address])
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// poll reads the registers of a controller and sends what they hold to the
+// server.
+func (m *modbusDriver) poll(ctx context.Context, address int32, registers *modbus.Map) {
+	log := logrus.WithField("bus_address", address)
+	values := make(modbus.Values)
+
+	for _, request := range registers.Reads(uint8(address)) {
+		words, err := m.transact(ctx, request, registers.Timeout)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.WithError(err).WithField("request", request).Warn("failed to poll controller")
+			}
+			return
+		}
+
+		values.Add(request, words)
+	}
+
+	commands, err := modbusTelemetry(registers, values)
+	if err != nil {
+		log.WithError(err).Error("failed to build telemetry")
+		return
+	}
+
+	now := time.Now()
+	timestamp := now.UnixNano() / int64(time.Millisecond)
+
+	for _, command := range commands {
+		command.BusAddress = address
+		command.Timestamp = timestamp
+		m.agent.watchdog.seen(address, command.TypeCommand, now)
+
+		m.agent.telemetry <- command
+
+		log.WithField(fmt.Sprintf("command %d", command.TypeCommand), string(command.Data)).Info("send to messages")
+	}
+}
+
+// write sets the registers a command changes, it is confirmed once the
+// controller answered every write.
+func (m *modbusDriver) write(ctx context.Context, job modbusJob, registers *modbus.Map) {
+	id := job.command.ID
+	log := logrus.WithField("bus_address", job.address)
+
+	if registers == nil {
+		ack(job.report, id, entity.AckFailed, fmt.Errorf("no register map for %d", job.address))
+		return
+	}
+
+	requests, err := modbusWrites(job.command, registers, uint8(job.address))
+	if err != nil {
+		log.WithError(err).Error("failed to build modbus request")
+		ack(job.report, id, entity.AckFailed, err)
+		return
+	}
+
+	for i, request := range requests {
+		if err := m.send(ctx, request); err != nil {
+			log.WithError(err).Error("failed write to device")
+			ack(job.report, id, entity.AckFailed, err)
+			return
+		}
+
+		if i == 0 {
+			ack(job.report, id, entity.AckWritten, nil)
+		}
+
+		if _, err := m.wait(ctx, request, registers.Timeout); err != nil {
+			log.WithError(err).WithField("request", request).Error("controller did not confirm write")
+			ack(job.report, id, entity.AckFailed, err)
+			return
+		}
+	}
+
+	log.WithField("command", job.command.TypeCommand).Info("success write to device")
+	ack(job.report, id, entity.AckConfirmed, nil)
+}
+
+// transact sends a request and returns the registers of the answer.
+func (m *modbusDriver) transact(ctx context.Context, request modbus.Request, timeout time.Duration) ([]uint16, error) {
+	if err := m.send(ctx, request); err != nil {
+		return nil, err
+	}
+
+	return m.wait(ctx, request, timeout)
+}
+
+func (m *modbusDriver) send(ctx context.Context, request modbus.Request) error {
+	raw, err := request.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	m.request = &request
+	// a late answer to an earlier request
+	select {
+	case <-m.responses:
+	default:
+	}
+	m.mutex.Unlock()
+
+	if err := m.agent.writeLine(ctx, raw); err != nil {
+		m.expect(nil)
+		return err
+	}
+
+	return nil
+}
+
+func (m *modbusDriver) wait(ctx context.Context, request modbus.Request, timeout time.Duration) ([]uint16, error) {
+	defer m.expect(nil)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case raw := <-m.responses:
+		return request.ParseResponse(raw)
+	case <-timer.C:
+		return nil, errModbusTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (m *modbusDriver) expect(request *modbus.Request) {
+	m.mutex.Lock()
+	m.request = request
+	m.mutex.Unlock()
+}
+
+// match tells the serial reader how long the answer to the request on the
+// line is, see protocol.Decoder.Share.
+func (m *modbusDriver) match(buf []byte) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.request == nil {
+		return 0
+	}
+
+	return m.request.Match(buf)
+}
+
+// receive takes the answer from the serial reader.
+func (m *modbusDriver) receive(raw []byte) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.request == nil {
+		return
+	}
+
+	m.request = nil
+
+	select {
+	case m.responses <- raw:
+	default:
+	}
+}
+
+// modbusTelemetry converts polled registers into the commands the frame
+// controllers send for the same values.
+func modbusTelemetry(registers *modbus.Map, values modbus.Values) ([]*entity.Command, error) {
+	read := func(r *modbus.Register) (float64, bool) {
+		if r == nil {
+			return 0, false
+		}
+
+		return r.Read(values)
+	}
+
+	value := func(r *modbus.Register) float64 {
+		v, _ := read(r)
+		return v
+	}
+
+	var (
+		messages  []interface{}
+		setpoints []entity.DataCommandTemperatureBySensor
+		vents     []entity.DataVent
+		humidity  []entity.DataCommandHumidityModule
+	)
+
+	for _, z := range registers.Zones {
+		if z.TempAir != nil || z.HumidityAir != nil || z.TempFloor != nil || z.CO2 != nil {
+			messages = append(messages, entity.DataCommandTemperature{
+				Zone:        z.Zone,
+				TempAir:     float32(value(z.TempAir)),
+				HumidityAir: int(value(z.HumidityAir)),
+				Tempfloor:   float32(value(z.TempFloor)),
+				CO2:         float32(value(z.CO2)),
+			})
+		}
+
+		if z.Setpoint != nil || z.TypeRegulation != nil {
+			// the register holds the type as command 2 writes it, the frame
+			// controllers report it one less
+			regulation := value(z.TypeRegulation)
+			if regulation > 0 {
+				regulation--
+			}
+
+			setpoints = append(setpoints, entity.DataCommandTemperatureBySensor{
+				Zone:              z.Zone,
+				SetpointValueTemp: float32(value(z.Setpoint)),
+				TypeRegulation:    uint8(regulation),
+			})
+		}
+
+		if z.VentSpeed != nil {
+			vents = append(vents, entity.DataVent{Zone: int16(z.Zone), VentSpeed: int16(value(z.VentSpeed))})
+		}
+
+		if z.HumiditySetpoint != nil || z.Hysteresis != nil {
+			humidity = append(humidity, entity.DataCommandHumidityModule{
+				Zone:       z.Zone,
+				Setpoint:   float32(value(z.HumiditySetpoint)),
+				Hysteresis: uint8(value(z.Hysteresis)),
+			})
+		}
+	}
+
+	if len(setpoints) > 0 {
+		messages = append(messages, setpoints)
+	}
+
+	if len(vents) > 0 {
+		messages = append(messages, vents)
+	}
+
+	module := registers.Module
+	if module.Delta != nil || module.TypeRegulation != nil || module.IntervalTimeVentilationDampers != nil ||
+		module.VentilationPeriodAfterCO2ReductionTime != nil || module.Zone != nil {
+		data := entity.DataVentModule{
+			Zone:                                   int16(value(module.Zone)),
+			Delta:                                  uint8(value(module.Delta)),
+			TypeRegulation:                         uint8(value(module.TypeRegulation)),
+			IntervalTimeVentilationDampers:         uint8(value(module.IntervalTimeVentilationDampers)),
+			VentilationPeriodAfterCO2ReductionTime: uint8(value(module.VentilationPeriodAfterCO2ReductionTime)),
+		}
+
+		if z, ok := registers.Zone(int32(data.Zone)); ok {
+			data.VentSpeed = int16(value(z.VentSpeed))
+		}
+
+		messages = append(messages, data)
+	}
+
+	if len(humidity) > 0 {
+		messages = append(messages, humidity)
+	}
+
+	commands := make([]*entity.Command, 0, len(messages))
+	for _, msg := range messages {
+		command, err := entity.NewCommand(msg, typeCommand)
+		if err != nil {
+			return nil, err
+		}
+
+		commands = append(commands, command)
+	}
+
+	return commands, nil
+}
+
+// modbusWrites converts a command received from the server into the writes
+// of the registers it sets.
+func modbusWrites(command *entity.Command, registers *modbus.Map, slave uint8) ([]modbus.Request, error) {
+	type write struct {
+		name  string
+		r     *modbus.Register
+		value float64
+	}
+
+	var writes []write
+
+	zone := func(n int32) (*modbus.Zone, error) {
+		z, ok := registers.Zone(n)
+		if !ok {
+			return nil, fmt.Errorf("register map has no zone %d", n)
+		}
+
+		return z, nil
+	}
+
+	module := func(delta, typeRegulation, interval, period uint8) {
+		writes = append(writes,
+			write{"module.delta", registers.Module.Delta, float64(delta)},
+			write{"module.type_regulation", registers.Module.TypeRegulation, float64(typeRegulation)},
+			write{"module.interval_time_ventilation_dampers", registers.Module.IntervalTimeVentilationDampers, float64(interval)},
+			write{"module.ventilation_period_after_co_2_reduction_time", registers.Module.VentilationPeriodAfterCO2ReductionTime, float64(period)},
+		)
+	}
+
+	switch command.TypeCommand {
+	case 1:
+		var data entity.CommandTemperature
+		if err := json.Unmarshal(command.Data, &data); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal command temperature: %w", err)
+		}
+
+		z, err := zone(int32(data.Zone))
+		if err != nil {
+			return nil, err
+		}
+
+		writes = append(writes, write{"setpoint", z.Setpoint, float64(data.Temperature)})
+	case 2:
+		var data entity.CommandTemperatureBySensor
+		if err := json.Unmarshal(command.Data, &data); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal command temperature by sensor: %w", err)
+		}
+
+		z, err := zone(int32(data.Zone))
+		if err != nil {
+			return nil, err
+		}
+
+		writes = append(writes, write{"type_regulation", z.TypeRegulation, float64(data.Type)})
+	case 3, 4:
+		var data entity.CommandDataVentModule
+		if err := json.Unmarshal(command.Data, &data); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal command data vent module: %w", err)
+		}
+
+		if !data.ForAll {
+			z, err := zone(int32(data.Zone))
+			if err != nil {
+				return nil, err
+			}
+
+			writes = append(writes, write{"vent_speed", z.VentSpeed, float64(data.VentSpeed)})
+		}
+
+		module(data.Delta, data.TypeRegulation, data.IntervalTimeVentilationDampers, data.VentilationPeriodAfterCO2ReductionTime)
+	case 5:
+		var data entity.CommandDataVentModuleForAll
+		if err := json.Unmarshal(command.Data, &data); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal command data vent module for all: %w", err)
+		}
+
+		module(data.Delta, data.TypeRegulation, data.IntervalTimeVentilationDampers, data.VentilationPeriodAfterCO2ReductionTime)
+	case 6:
+		var data entity.CommandDataVentByZone
+		if err := json.Unmarshal(command.Data, &data); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal command data vent by zone: %w", err)
+		}
+
+		if _, err := zone(int32(data.Zone)); err != nil {
+			return nil, err
+		}
+
+		writes = append(writes, write{"module.zone", registers.Module.Zone, float64(data.Zone)})
+	case 9:
+		var data entity.CommandHysteresisOnHumidityModule
+		if err := json.Unmarshal(command.Data, &data); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal command hysteresis on humidity module: %w", err)
+		}
+
+		z, err := zone(data.Zone)
+		if err != nil {
+			return nil, err
+		}
+
+		// the highest values keep the current setting of the controller
+		if data.Humidity != math.MaxFloat32 {
+			writes = append(writes, write{"humidity_setpoint", z.HumiditySetpoint, float64(data.Humidity)})
+		}
+		if data.Hysteresis != math.MaxUint8 {
+			writes = append(writes, write{"hysteresis", z.Hysteresis, float64(data.Hysteresis)})
+		}
+	default:
+		return nil, fmt.Errorf("not found command %d", command.TypeCommand)
+	}
+
+	requests := make([]modbus.Request, 0, len(writes))
+	for _, w := range writes {
+		if w.r == nil {
+			return nil, fmt.Errorf("register map has no %s", w.name)
+		}
+
+		request, err := w.r.Write(slave, w.value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", w.name, err)
+		}
+
+		requests = append(requests, request)
+	}
+
+	return requests, nil
+}
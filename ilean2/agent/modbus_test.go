@@ -0,0 +1,153 @@
+package agent
+
+import (
+	"encoding/json"
+	"iLean/entity"
+	"iLean/protocol/modbus"
+	"math"
+	"strings"
+	"testing"
+)
+
+func loadShippedMap(t *testing.T) *modbus.Map {
+	t.Helper()
+
+	m, err := modbus.LoadMap("../config/modbus.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+func TestModbusTelemetry(t *testing.T) {
+	m := loadShippedMap(t)
+
+	values := make(modbus.Values)
+	values.Add(modbus.Request{Function: modbus.ReadInputRegisters, Address: 0}, []uint16{215, 40, 0xfff6, 600})
+	values.Add(modbus.Request{Function: modbus.ReadHoldingRegisters, Address: 100}, []uint16{220, 2, 3, 450, 5})
+	values.Add(modbus.Request{Function: modbus.ReadHoldingRegisters, Address: 200}, []uint16{4, 1, 10, 20, 1})
+
+	commands, err := modbusTelemetry(m, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make(map[int]json.RawMessage)
+	for _, command := range commands {
+		data[command.TypeCommand] = command.Data
+	}
+
+	decode := func(typeCommand int, v interface{}) {
+		t.Helper()
+
+		raw, ok := data[typeCommand]
+		if !ok {
+			t.Fatalf("no command %d in %d commands", typeCommand, len(commands))
+		}
+
+		if err := json.Unmarshal(raw, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var telemetry entity.DataCommandTemperature
+	decode(1, &telemetry)
+	if telemetry.Zone != 1 || telemetry.TempAir != 21.5 || telemetry.HumidityAir != 40 || telemetry.Tempfloor != -1 || telemetry.CO2 != 600 {
+		t.Errorf("telemetry = %+v", telemetry)
+	}
+
+	var setpoints []entity.DataCommandTemperatureBySensor
+	decode(2, &setpoints)
+	// reported one less than written, as the frame controllers do
+	if len(setpoints) != 1 || setpoints[0].SetpointValueTemp != 22 || setpoints[0].TypeRegulation != 1 {
+		t.Errorf("setpoints = %+v", setpoints)
+	}
+
+	var vents []entity.DataVent
+	decode(3, &vents)
+	if len(vents) != 1 || vents[0].VentSpeed != 3 {
+		t.Errorf("vents = %+v", vents)
+	}
+
+	var module entity.DataVentModule
+	decode(7, &module)
+	if module.Zone != 1 || module.Delta != 4 || module.TypeRegulation != 1 || module.VentSpeed != 3 {
+		t.Errorf("module = %+v", module)
+	}
+
+	var humidity []entity.DataCommandHumidityModule
+	decode(8, &humidity)
+	if len(humidity) != 1 || humidity[0].Setpoint != 45 || humidity[0].Hysteresis != 5 {
+		t.Errorf("humidity = %+v", humidity)
+	}
+}
+
+func TestModbusWrites(t *testing.T) {
+	m := loadShippedMap(t)
+
+	type write struct {
+		address uint16
+		value   uint16
+	}
+
+	tests := []struct {
+		name        string
+		typeCommand int
+		data        interface{}
+		want        []write
+		err         string
+	}{
+		{"setpoint", 1, entity.CommandTemperature{Zone: 1, Temperature: 21.5}, []write{{100, 215}}, ""},
+		{"type regulation", 2, entity.CommandTemperatureBySensor{Zone: 1, Type: 2}, []write{{101, 2}}, ""},
+		{
+			"vent module", 3,
+			entity.CommandDataVentModule{Zone: 1, VentSpeed: 2, Delta: 4, TypeRegulation: 1, IntervalTimeVentilationDampers: 10, VentilationPeriodAfterCO2ReductionTime: 20},
+			[]write{{102, 2}, {200, 4}, {201, 1}, {202, 10}, {203, 20}}, "",
+		},
+		{
+			"vent module for all", 5,
+			entity.CommandDataVentModuleForAll{Delta: 4, TypeRegulation: 1, IntervalTimeVentilationDampers: 10, VentilationPeriodAfterCO2ReductionTime: 20},
+			[]write{{200, 4}, {201, 1}, {202, 10}, {203, 20}}, "",
+		},
+		{"vent by zone", 6, entity.CommandDataVentByZone{Zone: 1}, []write{{204, 1}}, ""},
+		{"humidity", 9, entity.CommandHysteresisOnHumidityModule{Zone: 1, Humidity: 45, Hysteresis: 5}, []write{{103, 450}, {104, 5}}, ""},
+		{"humidity kept", 9, entity.CommandHysteresisOnHumidityModule{Zone: 1, Humidity: math.MaxFloat32, Hysteresis: 5}, []write{{104, 5}}, ""},
+		{"hysteresis kept", 9, entity.CommandHysteresisOnHumidityModule{Zone: 1, Humidity: 45, Hysteresis: math.MaxUint8}, []write{{103, 450}}, ""},
+		{"unknown zone", 1, entity.CommandTemperature{Zone: 2, Temperature: 21.5}, nil, "no zone 2"},
+		{"does not fit", 1, entity.CommandTemperature{Zone: 1, Temperature: 4000}, nil, "setpoint"},
+		{"unknown command", 42, struct{}{}, nil, "not found command 42"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := json.Marshal(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			requests, err := modbusWrites(&entity.Command{TypeCommand: tt.typeCommand, Data: raw}, m, 101)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("writes: %v, want an error about %s", err, tt.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(requests) != len(tt.want) {
+				t.Fatalf("requests = %v, want %v", requests, tt.want)
+			}
+
+			for i, w := range tt.want {
+				r := requests[i]
+				if r.Slave != 101 || r.Function != modbus.WriteSingleRegister || r.Address != w.address || r.Values[0] != w.value {
+					t.Errorf("request %d = %v, want %d at %d", i, r, w.value, w.address)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package agent
+
+import (
+	"context"
+	"iLean/agent/systemd"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// probe is received from by a loop whenever it is free to take work, the
+// systemd watchdog sends to it to learn the loop is not stuck.
+type probe chan struct{}
+
+// ask reports whether the loop took the probe within timeout.
+func (p probe) ask(ctx context.Context, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case p <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// sleep is sleep for a loop that takes probes while it waits.
+func (p probe) sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			return true
+		case <-p:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// notifySystemd pings the systemd watchdog while the serial and forward
+// loops take probes. Until the agent is ready the start timeout is extended
+// instead, so an agent waiting for its links is not killed but a stuck one
+// is.
+func (a *Agent) notifySystemd(ctx context.Context) {
+	interval, err := systemd.WatchdogInterval()
+	if err != nil {
+		logrus.WithError(err).Warn("systemd watchdog is off")
+	}
+
+	var ping <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			a.notify(systemd.Stopping)
+			return
+		case <-ping:
+			if name := a.stuckLoop(ctx, interval/4); name != "" {
+				if ctx.Err() == nil {
+					logrus.WithField("loop", name).Error("loop is stuck, watchdog is not pinged")
+				}
+				continue
+			}
+
+			// a deadlocked agent mutex blocks here and stops the pings
+			a.mutex.Lock()
+			ready := a.ready
+			a.mutex.Unlock()
+
+			if ready {
+				a.notify(systemd.Watchdog)
+			} else {
+				a.notify(systemd.ExtendTimeout(interval))
+			}
+		}
+	}
+}
+
+// stuckLoop returns the loop that did not take a probe in time.
+func (a *Agent) stuckLoop(ctx context.Context, timeout time.Duration) string {
+	probes := []struct {
+		name  string
+		probe probe
+	}{
+		{"device", a.deviceProbe},
+		{"forward", a.forwardProbe},
+	}
+
+	for _, p := range probes {
+		if !p.probe.ask(ctx, timeout) {
+			return p.name
+		}
+	}
+
+	return ""
+}
+
+// linkUp tells systemd the agent is ready once the serial port and the
+// server link are up together for the first time.
+func (a *Agent) linkUp() {
+	a.mutex.Lock()
+	ready := !a.ready && a.online && a.deviceUp
+	if ready {
+		a.ready = true
+	}
+	a.mutex.Unlock()
+
+	if ready {
+		logrus.Info("agent is ready")
+		a.notify(systemd.Ready)
+	}
+}
+
+func (a *Agent) notify(state string) {
+	if _, err := systemd.Notify(state); err != nil {
+		logrus.WithError(err).WithField("state", state).Warn("failed to notify systemd")
+	}
+}
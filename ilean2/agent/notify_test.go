@@ -0,0 +1,134 @@
+package agent
+
+import (
+	"context"
+	"iLean/agent/systemd"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// takeProbes takes the probes of p until ctx is done, as a free loop does.
+func takeProbes(ctx context.Context, p probe) {
+	for {
+		select {
+		case <-p:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func TestProbe(t *testing.T) {
+	p := make(probe)
+
+	if p.ask(context.Background(), 10*time.Millisecond) {
+		t.Error("a busy loop took the probe")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	slept := make(chan bool, 1)
+	go func() { slept <- p.sleep(ctx, time.Hour) }()
+
+	if !p.ask(context.Background(), time.Second) {
+		t.Error("a sleeping loop did not take the probe")
+	}
+
+	cancel()
+	if <-slept {
+		t.Error("sleep ran to the end after cancel")
+	}
+
+	if !p.sleep(context.Background(), time.Millisecond) {
+		t.Error("sleep did not run to the end")
+	}
+}
+
+func TestNotifySystemd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "notify")
+	socket, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+
+	os.Setenv("NOTIFY_SOCKET", path)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	os.Setenv("WATCHDOG_USEC", "40000")
+	defer os.Unsetenv("WATCHDOG_USEC")
+
+	// next returns the next state sent, "" if none came within timeout.
+	next := func(timeout time.Duration) string {
+		buf := make([]byte, 64)
+		socket.SetReadDeadline(time.Now().Add(timeout))
+		n, err := socket.Read(buf)
+		if err != nil {
+			return ""
+		}
+		return string(buf[:n])
+	}
+
+	// expect skips states until want comes.
+	expect := func(want string) {
+		t.Helper()
+
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			if next(time.Second) == want {
+				return
+			}
+		}
+		t.Fatalf("systemd did not get %s", want)
+	}
+
+	a := newTestAgent(t, dir, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	loops, stopLoop := context.WithCancel(ctx)
+	go takeProbes(ctx, a.deviceProbe)
+	go takeProbes(loops, a.forwardProbe)
+
+	done := make(chan struct{})
+	go func() {
+		a.notifySystemd(ctx)
+		close(done)
+	}()
+
+	// waiting for the links extends the start timeout
+	expect(systemd.ExtendTimeout(40 * time.Millisecond))
+
+	a.mutex.Lock()
+	a.online, a.deviceUp = true, true
+	a.mutex.Unlock()
+	a.linkUp()
+
+	expect(systemd.Ready)
+	expect(systemd.Watchdog)
+
+	// a stuck loop stops the pings
+	stopLoop()
+	for next(50*time.Millisecond) != "" {
+	}
+	if state := next(200 * time.Millisecond); state != "" {
+		t.Errorf("got %s with the forward loop stuck", state)
+	}
+
+	cancel()
+	<-done
+
+	if state := next(time.Second); !strings.HasPrefix(state, systemd.Stopping) {
+		t.Errorf("got %q on shutdown, want %s", state, systemd.Stopping)
+	}
+}
@@ -0,0 +1,156 @@
+// Package policy holds the bounds the agent checks settings commands
+// against, so values out of range never reach the controllers whatever the
+// server sends.
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iLean/entity"
+	"io/ioutil"
+	"math"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Range bounds a value, both ends included.
+type Range struct {
+	Min float64 `yaml:"min"`
+	Max float64 `yaml:"max"`
+}
+
+// Policy is the policy file of the agent. A range left out is not checked.
+type Policy struct {
+	// Setpoint bounds the temperature of command 1.
+	Setpoint *Range `yaml:"setpoint"`
+	// VentSpeed bounds the vent speed of commands 3 and 4.
+	VentSpeed *Range `yaml:"vent_speed"`
+	// Humidity and Hysteresis bound the humidity setpoint of command 9.
+	Humidity   *Range `yaml:"humidity"`
+	Hysteresis *Range `yaml:"hysteresis"`
+	// Zones are the zones commands may address, any zone when empty.
+	Zones []int32 `yaml:"zones"`
+}
+
+// Load reads the policy file, unknown keys are an error so a typo does not
+// turn a bound off.
+func Load(path string) (*Policy, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read policy %s file: %w", path, err)
+	}
+
+	p := new(Policy)
+	if err := yaml.UnmarshalStrict(raw, p); err != nil {
+		return nil, fmt.Errorf("YAML unmarshal policy: %w", err)
+	}
+
+	if err := p.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid policy %s: %w", path, err)
+	}
+
+	return p, nil
+}
+
+func (p *Policy) Validate() error {
+	ranges := []struct {
+		name string
+		r    *Range
+	}{
+		{"setpoint", p.Setpoint},
+		{"vent_speed", p.VentSpeed},
+		{"humidity", p.Humidity},
+		{"hysteresis", p.Hysteresis},
+	}
+
+	for _, r := range ranges {
+		if r.r != nil && r.r.Min > r.r.Max {
+			return fmt.Errorf("%s: min is greater than max", r.name)
+		}
+	}
+
+	for _, zone := range p.Zones {
+		if zone <= 0 {
+			return errors.New("zones: zone must be positive")
+		}
+	}
+
+	return nil
+}
+
+// Check returns why the command must not be written to the controllers,
+// nil if it may. Commands the agent does not write are left to the drivers.
+func (p *Policy) Check(command *entity.Command) error {
+	req, ok := entity.NewRequest(command.TypeCommand)
+	if !ok {
+		return nil
+	}
+
+	if err := json.Unmarshal(command.Data, req); err != nil {
+		return fmt.Errorf("failed to unmarshal command %d: %w", command.TypeCommand, err)
+	}
+
+	switch data := req.(type) {
+	case *entity.CommandTemperature:
+		if err := p.zone(int32(data.Zone)); err != nil {
+			return err
+		}
+
+		return check("setpoint", p.Setpoint, float64(data.Temperature))
+	case *entity.CommandTemperatureBySensor:
+		return p.zone(int32(data.Zone))
+	case *entity.CommandDataVentModule:
+		// the module settings for all zones carry no zone and speed
+		if data.ForAll {
+			return nil
+		}
+
+		if err := p.zone(int32(data.Zone)); err != nil {
+			return err
+		}
+
+		return check("vent speed", p.VentSpeed, float64(data.VentSpeed))
+	case *entity.CommandDataVentByZone:
+		return p.zone(int32(data.Zone))
+	case *entity.CommandHysteresisOnHumidityModule:
+		if err := p.zone(data.Zone); err != nil {
+			return err
+		}
+
+		// the highest values keep the current setting of the controller
+		if data.Humidity != math.MaxFloat32 {
+			if err := check("humidity", p.Humidity, float64(data.Humidity)); err != nil {
+				return err
+			}
+		}
+
+		if data.Hysteresis != math.MaxUint8 {
+			return check("hysteresis", p.Hysteresis, float64(data.Hysteresis))
+		}
+	}
+
+	return nil
+}
+
+func (p *Policy) zone(zone int32) error {
+	if len(p.Zones) == 0 {
+		return nil
+	}
+
+	for _, z := range p.Zones {
+		if z == zone {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("zone %d is not allowed", zone)
+}
+
+func check(name string, r *Range, value float64) error {
+	if r == nil || (value >= r.Min && value <= r.Max) {
+		return nil
+	}
+
+	return fmt.Errorf("%s %v is out of range [%v, %v]", name, value, r.Min, r.Max)
+}
@@ -0,0 +1,132 @@
+package policy
+
+import (
+	"encoding/json"
+	"iLean/entity"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func command(t *testing.T, typeCommand int, data interface{}) *entity.Command {
+	t.Helper()
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &entity.Command{TypeCommand: typeCommand, Data: raw}
+}
+
+func TestCheck(t *testing.T) {
+	p := &Policy{
+		Setpoint:   &Range{Min: 5, Max: 35},
+		VentSpeed:  &Range{Min: 0, Max: 5},
+		Humidity:   &Range{Min: 20, Max: 80},
+		Hysteresis: &Range{Min: 1, Max: 10},
+		Zones:      []int32{1, 2},
+	}
+
+	tests := []struct {
+		name    string
+		command *entity.Command
+		wantErr bool
+	}{
+		{"setpoint", command(t, 1, entity.CommandTemperature{Zone: 1, Temperature: 21}), false},
+		{"setpoint at min", command(t, 1, entity.CommandTemperature{Zone: 1, Temperature: 5}), false},
+		{"setpoint at max", command(t, 1, entity.CommandTemperature{Zone: 1, Temperature: 35}), false},
+		{"setpoint too low", command(t, 1, entity.CommandTemperature{Zone: 1, Temperature: 4.5}), true},
+		{"setpoint too high", command(t, 1, entity.CommandTemperature{Zone: 1, Temperature: 90}), true},
+		{"setpoint of another zone", command(t, 1, entity.CommandTemperature{Zone: 3, Temperature: 21}), true},
+		{"sensor", command(t, 2, entity.CommandTemperatureBySensor{Zone: 2, Type: 1}), false},
+		{"sensor of another zone", command(t, 2, entity.CommandTemperatureBySensor{Zone: 3, Type: 1}), true},
+		{"vent speed", command(t, 3, entity.CommandDataVentModule{Zone: 1, VentSpeed: 5}), false},
+		{"vent speed too high", command(t, 3, entity.CommandDataVentModule{Zone: 1, VentSpeed: 6}), true},
+		{"vent speed too high on command 4", command(t, 4, entity.CommandDataVentModule{Zone: 1, VentSpeed: 6}), true},
+		{"vent speed too low", command(t, 4, entity.CommandDataVentModule{Zone: 1, VentSpeed: -1}), true},
+		{"vent of another zone", command(t, 3, entity.CommandDataVentModule{Zone: 3, VentSpeed: 1}), true},
+		{"vent for all zones", command(t, 3, entity.CommandDataVentModule{ForAll: true, Zone: 9, VentSpeed: 60}), false},
+		{"vent module for all zones", command(t, 5, entity.CommandDataVentModuleForAll{Delta: 200}), false},
+		{"vent by zone", command(t, 6, entity.CommandDataVentByZone{Zone: 1}), false},
+		{"vent by another zone", command(t, 6, entity.CommandDataVentByZone{Zone: 3}), true},
+		{"humidity", command(t, 9, entity.CommandHysteresisOnHumidityModule{Zone: 1, Humidity: 50, Hysteresis: 2}), false},
+		{"humidity too high", command(t, 9, entity.CommandHysteresisOnHumidityModule{Zone: 1, Humidity: 95, Hysteresis: 2}), true},
+		{"hysteresis too high", command(t, 9, entity.CommandHysteresisOnHumidityModule{Zone: 1, Humidity: 50, Hysteresis: 11}), true},
+		{"humidity unchanged", command(t, 9, entity.CommandHysteresisOnHumidityModule{Zone: 1, Humidity: math.MaxFloat32, Hysteresis: 2}), false},
+		{"hysteresis unchanged", command(t, 9, entity.CommandHysteresisOnHumidityModule{Zone: 1, Humidity: 50, Hysteresis: math.MaxUint8}), false},
+		{"both unchanged", command(t, 9, entity.CommandHysteresisOnHumidityModule{Zone: 1, Humidity: math.MaxFloat32, Hysteresis: math.MaxUint8}), false},
+		{"unchanged hysteresis with humidity too low", command(t, 9, entity.CommandHysteresisOnHumidityModule{Zone: 1, Humidity: 10, Hysteresis: math.MaxUint8}), true},
+		{"humidity of another zone", command(t, 9, entity.CommandHysteresisOnHumidityModule{Zone: 3, Humidity: 50, Hysteresis: 2}), true},
+		{"not a settings command", &entity.Command{TypeCommand: 7, Data: json.RawMessage(`"anything"`)}, false},
+		{"data does not decode", &entity.Command{TypeCommand: 1, Data: json.RawMessage(`[1]`)}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := p.Check(tt.command); (err != nil) != tt.wantErr {
+				t.Errorf("check: %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckUnbounded(t *testing.T) {
+	p := &Policy{}
+
+	for _, c := range []*entity.Command{
+		command(t, 1, entity.CommandTemperature{Zone: 7, Temperature: 90}),
+		command(t, 3, entity.CommandDataVentModule{Zone: 7, VentSpeed: 60}),
+		command(t, 9, entity.CommandHysteresisOnHumidityModule{Zone: 7, Humidity: 99, Hysteresis: 50}),
+	} {
+		if err := p.Check(c); err != nil {
+			t.Errorf("command %d: %v, want no checks without ranges and zones", c.TypeCommand, err)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr bool
+	}{
+		{"ranges", "setpoint:\n  min: 5\n  max: 35\nzones: [1, 2]\n", false},
+		{"empty", "", false},
+		{"unknown key", "setpiont:\n  min: 5\n  max: 35\n", true},
+		{"min over max", "vent_speed:\n  min: 5\n  max: 0\n", true},
+		{"zone not positive", "zones: [0]\n", true},
+	}
+
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "policy.yaml")
+			if err := ioutil.WriteFile(path, []byte(tt.yaml), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := Load(path); (err != nil) != tt.wantErr {
+				t.Errorf("load: %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadShippedPolicy(t *testing.T) {
+	p, err := Load("../../config/policy.yaml")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	if p.Setpoint == nil || p.VentSpeed == nil || p.Humidity == nil || p.Hysteresis == nil {
+		t.Errorf("loaded %+v, want every range", p)
+	}
+}
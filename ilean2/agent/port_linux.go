@@ -0,0 +1,30 @@
+package agent
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// pollable moves the serial port to the runtime poller. go-serial leaves the
+// file in blocking mode, where Close does not interrupt a pending Read and
+// the agent could not stop while the controller is silent.
+func pollable(port io.ReadWriteCloser) (io.ReadWriteCloser, error) {
+	file, ok := port.(*os.File)
+	if !ok {
+		return port, nil
+	}
+	defer file.Close()
+
+	fd, err := syscall.Dup(int(file.Fd()))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	return os.NewFile(uintptr(fd), file.Name()), nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package agent
+
+import "io"
+
+func pollable(port io.ReadWriteCloser) (io.ReadWriteCloser, error) {
+	return port, nil
+}
@@ -0,0 +1,392 @@
+package queue
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	segmentExt  = ".log"
+	headFile    = "head"
+	minSegment  = 64 << 10
+	segmentsMax = 16
+
+	// saveEvery bounds how many records are sent twice after a crash.
+	saveEvery = 100
+)
+
+// ErrRecord is returned for records that can not be stored as a single line.
+var ErrRecord = errors.New("record must be non empty and must not contain a newline")
+
+// Queue is a FIFO of newline separated records kept in segment files under
+// a directory, so it survives restarts of the agent. When the queue grows
+// past its limit the oldest segment is dropped.
+//
+// Records are delivered at least once: a record whose delivery was not
+// committed before a crash is replayed again after the restart.
+type Queue struct {
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+
+	mutex    sync.Mutex
+	segments []*segment
+	writer   *os.File
+
+	// head is the committed position inside segments[0], offset is where
+	// the reader stopped
+	head   int64
+	offset int64
+	reader *bufio.Reader
+	file   *os.File
+
+	dropped int64
+
+	replayMutex sync.Mutex
+}
+
+type segment struct {
+	seq  uint64
+	size int64
+}
+
+// Open loads the queue stored in dir, creating the directory if needed.
+func Open(dir string, maxBytes int64) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create queue dir: %w", err)
+	}
+
+	segmentBytes := maxBytes / segmentsMax
+	if segmentBytes < minSegment {
+		segmentBytes = minSegment
+	}
+
+	q := &Queue{dir: dir, maxBytes: maxBytes, segmentBytes: segmentBytes}
+
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// Append adds a record to the tail of the queue.
+func (q *Queue) Append(record []byte) error {
+	if len(record) == 0 || bytes.IndexByte(record, '\n') >= 0 {
+		return ErrRecord
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	tail := q.segments[len(q.segments)-1]
+	if tail.size >= q.segmentBytes {
+		if err := q.rotate(); err != nil {
+			return err
+		}
+		tail = q.segments[len(q.segments)-1]
+	}
+
+	n, err := q.writer.Write(append(record, '\n'))
+	tail.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("append record: %w", err)
+	}
+
+	q.trim()
+
+	return nil
+}
+
+// Size returns the number of bytes waiting to be replayed.
+func (q *Queue) Size() int64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.size()
+}
+
+// Dropped returns the number of bytes discarded because of the size limit.
+func (q *Queue) Dropped() int64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.dropped
+}
+
+// Replay hands records to fn from the oldest one until the queue is empty.
+// A record is removed only after fn returns nil, on error Replay stops and
+// the record stays at the head of the queue.
+func (q *Queue) Replay(fn func(record []byte) error) error {
+	q.replayMutex.Lock()
+	defer q.replayMutex.Unlock()
+
+	for i := 1; ; i++ {
+		record, seq, next, err := q.next()
+		if err == io.EOF {
+			return q.saveHead()
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if err := fn(record); err != nil {
+			q.rewind()
+			return err
+		}
+
+		q.commit(seq, next)
+
+		if i%saveEvery == 0 {
+			q.saveHead()
+		}
+	}
+}
+
+func (q *Queue) Close() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.closeReader()
+
+	err := q.saveHeadLocked()
+	if cerr := q.writer.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+func (q *Queue) load() error {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return fmt.Errorf("read queue dir: %w", err)
+	}
+
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), segmentExt) {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		q.segments = append(q.segments, &segment{seq: seq, size: f.Size()})
+	}
+
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i].seq < q.segments[j].seq })
+
+	if len(q.segments) == 0 {
+		q.segments = append(q.segments, &segment{seq: 1})
+	}
+
+	q.loadHead()
+
+	tail := q.segments[len(q.segments)-1]
+
+	if err := q.repair(tail); err != nil {
+		return err
+	}
+
+	writer, err := os.OpenFile(q.path(tail), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("open queue segment: %w", err)
+	}
+	q.writer = writer
+
+	return nil
+}
+
+// repair cuts a record torn by a crash off the end of the segment.
+func (q *Queue) repair(s *segment) error {
+	raw, err := ioutil.ReadFile(q.path(s))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("read queue segment: %w", err)
+	}
+
+	size := int64(bytes.LastIndexByte(raw, '\n') + 1)
+	if size == int64(len(raw)) {
+		return nil
+	}
+
+	if err := os.Truncate(q.path(s), size); err != nil {
+		return fmt.Errorf("repair queue segment: %w", err)
+	}
+
+	s.size = size
+	if q.segments[0] == s && q.head > size {
+		q.head = size
+	}
+
+	return nil
+}
+
+// loadHead restores the read position, an unreadable head file means the
+// queue is replayed from the start of the oldest segment.
+func (q *Queue) loadHead() {
+	raw, err := ioutil.ReadFile(filepath.Join(q.dir, headFile))
+	if err != nil {
+		return
+	}
+
+	var seq uint64
+	var offset int64
+	if _, err := fmt.Sscanf(string(raw), "%d %d", &seq, &offset); err != nil {
+		return
+	}
+
+	if seq == q.segments[0].seq && offset >= 0 && offset <= q.segments[0].size {
+		q.head = offset
+	}
+}
+
+func (q *Queue) saveHead() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.saveHeadLocked()
+}
+
+func (q *Queue) saveHeadLocked() error {
+	path := filepath.Join(q.dir, headFile)
+	tmp := path + ".tmp"
+
+	raw := fmt.Sprintf("%d %d\n", q.segments[0].seq, q.head)
+	if err := ioutil.WriteFile(tmp, []byte(raw), 0644); err != nil {
+		return fmt.Errorf("save queue head: %w", err)
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// next reads the record at the head without removing it and returns the
+// position right after it.
+func (q *Queue) next() ([]byte, uint64, int64, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for {
+		if q.reader == nil {
+			file, err := os.Open(q.path(q.segments[0]))
+			if err != nil {
+				return nil, 0, 0, fmt.Errorf("open queue segment: %w", err)
+			}
+
+			if _, err := file.Seek(q.head, io.SeekStart); err != nil {
+				file.Close()
+				return nil, 0, 0, fmt.Errorf("seek queue segment: %w", err)
+			}
+
+			q.file = file
+			q.reader = bufio.NewReader(file)
+			q.offset = q.head
+		}
+
+		line, err := q.reader.ReadBytes('\n')
+		if err == nil {
+			q.offset += int64(len(line))
+			return line[:len(line)-1], q.segments[0].seq, q.offset, nil
+		}
+
+		if err != io.EOF {
+			return nil, 0, 0, fmt.Errorf("read queue segment: %w", err)
+		}
+
+		if len(q.segments) == 1 {
+			return nil, 0, 0, io.EOF
+		}
+
+		q.removeHeadSegment()
+	}
+}
+
+// commit moves the head past a delivered record unless the segment was
+// dropped in the meantime.
+func (q *Queue) commit(seq uint64, head int64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.segments[0].seq == seq {
+		q.head = head
+	}
+}
+
+// rewind makes the next read start from the head again.
+func (q *Queue) rewind() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.closeReader()
+	q.saveHeadLocked()
+}
+
+func (q *Queue) size() int64 {
+	var total int64
+	for _, s := range q.segments {
+		total += s.size
+	}
+
+	return total - q.head
+}
+
+func (q *Queue) rotate() error {
+	tail := q.segments[len(q.segments)-1]
+	next := &segment{seq: tail.seq + 1}
+
+	writer, err := os.OpenFile(q.path(next), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("open queue segment: %w", err)
+	}
+
+	q.writer.Close()
+	q.writer = writer
+	q.segments = append(q.segments, next)
+
+	return nil
+}
+
+// trim drops the oldest segments while the queue is over its limit.
+func (q *Queue) trim() {
+	for len(q.segments) > 1 && q.size() > q.maxBytes {
+		q.dropped += q.segments[0].size - q.head
+		q.removeHeadSegment()
+	}
+}
+
+func (q *Queue) removeHeadSegment() {
+	q.closeReader()
+	os.Remove(q.path(q.segments[0]))
+
+	q.segments = q.segments[1:]
+	q.head = 0
+}
+
+func (q *Queue) closeReader() {
+	if q.file != nil {
+		q.file.Close()
+	}
+
+	q.file = nil
+	q.reader = nil
+}
+
+func (q *Queue) path(s *segment) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", s.seq, segmentExt))
+}
@@ -0,0 +1,276 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var errStop = errors.New("stop")
+
+func record(i, size int) []byte {
+	r := fmt.Sprintf("%06d", i)
+	if size > len(r) {
+		r += strings.Repeat("x", size-len(r))
+	}
+
+	return []byte(r)
+}
+
+func open(t *testing.T, dir string, maxBytes int64) *Queue {
+	t.Helper()
+
+	q, err := Open(dir, maxBytes)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	return q
+}
+
+func fill(t *testing.T, q *Queue, from, to, size int) {
+	t.Helper()
+
+	for i := from; i < to; i++ {
+		if err := q.Append(record(i, size)); err != nil {
+			t.Fatalf("append %d: %v", i, err)
+		}
+	}
+}
+
+// replayed returns the numbers of the records replayed until fn fails at
+// the record number stop, all of them if stop is negative.
+func replayed(t *testing.T, q *Queue, stop int) []int {
+	t.Helper()
+
+	var got []int
+	err := q.Replay(func(r []byte) error {
+		var i int
+		if _, err := fmt.Sscanf(string(r[:6]), "%d", &i); err != nil {
+			t.Fatalf("record %q: %v", r, err)
+		}
+
+		if i == stop {
+			return errStop
+		}
+
+		got = append(got, i)
+		return nil
+	})
+
+	if stop < 0 && err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+
+	return got
+}
+
+func span(from, to int) []int {
+	var out []int
+	for i := from; i < to; i++ {
+		out = append(out, i)
+	}
+
+	return out
+}
+
+func equal(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestReplay(t *testing.T) {
+	tests := []struct {
+		name    string
+		records int
+		size    int
+		// stop fails the first replay at this record, -1 for none.
+		stop int
+		// reopen closes the queue between the replays.
+		reopen bool
+	}{
+		{"empty", 0, 10, -1, false},
+		{"one segment", 50, 10, -1, false},
+		{"segments rotated", 300, 1000, -1, false},
+		{"stopped", 50, 10, 20, false},
+		{"stopped across segments", 300, 1000, 150, false},
+		{"stopped and restarted", 300, 1000, 150, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "queue")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			q := open(t, dir, 64<<20)
+			fill(t, q, 0, tt.records, tt.size)
+
+			first := tt.records
+			if tt.stop >= 0 {
+				first = tt.stop
+			}
+
+			if got := replayed(t, q, tt.stop); !equal(got, span(0, first)) {
+				t.Fatalf("replayed %v, want records 0 to %d", got, first)
+			}
+
+			if tt.reopen {
+				if err := q.Close(); err != nil {
+					t.Fatal(err)
+				}
+				q = open(t, dir, 64<<20)
+			}
+			defer q.Close()
+
+			if got := replayed(t, q, -1); !equal(got, span(first, tt.records)) {
+				t.Errorf("replayed %v after the stop, want records %d to %d", got, first, tt.records)
+			}
+
+			if size := q.Size(); size != 0 {
+				t.Errorf("size %d after the replay", size)
+			}
+		})
+	}
+}
+
+// TestRestartPartiallyReplayed restarts the queue from a head saved before
+// the last records were delivered, as after a crash: those records are
+// replayed again and none is lost.
+func TestRestartPartiallyReplayed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q := open(t, dir, 64<<20)
+	fill(t, q, 0, 250, 1000)
+
+	// the head is saved every saveEvery records
+	var saved []byte
+	err = q.Replay(func(r []byte) error {
+		if string(r[:6]) == fmt.Sprintf("%06d", saveEvery+50) {
+			saved, err = ioutil.ReadFile(filepath.Join(dir, headFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop {
+		t.Fatalf("replay: %v", err)
+	}
+
+	// a crash loses the head saved on the stop
+	if err := ioutil.WriteFile(filepath.Join(dir, headFile), saved, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	q = open(t, dir, 64<<20)
+	defer q.Close()
+
+	if got := replayed(t, q, -1); !equal(got, span(saveEvery, 250)) {
+		t.Errorf("replayed %v after the restart, want records %d to 250", got, saveEvery)
+	}
+}
+
+func TestRestartTornRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q := open(t, dir, 64<<20)
+	fill(t, q, 0, 10, 10)
+	tail := q.path(q.segments[len(q.segments)-1])
+	q.Close()
+
+	f, err := os.OpenFile(tail, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("000010xx")
+	f.Close()
+
+	q = open(t, dir, 64<<20)
+	defer q.Close()
+
+	fill(t, q, 11, 13, 10)
+
+	if got, want := replayed(t, q, -1), append(span(0, 10), 11, 12); !equal(got, want) {
+		t.Errorf("replayed %v, want %v", got, want)
+	}
+}
+
+func TestTrim(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// segments of minSegment, records of 1000 bytes and a newline
+	const maxBytes = 4 * minSegment
+	perSegment := int(minSegment/1001) + 1
+
+	q := open(t, dir, maxBytes)
+	defer q.Close()
+
+	fill(t, q, 0, 6*perSegment, 1000)
+
+	if size := q.Size(); size > maxBytes {
+		t.Errorf("size %d over the limit of %d", size, maxBytes)
+	}
+
+	if q.Dropped() == 0 {
+		t.Fatal("nothing dropped over the limit")
+	}
+
+	got := replayed(t, q, -1)
+	if len(got) == 0 || got[len(got)-1] != 6*perSegment-1 || !equal(got, span(got[0], 6*perSegment)) {
+		t.Fatalf("replayed %d records, want the newest ones in order", len(got))
+	}
+
+	if dropped := int64(got[0]) * 1001; q.Dropped() != dropped {
+		t.Errorf("dropped %d bytes, want %d", q.Dropped(), dropped)
+	}
+}
+
+func TestAppendRejects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q := open(t, dir, 64<<20)
+	defer q.Close()
+
+	for _, r := range [][]byte{nil, {}, []byte("a\nb")} {
+		if err := q.Append(r); err != ErrRecord {
+			t.Errorf("append %q: %v, want ErrRecord", r, err)
+		}
+	}
+
+	if size := q.Size(); size != 0 {
+		t.Errorf("size %d after rejected appends", size)
+	}
+}
@@ -0,0 +1,178 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"iLean/agent/update"
+	"iLean/entity"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// announce hands a release announced by the server to the updater, the
+// server announces it on every connect.
+func (a *Agent) announce(data []byte) {
+	var release entity.Release
+	if err := json.Unmarshal(data, &release); err != nil {
+		a.reportUpdate(release.Version, entity.UpdateRejected, err)
+		return
+	}
+
+	if release.Version == Version {
+		return
+	}
+
+	if a.binary == nil {
+		a.reportUpdate(release.Version, entity.UpdateRejected, errors.New("binary of the agent is unknown"))
+		return
+	}
+
+	if a.config().Update.PublicKey == "" {
+		a.reportUpdate(release.Version, entity.UpdateRejected, errors.New("updates are off"))
+		return
+	}
+
+	if version, _, ok := a.binary.RolledBack(); ok && version == release.Version {
+		// reported on connect, it takes another release
+		return
+	}
+
+	select {
+	case a.releases <- release:
+	default:
+		logrus.WithField("version", release.Version).Info("update in progress, release skipped")
+	}
+}
+
+// updater installs announced releases and restarts into them. A release
+// the agent runs on trial has to report healthy within the grace period,
+// otherwise the previous binary is put back.
+func (a *Agent) updater(ctx context.Context) {
+	if a.binary != nil {
+		if version, ok := a.binary.Trial(); ok && version == Version {
+			a.watchRelease(ctx)
+		}
+	}
+
+	for {
+		select {
+		case release := <-a.releases:
+			a.install(ctx, release)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (a *Agent) install(ctx context.Context, release entity.Release) {
+	log := logrus.WithField("version", release.Version)
+
+	key, err := update.ParseKey(a.config().Update.PublicKey)
+	if err != nil {
+		a.reportUpdate(release.Version, entity.UpdateRejected, err)
+		return
+	}
+
+	if err := update.CheckNewer(release.Version, Version); err != nil {
+		log.WithError(err).Error("release rejected")
+		a.reportUpdate(release.Version, entity.UpdateRejected, err)
+		return
+	}
+
+	if err := update.Verify(release, key); err != nil {
+		log.WithError(err).Error("release rejected")
+		a.reportUpdate(release.Version, entity.UpdateRejected, err)
+		return
+	}
+
+	log.Info("install release")
+	a.reportUpdate(release.Version, entity.UpdateInstalling, nil)
+
+	if err := a.binary.Install(ctx, release, key); err != nil {
+		log.WithError(err).Error("failed to install release")
+		a.reportUpdate(release.Version, entity.UpdateFailed, err)
+		return
+	}
+
+	log.Info("release installed, restart into it")
+	a.reportUpdate(release.Version, entity.UpdateRestarting, nil)
+	a.restart()
+}
+
+// watchRelease confirms the running release once both links are up and a
+// health report reached the server.
+func (a *Agent) watchRelease(ctx context.Context) {
+	log := logrus.WithField("version", Version)
+	log.Info("release on trial")
+
+	grace := time.NewTimer(a.config().Update.Grace)
+	defer grace.Stop()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-grace.C:
+			log.Error("release did not report healthy, roll back")
+
+			if err := a.binary.Rollback("no health report within the grace period"); err != nil {
+				log.WithError(err).Error("failed to roll back release")
+				return
+			}
+
+			a.restart()
+			return
+		case <-ctx.Done():
+			return
+		}
+
+		a.mutex.Lock()
+		up := a.online && a.deviceConnects > 0
+		a.mutex.Unlock()
+
+		if !up || a.reportHealth() != nil {
+			continue
+		}
+
+		if err := a.binary.Confirm(); err != nil {
+			log.WithError(err).Error("failed to confirm release")
+		}
+
+		log.Info("release applied")
+		a.reportUpdate(Version, entity.UpdateApplied, nil)
+		return
+	}
+}
+
+// reportRolledBack tells the server about a release that was rolled back,
+// until another one is installed.
+func (a *Agent) reportRolledBack() {
+	if a.binary == nil {
+		return
+	}
+
+	if version, reason, ok := a.binary.RolledBack(); ok {
+		a.reportUpdate(version, entity.UpdateRolledBack, errors.New(reason))
+	}
+}
+
+func (a *Agent) reportUpdate(version, status string, cause error) {
+	report := entity.UpdateStatus{Version: version, Status: status}
+	if cause != nil {
+		report.Error = cause.Error()
+	}
+
+	command, err := entity.NewCommand(report, typeCommand)
+	if err != nil {
+		logrus.WithError(err).Error("failed to build update status")
+		return
+	}
+
+	if err := a.sendToServer(command); err != nil {
+		logrus.WithError(err).WithField("status", report).Warn("failed to send update status")
+	}
+}
@@ -0,0 +1,326 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iLean/config"
+	"iLean/entity"
+	"reflect"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// trialTimeout is how long a pushed config has to bring the links back up
+// before the previous config is restored.
+const trialTimeout = 3 * time.Minute
+
+// ErrRestart is returned by Run when the agent stopped to start over with a
+// config that can not be applied while it runs or with a new binary.
+var ErrRestart = errors.New("restart to apply the update")
+
+var errReopen = errors.New("device settings changed")
+
+// trial is a config that has to prove it works: the agent has to be online
+// and the links have to have connected as many times as given, the links
+// the config changed once more than when it was applied.
+type trial struct {
+	version        int
+	socketConnects int
+	deviceConnects int
+	// restart tells that the previous config needs a restart as well.
+	restart bool
+}
+
+// config returns the config the agent runs with, it changes when the
+// server pushes a new one.
+func (a *Agent) config() config.Config {
+	a.confMutex.Lock()
+	defer a.confMutex.Unlock()
+
+	return a.conf
+}
+
+func (a *Agent) setConfig(conf config.Config) {
+	a.confMutex.Lock()
+	a.conf = conf
+	a.confMutex.Unlock()
+
+	a.buses.update(conf.Device)
+}
+
+// applyConfig handles a config pushed by the server. Upstream, device,
+// backoff and health settings are applied in place, anything else makes
+// the agent restart. Either way the config stays on trial until the links
+// are up again with it.
+func (a *Agent) applyConfig(data []byte) {
+	var desired entity.AgentConfig
+	if err := json.Unmarshal(data, &desired); err != nil {
+		a.reportConfig(0, entity.ConfigRejected, err)
+		return
+	}
+
+	log := logrus.WithField("version", desired.Version)
+
+	if a.store != nil {
+		if version, ok := a.store.Trial(); ok && version == desired.Version {
+			// pushed again on reconnect, the trial reports it
+			return
+		}
+	}
+
+	current := a.config()
+
+	conf, err := a.checkConfig(desired, current)
+	if err != nil {
+		log.WithError(err).Error("config rejected")
+		a.reportConfig(desired.Version, entity.ConfigRejected, err)
+		return
+	}
+
+	if desired.Version == current.Version {
+		a.reportConfig(desired.Version, entity.ConfigApplied, nil)
+		return
+	}
+
+	a.mutex.Lock()
+	next := trial{version: desired.Version, socketConnects: a.socketConnects, deviceConnects: a.deviceConnects}
+	a.mutex.Unlock()
+
+	if err := a.store.Update([]byte(desired.Config), desired.Version); err != nil {
+		log.WithError(err).Error("failed to save config")
+		a.reportConfig(desired.Version, entity.ConfigRejected, err)
+		return
+	}
+
+	if !hotSwappable(current, conf) {
+		log.Info("config saved, restart to apply it")
+		a.reportConfig(desired.Version, entity.ConfigRestarting, nil)
+		a.restart()
+		return
+	}
+
+	log.Info("apply config")
+
+	if conf.Upstream != current.Upstream {
+		next.socketConnects++
+	}
+
+	if !reflect.DeepEqual(conf.Device, current.Device) {
+		next.deviceConnects++
+	}
+
+	a.swapConfig(current, conf)
+
+	a.trials <- next
+}
+
+// checkConfig returns the pushed config if the agent can run it.
+func (a *Agent) checkConfig(desired entity.AgentConfig, current config.Config) (config.Config, error) {
+	if a.store == nil {
+		return config.Config{}, errors.New("remote config is off")
+	}
+
+	if version, ok := a.store.Trial(); ok {
+		return config.Config{}, fmt.Errorf("config %d is on trial", version)
+	}
+
+	if desired.Version < current.Version {
+		return config.Config{}, fmt.Errorf("version %d is older than %d", desired.Version, current.Version)
+	}
+
+	// auth, update and policy are kept as the agent runs them
+	conf, err := config.ParsePushedWithEnv([]byte(desired.Config), current)
+	if err != nil {
+		return config.Config{}, err
+	}
+
+	if conf.Version != 0 {
+		return config.Config{}, errors.New("config sets its own version")
+	}
+
+	if conf.Serial != current.Serial {
+		return config.Config{}, fmt.Errorf("config is for serial %d", conf.Serial)
+	}
+
+	if _, err := loadRegisterMaps(conf.Device); err != nil {
+		return config.Config{}, err
+	}
+
+	conf.Version = desired.Version
+	// replay is set on the command line
+	conf.Replay = current.Replay
+
+	return conf, nil
+}
+
+// hotSwappable reports whether the links can switch to next without a
+// restart, the other settings are held by objects built once.
+func hotSwappable(current, next config.Config) bool {
+	current.Version = next.Version
+	current.Upstream = next.Upstream
+	current.Device = next.Device
+	current.Backoff = next.Backoff
+	current.Health = next.Health
+	current.Watchdog = next.Watchdog
+
+	return reflect.DeepEqual(current, next)
+}
+
+// swapConfig switches the running agent from current to next, the links
+// whose settings changed reconnect.
+func (a *Agent) swapConfig(current, next config.Config) {
+	a.setConfig(next)
+
+	if next.Upstream != current.Upstream {
+		a.mutex.Lock()
+		if a.online {
+			// the socket supervisor redials with the new url
+			a.connect.Close()
+		}
+		a.mutex.Unlock()
+	}
+
+	if !reflect.DeepEqual(next.Device, current.Device) {
+		select {
+		case a.reopen <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// restart stops the agent, Run returns ErrRestart.
+func (a *Agent) restart() {
+	a.mutex.Lock()
+	a.restarting = true
+	a.mutex.Unlock()
+
+	a.stop()
+}
+
+// watchTrials confirms configs that bring the links up and rolls back the
+// ones that do not. A trial left by a restart is watched from the start.
+func (a *Agent) watchTrials(ctx context.Context) {
+	if a.store != nil {
+		if version, ok := a.store.Trial(); ok {
+			a.watch(ctx, trial{version: version, socketConnects: 1, deviceConnects: 1, restart: true})
+		}
+	}
+
+	for {
+		select {
+		case next := <-a.trials:
+			a.watch(ctx, next)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (a *Agent) watch(ctx context.Context, next trial) {
+	log := logrus.WithField("version", next.version)
+	log.Info("config on trial")
+
+	deadline := time.NewTimer(trialTimeout)
+	defer deadline.Stop()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			a.rollback(next, errors.New("links did not come up with the config"))
+			return
+		case <-ctx.Done():
+			return
+		}
+
+		a.mutex.Lock()
+		up := a.online && a.socketConnects >= next.socketConnects && a.deviceConnects >= next.deviceConnects
+		a.mutex.Unlock()
+
+		if !up {
+			continue
+		}
+
+		if err := a.store.Confirm(); err != nil {
+			log.WithError(err).Error("failed to confirm config")
+		}
+
+		log.Info("config applied")
+		a.reportConfig(next.version, entity.ConfigApplied, nil)
+		return
+	}
+}
+
+// rollback restores the previous config, the server learns about it once
+// the agent is connected.
+func (a *Agent) rollback(failed trial, cause error) {
+	log := logrus.WithField("version", failed.version).WithError(cause)
+	log.Error("roll back config")
+
+	if err := a.store.Rollback(cause.Error()); err != nil {
+		log.WithError(err).Error("failed to roll back config")
+		return
+	}
+
+	if failed.restart {
+		a.restart()
+		return
+	}
+
+	current := a.config()
+
+	previous, err := config.LoadConfig(a.store.Path())
+	if err != nil {
+		// the previous file was running a moment ago
+		log.WithError(err).Error("failed to load previous config")
+		a.restart()
+		return
+	}
+
+	previous.Replay = current.Replay
+
+	a.swapConfig(current, previous)
+	a.reportConfig(failed.version, entity.ConfigRolledBack, cause)
+}
+
+// reportConnected tells the server which config runs after the agent
+// connected, a config on trial is reported when its trial ends.
+func (a *Agent) reportConnected() {
+	if a.store == nil {
+		return
+	}
+
+	if _, ok := a.store.Trial(); ok {
+		return
+	}
+
+	if version, reason, ok := a.store.RolledBack(); ok {
+		a.reportConfig(version, entity.ConfigRolledBack, errors.New(reason))
+		return
+	}
+
+	a.reportConfig(a.config().Version, entity.ConfigApplied, nil)
+}
+
+func (a *Agent) reportConfig(version int, status string, cause error) {
+	report := entity.ConfigStatus{Version: version, Status: status}
+	if cause != nil {
+		report.Error = cause.Error()
+	}
+
+	command, err := entity.NewCommand(report, typeCommand)
+	if err != nil {
+		logrus.WithError(err).Error("failed to build config status")
+		return
+	}
+
+	if err := a.sendToServer(command); err != nil {
+		logrus.WithError(err).WithField("status", report).Warn("failed to send config status")
+	}
+}
@@ -0,0 +1,191 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"iLean/config"
+	"iLean/entity"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const remoteConfig = "serial: 12345\nauth:\n  unsigned: true\nversion: 1\n"
+
+// newRemoteAgent returns an agent running the config file in dir with
+// remote config on, online over a fake connection.
+func newRemoteAgent(t *testing.T, dir string) (*Agent, *fakeConn) {
+	t.Helper()
+
+	path := filepath.Join(dir, "pi.conf")
+	if err := ioutil.WriteFile(path, []byte(remoteConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err := config.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewAgent(&conf, config.NewStore(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := newFakeConn()
+	a.connect = conn
+	a.online = true
+
+	return a, conn
+}
+
+// configStatuses returns the config statuses the agent sent.
+func configStatuses(t *testing.T, conn *fakeConn) []entity.ConfigStatus {
+	t.Helper()
+
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	var statuses []entity.ConfigStatus
+	for _, data := range conn.sent {
+		var command entity.Command
+		if err := json.Unmarshal(data, &command); err != nil {
+			t.Fatal(err)
+		}
+
+		if command.TypeCommand != entity.CommandConfigStatus {
+			continue
+		}
+
+		var status entity.ConfigStatus
+		if err := json.Unmarshal(command.Data, &status); err != nil {
+			t.Fatal(err)
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses
+}
+
+func pushConfig(t *testing.T, a *Agent, version int, yaml string) {
+	t.Helper()
+
+	data, err := json.Marshal(entity.AgentConfig{Version: version, Config: yaml})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.applyConfig(data)
+}
+
+func TestApplyConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int
+		yaml    string
+		// status is the status reported right away, empty while the
+		// config is on trial.
+		status string
+		err    string
+	}{
+		{"hot swap", 2, "serial: 12345\nhealth:\n  interval: 1m\n", "", ""},
+		{"restart", 2, "serial: 12345\nbuffer:\n  dir: \"\"\n  max_size_mb: 1\n", entity.ConfigRestarting, ""},
+		{"same version", 1, "serial: 12345\n", entity.ConfigApplied, ""},
+		{"older version", 0, "serial: 12345\n", entity.ConfigRejected, "older"},
+		{"own version", 2, "serial: 12345\nversion: 3\n", entity.ConfigRejected, "own version"},
+		{"other serial", 2, "serial: 7\n", entity.ConfigRejected, "serial 7"},
+		{"agent only section", 2, "serial: 12345\nauth:\n  unsigned: false\n", entity.ConfigRejected, "agent only"},
+		{"invalid", 2, "serial: 12345\nhealth:\n  interval: 0s\n", entity.ConfigRejected, "health.interval"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "remote")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			a, conn := newRemoteAgent(t, dir)
+			stopped := false
+			a.stop = func() { stopped = true }
+
+			pushConfig(t, a, tt.version, tt.yaml)
+
+			statuses := configStatuses(t, conn)
+			if tt.status == "" {
+				if len(statuses) != 0 {
+					t.Fatalf("reported %+v while on trial", statuses)
+				}
+
+				select {
+				case next := <-a.trials:
+					if next.version != tt.version {
+						t.Errorf("trial of version %d, want %d", next.version, tt.version)
+					}
+				default:
+					t.Fatal("config is not on trial")
+				}
+
+				if c := a.config(); c.Version != tt.version || c.Health.Interval != time.Minute {
+					t.Errorf("running version %d with health interval %v", c.Version, c.Health.Interval)
+				}
+				return
+			}
+
+			if len(statuses) != 1 || statuses[0].Status != tt.status || !strings.Contains(statuses[0].Error, tt.err) {
+				t.Fatalf("reported %+v, want %s with an error about %q", statuses, tt.status, tt.err)
+			}
+
+			if stopped != (tt.status == entity.ConfigRestarting) {
+				t.Errorf("stopped %v", stopped)
+			}
+
+			if version, ok := a.store.Trial(); ok != (tt.status == entity.ConfigRestarting) {
+				t.Errorf("trial of version %d %v", version, ok)
+			}
+		})
+	}
+}
+
+func TestRollbackConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a, conn := newRemoteAgent(t, dir)
+
+	pushConfig(t, a, 2, "serial: 12345\nhealth:\n  interval: 1m\n")
+	next := <-a.trials
+
+	// a second push waits for the trial to end
+	pushConfig(t, a, 3, "serial: 12345\n")
+
+	a.rollback(next, errors.New("links did not come up"))
+
+	if c := a.config(); c.Version != 1 || c.Health.Interval == time.Minute {
+		t.Errorf("running version %d with health interval %v after rollback", c.Version, c.Health.Interval)
+	}
+
+	statuses := configStatuses(t, conn)
+	if len(statuses) != 2 {
+		t.Fatalf("reported %+v, want the rejected push and the rollback", statuses)
+	}
+
+	if s := statuses[0]; s.Version != 3 || s.Status != entity.ConfigRejected || !strings.Contains(s.Error, "on trial") {
+		t.Errorf("second push reported %+v", s)
+	}
+
+	if s := statuses[1]; s.Version != 2 || s.Status != entity.ConfigRolledBack {
+		t.Errorf("rollback reported %+v", s)
+	}
+
+	if raw, err := ioutil.ReadFile(a.store.Path()); err != nil || string(raw) != remoteConfig {
+		t.Errorf("config file %q after rollback, want %q", raw, remoteConfig)
+	}
+}
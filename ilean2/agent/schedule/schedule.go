@@ -0,0 +1,210 @@
+package schedule
+
+import (
+	"encoding/json"
+	"fmt"
+	"iLean/entity"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxActions caps the actions kept for the server, the oldest are dropped.
+const maxActions = 500
+
+// Store keeps the schedule synced by the server and the actions taken by it
+// in a JSON file, so both survive a restart while the server is
+// unreachable.
+type Store struct {
+	path string
+
+	mutex sync.Mutex
+	state state
+}
+
+type state struct {
+	Schedule entity.Schedule          `json:"schedule"`
+	Actions  []entity.ScheduledAction `json:"actions"`
+}
+
+// Open reads the file, a missing file is an empty schedule.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path}
+
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read schedule: %w", err)
+	}
+
+	if err := json.Unmarshal(raw, &s.state); err != nil {
+		return nil, fmt.Errorf("unmarshal schedule %s: %w", path, err)
+	}
+
+	return s, nil
+}
+
+func (s *Store) Schedule() entity.Schedule {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.state.Schedule
+}
+
+// Set replaces the schedule, actions taken by the previous one are kept
+// until they are reported.
+func (s *Store) Set(schedule entity.Schedule) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous := s.state.Schedule
+	s.state.Schedule = schedule
+
+	if err := s.save(); err != nil {
+		s.state.Schedule = previous
+		return err
+	}
+
+	return nil
+}
+
+// Record keeps an action until it is reported.
+func (s *Store) Record(action entity.ScheduledAction) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.state.Actions = append(s.state.Actions, action)
+	if n := len(s.state.Actions) - maxActions; n > 0 {
+		s.state.Actions = s.state.Actions[n:]
+	}
+
+	return s.save()
+}
+
+// Actions returns the actions that were not reported yet.
+func (s *Store) Actions() []entity.ScheduledAction {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]entity.ScheduledAction(nil), s.state.Actions...)
+}
+
+// Reported drops the first n actions, actions recorded while they were
+// being sent stay.
+func (s *Store) Reported(n int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if n > len(s.state.Actions) {
+		n = len(s.state.Actions)
+	}
+
+	s.state.Actions = append([]entity.ScheduledAction(nil), s.state.Actions[n:]...)
+
+	return s.save()
+}
+
+// save replaces the file so that a crash leaves either the old or the new
+// content.
+func (s *Store) save() error {
+	raw, err := json.Marshal(s.state)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(raw)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, s.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if dir, err := os.Open(filepath.Dir(s.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	return nil
+}
+
+// Check returns an error for an entry the agent can not follow.
+func Check(entry entity.ScheduleEntry) error {
+	if entry.Day < 0 || entry.Day > 6 {
+		return fmt.Errorf("day %d is out of range 0-6", entry.Day)
+	}
+
+	if _, err := entry.Minute(); err != nil {
+		return err
+	}
+
+	switch entry.Command {
+	case 1, 3, 4:
+	default:
+		return fmt.Errorf("command %d can not be scheduled", entry.Command)
+	}
+
+	return nil
+}
+
+// Occurrence is an entry that is due at At.
+type Occurrence struct {
+	entity.ScheduleEntry
+	At time.Time
+}
+
+// Due returns the entries due after from up to to in the order they are
+// due, by the clock of from.
+func Due(schedule entity.Schedule, from, to time.Time) []Occurrence {
+	var due []Occurrence
+
+	if !to.After(from) {
+		return nil
+	}
+
+	year, month, day := from.Date()
+	for date := time.Date(year, month, day, 0, 0, 0, 0, from.Location()); !date.After(to); date = date.AddDate(0, 0, 1) {
+		for _, entry := range schedule.Entries {
+			if time.Weekday(entry.Day) != date.Weekday() {
+				continue
+			}
+
+			minute, err := entry.Minute()
+			if err != nil {
+				continue
+			}
+
+			at := time.Date(date.Year(), date.Month(), date.Day(), minute/60, minute%60, 0, 0, date.Location())
+			if at.After(from) && !at.After(to) {
+				due = append(due, Occurrence{ScheduleEntry: entry, At: at})
+			}
+		}
+	}
+
+	sort.SliceStable(due, func(i, j int) bool {
+		return due[i].At.Before(due[j].At)
+	})
+
+	return due
+}
@@ -0,0 +1,169 @@
+package schedule
+
+import (
+	"encoding/json"
+	"iLean/entity"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func entry(day time.Weekday, at string) entity.ScheduleEntry {
+	return entity.ScheduleEntry{Day: int(day), Time: at, Command: 1, Data: json.RawMessage(`{}`)}
+}
+
+func TestDue(t *testing.T) {
+	// a Monday
+	monday := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	at := func(days int, clock string) time.Time {
+		c, err := time.Parse("15:04", clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return monday.AddDate(0, 0, days).Add(time.Duration(c.Hour())*time.Hour + time.Duration(c.Minute())*time.Minute)
+	}
+
+	schedule := entity.Schedule{Entries: []entity.ScheduleEntry{
+		entry(time.Monday, "07:00"),
+		entry(time.Monday, "06:30"),
+		entry(time.Tuesday, "22:00"),
+		entry(time.Sunday, "09:00"),
+		entry(time.Monday, "7am"),
+	}}
+
+	tests := []struct {
+		name     string
+		from, to time.Time
+		want     []time.Time
+	}{
+		{"nothing due", at(0, "07:01"), at(0, "08:00"), nil},
+		{"in order of time", at(0, "06:00"), at(0, "08:00"), []time.Time{at(0, "06:30"), at(0, "07:00")}},
+		{"from is excluded", at(0, "06:30"), at(0, "06:59"), nil},
+		{"to is included", at(0, "06:31"), at(0, "07:00"), []time.Time{at(0, "07:00")}},
+		{"over days", at(0, "06:45"), at(1, "23:00"), []time.Time{at(0, "07:00"), at(1, "22:00")}},
+		{"over the week end", at(6, "08:00"), at(7, "06:30"), []time.Time{at(6, "09:00"), at(7, "06:30")}},
+		{"every week", at(0, "06:45"), at(7, "06:45"),
+			[]time.Time{at(0, "07:00"), at(1, "22:00"), at(6, "09:00"), at(7, "06:30")}},
+		{"backwards", at(0, "08:00"), at(0, "06:00"), nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			due := Due(schedule, tt.from, tt.to)
+
+			if len(due) != len(tt.want) {
+				t.Fatalf("due %v, want %v", due, tt.want)
+			}
+
+			for i, want := range tt.want {
+				if !due[i].At.Equal(want) {
+					t.Errorf("due[%d] at %v, want %v", i, due[i].At, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDueLocalClock(t *testing.T) {
+	zone := time.FixedZone("UTC+3", 3*60*60)
+	schedule := entity.Schedule{Entries: []entity.ScheduleEntry{entry(time.Monday, "07:00")}}
+
+	// 03:30 UTC on Monday is 06:30 on the agent's clock
+	from := time.Date(2020, 6, 1, 3, 30, 0, 0, time.UTC).In(zone)
+
+	due := Due(schedule, from, from.Add(time.Hour))
+	if len(due) != 1 || !due[0].At.Equal(time.Date(2020, 6, 1, 4, 0, 0, 0, time.UTC)) {
+		t.Errorf("due %v, want 07:00 of the agent's clock", due)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry entity.ScheduleEntry
+		err   string
+	}{
+		{"temperature", entity.ScheduleEntry{Day: 0, Time: "23:59", Command: 1}, ""},
+		{"vent module", entity.ScheduleEntry{Day: 6, Time: "00:00", Command: 4}, ""},
+		{"day", entity.ScheduleEntry{Day: 7, Time: "07:00", Command: 1}, "day 7"},
+		{"time", entity.ScheduleEntry{Day: 1, Time: "24:00", Command: 1}, "HH:MM"},
+		{"command", entity.ScheduleEntry{Day: 1, Time: "07:00", Command: 6}, "command 6"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Check(tt.entry)
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("check: %v", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("check: %v, want an error about %s", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schedule")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "schedule.json")
+
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := s.Schedule().Version; v != 0 {
+		t.Errorf("version of a missing file = %d", v)
+	}
+
+	if err := s.Set(entity.Schedule{Version: 3, Entries: []entity.ScheduleEntry{entry(time.Monday, "07:00")}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < maxActions+2; i++ {
+		action := entity.ScheduledAction{ScheduleEntry: entry(time.Monday, "07:00"), Status: entity.AckConfirmed}
+		action.At = time.Unix(int64(i), 0)
+		if err := s.Record(action); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the schedule and the actions survive a restart
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := s.Schedule(); got.Version != 3 || len(got.Entries) != 1 {
+		t.Errorf("schedule = %+v", got)
+	}
+
+	actions := s.Actions()
+	if len(actions) != maxActions || actions[0].At.Unix() != 2 {
+		t.Fatalf("kept %d actions from %v, want the last %d", len(actions), actions[0].At, maxActions)
+	}
+
+	if err := s.Reported(maxActions - 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if actions := s.Actions(); len(actions) != 1 || actions[0].At.Unix() != maxActions+1 {
+		t.Errorf("left %+v, want the last action", actions)
+	}
+
+	if err := s.Reported(5); err != nil || len(s.Actions()) != 0 {
+		t.Errorf("reported more than recorded: %v, %d left", err, len(s.Actions()))
+	}
+}
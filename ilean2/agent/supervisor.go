@@ -0,0 +1,216 @@
+package agent
+
+import (
+	"context"
+	"iLean/agent/upstream"
+	"io"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// superviseDevice keeps the serial port open until ctx is done. A failing
+// port is reopened with its own backoff, the server link is not touched.
+func (a *Agent) superviseDevice(ctx context.Context) {
+	// the reader is the only sender and it has returned by now
+	defer close(a.telemetry)
+
+	backoff := newBackoff(a.config().Backoff)
+	connected := false
+
+	for {
+		log := logrus.WithField("port", a.config().Device.Port)
+
+		port, err := a.connectToDevice()
+		if err != nil {
+			log.WithError(err).Error("failed to connect to device")
+			if !a.deviceProbe.sleep(ctx, backoff.Next()) {
+				return
+			}
+			continue
+		}
+
+		backoff = newBackoff(a.config().Backoff)
+		if connected {
+			atomic.AddUint64(&a.stats.deviceReconnects, 1)
+		}
+		connected = true
+
+		a.mutex.Lock()
+		a.deviceConnects++
+		a.deviceUp = true
+		a.mutex.Unlock()
+
+		log.Info("successfully connected to device")
+		a.linkUp()
+
+		err = a.serveDevice(ctx, port)
+
+		a.mutex.Lock()
+		a.deviceUp = false
+		a.mutex.Unlock()
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err == errReopen {
+			log.Info("reopen device")
+			continue
+		}
+
+		log.WithError(err).Error("lost connection to device")
+	}
+}
+
+// serveDevice reads the port, polls the Modbus controllers and writes
+// queued data to the port until one of them fails or ctx is done, the port
+// is closed on return.
+func (a *Agent) serveDevice(ctx context.Context, port io.ReadWriteCloser) error {
+	maps, err := loadRegisterMaps(a.config().Device)
+	if err != nil {
+		port.Close()
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- a.ProcessIncomingDataFromDevice(port)
+	}()
+
+	polled := make(chan struct{})
+	go func() {
+		defer close(polled)
+		a.modbus.run(ctx, maps)
+	}()
+
+	// the poller sends telemetry as well, it stops before the channel is
+	// closed; closing the port unblocks the reader
+	defer func() {
+		cancel()
+		<-polled
+		port.Close()
+		<-readErr
+	}()
+
+	for {
+		select {
+		case request := <-a.writes:
+			// a single write, so data of concurrent writers never
+			// interleaves on the line
+			_, err := port.Write(request.data)
+			request.result <- err
+			if err != nil {
+				return err
+			}
+		case err := <-readErr:
+			// put it back for the deferred wait
+			readErr <- err
+			return err
+		case <-a.reopen:
+			return errReopen
+		case <-a.deviceProbe:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// superviseSocket keeps the server connection up until ctx is done. While
+// it is down the serial port keeps being read and telemetry is buffered.
+func (a *Agent) superviseSocket(ctx context.Context) {
+	backoff := newBackoff(a.config().Backoff)
+	connected := false
+
+	for {
+		logrus.WithField("url", a.config().Upstream.URL).Info("connect to server")
+
+		conn, err := a.connectToSocket(ctx)
+		if err != nil {
+			logrus.WithError(err).Error("failed to connect to socket")
+			if !sleep(ctx, backoff.Next()) {
+				return
+			}
+			continue
+		}
+
+		backoff = newBackoff(a.config().Backoff)
+		if connected {
+			atomic.AddUint64(&a.stats.socketReconnects, 1)
+		}
+		connected = true
+
+		logrus.Info("successfully connected to server")
+
+		err = a.serveSocket(ctx, conn)
+		if ctx.Err() != nil {
+			return
+		}
+
+		logrus.WithError(err).Error("lost connection to server")
+	}
+}
+
+// serveSocket executes commands from the connection and replays buffered
+// telemetry until the connection fails or ctx is done.
+func (a *Agent) serveSocket(ctx context.Context, conn upstream.Conn) error {
+	a.mutex.Lock()
+	a.connect = conn
+	a.online = true
+	a.socketConnects++
+	a.mutex.Unlock()
+
+	a.reportConnected()
+	a.reportRolledBack()
+	a.reportSchedule()
+	a.reportDevices()
+	a.linkUp()
+
+	replayed := make(chan struct{})
+	go func() {
+		defer close(replayed)
+		a.replay()
+	}()
+
+	// closing the connection unblocks the reader
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	err := a.ProcessIncomingCommandsFromServer(conn)
+	close(stop)
+
+	a.mutex.Lock()
+	a.online = false
+	conn.Close()
+	a.mutex.Unlock()
+
+	// a replay in progress fails once the agent is offline
+	<-replayed
+
+	return err
+}
+
+// forward publishes telemetry read from the controllers, so a slow server
+// link does not stall the serial reader. It returns once the serial
+// supervisor has stopped and everything it read is published or buffered.
+func (a *Agent) forward(ctx context.Context) {
+	for {
+		select {
+		case command, ok := <-a.telemetry:
+			if !ok {
+				return
+			}
+
+			a.publish(command)
+		case <-a.forwardProbe:
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"iLean/config"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConn is a server connection that fails when told to.
+type fakeConn struct {
+	mutex  sync.Mutex
+	sent   [][]byte
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{closed: make(chan struct{})}
+}
+
+func (c *fakeConn) Send(data []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.sent = append(c.sent, data)
+	return nil
+}
+
+func (c *fakeConn) Receive() ([]byte, error) {
+	<-c.closed
+	return nil, errors.New("connection closed")
+}
+
+func (c *fakeConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *fakeConn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// fakePort is a serial port that fails when told to.
+type fakePort struct {
+	r *io.PipeReader
+	w *io.PipeWriter
+
+	mutex   sync.Mutex
+	written bytes.Buffer
+	closed  bool
+}
+
+func newFakePort() *fakePort {
+	r, w := io.Pipe()
+	return &fakePort{r: r, w: w}
+}
+
+func (p *fakePort) Read(b []byte) (int, error) { return p.r.Read(b) }
+
+func (p *fakePort) Write(b []byte) (int, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.written.Write(b)
+}
+
+func (p *fakePort) Close() error {
+	p.mutex.Lock()
+	p.closed = true
+	p.mutex.Unlock()
+
+	return p.r.Close()
+}
+
+func (p *fakePort) fail() {
+	p.w.CloseWithError(errors.New("port gone"))
+}
+
+func (p *fakePort) isClosed() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.closed
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLinksFailIndependently(t *testing.T) {
+	dir, err := ioutil.TempDir("", "supervisor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := newTestAgent(t, dir, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	port := newFakePort()
+	deviceDone := make(chan error, 1)
+	go func() { deviceDone <- a.serveDevice(ctx, port) }()
+
+	conn := newFakeConn()
+	socketDone := make(chan error, 1)
+	go func() { socketDone <- a.serveSocket(ctx, conn) }()
+
+	waitFor(t, "the server link", a.isOnline)
+
+	// a lost server connection leaves the serial port open and writable
+	conn.Close()
+	<-socketDone
+
+	if a.isOnline() {
+		t.Error("online after the server connection failed")
+	}
+	if port.isClosed() {
+		t.Error("port closed after the server connection failed")
+	}
+	if err := a.writeLine(ctx, []byte("frame")); err != nil {
+		t.Errorf("write after the server connection failed: %v", err)
+	}
+	port.mutex.Lock()
+	if written := port.written.String(); written != "frame" {
+		t.Errorf("port got %q, want the frame", written)
+	}
+	port.mutex.Unlock()
+
+	conn = newFakeConn()
+	go func() { socketDone <- a.serveSocket(ctx, conn) }()
+	waitFor(t, "the server link again", a.isOnline)
+
+	// a failing serial port leaves the server connection up
+	port.fail()
+	if err := <-deviceDone; err == nil {
+		t.Error("serial link ended without an error")
+	}
+
+	if !port.isClosed() {
+		t.Error("failed port is not closed")
+	}
+	if !a.isOnline() || conn.isClosed() {
+		t.Error("server connection dropped with the serial port")
+	}
+
+	cancel()
+	<-socketDone
+
+	if !conn.isClosed() {
+		t.Error("server connection open after shutdown")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := newBackoff(config.BackoffConfig{Initial: time.Second, Max: 5 * time.Second, Multiplier: 2})
+
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, w := range want {
+		if got := b.Next(); got != w {
+			t.Errorf("delay %d = %v, want %v", i, got, w)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Package systemd speaks the sd_notify protocol over NOTIFY_SOCKET, so the
+// agent runs as a Type=notify service with a watchdog without libsystemd.
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// Ready tells the service has started.
+	Ready = "READY=1"
+	// Stopping tells the service is shutting down.
+	Stopping = "STOPPING=1"
+	// Watchdog resets the watchdog timer.
+	Watchdog = "WATCHDOG=1"
+)
+
+// ExtendTimeout asks for d more to finish starting or stopping.
+func ExtendTimeout(d time.Duration) string {
+	return fmt.Sprintf("EXTEND_TIMEOUT_USEC=%d", d.Microseconds())
+}
+
+// Notify sends the state to the service manager. It returns false without
+// an error when the process is not run by systemd.
+func Notify(state string) (bool, error) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return false, nil
+	}
+
+	// a leading @ is the abstract namespace, the net package maps it
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return false, fmt.Errorf("failed to dial notify socket: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, fmt.Errorf("failed to notify: %w", err)
+	}
+
+	return true, nil
+}
+
+// WatchdogInterval returns how often systemd expects WATCHDOG=1, zero when
+// the watchdog is off or meant for another process.
+func WatchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" {
+		n, err := strconv.Atoi(pid)
+		if err != nil {
+			return 0, fmt.Errorf("bad WATCHDOG_PID %q: %w", pid, err)
+		}
+
+		if n != os.Getpid() {
+			return 0, nil
+		}
+	}
+
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("bad WATCHDOG_USEC %q", usec)
+	}
+
+	return time.Duration(n) * time.Microsecond, nil
+}
@@ -0,0 +1,131 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// setenv sets the variables for the test and returns a func that restores
+// them.
+func setenv(t *testing.T, env map[string]string) func() {
+	t.Helper()
+
+	old := make(map[string]*string)
+	for key, value := range env {
+		if v, ok := os.LookupEnv(key); ok {
+			old[key] = &v
+		} else {
+			old[key] = nil
+		}
+
+		if err := os.Setenv(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return func() {
+		for key, v := range old {
+			if v == nil {
+				os.Unsetenv(key)
+			} else {
+				os.Setenv(key, *v)
+			}
+		}
+	}
+}
+
+func TestNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "systemd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	defer setenv(t, map[string]string{"NOTIFY_SOCKET": path})()
+
+	for _, state := range []string{Ready, ExtendTimeout(1500 * time.Millisecond), Stopping} {
+		sent, err := Notify(state)
+		if err != nil || !sent {
+			t.Fatalf("notify %s: %v %v", state, sent, err)
+		}
+
+		buf := make([]byte, 64)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := string(buf[:n]); got != state {
+			t.Errorf("got %q, want %q", got, state)
+		}
+	}
+
+	if ExtendTimeout(1500*time.Millisecond) != "EXTEND_TIMEOUT_USEC=1500000" {
+		t.Errorf("extend timeout = %s", ExtendTimeout(1500*time.Millisecond))
+	}
+
+	// the manager is gone
+	conn.Close()
+	os.Remove(path)
+	if _, err := Notify(Watchdog); err == nil {
+		t.Error("notified a missing socket")
+	}
+}
+
+func TestNotifyWithoutSystemd(t *testing.T) {
+	defer setenv(t, map[string]string{"NOTIFY_SOCKET": ""})()
+
+	sent, err := Notify(Ready)
+	if sent || err != nil {
+		t.Errorf("notify = %v %v, want nothing sent", sent, err)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	self := strconv.Itoa(os.Getpid())
+
+	tests := []struct {
+		name  string
+		usec  string
+		pid   string
+		want  time.Duration
+		isErr bool
+	}{
+		{"off", "", "", 0, false},
+		{"on", "30000000", "", 30 * time.Second, false},
+		{"for this process", "30000000", self, 30 * time.Second, false},
+		{"for another process", "30000000", strconv.Itoa(os.Getpid() + 1), 0, false},
+		{"bad pid", "30000000", "init", 0, true},
+		{"bad interval", "30s", "", 0, true},
+		{"zero interval", "0", "", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			restore := setenv(t, map[string]string{"WATCHDOG_USEC": tt.usec, "WATCHDOG_PID": tt.pid})
+			defer restore()
+
+			got, err := WatchdogInterval()
+			if (err != nil) != tt.isErr {
+				t.Fatalf("interval: %v", err)
+			}
+
+			if got != tt.want {
+				t.Errorf("interval = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
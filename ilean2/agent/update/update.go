@@ -0,0 +1,357 @@
+package update
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"iLean/entity"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	newExt        = ".new"
+	prevExt       = ".prev"
+	trialExt      = ".trial"
+	rolledBackExt = ".rolledback"
+
+	// maxSize caps the download, the agent is a few megabytes.
+	maxSize = 64 << 20
+
+	// maxStarts is how often a release on trial may start before it is
+	// rolled back without waiting for the grace period, it catches a binary
+	// that crashes on start.
+	maxStarts = 3
+
+	// checkTimeout bounds the -version run of a downloaded binary.
+	checkTimeout = 30 * time.Second
+)
+
+// Binary is the executable of the agent. A release is downloaded next to
+// it and renamed over it, the previous binary is kept as <path>.prev.
+// <path>.trial holds the version of a release that has not reported healthy
+// yet and how often it was started, <path>.rolledback the release that was
+// rolled back last and why.
+type Binary struct {
+	path string
+}
+
+// Open returns the binary of the running process.
+func Open() (*Binary, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	path, err = filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Binary{path: path}, nil
+}
+
+func (b *Binary) Path() string {
+	return b.path
+}
+
+// Message is what the signature of a release covers.
+func Message(version, checksum string) []byte {
+	return []byte("ilean " + version + " " + strings.ToLower(checksum))
+}
+
+// ParseKey decodes a base64 ed25519 public key.
+func ParseKey(encoded string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("decode public key: %w", err)
+	}
+
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key is %d bytes, want %d", len(key), ed25519.PublicKeySize)
+	}
+
+	return ed25519.PublicKey(key), nil
+}
+
+// Verify checks that the release is signed by the key.
+func Verify(release entity.Release, key ed25519.PublicKey) error {
+	signature, err := base64.StdEncoding.DecodeString(release.Signature)
+	if err != nil {
+		return fmt.Errorf("decode signature: %w", err)
+	}
+
+	if !ed25519.Verify(key, Message(release.Version, release.SHA256), signature) {
+		return errors.New("bad signature")
+	}
+
+	return nil
+}
+
+// Install downloads a verified release, checks it and swaps it in. The
+// release is on trial until Confirm, the running process keeps running the
+// previous binary until it restarts.
+func (b *Binary) Install(ctx context.Context, release entity.Release, key ed25519.PublicKey) error {
+	if release.Version == "" || strings.ContainsAny(release.Version, " \t\r\n") {
+		return fmt.Errorf("bad version %q", release.Version)
+	}
+
+	if err := Verify(release, key); err != nil {
+		return err
+	}
+
+	next := b.path + newExt
+	defer os.Remove(next)
+
+	if err := download(ctx, release, next); err != nil {
+		return err
+	}
+
+	if err := check(ctx, next, release.Version); err != nil {
+		return err
+	}
+
+	if err := os.Remove(b.path + prevExt); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove previous binary: %w", err)
+	}
+
+	if err := os.Link(b.path, b.path+prevExt); err != nil {
+		return fmt.Errorf("keep previous binary: %w", err)
+	}
+
+	// the marker goes first, a binary that starts without one is not
+	// rolled back
+	if err := writeMarker(b.path+trialExt, release.Version+" 0"); err != nil {
+		return fmt.Errorf("save trial marker: %w", err)
+	}
+
+	if err := os.Rename(next, b.path); err != nil {
+		os.Remove(b.path + trialExt)
+		return fmt.Errorf("swap binary: %w", err)
+	}
+
+	syncDir(b.path)
+
+	if err := os.Remove(b.path + rolledBackExt); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// download writes the release to path and checks its checksum.
+func download(ctx context.Context, release entity.Release, path string) error {
+	req, err := http.NewRequest(http.MethodGet, release.URL, nil)
+	if err != nil {
+		return fmt.Errorf("build request: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("download %s: %w", release.URL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download %s: %s", release.URL, resp.Status)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+
+	n, err := io.Copy(io.MultiWriter(file, hash), io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return fmt.Errorf("download %s: %w", release.URL, err)
+	}
+
+	if n > maxSize {
+		return fmt.Errorf("binary is larger than %d bytes", maxSize)
+	}
+
+	if sum := hex.EncodeToString(hash.Sum(nil)); !strings.EqualFold(sum, release.SHA256) {
+		return fmt.Errorf("checksum mismatch: got %s", sum)
+	}
+
+	if err := file.Sync(); err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// check runs the binary with -version, which catches a binary built for
+// another platform before it replaces the running one.
+func check(ctx context.Context, path, version string) error {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, path, "-version").Output()
+	if err != nil {
+		return fmt.Errorf("run new binary: %w", err)
+	}
+
+	if got := strings.TrimSpace(string(out)); got != version {
+		return fmt.Errorf("new binary reports version %q", got)
+	}
+
+	return nil
+}
+
+// Trial returns the release on trial, if any.
+func (b *Binary) Trial() (string, bool) {
+	version, _, ok := b.trial()
+	return version, ok
+}
+
+func (b *Binary) trial() (string, int, bool) {
+	raw, err := ioutil.ReadFile(b.path + trialExt)
+	if err != nil {
+		return "", 0, false
+	}
+
+	fields := strings.Fields(string(raw))
+	if len(fields) != 2 {
+		return "", 0, false
+	}
+
+	starts, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return "", 0, false
+	}
+
+	return fields[0], starts, true
+}
+
+// Start counts a start of the running version while it is on trial and
+// rolls it back once it started too often. A marker left by another
+// version, e.g. a binary deployed by hand, is dropped.
+func (b *Binary) Start(running string) error {
+	version, starts, ok := b.trial()
+	if !ok {
+		return nil
+	}
+
+	if version != running {
+		return b.Confirm()
+	}
+
+	starts++
+	if starts > maxStarts {
+		reason := fmt.Sprintf("started %d times without reporting healthy", maxStarts)
+		if err := b.Rollback(reason); err != nil {
+			return fmt.Errorf("failed to roll back: %w", err)
+		}
+
+		return fmt.Errorf("release %s %s, rolled back", version, reason)
+	}
+
+	return writeMarker(b.path+trialExt, fmt.Sprintf("%s %d", version, starts))
+}
+
+// Confirm ends the trial, the release stays.
+func (b *Binary) Confirm() error {
+	err := os.Remove(b.path + trialExt)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// Rollback puts the previous binary back in place of the one on trial, it
+// runs from the next start.
+func (b *Binary) Rollback(reason string) error {
+	version, ok := b.Trial()
+	if !ok {
+		return errors.New("no release on trial")
+	}
+
+	if err := os.Rename(b.path+prevExt, b.path); err != nil {
+		return fmt.Errorf("restore previous binary: %w", err)
+	}
+
+	syncDir(b.path)
+
+	marker := version + " " + strings.ReplaceAll(reason, "\n", " ")
+	if err := writeMarker(b.path+rolledBackExt, marker); err != nil {
+		return fmt.Errorf("save rollback marker: %w", err)
+	}
+
+	return b.Confirm()
+}
+
+// RolledBack returns the release that was rolled back last and why, it is
+// kept until another release is installed.
+func (b *Binary) RolledBack() (string, string, bool) {
+	raw, err := ioutil.ReadFile(b.path + rolledBackExt)
+	if err != nil {
+		return "", "", false
+	}
+
+	fields := strings.SplitN(strings.TrimSpace(string(raw)), " ", 2)
+	if fields[0] == "" {
+		return "", "", false
+	}
+
+	reason := ""
+	if len(fields) == 2 {
+		reason = fields[1]
+	}
+
+	return fields[0], reason, true
+}
+
+// writeMarker replaces the marker so that a crash leaves either the old or
+// the new content.
+func writeMarker(path, content string) error {
+	tmp := path + ".tmp"
+
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.WriteString(content)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	syncDir(path)
+
+	return nil
+}
+
+func syncDir(path string) {
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+}
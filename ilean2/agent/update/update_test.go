@@ -0,0 +1,274 @@
+package update
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"iLean/entity"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// script is a binary that reports the version with -version.
+func script(version string) []byte {
+	return []byte("#!/bin/sh\necho " + version + "\n")
+}
+
+func sign(t *testing.T, private ed25519.PrivateKey, version string, binary []byte) entity.Release {
+	t.Helper()
+
+	sum := sha256.Sum256(binary)
+	release := entity.Release{Version: version, SHA256: hex.EncodeToString(sum[:])}
+	release.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(private, Message(release.Version, release.SHA256)))
+
+	return release
+}
+
+func newKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return public, private
+}
+
+// binary writes the running binary to a new directory.
+func binary(t *testing.T, version string) (*Binary, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "update")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "lean")
+	if err := ioutil.WriteFile(path, script(version), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	return &Binary{path: path}, func() { os.RemoveAll(dir) }
+}
+
+func TestVerify(t *testing.T) {
+	public, private := newKey(t)
+	otherPublic, _ := newKey(t)
+
+	tests := []struct {
+		name    string
+		key     ed25519.PublicKey
+		tamper  func(r *entity.Release)
+		wantErr bool
+	}{
+		{"signed", public, func(r *entity.Release) {}, false},
+		{"checksum in upper case", public, func(r *entity.Release) { r.SHA256 = strings.ToUpper(r.SHA256) }, false},
+		{"other key", otherPublic, func(r *entity.Release) {}, true},
+		{"version changed", public, func(r *entity.Release) { r.Version = "v1.0.0" }, true},
+		{"checksum changed", public, func(r *entity.Release) { r.SHA256 = strings.Repeat("0", 64) }, true},
+		{"signature not base64", public, func(r *entity.Release) { r.Signature = "!" }, true},
+		{"unsigned", public, func(r *entity.Release) { r.Signature = "" }, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := sign(t, private, "v1.2.0", script("v1.2.0"))
+			tt.tamper(&release)
+
+			if err := Verify(release, tt.key); (err != nil) != tt.wantErr {
+				t.Errorf("verify: %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckNewer(t *testing.T) {
+	tests := []struct {
+		release, running string
+		wantErr          bool
+	}{
+		{"v1.2.0", "v1.1.9", false},
+		{"v1.10.0", "v1.9.0", false},
+		{"v2.0.0", "v1.12.3", false},
+		{"v1.2.0-3-g1a2b3c4", "v1.2.0", false},
+		{"v1.2.0-12-g1a2b3c4", "v1.2.0-3-g5d6e7f8-dirty", false},
+		{"v1.2.0", "dev", false},
+		{"v1.2.0", "v1.2.0", true},
+		{"v1.1.0", "v1.2.0", true},
+		{"v1.2.0", "v1.2.0-3-g1a2b3c4", true},
+		{"v0.9.9", "v1.0.0", true},
+		{"dev", "v1.0.0", true},
+		{"1.3.0", "v1.0.0", true},
+		{"v1.3.0-rc1", "v1.0.0", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.release+" over "+tt.running, func(t *testing.T) {
+			if err := CheckNewer(tt.release, tt.running); (err != nil) != tt.wantErr {
+				t.Errorf("check: %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestInstall(t *testing.T) {
+	public, private := newKey(t)
+	next := script("v1.2.0")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(next)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		release func() entity.Release
+		wantErr bool
+	}{
+		{"signed", func() entity.Release { return sign(t, private, "v1.2.0", next) }, false},
+		{"bad signature", func() entity.Release {
+			release := sign(t, private, "v1.2.0", next)
+			release.Signature = sign(t, private, "v1.3.0", next).Signature
+			return release
+		}, true},
+		{"checksum of another binary", func() entity.Release { return sign(t, private, "v1.2.0", script("v1.3.0")) }, true},
+		{"binary reports another version", func() entity.Release { return sign(t, private, "v1.3.0", next) }, true},
+		{"version with a space", func() entity.Release { return sign(t, private, "v1.2.0 x", next) }, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, cleanup := binary(t, "v1.1.0")
+			defer cleanup()
+
+			release := tt.release()
+			release.URL = server.URL
+
+			err := b.Install(context.Background(), release, public)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("install: %v, want error %v", err, tt.wantErr)
+			}
+
+			want, prev, trial := script("v1.1.0"), false, false
+			if !tt.wantErr {
+				want, prev, trial = next, true, true
+			}
+
+			if got, err := ioutil.ReadFile(b.path); err != nil || string(got) != string(want) {
+				t.Errorf("binary %q, want %q", got, want)
+			}
+
+			if _, err := os.Stat(b.path + prevExt); (err == nil) != prev {
+				t.Errorf("previous binary kept: %v, want %v", err == nil, prev)
+			}
+
+			if version, ok := b.Trial(); ok != trial || (trial && version != "v1.2.0") {
+				t.Errorf("trial %q %v, want %v", version, ok, trial)
+			}
+
+			if _, err := os.Stat(b.path + newExt); !os.IsNotExist(err) {
+				t.Errorf("download left behind: %v", err)
+			}
+		})
+	}
+}
+
+// install puts v1.2.0 on trial over v1.1.0.
+func install(t *testing.T) (*Binary, func()) {
+	t.Helper()
+
+	b, cleanup := binary(t, "v1.1.0")
+
+	if err := ioutil.WriteFile(b.path+prevExt, script("v1.1.0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(b.path, script("v1.2.0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeMarker(b.path+trialExt, "v1.2.0 0"); err != nil {
+		t.Fatal(err)
+	}
+
+	return b, cleanup
+}
+
+func TestStart(t *testing.T) {
+	b, cleanup := install(t)
+	defer cleanup()
+
+	for i := 1; i <= maxStarts; i++ {
+		if err := b.Start("v1.2.0"); err != nil {
+			t.Fatalf("start %d: %v", i, err)
+		}
+
+		if _, starts, ok := b.trial(); !ok || starts != i {
+			t.Fatalf("start %d counted as %d", i, starts)
+		}
+	}
+
+	if err := b.Start("v1.2.0"); err == nil {
+		t.Fatal("start over the limit is not refused")
+	}
+
+	if _, ok := b.Trial(); ok {
+		t.Error("release still on trial after the rollback")
+	}
+
+	if got, _ := ioutil.ReadFile(b.path); string(got) != string(script("v1.1.0")) {
+		t.Errorf("binary %q after the rollback, want the previous one", got)
+	}
+
+	if version, _, ok := b.RolledBack(); !ok || version != "v1.2.0" {
+		t.Errorf("rolled back %q %v, want v1.2.0", version, ok)
+	}
+}
+
+func TestStartOtherVersion(t *testing.T) {
+	b, cleanup := install(t)
+	defer cleanup()
+
+	// a binary deployed by hand drops the trial
+	if err := b.Start("v1.3.0"); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	if _, ok := b.Trial(); ok {
+		t.Error("trial of another version kept")
+	}
+
+	if got, _ := ioutil.ReadFile(b.path); string(got) != string(script("v1.2.0")) {
+		t.Errorf("binary %q, want it kept", got)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	b, cleanup := install(t)
+	defer cleanup()
+
+	if err := b.Rollback("no health report"); err != nil {
+		t.Fatalf("rollback: %v", err)
+	}
+
+	if got, _ := ioutil.ReadFile(b.path); string(got) != string(script("v1.1.0")) {
+		t.Errorf("binary %q, want the previous one", got)
+	}
+
+	if version, reason, ok := b.RolledBack(); !ok || version != "v1.2.0" || reason != "no health report" {
+		t.Errorf("rolled back %q %q %v", version, reason, ok)
+	}
+
+	if err := b.Rollback("again"); err == nil {
+		t.Error("rollback without a release on trial")
+	}
+}
@@ -0,0 +1,84 @@
+package update
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// version is a version as git describe prints it for a tag vX.Y.Z: the
+// tag, the commits since it and -dirty, e.g. v1.2.0-3-g1a2b3c4-dirty.
+type version struct {
+	major, minor, patch int
+	// commits since the tag.
+	commits int
+}
+
+func parseVersion(s string) (version, error) {
+	bad := fmt.Errorf("version %q is not vX.Y.Z as git describe prints it", s)
+
+	rest := strings.TrimSuffix(s, "-dirty")
+	if !strings.HasPrefix(rest, "v") {
+		return version{}, bad
+	}
+
+	parts := strings.Split(rest[1:], "-")
+	if len(parts) != 1 && (len(parts) != 3 || !strings.HasPrefix(parts[2], "g")) {
+		return version{}, bad
+	}
+
+	numbers := strings.Split(parts[0], ".")
+	if len(numbers) != 3 {
+		return version{}, bad
+	}
+
+	if len(parts) == 3 {
+		numbers = append(numbers, parts[1])
+	}
+
+	var fields [4]int
+	for i, n := range numbers {
+		v, err := strconv.Atoi(n)
+		if err != nil || v < 0 {
+			return version{}, bad
+		}
+
+		fields[i] = v
+	}
+
+	return version{major: fields[0], minor: fields[1], patch: fields[2], commits: fields[3]}, nil
+}
+
+func (v version) newer(than version) bool {
+	switch {
+	case v.major != than.major:
+		return v.major > than.major
+	case v.minor != than.minor:
+		return v.minor > than.minor
+	case v.patch != than.patch:
+		return v.patch > than.patch
+	}
+
+	return v.commits > than.commits
+}
+
+// CheckNewer refuses a release that is not newer than the running version,
+// a signed old release announced again must not downgrade the agent. A
+// running version that is not from a tag, e.g. dev, takes any release.
+func CheckNewer(release, running string) error {
+	next, err := parseVersion(release)
+	if err != nil {
+		return err
+	}
+
+	current, err := parseVersion(running)
+	if err != nil {
+		return nil
+	}
+
+	if !next.newer(current) {
+		return fmt.Errorf("release %s is not newer than %s", release, running)
+	}
+
+	return nil
+}
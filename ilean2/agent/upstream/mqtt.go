@@ -0,0 +1,214 @@
+package upstream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iLean/config"
+	"iLean/entity"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	// qos 1: messages are delivered at least once, commands published
+	// while the agent is offline wait in its session on the broker.
+	qos = 1
+
+	statusOnline  = "online"
+	statusOffline = "offline"
+
+	// closeWait bounds publishing the offline status on close, close may
+	// be called with the agent's locks held.
+	closeWait = time.Second
+
+	// disconnectQuiesce is how long in milliseconds pending work may finish
+	// on close.
+	disconnectQuiesce = 250
+)
+
+var errClosed = errors.New("connection closed")
+
+// Topics are where the agent publishes and subscribes on the broker, all
+// of them under <prefix>/<serial>/.
+type Topics struct {
+	// Telemetry gets what the controllers report.
+	Telemetry string
+	// Acks gets the progress of commands with an id.
+	Acks string
+	// Health gets the health reports and the controllers that fall silent
+	// or talk again.
+	Health string
+	// Reports gets the config, update and schedule statuses.
+	Reports string
+	// Commands is where the agent takes commands from.
+	Commands string
+	// Status is online while the agent is connected and offline after,
+	// retained. The broker publishes offline when the agent drops off.
+	Status string
+}
+
+func NewTopics(prefix string, serial int) Topics {
+	base := prefix + "/" + strconv.Itoa(serial) + "/"
+
+	return Topics{
+		Telemetry: base + "telemetry",
+		Acks:      base + "acks",
+		Health:    base + "health",
+		Reports:   base + "reports",
+		Commands:  base + "commands",
+		Status:    base + "status",
+	}
+}
+
+// topic returns where a message of the agent goes by its command type.
+func (t Topics) topic(data []byte) string {
+	var command struct {
+		TypeCommand int `json:"command"`
+	}
+	json.Unmarshal(data, &command)
+
+	switch command.TypeCommand {
+	case entity.CommandAck:
+		return t.Acks
+	case entity.CommandHealth, entity.CommandDeviceStatus:
+		return t.Health
+	case entity.CommandConfigStatus, entity.CommandUpdateStatus,
+		entity.CommandScheduleStatus, entity.CommandScheduleReport:
+		return t.Reports
+	}
+
+	return t.Telemetry
+}
+
+type mqttConn struct {
+	client mqtt.Client
+	topics Topics
+
+	messages chan []byte
+
+	once sync.Once
+	done chan struct{}
+	err  error
+}
+
+func dialMQTT(ctx context.Context, u *url.URL, conf config.MQTTConfig, serial int) (*mqttConn, error) {
+	broker := *u
+	broker.Scheme = "tcp"
+	if u.Scheme == "mqtts" {
+		broker.Scheme = "ssl"
+	}
+
+	c := &mqttConn{
+		topics:   NewTopics(conf.Prefix, serial),
+		messages: make(chan []byte),
+		done:     make(chan struct{}),
+	}
+
+	options := mqtt.NewClientOptions().
+		AddBroker(broker.String()).
+		SetClientID(fmt.Sprintf("ilean-%d", serial)).
+		SetUsername(conf.Username).
+		SetPassword(conf.Password).
+		// keep the session so commands sent while offline are delivered
+		SetCleanSession(false).
+		// the socket supervisor reconnects
+		SetAutoReconnect(false).
+		SetConnectTimeout(writeWait).
+		SetWill(c.topics.Status, statusOffline, qos, true).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			c.close(err)
+		})
+
+	c.client = mqtt.NewClient(options)
+
+	commands := func(_ mqtt.Client, msg mqtt.Message) {
+		select {
+		case c.messages <- msg.Payload():
+		case <-c.done:
+		}
+	}
+
+	// the broker delivers the commands kept in the session as soon as the
+	// connection is up, before the subscription is renewed
+	c.client.AddRoute(c.topics.Commands, commands)
+
+	if err := wait(ctx, c.client.Connect(), writeWait); err != nil {
+		c.close(err)
+		c.client.Disconnect(0)
+		return nil, fmt.Errorf("failed to connect to broker: %w", err)
+	}
+
+	if err := wait(ctx, c.client.Subscribe(c.topics.Commands, qos, commands), writeWait); err != nil {
+		c.close(err)
+		c.client.Disconnect(0)
+		return nil, fmt.Errorf("failed to subscribe to %s: %w", c.topics.Commands, err)
+	}
+
+	if err := wait(ctx, c.client.Publish(c.topics.Status, qos, true, statusOnline), writeWait); err != nil {
+		c.close(err)
+		c.client.Disconnect(0)
+		return nil, fmt.Errorf("failed to publish status: %w", err)
+	}
+
+	return c, nil
+}
+
+// wait waits for the token until timeout runs out or ctx is done.
+func wait(ctx context.Context, token mqtt.Token, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-timer.C:
+		return errors.New("timed out")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *mqttConn) Send(data []byte) error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+	}
+
+	return wait(context.Background(), c.client.Publish(c.topics.topic(data), qos, false, data), writeWait)
+}
+
+func (c *mqttConn) Receive() ([]byte, error) {
+	select {
+	case data := <-c.messages:
+		return data, nil
+	case <-c.done:
+		return nil, c.err
+	}
+}
+
+// Close marks the agent offline, the will only covers connections that
+// drop.
+func (c *mqttConn) Close() error {
+	if c.client.IsConnectionOpen() {
+		wait(context.Background(), c.client.Publish(c.topics.Status, qos, true, statusOffline), closeWait)
+	}
+
+	c.close(errClosed)
+	c.client.Disconnect(disconnectQuiesce)
+
+	return nil
+}
+
+func (c *mqttConn) close(err error) {
+	c.once.Do(func() {
+		c.err = err
+		close(c.done)
+	})
+}
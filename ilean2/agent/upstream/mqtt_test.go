@@ -0,0 +1,151 @@
+package upstream
+
+import (
+	"context"
+	"encoding/json"
+	"iLean/config"
+	"iLean/entity"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestTopics(t *testing.T) {
+	topics := NewTopics("ilean", 7)
+
+	if topics.Commands != "ilean/7/commands" || topics.Status != "ilean/7/status" {
+		t.Errorf("topics = %+v, want them under ilean/7/", topics)
+	}
+
+	tests := []struct {
+		name        string
+		typeCommand int
+		want        string
+	}{
+		{"telemetry", 1, topics.Telemetry},
+		{"setpoint table", 2, topics.Telemetry},
+		{"ack", entity.CommandAck, topics.Acks},
+		{"health", entity.CommandHealth, topics.Health},
+		{"device status", entity.CommandDeviceStatus, topics.Health},
+		{"config status", entity.CommandConfigStatus, topics.Reports},
+		{"update status", entity.CommandUpdateStatus, topics.Reports},
+		{"schedule status", entity.CommandScheduleStatus, topics.Reports},
+		{"schedule report", entity.CommandScheduleReport, topics.Reports},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := json.Marshal(entity.Command{TypeCommand: tt.typeCommand})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := topics.topic(data); got != tt.want {
+				t.Errorf("topic = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	if got := topics.topic([]byte("not json")); got != topics.Telemetry {
+		t.Errorf("topic of a broken message = %s, want %s", got, topics.Telemetry)
+	}
+}
+
+func TestDialUnsupportedScheme(t *testing.T) {
+	_, err := Dial(context.Background(), config.UpstreamConfig{URL: "http://example.com"}, 7, nil)
+	if err == nil {
+		t.Fatal("dialed an http url")
+	}
+}
+
+// TestMQTTBroker runs against the broker at ILEAN_TEST_MQTT_URL, e.g. the
+// one of docker-compose at mqtt://localhost:1883.
+func TestMQTTBroker(t *testing.T) {
+	brokerURL := os.Getenv("ILEAN_TEST_MQTT_URL")
+	if brokerURL == "" {
+		t.Skip("ILEAN_TEST_MQTT_URL is not set")
+	}
+
+	conf := config.UpstreamConfig{URL: brokerURL, MQTT: config.MQTTConfig{Prefix: "ilean-test"}}
+	topics := NewTopics(conf.MQTT.Prefix, 7)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := Dial(ctx, conf, 7, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	u, err := url.Parse(brokerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Scheme = "tcp"
+	server := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(u.String()).SetClientID("ilean-test-server"))
+	if err := wait(ctx, server.Connect(), writeWait); err != nil {
+		t.Fatalf("connect server: %v", err)
+	}
+	defer server.Disconnect(0)
+
+	received := make(chan mqtt.Message, 8)
+	handler := func(_ mqtt.Client, msg mqtt.Message) { received <- msg }
+
+	for _, topic := range []string{topics.Telemetry, topics.Status} {
+		if err := wait(ctx, server.Subscribe(topic, qos, handler), writeWait); err != nil {
+			t.Fatalf("subscribe %s: %v", topic, err)
+		}
+	}
+
+	next := func(topic string) string {
+		t.Helper()
+
+		for {
+			select {
+			case msg := <-received:
+				if msg.Topic() == topic {
+					return string(msg.Payload())
+				}
+			case <-ctx.Done():
+				t.Fatalf("nothing on %s", topic)
+			}
+		}
+	}
+
+	// retained, so it arrives although the agent published it first
+	if status := next(topics.Status); status != statusOnline {
+		t.Errorf("status = %s, want %s", status, statusOnline)
+	}
+
+	telemetry := `{"command":1,"data":{"zone":1}}`
+	if err := conn.Send([]byte(telemetry)); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	if got := next(topics.Telemetry); got != telemetry {
+		t.Errorf("telemetry = %s, want %s", got, telemetry)
+	}
+
+	command := `{"command":2}`
+	if err := wait(ctx, server.Publish(topics.Commands, qos, false, command), writeWait); err != nil {
+		t.Fatalf("publish command: %v", err)
+	}
+
+	got, err := conn.Receive()
+	if err != nil || string(got) != command {
+		t.Errorf("received %s %v, want %s", got, err, command)
+	}
+
+	conn.Close()
+
+	if status := next(topics.Status); status != statusOffline {
+		t.Errorf("status after close = %s, want %s", status, statusOffline)
+	}
+
+	if _, err := conn.Receive(); err != errClosed {
+		t.Errorf("receive after close = %v, want %v", err, errClosed)
+	}
+}
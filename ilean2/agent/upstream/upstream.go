@@ -0,0 +1,45 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"iLean/auth"
+	"iLean/config"
+	"net/url"
+	"time"
+)
+
+// writeWait bounds sending a message to the server.
+const writeWait = 10 * time.Second
+
+// Conn is a connection of the agent to the server or to a broker between
+// them. Messages are entity.Command JSON both ways.
+type Conn interface {
+	// Send delivers a message of the agent: telemetry, acks and reports.
+	Send(data []byte) error
+	// Receive blocks until the next command for the agent arrives or the
+	// connection fails.
+	Receive() ([]byte, error)
+	// Close ends the connection, a blocked Receive returns.
+	Close() error
+}
+
+// Dial connects with the transport picked by the scheme of the upstream url:
+// ws and wss speak the websocket protocol of the iLean server, mqtt and
+// mqtts use an MQTT 3.1.1 broker. The key signs the greeting of the
+// websocket protocol, the broker authenticates MQTT clients on its own.
+func Dial(ctx context.Context, conf config.UpstreamConfig, serial int, key auth.Key) (Conn, error) {
+	u, err := url.Parse(conf.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "ws", "wss":
+		return dialWebsocket(ctx, conf.URL, serial, key)
+	case "mqtt", "mqtts":
+		return dialMQTT(ctx, u, conf.MQTT, serial)
+	}
+
+	return nil, fmt.Errorf("unsupported upstream scheme %q", u.Scheme)
+}
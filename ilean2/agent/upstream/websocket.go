@@ -0,0 +1,87 @@
+package upstream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"iLean/auth"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type websocketConn struct {
+	conn *websocket.Conn
+}
+
+func dialWebsocket(ctx context.Context, url string, serial int, key auth.Key) (*websocketConn, error) {
+	connect, _, err := websocket.DefaultDialer.DialContext(ctx, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to establish websocket connection: %w", err)
+	}
+
+	if err := greet(connect, serial, key); err != nil {
+		connect.Close()
+		return nil, err
+	}
+
+	return &websocketConn{conn: connect}, nil
+}
+
+// greet introduces the agent, the server answers with a literal ok. With a
+// key the greeting is signed to prove the agent is the one with the serial.
+func greet(connect *websocket.Conn, serial int, key auth.Key) error {
+	// Подготовка приветственного сообщения
+	greet := auth.Greet{
+		SerialNumber: serial,
+		TypeClient:   "controller",
+	}
+
+	if key != nil {
+		if err := auth.SignGreet(key, &greet); err != nil {
+			return err
+		}
+	}
+
+	byteGreet, err := json.Marshal(greet)
+	if err != nil {
+		return fmt.Errorf("failed to marshal greeting message: %w", err)
+	}
+
+	connect.SetWriteDeadline(time.Now().Add(writeWait))
+	connect.SetReadDeadline(time.Now().Add(writeWait))
+	defer connect.SetReadDeadline(time.Time{})
+
+	// Отправка приветствия
+	if err := connect.WriteMessage(websocket.TextMessage, byteGreet); err != nil {
+		return fmt.Errorf("failed to send greeting message: %w", err)
+	}
+
+	// Чтение ответа
+	_, response, err := connect.ReadMessage()
+	if err != nil {
+		return fmt.Errorf("failed to read server response: %w", err)
+	}
+
+	// Проверка ответа
+	if string(response) != "ok" {
+		return fmt.Errorf("unexpected server response %q", response)
+	}
+
+	return nil
+}
+
+func (c *websocketConn) Send(data []byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func (c *websocketConn) Receive() ([]byte, error) {
+	_, mes, err := c.conn.ReadMessage()
+	return mes, err
+}
+
+func (c *websocketConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,253 @@
+package agent
+
+import (
+	"context"
+	"iLean/config"
+	"iLean/entity"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// watchdogTick is how often the controllers are checked for silence.
+	watchdogTick = time.Second
+	// minSamples is how many intervals are learned before a command without
+	// a configured interval is watched.
+	minSamples = 3
+)
+
+// watchdog learns how often every controller sends each command and tells
+// when a controller stopped sending all of them.
+type watchdog struct {
+	mutex    sync.Mutex
+	start    time.Time
+	cadences map[cadenceKey]*cadence
+	// lastSeen is when anything was read from the controller last.
+	lastSeen map[int32]time.Time
+	silent   map[int32]bool
+	reopened time.Time
+}
+
+type cadenceKey struct {
+	address int32
+	command int
+}
+
+// cadence is the learned interval of a command. Controllers send telemetry
+// of their zones in bursts, so the interval follows the longest gaps and
+// shrinks slowly on short ones.
+type cadence struct {
+	last     time.Time
+	interval time.Duration
+	samples  int
+}
+
+func newWatchdog() *watchdog {
+	return &watchdog{
+		start:    time.Now(),
+		cadences: make(map[cadenceKey]*cadence),
+		lastSeen: make(map[int32]time.Time),
+		silent:   make(map[int32]bool),
+	}
+}
+
+// seen records a command read from the controller.
+func (w *watchdog) seen(address int32, command int, now time.Time) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.lastSeen[address] = now
+
+	key := cadenceKey{address: address, command: command}
+	c, ok := w.cadences[key]
+	if !ok {
+		w.cadences[key] = &cadence{last: now}
+		return
+	}
+
+	gap := now.Sub(c.last)
+	c.last = now
+
+	switch {
+	case c.samples == 0 || gap > c.interval:
+		c.interval = gap
+	default:
+		c.interval -= (c.interval - gap) / 16
+	}
+	c.samples++
+}
+
+// alive records a frame of the controller that is not sent regularly.
+func (w *watchdog) alive(address int32, now time.Time) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.lastSeen[address] = now
+}
+
+// check returns the status of every controller on the bus whose commands
+// are watched.
+func (w *watchdog) check(conf config.Config, now time.Time) []entity.DeviceStatus {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	var statuses []entity.DeviceStatus
+	for _, bus := range conf.Device.Buses {
+		if status, ok := w.status(conf.Watchdog, bus.Address, now); ok {
+			statuses = append(statuses, status)
+		}
+	}
+
+	return statuses
+}
+
+// changed reports whether the controller fell silent or talks again since
+// the last call.
+func (w *watchdog) changed(status entity.DeviceStatus) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	silent := status.Status == entity.DeviceSilent
+	changed := silent != w.silent[status.BusAddress]
+	w.silent[status.BusAddress] = silent
+
+	return changed
+}
+
+// status reports the controller silent when every watched command is
+// overdue, ok is false while none is watched.
+func (w *watchdog) status(conf config.WatchdogConfig, address int32, now time.Time) (status entity.DeviceStatus, ok bool) {
+	status = entity.DeviceStatus{BusAddress: address, LastSeen: w.lastSeen[address]}
+
+	expected := make(map[int]cadence)
+	for command, interval := range conf.Intervals {
+		// configured commands are expected since the start
+		expected[command] = cadence{last: w.start, interval: interval}
+	}
+
+	for key, c := range w.cadences {
+		if key.address != address {
+			continue
+		}
+
+		if interval, ok := conf.Intervals[key.command]; ok {
+			expected[key.command] = cadence{last: c.last, interval: interval}
+			continue
+		}
+
+		if c.samples >= minSamples {
+			expected[key.command] = *c
+		}
+	}
+
+	if len(expected) == 0 {
+		return status, false
+	}
+
+	for command, c := range expected {
+		if now.Sub(c.last) > time.Duration(conf.Factor*float64(c.interval)) {
+			status.Late = append(status.Late, command)
+		}
+	}
+	sort.Ints(status.Late)
+
+	status.Status = entity.DeviceResponding
+	if len(status.Late) == len(expected) {
+		status.Status = entity.DeviceSilent
+	}
+
+	return status, true
+}
+
+// shouldReopen reports whether the port is due to be reopened: a controller
+// is silent for reopen and the port was not reopened for as long.
+func (w *watchdog) shouldReopen(statuses []entity.DeviceStatus, reopen time.Duration, now time.Time) bool {
+	if reopen <= 0 {
+		return false
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if now.Sub(w.reopened) < reopen {
+		return false
+	}
+
+	for _, status := range statuses {
+		since := status.LastSeen
+		if since.IsZero() {
+			since = w.start
+		}
+
+		if status.Status == entity.DeviceSilent && now.Sub(since) >= reopen {
+			w.reopened = now
+			return true
+		}
+	}
+
+	return false
+}
+
+// watchDevices reports controllers that fall silent or talk again and
+// reopens the serial port while one stays silent.
+func (a *Agent) watchDevices(ctx context.Context) {
+	ticker := time.NewTicker(watchdogTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			conf := a.config()
+			statuses := a.watchdog.check(conf, now)
+
+			for _, status := range statuses {
+				if !a.watchdog.changed(status) {
+					continue
+				}
+
+				log := logrus.WithField("bus_address", status.BusAddress).WithField("late", status.Late)
+				if status.Status == entity.DeviceSilent {
+					log.WithField("last_seen", status.LastSeen).Warn("controller is silent")
+				} else {
+					log.Info("controller responds again")
+				}
+
+				a.reportDevice(status)
+			}
+
+			if a.watchdog.shouldReopen(statuses, conf.Watchdog.Reopen, now) {
+				logrus.Warn("controller is silent too long, reopen device")
+
+				select {
+				case a.reopen <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// reportDevices sends the status of every watched controller to the server
+// after it connects, so it knows about changes made while it was lost.
+func (a *Agent) reportDevices() {
+	for _, status := range a.watchdog.check(a.config(), time.Now()) {
+		a.reportDevice(status)
+	}
+}
+
+func (a *Agent) reportDevice(status entity.DeviceStatus) {
+	command, err := entity.NewCommand(status, typeCommand)
+	if err != nil {
+		logrus.WithError(err).Error("failed to build device status")
+		return
+	}
+
+	if err := a.sendToServer(command); err != nil && a.isOnline() {
+		logrus.WithError(err).Error("failed to send device status")
+	}
+}
@@ -0,0 +1,209 @@
+package agent
+
+import (
+	"iLean/config"
+	"iLean/entity"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func watchdogConfig(intervals map[int]time.Duration) config.Config {
+	return config.Config{
+		Device:   config.DeviceConfig{Buses: []config.BusConfig{{Address: 101}, {Address: 102}}},
+		Watchdog: config.WatchdogConfig{Intervals: intervals, Factor: 3, Reopen: time.Minute},
+	}
+}
+
+func TestWatchdogLearnsCadence(t *testing.T) {
+	start := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+
+	w := newWatchdog()
+	w.start = start
+	conf := watchdogConfig(nil)
+
+	for _, s := range []int{0, 10, 20} {
+		w.seen(101, 1, at(s))
+	}
+
+	if statuses := w.check(conf, at(100)); len(statuses) != 0 {
+		t.Fatalf("watched before %d intervals: %+v", minSamples, statuses)
+	}
+
+	w.seen(101, 1, at(30))
+	w.seen(101, 2, at(30))
+
+	tests := []struct {
+		name   string
+		now    int
+		status string
+		late   []int
+	}{
+		{"in time", 40, entity.DeviceResponding, nil},
+		{"at factor times the interval", 60, entity.DeviceResponding, nil},
+		{"overdue", 61, entity.DeviceSilent, []int{1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			statuses := w.check(conf, at(tt.now))
+			if len(statuses) != 1 {
+				t.Fatalf("statuses = %+v, want only bus 101", statuses)
+			}
+
+			status := statuses[0]
+			if status.BusAddress != 101 || status.Status != tt.status || !reflect.DeepEqual(status.Late, tt.late) {
+				t.Errorf("status = %+v, want %s late %v", status, tt.status, tt.late)
+			}
+
+			if !status.LastSeen.Equal(at(30)) {
+				t.Errorf("last seen %v, want %v", status.LastSeen, at(30))
+			}
+		})
+	}
+}
+
+func TestWatchdogCadenceFollowsLongestGap(t *testing.T) {
+	start := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	w := newWatchdog()
+
+	w.seen(101, 1, start)
+	w.seen(101, 1, start.Add(10*time.Second))
+	w.seen(101, 1, start.Add(10*time.Second+100*time.Millisecond))
+
+	c := w.cadences[cadenceKey{address: 101, command: 1}]
+	if want := 10*time.Second - (10*time.Second-100*time.Millisecond)/16; c.interval != want {
+		t.Errorf("interval after a burst = %v, want %v", c.interval, want)
+	}
+
+	w.seen(101, 1, start.Add(30*time.Second))
+	if c.interval <= 19*time.Second {
+		t.Errorf("interval after a long gap = %v, want the gap", c.interval)
+	}
+}
+
+func TestWatchdogConfiguredIntervals(t *testing.T) {
+	start := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	w := newWatchdog()
+	w.start = start
+
+	conf := watchdogConfig(map[int]time.Duration{1: 10 * time.Second, 2: time.Minute})
+
+	// configured commands are expected from the start, so a controller that
+	// never talked falls silent too
+	statuses := w.check(conf, start.Add(31*time.Second))
+	if len(statuses) != 2 {
+		t.Fatalf("statuses = %+v, want both buses", statuses)
+	}
+	if statuses[1].Status != entity.DeviceResponding || !reflect.DeepEqual(statuses[1].Late, []int{1}) {
+		t.Errorf("status with telemetry late = %+v", statuses[1])
+	}
+
+	// the configured interval wins over the learned one
+	for i := 0; i < minSamples+1; i++ {
+		w.seen(101, 1, start.Add(time.Duration(i)*time.Hour))
+	}
+	w.seen(101, 2, start.Add(3*time.Hour))
+
+	status := w.check(conf, start.Add(3*time.Hour+31*time.Second))[0]
+	if status.Status != entity.DeviceResponding || !reflect.DeepEqual(status.Late, []int{1}) {
+		t.Errorf("status = %+v, want telemetry late", status)
+	}
+
+	status = w.check(conf, start.Add(3*time.Hour+181*time.Second))[1]
+	if status.Status != entity.DeviceSilent || !reflect.DeepEqual(status.Late, []int{1, 2}) {
+		t.Errorf("status of the controller never seen = %+v, want silent", status)
+	}
+}
+
+func TestWatchdogAlive(t *testing.T) {
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	w := newWatchdog()
+	w.start = now
+
+	w.alive(101, now.Add(time.Second))
+
+	conf := watchdogConfig(map[int]time.Duration{1: 10 * time.Second})
+	status := w.check(conf, now.Add(time.Minute))[0]
+
+	// a frame that is not sent regularly moves last seen but does not count
+	// as the overdue telemetry
+	if status.Status != entity.DeviceSilent || !status.LastSeen.Equal(now.Add(time.Second)) {
+		t.Errorf("status = %+v", status)
+	}
+}
+
+func TestWatchdogChanged(t *testing.T) {
+	w := newWatchdog()
+
+	silent := entity.DeviceStatus{BusAddress: 101, Status: entity.DeviceSilent}
+	responding := entity.DeviceStatus{BusAddress: 101, Status: entity.DeviceResponding}
+
+	steps := []struct {
+		status entity.DeviceStatus
+		want   bool
+	}{
+		{responding, false},
+		{silent, true},
+		{silent, false},
+		{entity.DeviceStatus{BusAddress: 102, Status: entity.DeviceSilent}, true},
+		{responding, true},
+	}
+
+	for i, step := range steps {
+		if got := w.changed(step.status); got != step.want {
+			t.Errorf("step %d: changed = %v, want %v", i, got, step.want)
+		}
+	}
+}
+
+func TestWatchdogShouldReopen(t *testing.T) {
+	start := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	silent := func(lastSeen time.Time) []entity.DeviceStatus {
+		return []entity.DeviceStatus{
+			{BusAddress: 101, Status: entity.DeviceResponding, LastSeen: start},
+			{BusAddress: 102, Status: entity.DeviceSilent, LastSeen: lastSeen},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		statuses []entity.DeviceStatus
+		reopen   time.Duration
+		now      time.Duration
+		want     bool
+	}{
+		{"silent long enough", silent(start), time.Minute, time.Minute, true},
+		{"silent not long enough", silent(start.Add(30 * time.Second)), time.Minute, time.Minute, false},
+		{"never seen since the start", silent(time.Time{}), time.Minute, time.Minute, true},
+		{"disabled", silent(start), 0, time.Hour, false},
+		{"all responding", silent(start)[:1], time.Minute, time.Hour, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newWatchdog()
+			w.start = start
+			w.reopened = start
+
+			if got := w.shouldReopen(tt.statuses, tt.reopen, start.Add(tt.now)); got != tt.want {
+				t.Errorf("reopen = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	w := newWatchdog()
+	w.start = start
+
+	if !w.shouldReopen(silent(start), time.Minute, start.Add(time.Minute)) {
+		t.Fatal("did not reopen")
+	}
+	if w.shouldReopen(silent(start), time.Minute, start.Add(90*time.Second)) {
+		t.Error("reopened again within a minute")
+	}
+	if !w.shouldReopen(silent(start), time.Minute, start.Add(2*time.Minute)) {
+		t.Error("did not reopen a minute later")
+	}
+}
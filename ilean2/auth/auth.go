@@ -0,0 +1,235 @@
+// Package auth signs what the server and the agents send each other with a
+// key of each device shared by both: commands of the server carry a
+// timestamp, a nonce and an HMAC-SHA256 of them, and the greeting of an
+// agent proves it holds the key of the serial it claims. Mobile clients
+// greet with a key of their own the server derives from the device key, it
+// can not sign commands or greet as the agent.
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iLean/entity"
+	"io/ioutil"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// minKeySize is the shortest key accepted, in bytes.
+const minKeySize = 16
+
+var (
+	ErrNoSignature  = errors.New("message is not signed")
+	ErrBadSignature = errors.New("signature does not match")
+)
+
+// Key is the secret of a device.
+type Key []byte
+
+// ParseKey decodes a hex key.
+func ParseKey(s string) (Key, error) {
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("key is not hex: %w", err)
+	}
+
+	if len(key) < minKeySize {
+		return nil, fmt.Errorf("key is shorter than %d bytes", minKeySize)
+	}
+
+	return key, nil
+}
+
+// Keys are the keys of the devices by serial number.
+type Keys map[int]Key
+
+// LoadKeys reads a YAML file of hex keys by serial number.
+func LoadKeys(path string) (Keys, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read keys %s file: %w", path, err)
+	}
+
+	var hexKeys map[int]string
+	if err := yaml.UnmarshalStrict(raw, &hexKeys); err != nil {
+		return nil, fmt.Errorf("YAML unmarshal keys: %w", err)
+	}
+
+	keys := make(Keys, len(hexKeys))
+	for serial, s := range hexKeys {
+		key, err := ParseKey(s)
+		if err != nil {
+			return nil, fmt.Errorf("key of %d: %w", serial, err)
+		}
+
+		keys[serial] = key
+	}
+
+	return keys, nil
+}
+
+// Nonce returns a random nonce.
+func Nonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// Signed is the envelope of a signed command.
+type Signed struct {
+	entity.Command
+	Nonce     string `json:"nonce"`
+	Signature string `json:"signature"`
+}
+
+// SignCommand stamps the command with the time and a fresh nonce and signs
+// it for the device with the serial number.
+func SignCommand(key Key, serial int, command entity.Command) (Signed, error) {
+	nonce, err := Nonce()
+	if err != nil {
+		return Signed{}, err
+	}
+
+	command.Timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+
+	signed := Signed{Command: command, Nonce: nonce}
+
+	mac, err := commandMAC(key, serial, signed)
+	if err != nil {
+		return Signed{}, err
+	}
+	signed.Signature = hex.EncodeToString(mac)
+
+	return signed, nil
+}
+
+// VerifyCommand checks the signature of the command, whether it is fresh is
+// up to a Replay.
+func VerifyCommand(key Key, serial int, signed Signed) error {
+	if signed.Signature == "" {
+		return ErrNoSignature
+	}
+
+	sig, err := hex.DecodeString(signed.Signature)
+	if err != nil {
+		return ErrBadSignature
+	}
+
+	mac, err := commandMAC(key, serial, signed)
+	if err != nil {
+		return err
+	}
+
+	if !hmac.Equal(sig, mac) {
+		return ErrBadSignature
+	}
+
+	return nil
+}
+
+// commandMAC signs every field of the command, the data compacted as it
+// goes over the wire.
+func commandMAC(key Key, serial int, signed Signed) ([]byte, error) {
+	var data bytes.Buffer
+	if len(signed.Data) > 0 {
+		if err := json.Compact(&data, signed.Data); err != nil {
+			return nil, fmt.Errorf("failed to compact command data: %w", err)
+		}
+	}
+
+	return sum(key,
+		"command",
+		strconv.Itoa(serial),
+		strconv.Itoa(signed.TypeCommand),
+		signed.ID,
+		strconv.Itoa(int(signed.BusAddress)),
+		strconv.FormatInt(signed.Timestamp, 10),
+		signed.Nonce,
+		data.String(),
+	), nil
+}
+
+// Greet is the greeting a controller signs with the key of the serial
+// number, a mobile client with its MobileKey, to prove who it is.
+type Greet struct {
+	SerialNumber int    `json:"serial_number"`
+	TypeClient   string `json:"type_client"`
+	// Client names the mobile client, empty for a controller.
+	Client string `json:"client,omitempty"`
+	// Timestamp is in unix milliseconds.
+	Timestamp int64  `json:"timestamp,omitempty"`
+	Nonce     string `json:"nonce,omitempty"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// SignGreet stamps and signs the greeting.
+func SignGreet(key Key, greet *Greet) error {
+	nonce, err := Nonce()
+	if err != nil {
+		return err
+	}
+
+	greet.Timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+	greet.Nonce = nonce
+	greet.Signature = hex.EncodeToString(greetMAC(key, *greet))
+
+	return nil
+}
+
+// VerifyGreet checks the signature of the greeting, whether it is fresh is
+// up to a Replay.
+func VerifyGreet(key Key, greet Greet) error {
+	if greet.Signature == "" {
+		return ErrNoSignature
+	}
+
+	sig, err := hex.DecodeString(greet.Signature)
+	if err != nil || !hmac.Equal(sig, greetMAC(key, greet)) {
+		return ErrBadSignature
+	}
+
+	return nil
+}
+
+func greetMAC(key Key, greet Greet) []byte {
+	return sum(key,
+		"greet",
+		strconv.Itoa(greet.SerialNumber),
+		greet.TypeClient,
+		greet.Client,
+		strconv.FormatInt(greet.Timestamp, 10),
+		greet.Nonce,
+	)
+}
+
+// MobileKey is the key the server gives the mobile client with the name
+// when it is paired with the device. It is derived from the device key one
+// way, so it proves only that the server issued it.
+func MobileKey(key Key, serial int, client string) Key {
+	return sum(key, "mobile", strconv.Itoa(serial), client)
+}
+
+// sum is the HMAC of the fields, each prefixed with its length so fields
+// can not run into each other.
+func sum(key Key, fields ...string) []byte {
+	h := hmac.New(sha256.New, key)
+
+	for _, field := range fields {
+		h.Write([]byte(strconv.Itoa(len(field))))
+		h.Write([]byte{':'})
+		h.Write([]byte(field))
+	}
+
+	return h.Sum(nil)
+}
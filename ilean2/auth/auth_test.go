@@ -0,0 +1,170 @@
+package auth
+
+import (
+	"encoding/json"
+	"iLean/entity"
+	"strings"
+	"testing"
+)
+
+var (
+	testKey  = Key(strings.Repeat("k", minKeySize))
+	otherKey = Key(strings.Repeat("o", minKeySize))
+)
+
+const testSerial = 12345
+
+func signedCommand(t *testing.T) Signed {
+	t.Helper()
+
+	signed, err := SignCommand(testKey, testSerial, entity.Command{
+		TypeCommand: 2,
+		ID:          "5b0e7b8e-6f1b-4f53-9a37-5f0a3c1f2b10",
+		BusAddress:  101,
+		Data:        json.RawMessage(`{"zone": 1, "temperature": 23}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed
+}
+
+func TestVerifyCommand(t *testing.T) {
+	tests := []struct {
+		name   string
+		key    Key
+		serial int
+		tamper func(s *Signed)
+		want   error
+	}{
+		{"signed", testKey, testSerial, func(s *Signed) {}, nil},
+		{"data reformatted", testKey, testSerial, func(s *Signed) {
+			s.Data = json.RawMessage("{\n  \"zone\": 1,\n  \"temperature\": 23\n}")
+		}, nil},
+		{"unsigned", testKey, testSerial, func(s *Signed) { s.Signature = "" }, ErrNoSignature},
+		{"signature not hex", testKey, testSerial, func(s *Signed) { s.Signature = "zz" }, ErrBadSignature},
+		{"other key", otherKey, testSerial, func(s *Signed) {}, ErrBadSignature},
+		{"other serial", testKey, testSerial + 1, func(s *Signed) {}, ErrBadSignature},
+		{"command changed", testKey, testSerial, func(s *Signed) { s.TypeCommand = 4 }, ErrBadSignature},
+		{"id changed", testKey, testSerial, func(s *Signed) { s.ID = "other" }, ErrBadSignature},
+		{"bus address changed", testKey, testSerial, func(s *Signed) { s.BusAddress = 102 }, ErrBadSignature},
+		{"timestamp changed", testKey, testSerial, func(s *Signed) { s.Timestamp++ }, ErrBadSignature},
+		{"nonce changed", testKey, testSerial, func(s *Signed) { s.Nonce = "other" }, ErrBadSignature},
+		{"data changed", testKey, testSerial, func(s *Signed) {
+			s.Data = json.RawMessage(`{"zone": 1, "temperature": 30}`)
+		}, ErrBadSignature},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signed := signedCommand(t)
+			tt.tamper(&signed)
+
+			if err := VerifyCommand(tt.key, tt.serial, signed); err != tt.want {
+				t.Errorf("verify: %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyCommandOverJSON(t *testing.T) {
+	raw, err := json.Marshal(signedCommand(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var signed Signed
+	if err := json.Unmarshal(raw, &signed); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := VerifyCommand(testKey, testSerial, signed); err != nil {
+		t.Errorf("verify after a JSON round-trip: %v", err)
+	}
+}
+
+func TestVerifyGreet(t *testing.T) {
+	tests := []struct {
+		name   string
+		key    Key
+		tamper func(g *Greet)
+		want   error
+	}{
+		{"signed", testKey, func(g *Greet) {}, nil},
+		{"unsigned", testKey, func(g *Greet) { g.Signature = "" }, ErrNoSignature},
+		{"other key", otherKey, func(g *Greet) {}, ErrBadSignature},
+		{"serial changed", testKey, func(g *Greet) { g.SerialNumber++ }, ErrBadSignature},
+		{"client type changed", testKey, func(g *Greet) { g.TypeClient = "controller" }, ErrBadSignature},
+		{"client changed", testKey, func(g *Greet) { g.Client = "other" }, ErrBadSignature},
+		{"timestamp changed", testKey, func(g *Greet) { g.Timestamp++ }, ErrBadSignature},
+		{"nonce changed", testKey, func(g *Greet) { g.Nonce = "other" }, ErrBadSignature},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			greet := Greet{SerialNumber: testSerial, TypeClient: "mobile", Client: "phone"}
+			if err := SignGreet(testKey, &greet); err != nil {
+				t.Fatal(err)
+			}
+			tt.tamper(&greet)
+
+			if err := VerifyGreet(tt.key, greet); err != tt.want {
+				t.Errorf("verify: %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMobileKey(t *testing.T) {
+	key := MobileKey(testKey, testSerial, "phone")
+
+	if string(key) == string(testKey) {
+		t.Fatal("mobile key is the device key")
+	}
+
+	if string(MobileKey(testKey, testSerial, "phone")) != string(key) {
+		t.Error("mobile key is not derived the same way twice")
+	}
+
+	for _, other := range []Key{
+		MobileKey(testKey, testSerial, "tablet"),
+		MobileKey(testKey, testSerial+1, "phone"),
+		MobileKey(otherKey, testSerial, "phone"),
+	} {
+		if string(other) == string(key) {
+			t.Error("mobile keys of other clients or devices are the same")
+		}
+	}
+
+	// the agent greets with the device key, a mobile key does not pass
+	greet := Greet{SerialNumber: testSerial, TypeClient: "controller"}
+	if err := SignGreet(key, &greet); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := VerifyGreet(testKey, greet); err != ErrBadSignature {
+		t.Errorf("controller greeting signed with a mobile key: %v, want ErrBadSignature", err)
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		wantErr bool
+	}{
+		{"hex", strings.Repeat("ab", minKeySize), false},
+		{"not hex", strings.Repeat("zz", minKeySize), true},
+		{"too short", strings.Repeat("ab", minKeySize-1), true},
+		{"empty", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseKey(tt.key); (err != nil) != tt.wantErr {
+				t.Errorf("parse: %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var ErrReplayed = errors.New("nonce was seen before")
+
+// Replay rejects messages stamped outside of the window around now and
+// messages whose nonce was seen within the window.
+type Replay struct {
+	window time.Duration
+
+	mutex sync.Mutex
+	seen  map[string]time.Time
+}
+
+func NewReplay(window time.Duration) *Replay {
+	return &Replay{window: window, seen: make(map[string]time.Time)}
+}
+
+// Check accepts the message stamped with timestamp, in unix milliseconds,
+// once.
+func (r *Replay) Check(timestamp int64, nonce string, now time.Time) error {
+	if nonce == "" {
+		return errors.New("message has no nonce")
+	}
+
+	at := time.Unix(0, timestamp*int64(time.Millisecond))
+	if skew := now.Sub(at); skew > r.window || skew < -r.window {
+		return fmt.Errorf("message is stamped %v, %v away from now", at.UTC(), skew)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for n, expires := range r.seen {
+		if now.After(expires) {
+			delete(r.seen, n)
+		}
+	}
+
+	if _, ok := r.seen[nonce]; ok {
+		return ErrReplayed
+	}
+
+	// a message is stale once now passes its stamp by the window
+	r.seen[nonce] = at.Add(r.window)
+
+	return nil
+}
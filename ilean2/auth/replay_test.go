@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplayCheck(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	ms := func(at time.Time) int64 { return at.UnixNano() / int64(time.Millisecond) }
+
+	type check struct {
+		at      time.Time
+		nonce   string
+		now     time.Time
+		wantErr bool
+	}
+
+	tests := []struct {
+		name   string
+		checks []check
+	}{
+		{"fresh", []check{{now, "a", now, false}}},
+		{"no nonce", []check{{now, "", now, true}}},
+		{"stale", []check{{now.Add(-3 * time.Minute), "a", now, true}}},
+		{"from the future", []check{{now.Add(3 * time.Minute), "a", now, true}}},
+		{"at the window", []check{{now.Add(-2 * time.Minute), "a", now, false}}},
+		{"replayed", []check{
+			{now, "a", now, false},
+			{now, "a", now.Add(time.Second), true},
+		}},
+		{"replayed with a new stamp", []check{
+			{now, "a", now, false},
+			{now.Add(time.Second), "a", now.Add(time.Second), true},
+		}},
+		{"other nonce", []check{
+			{now, "a", now, false},
+			{now, "b", now, false},
+		}},
+		{"replayed once stale", []check{
+			{now, "a", now, false},
+			{now, "a", now.Add(3 * time.Minute), true},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReplay(2 * time.Minute)
+
+			for i, c := range tt.checks {
+				if err := r.Check(ms(c.at), c.nonce, c.now); (err != nil) != c.wantErr {
+					t.Errorf("check %d: %v, want error %v", i, err, c.wantErr)
+				}
+			}
+		})
+	}
+}
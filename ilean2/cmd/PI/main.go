@@ -1,7 +1,12 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"iLean/agent"
+	"iLean/agent/update"
 	"iLean/config"
 	"os"
 	"os/signal"
@@ -25,27 +30,86 @@ func run() error {
 
 	var st time.Time
 	defer func() {
+		if st.IsZero() {
+			// stopped without a signal
+			st = time.Now()
+		}
 		logrus.WithField("shutdown_time", time.Now().Sub(st)).Info("stopped")
 	}()
 
-	config, err := config.LoadConfig("config/pi.conf")
+	configPath := flag.String("config", "config/pi.conf", "path to the agent config")
+	replay := flag.String("replay", "", "read this capture file in place of the serial port")
+	replaySpeed := flag.Float64("replay-speed", 1, "scale of the recorded pauses, 0 replays without pauses")
+	version := flag.Bool("version", false, "print the version and exit")
+	flag.Parse()
+
+	if *version {
+		fmt.Println(agent.Version)
+		os.Exit(0)
+	}
+
+	// a release that keeps failing to start is rolled back here, the next
+	// start runs the previous binary
+	if binary, err := update.Open(); err == nil {
+		if err := binary.Start(agent.Version); err != nil {
+			return err
+		}
+	}
+
+	store := config.NewStore(*configPath)
+
+	config, err := config.LoadConfig(*configPath)
 
 	if err != nil {
-		logrus.Fatal("failed load config", err)
+		return rollback(store, fmt.Errorf("failed load config: %w", err))
+	}
+
+	if *replay != "" {
+		if *replaySpeed < 0 {
+			return errors.New("-replay-speed is negative")
+		}
+
+		config.Replay.File = *replay
+		config.Replay.Speed = *replaySpeed
 	}
 
-	agent, err := agent.NewAgent(&config)
+	lean, err := agent.NewAgent(&config, store)
 
 	if err != nil {
-		return err
+		return rollback(store, err)
 	}
 
-	defer agent.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	signals := make(chan os.Signal)
+	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 
-	<-signals
+	go func() {
+		logrus.Infof("captured %v signal, stopping", <-signals)
+		st = time.Now()
+		cancel()
+	}()
+
+	err = lean.Run(ctx)
+	if err != nil && err != agent.ErrRestart {
+		return rollback(store, err)
+	}
+
+	// systemd starts the agent again with the new config
+	return err
+}
+
+// rollback restores the previous config when the agent fails with a config
+// pushed by the server, the next start runs the previous one.
+func rollback(store *config.Store, cause error) error {
+	if _, ok := store.Trial(); !ok {
+		return cause
+	}
+
+	if err := store.Rollback(cause.Error()); err != nil {
+		logrus.WithError(err).Error("failed to roll back config")
+	}
 
-	return nil
+	return cause
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"iLean/agent/update"
+	"iLean/entity"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// release signs agent binaries for the update endpoint of the server:
+//
+//	release -keygen release.key
+//	release -key release.key -version v1.2.0 deploy/build/pi
+//
+// The first prints the public key for update.public_key of pi.conf, the
+// second the body for PUT /api/v1/agent/release, sent with the admin token
+// of the server as a bearer token. The binary goes to
+// <releases dir>/<version>/lean on the server.
+func main() {
+	if err := run(); err != nil {
+		logrus.Fatal(err)
+	}
+}
+
+func run() error {
+	keygen := flag.String("keygen", "", "write a new private key to this file and print its public key")
+	keyPath := flag.String("key", "release.key", "private key to sign with")
+	version := flag.String("version", "", "version the binary reports with -version")
+	flag.Parse()
+
+	if *keygen != "" {
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+
+		if err := ioutil.WriteFile(*keygen, []byte(base64.StdEncoding.EncodeToString(private)), 0600); err != nil {
+			return fmt.Errorf("failed to write key: %w", err)
+		}
+
+		fmt.Println(base64.StdEncoding.EncodeToString(public))
+		return nil
+	}
+
+	if *version == "" || flag.NArg() != 1 {
+		return errors.New("usage: release -key release.key -version <version> <binary>")
+	}
+
+	encoded, err := ioutil.ReadFile(*keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to read key: %w", err)
+	}
+
+	private, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil || len(private) != ed25519.PrivateKeySize {
+		return errors.New("key is not a base64 ed25519 private key")
+	}
+
+	file, err := os.Open(flag.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return err
+	}
+
+	release := entity.Release{
+		Version: *version,
+		SHA256:  hex.EncodeToString(hash.Sum(nil)),
+	}
+	release.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(private, update.Message(release.Version, release.SHA256)))
+
+	out, err := json.MarshalIndent(release, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(out))
+	return nil
+}
@@ -2,11 +2,15 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"github.com/sirupsen/logrus"
+	"iLean/auth"
 	"iLean/server"
+	"iLean/server/storage"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 func main() {
@@ -21,7 +25,66 @@ func run() error {
 	if serverPort == "" {
 		return errors.New("websocket port must be specified")
 	}
-	server, err := server.NewServer(":4000", "key")
+	releases := server.Releases{
+		Dir: os.Getenv("SERVER_RELEASES_DIR"),
+		URL: os.Getenv("SERVER_PUBLIC_URL"),
+	}
+	if releases.Dir == "" {
+		releases.Dir = "releases"
+	}
+	if releases.URL == "" {
+		releases.URL = "http://localhost:4000"
+	}
+
+	// keys of the controllers, commands are not signed without them
+	var keys auth.Keys
+	if path := os.Getenv("SERVER_DEVICE_KEYS"); path != "" {
+		var err error
+		keys, err = auth.LoadKeys(path)
+		if err != nil {
+			return err
+		}
+	} else {
+		logrus.Warn("device keys are not set, commands are not signed and controllers are not verified")
+	}
+
+	// telemetry goes to a directory or a postgres:// database
+	storageAddress := os.Getenv("SERVER_STORAGE")
+	if storageAddress == "" {
+		storageAddress = "telemetry"
+	}
+
+	repo, err := storage.Open(storageAddress)
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+
+	// raw readings and rollups expire by the retention
+	retentionSpec := os.Getenv("SERVER_RETENTION")
+	if retentionSpec == "" {
+		retentionSpec = storage.DefaultRetention
+	}
+
+	retention, err := storage.ParseRetention(retentionSpec)
+	if err != nil {
+		return err
+	}
+
+	interval := storage.DefaultCompactionInterval
+	if raw := os.Getenv("SERVER_COMPACTION_INTERVAL"); raw != "" {
+		interval, err = time.ParseDuration(raw)
+		if err != nil || interval <= 0 {
+			return fmt.Errorf("compaction interval %q must be a positive duration", raw)
+		}
+	}
+
+	compactor := storage.NewCompactor(repo, retention, interval)
+
+	// config, schedule, release and compaction changes need this token
+	adminToken := os.Getenv("SERVER_ADMIN_TOKEN")
+
+	server, err := server.NewServer(":4000", "key", adminToken, releases, keys, repo, compactor)
 
 	if err != nil {
 		return err
@@ -29,7 +92,7 @@ func run() error {
 
 	defer server.Stop()
 
-	signals := make(chan os.Signal)
+	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 
 	logrus.Infof("captured %v signal, stopping", <-signals)
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"iLean/simulator"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+func main() {
+	if err := run(); err != nil {
+		logrus.Fatal(err)
+	}
+}
+
+func run() error {
+	scenarioPath := flag.String("scenario", "", "path to the scenario file, a single zone is emulated if empty")
+	link := flag.String("link", "", "create a symlink to the pseudo-terminal, e.g. /tmp/ttyLEAN")
+	flag.Parse()
+
+	scenario := simulator.DefaultScenario()
+	if *scenarioPath != "" {
+		var err error
+		if scenario, err = simulator.LoadScenario(*scenarioPath); err != nil {
+			return err
+		}
+	}
+
+	pty, err := simulator.OpenPTY()
+	if err != nil {
+		return err
+	}
+	defer pty.Close()
+
+	port := pty.Path
+	if *link != "" {
+		os.Remove(*link)
+		if err := os.Symlink(pty.Path, *link); err != nil {
+			return err
+		}
+		defer os.Remove(*link)
+
+		port = *link
+	}
+
+	logrus.WithField("port", port).Info("simulator is listening, point device.port of the agent here")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		logrus.Infof("captured %v signal, stopping", <-signals)
+		cancel()
+	}()
+
+	return simulator.New(scenario, pty.Master).Run(ctx)
+}
@@ -1,20 +1,418 @@
 package config
 
 import (
+	"crypto/ed25519"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"iLean/auth"
 	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
 type Config struct {
-	Serial         int  `yaml:"serial"`
+	// Version is set by the server on configs it pushes, 0 for a file
+	// written by hand.
+	Version  int            `yaml:"version,omitempty"`
+	Serial   int            `yaml:"serial"`
+	Upstream UpstreamConfig `yaml:"upstream"`
+	Device   DeviceConfig   `yaml:"device"`
+	Backoff  BackoffConfig  `yaml:"backoff"`
+	Buffer   BufferConfig   `yaml:"buffer"`
+	Local    LocalConfig    `yaml:"local"`
+	Health   HealthConfig   `yaml:"health"`
+	Capture  CaptureConfig  `yaml:"capture"`
+	Replay   ReplayConfig   `yaml:"replay"`
+	Update   UpdateConfig   `yaml:"update"`
+	Schedule ScheduleConfig `yaml:"schedule"`
+	Watchdog WatchdogConfig `yaml:"watchdog"`
+	Policy   PolicyConfig   `yaml:"policy"`
+	Auth     AuthConfig     `yaml:"auth"`
+}
+
+// UpstreamConfig is where the agent reports to: the iLean server with a
+// ws:// or wss:// url or an MQTT broker with mqtt:// or mqtts://.
+type UpstreamConfig struct {
+	URL  string     `yaml:"url"`
+	MQTT MQTTConfig `yaml:"mqtt"`
+}
+
+// MQTTConfig is used with an MQTT broker, the agent publishes and
+// subscribes under <Prefix>/<serial>/.
+type MQTTConfig struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Prefix   string `yaml:"prefix"`
+}
+
+type DeviceConfig struct {
+	Port        string `yaml:"port"`
+	BaudRate    uint   `yaml:"baud_rate"`
+	DataBits    uint   `yaml:"data_bits"`
+	StopBits    uint   `yaml:"stop_bits"`
+	MinReadSize uint   `yaml:"min_read_size"`
+	// Buses lists the controllers chained on the RS-485 line, the first one
+	// gets commands and telemetry that do not name a bus address.
+	Buses []BusConfig `yaml:"buses"`
+	// AckTimeout is how long the controller has to confirm a settings frame.
+	AckTimeout time.Duration `yaml:"ack_timeout"`
+}
+
+// Drivers speak the wire protocol of a controller.
+const (
+	// DriverFrame is the 55 AA framing of the older controllers, the
+	// default.
+	DriverFrame = "frame"
+	// DriverModbus is Modbus RTU, the address is the slave address.
+	DriverModbus = "modbus"
+)
+
+type BusConfig struct {
+	Address int32  `yaml:"address"`
+	Driver  string `yaml:"driver"`
+	// RegisterMap is the file that maps the registers of a Modbus
+	// controller to telemetry and commands.
+	RegisterMap string `yaml:"register_map"`
+}
+
+// IsModbus reports whether the controller speaks Modbus RTU.
+func (b BusConfig) IsModbus() bool {
+	return b.Driver == DriverModbus
+}
+
+// Primary returns the address of the first controller on the bus.
+func (d DeviceConfig) Primary() int32 {
+	if len(d.Buses) == 0 {
+		return 0
+	}
+
+	return d.Buses[0].Address
+}
+
+// HasAddress reports whether a controller with the address is on the bus.
+func (d DeviceConfig) HasAddress(address int32) bool {
+	_, ok := d.Bus(address)
+	return ok
+}
+
+// Bus returns the controller with the address.
+func (d DeviceConfig) Bus(address int32) (BusConfig, bool) {
+	for _, b := range d.Buses {
+		if b.Address == address {
+			return b, true
+		}
+	}
+
+	return BusConfig{}, false
+}
+
+// BackoffConfig is the delay between reconnect attempts, it starts at
+// Initial and grows by Multiplier up to Max.
+type BackoffConfig struct {
+	Initial    time.Duration `yaml:"initial"`
+	Max        time.Duration `yaml:"max"`
+	Multiplier float64       `yaml:"multiplier"`
+}
+
+// BufferConfig is the on-disk queue keeping telemetry while the server is
+// unreachable, an empty Dir turns it off.
+type BufferConfig struct {
+	Dir       string `yaml:"dir"`
+	MaxSizeMB int    `yaml:"max_size_mb"`
+}
+
+// LocalConfig is the API the agent serves on the home network so the app
+// keeps working without the server, an empty Listen turns it off.
+type LocalConfig struct {
+	Listen string `yaml:"listen"`
+	// Token must be sent by clients as a bearer token.
+	Token string `yaml:"token"`
+	// MDNS advertises the API as _ilean._tcp on the local network.
+	MDNS bool `yaml:"mdns"`
+}
+
+// HealthConfig is how often the agent reports its health to the server.
+type HealthConfig struct {
+	Interval time.Duration `yaml:"interval"`
+}
+
+// CaptureConfig records the raw serial traffic to a rotating file, an
+// empty File turns it off.
+type CaptureConfig struct {
+	File      string `yaml:"file"`
+	MaxSizeMB int    `yaml:"max_size_mb"`
+	// Keep is how many rotated files are kept next to File.
+	Keep int `yaml:"keep"`
+}
+
+// ReplayConfig feeds a capture file to the agent in place of the serial
+// port, an empty File turns it off.
+type ReplayConfig struct {
+	File string `yaml:"file"`
+	// Speed scales the recorded pauses, 0 replays without pauses.
+	Speed float64 `yaml:"speed"`
+}
+
+// UpdateConfig lets the server update the agent binary, an empty PublicKey
+// turns updates off.
+type UpdateConfig struct {
+	// PublicKey is the base64 ed25519 key releases must be signed with.
+	PublicKey string `yaml:"public_key"`
+	// Grace is how long a new binary has to report healthy before the
+	// previous one is restored.
+	Grace time.Duration `yaml:"grace"`
+}
+
+// ScheduleConfig keeps the weekly schedule synced by the server, the agent
+// follows it once it lost the server for After. An empty File turns it off.
+type ScheduleConfig struct {
+	File  string        `yaml:"file"`
+	After time.Duration `yaml:"after"`
+}
+
+// PolicyConfig is the file with the bounds settings commands are checked
+// against before they are written to the controllers, an empty File turns
+// the checks off.
+type PolicyConfig struct {
+	File string `yaml:"file"`
+}
+
+// AuthConfig is the key of the device shared with the server, hex. With a
+// key the agent proves its identity when it connects and executes only
+// commands the server signed within Window of now, once. Running without a
+// key, commands not checked, takes Unsigned.
+type AuthConfig struct {
+	Key      string        `yaml:"key"`
+	Window   time.Duration `yaml:"window"`
+	Unsigned bool          `yaml:"unsigned"`
+}
+
+// WatchdogConfig tells when a controller counts as silent: every command it
+// sends regularly is overdue by Factor times its interval. Intervals that
+// are not set are learned from the traffic.
+type WatchdogConfig struct {
+	// Intervals are the expected intervals by command, e.g. 1 for telemetry.
+	Intervals map[int]time.Duration `yaml:"intervals"`
+	Factor    float64               `yaml:"factor"`
+	// Reopen is how long a controller may be silent before the serial port
+	// is reopened, 0 turns it off.
+	Reopen time.Duration `yaml:"reopen"`
+}
+
+// Default returns the settings used for anything missing in the file.
+func Default() Config {
+	return Config{
+		Upstream: UpstreamConfig{
+			URL: "ws://185.27.192.21:63240/ws",
+			MQTT: MQTTConfig{
+				Prefix: "ilean",
+			},
+		},
+		Device: DeviceConfig{
+			Port:        "/dev/ttyAMA0",
+			BaudRate:    115200,
+			DataBits:    8,
+			StopBits:    1,
+			MinReadSize: 2,
+			Buses:       []BusConfig{{Address: 101}},
+			AckTimeout:  5 * time.Second,
+		},
+		Backoff: BackoffConfig{
+			Initial:    4 * time.Second,
+			Max:        time.Minute,
+			Multiplier: 1.5,
+		},
+		Buffer: BufferConfig{
+			MaxSizeMB: 64,
+		},
+		Local: LocalConfig{
+			MDNS: true,
+		},
+		Health: HealthConfig{
+			Interval: 30 * time.Second,
+		},
+		Capture: CaptureConfig{
+			MaxSizeMB: 16,
+			Keep:      3,
+		},
+		Replay: ReplayConfig{
+			Speed: 1,
+		},
+		Update: UpdateConfig{
+			Grace: 5 * time.Minute,
+		},
+		Schedule: ScheduleConfig{
+			After: 30 * time.Minute,
+		},
+		Auth: AuthConfig{
+			Window: 2 * time.Minute,
+		},
+		Watchdog: WatchdogConfig{
+			Factor: 3,
+			Reopen: 2 * time.Minute,
+		},
+	}
 }
 
 func (c Config) Validate() error {
-	if c.Serial == 0 {
-		return errors.New("rabbitmq_uri is empty")
+	if c.Serial < 1 {
+		return errors.New("serial is empty")
+	}
+
+	u, err := url.Parse(c.Upstream.URL)
+	if err != nil {
+		return fmt.Errorf("upstream.url: %w", err)
+	}
+
+	switch u.Scheme {
+	case "ws", "wss":
+	case "mqtt", "mqtts":
+		if c.Upstream.MQTT.Prefix == "" || strings.ContainsAny(c.Upstream.MQTT.Prefix, "+#") {
+			return errors.New("upstream.mqtt.prefix must be a topic without wildcards")
+		}
+	default:
+		return fmt.Errorf("upstream.url: unsupported scheme %q", u.Scheme)
+	}
+
+	if c.Device.Port == "" {
+		return errors.New("device.port is empty")
+	}
+
+	if c.Device.BaudRate == 0 {
+		return errors.New("device.baud_rate is empty")
+	}
+
+	if c.Device.DataBits < 5 || c.Device.DataBits > 8 {
+		return fmt.Errorf("device.data_bits: %d is out of range 5-8", c.Device.DataBits)
+	}
+
+	if c.Device.StopBits != 1 && c.Device.StopBits != 2 {
+		return fmt.Errorf("device.stop_bits: %d must be 1 or 2", c.Device.StopBits)
+	}
+
+	if len(c.Device.Buses) == 0 {
+		return errors.New("device.buses is empty")
+	}
+
+	addresses := make(map[int32]bool, len(c.Device.Buses))
+	for i, b := range c.Device.Buses {
+		if b.Address < 1 {
+			return fmt.Errorf("device.buses[%d].address is empty", i)
+		}
+
+		if addresses[b.Address] {
+			return fmt.Errorf("device.buses[%d].address: duplicate address %d", i, b.Address)
+		}
+
+		addresses[b.Address] = true
+
+		switch b.Driver {
+		case "", DriverFrame:
+			if b.RegisterMap != "" {
+				return fmt.Errorf("device.buses[%d].register_map is only used by the %s driver", i, DriverModbus)
+			}
+		case DriverModbus:
+			if b.Address > 247 {
+				return fmt.Errorf("device.buses[%d].address: %d is out of range 1-247 for Modbus", i, b.Address)
+			}
+
+			if b.RegisterMap == "" {
+				return fmt.Errorf("device.buses[%d].register_map is empty", i)
+			}
+		default:
+			return fmt.Errorf("device.buses[%d].driver: unknown driver %q", i, b.Driver)
+		}
+	}
+
+	if c.Device.AckTimeout <= 0 {
+		return errors.New("device.ack_timeout must be positive")
+	}
+
+	if c.Backoff.Initial <= 0 {
+		return errors.New("backoff.initial must be positive")
+	}
+
+	if c.Backoff.Max < c.Backoff.Initial {
+		return errors.New("backoff.max is less than backoff.initial")
+	}
+
+	if c.Backoff.Multiplier < 1 {
+		return errors.New("backoff.multiplier is less than 1")
+	}
+
+	if c.Buffer.Dir != "" && c.Buffer.MaxSizeMB < 1 {
+		return errors.New("buffer.max_size_mb must be positive")
+	}
+
+	if c.Local.Listen != "" && c.Local.Token == "" {
+		return errors.New("local.token is empty")
+	}
+
+	if c.Health.Interval <= 0 {
+		return errors.New("health.interval must be positive")
+	}
+
+	if c.Capture.File != "" && c.Capture.MaxSizeMB < 1 {
+		return errors.New("capture.max_size_mb must be positive")
+	}
+
+	if c.Capture.Keep < 0 {
+		return errors.New("capture.keep is negative")
+	}
+
+	if c.Replay.Speed < 0 {
+		return errors.New("replay.speed is negative")
+	}
+
+	if c.Update.PublicKey != "" {
+		key, err := base64.StdEncoding.DecodeString(c.Update.PublicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return errors.New("update.public_key is not a base64 ed25519 key")
+		}
+	}
+
+	if c.Update.Grace <= 0 {
+		return errors.New("update.grace must be positive")
+	}
+
+	if c.Schedule.After <= 0 {
+		return errors.New("schedule.after must be positive")
+	}
+
+	if c.Auth.Key != "" {
+		if _, err := auth.ParseKey(c.Auth.Key); err != nil {
+			return fmt.Errorf("auth.key: %w", err)
+		}
+
+		if c.Auth.Unsigned {
+			return errors.New("auth.unsigned is set along with auth.key")
+		}
+	} else if !c.Auth.Unsigned {
+		return errors.New("auth.key is not set: set ILEAN_AUTH_KEY to the key of the device on the server, or auth.unsigned to execute commands unchecked")
+	}
+
+	if c.Auth.Window <= 0 {
+		return errors.New("auth.window must be positive")
+	}
+
+	for command, interval := range c.Watchdog.Intervals {
+		if interval <= 0 {
+			return fmt.Errorf("watchdog.intervals: interval of command %d must be positive", command)
+		}
+	}
+
+	if c.Watchdog.Factor < 1 {
+		return errors.New("watchdog.factor is less than 1")
+	}
+
+	if c.Watchdog.Reopen < 0 {
+		return errors.New("watchdog.reopen is negative")
 	}
 
 	return nil
@@ -26,12 +424,209 @@ func LoadConfig(configPath string) (Config, error) {
 		return Config{}, fmt.Errorf("read config %s file: %w", configPath, err)
 	}
 
-	var c Config
+	c, err := ParseWithEnv(configYAML)
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid config %s: %w", configPath, err)
+	}
+
+	return c, nil
+}
+
+// ParseWithEnv reads a config on top of the defaults with the ILEAN_*
+// environment variables on top of the YAML, the way LoadConfig reads the
+// file, and validates it.
+func ParseWithEnv(configYAML []byte) (Config, error) {
+	return parse(configYAML, true, nil)
+}
+
+// AgentOnly are the sections of the config the server can not push: the
+// keys pushes, commands and releases are checked with and the policy that
+// guards the controllers against the server as well.
+var AgentOnly = []string{"auth", "update", "policy"}
+
+// ParsePushed reads a config the server pushes. It must leave out the
+// AgentOnly sections, they are taken from agent: the config the agent runs
+// or, on the server that does not know them, Unknown(). The server checks
+// the configs it pushes with it, its environment has nothing to do with
+// them.
+func ParsePushed(configYAML []byte, agent Config) (Config, error) {
+	return parse(configYAML, false, &agent)
+}
+
+// ParsePushedWithEnv is ParsePushed with the ILEAN_* environment variables
+// on top of the YAML, the way the agent reads a pushed config.
+func ParsePushedWithEnv(configYAML []byte, agent Config) (Config, error) {
+	return parse(configYAML, true, &agent)
+}
+
+// Unknown is the defaults with the AgentOnly sections as the server
+// validates pushed configs with, the agent runs them with its own.
+func Unknown() Config {
+	c := Default()
+	c.Auth.Unsigned = true
+
+	return c
+}
+
+func parse(configYAML []byte, env bool, agent *Config) (Config, error) {
+	c := Default()
 
-	err = yaml.Unmarshal(configYAML, &c)
+	if agent != nil {
+		var sections map[string]interface{}
+		if err := yaml.Unmarshal(configYAML, &sections); err != nil {
+			return Config{}, fmt.Errorf("YAML unmarshal config: %w", err)
+		}
+
+		for _, section := range AgentOnly {
+			if _, ok := sections[section]; ok {
+				return Config{}, fmt.Errorf("%s is set on the agent only", section)
+			}
+		}
+	}
+
+	err := yaml.Unmarshal(configYAML, &c)
 	if err != nil {
 		return Config{}, fmt.Errorf("YAML unmarshal config: %w", err)
 	}
 
+	if env {
+		if err := c.applyEnv(); err != nil {
+			return Config{}, err
+		}
+	}
+
+	if agent != nil {
+		c.Auth = agent.Auth
+		c.Update = agent.Update
+		c.Policy = agent.Policy
+	}
+
+	if err := c.Validate(); err != nil {
+		return Config{}, err
+	}
+
 	return c, nil
 }
+
+// applyEnv overrides file settings with ILEAN_* environment variables.
+func (c *Config) applyEnv() error {
+	overrides := []struct {
+		env   string
+		field string
+		set   func(string) error
+	}{
+		{"ILEAN_SERIAL", "serial", intVar(&c.Serial)},
+		{"ILEAN_UPSTREAM_URL", "upstream.url", stringVar(&c.Upstream.URL)},
+		{"ILEAN_UPSTREAM_MQTT_USERNAME", "upstream.mqtt.username", stringVar(&c.Upstream.MQTT.Username)},
+		{"ILEAN_UPSTREAM_MQTT_PASSWORD", "upstream.mqtt.password", stringVar(&c.Upstream.MQTT.Password)},
+		{"ILEAN_UPSTREAM_MQTT_PREFIX", "upstream.mqtt.prefix", stringVar(&c.Upstream.MQTT.Prefix)},
+		{"ILEAN_DEVICE_PORT", "device.port", stringVar(&c.Device.Port)},
+		{"ILEAN_DEVICE_BAUD_RATE", "device.baud_rate", uintVar(&c.Device.BaudRate)},
+		{"ILEAN_DEVICE_DATA_BITS", "device.data_bits", uintVar(&c.Device.DataBits)},
+		{"ILEAN_DEVICE_STOP_BITS", "device.stop_bits", uintVar(&c.Device.StopBits)},
+		{"ILEAN_DEVICE_ADDRESSES", "device.buses", busesVar(&c.Device.Buses)},
+		{"ILEAN_DEVICE_ACK_TIMEOUT", "device.ack_timeout", durationVar(&c.Device.AckTimeout)},
+		{"ILEAN_BACKOFF_INITIAL", "backoff.initial", durationVar(&c.Backoff.Initial)},
+		{"ILEAN_BACKOFF_MAX", "backoff.max", durationVar(&c.Backoff.Max)},
+		{"ILEAN_BACKOFF_MULTIPLIER", "backoff.multiplier", floatVar(&c.Backoff.Multiplier)},
+		{"ILEAN_BUFFER_DIR", "buffer.dir", stringVar(&c.Buffer.Dir)},
+		{"ILEAN_BUFFER_MAX_SIZE_MB", "buffer.max_size_mb", intVar(&c.Buffer.MaxSizeMB)},
+		{"ILEAN_LOCAL_LISTEN", "local.listen", stringVar(&c.Local.Listen)},
+		{"ILEAN_LOCAL_TOKEN", "local.token", stringVar(&c.Local.Token)},
+		{"ILEAN_LOCAL_MDNS", "local.mdns", boolVar(&c.Local.MDNS)},
+		{"ILEAN_HEALTH_INTERVAL", "health.interval", durationVar(&c.Health.Interval)},
+		{"ILEAN_CAPTURE_FILE", "capture.file", stringVar(&c.Capture.File)},
+		{"ILEAN_CAPTURE_MAX_SIZE_MB", "capture.max_size_mb", intVar(&c.Capture.MaxSizeMB)},
+		{"ILEAN_CAPTURE_KEEP", "capture.keep", intVar(&c.Capture.Keep)},
+		{"ILEAN_REPLAY_FILE", "replay.file", stringVar(&c.Replay.File)},
+		{"ILEAN_REPLAY_SPEED", "replay.speed", floatVar(&c.Replay.Speed)},
+		{"ILEAN_UPDATE_PUBLIC_KEY", "update.public_key", stringVar(&c.Update.PublicKey)},
+		{"ILEAN_UPDATE_GRACE", "update.grace", durationVar(&c.Update.Grace)},
+		{"ILEAN_SCHEDULE_FILE", "schedule.file", stringVar(&c.Schedule.File)},
+		{"ILEAN_SCHEDULE_AFTER", "schedule.after", durationVar(&c.Schedule.After)},
+		{"ILEAN_WATCHDOG_FACTOR", "watchdog.factor", floatVar(&c.Watchdog.Factor)},
+		{"ILEAN_WATCHDOG_REOPEN", "watchdog.reopen", durationVar(&c.Watchdog.Reopen)},
+		{"ILEAN_POLICY_FILE", "policy.file", stringVar(&c.Policy.File)},
+		{"ILEAN_AUTH_KEY", "auth.key", stringVar(&c.Auth.Key)},
+		{"ILEAN_AUTH_WINDOW", "auth.window", durationVar(&c.Auth.Window)},
+		{"ILEAN_AUTH_UNSIGNED", "auth.unsigned", boolVar(&c.Auth.Unsigned)},
+	}
+
+	for _, o := range overrides {
+		value, ok := os.LookupEnv(o.env)
+		if !ok {
+			continue
+		}
+
+		if err := o.set(value); err != nil {
+			return fmt.Errorf("%s (from %s): %w", o.field, o.env, err)
+		}
+	}
+
+	return nil
+}
+
+func stringVar(p *string) func(string) error {
+	return func(s string) error {
+		*p = s
+		return nil
+	}
+}
+
+func intVar(p *int) func(string) error {
+	return func(s string) error {
+		v, err := strconv.Atoi(s)
+		*p = v
+		return err
+	}
+}
+
+// busesVar reads a comma separated list of bus addresses.
+func busesVar(p *[]BusConfig) func(string) error {
+	return func(s string) error {
+		var buses []BusConfig
+		for _, field := range strings.Split(s, ",") {
+			v, err := strconv.ParseInt(strings.TrimSpace(field), 10, 32)
+			if err != nil {
+				return err
+			}
+
+			buses = append(buses, BusConfig{Address: int32(v)})
+		}
+
+		*p = buses
+		return nil
+	}
+}
+
+func uintVar(p *uint) func(string) error {
+	return func(s string) error {
+		v, err := strconv.ParseUint(s, 10, 32)
+		*p = uint(v)
+		return err
+	}
+}
+
+func boolVar(p *bool) func(string) error {
+	return func(s string) error {
+		v, err := strconv.ParseBool(s)
+		*p = v
+		return err
+	}
+}
+
+func floatVar(p *float64) func(string) error {
+	return func(s string) error {
+		v, err := strconv.ParseFloat(s, 64)
+		*p = v
+		return err
+	}
+}
+
+func durationVar(p *time.Duration) func(string) error {
+	return func(s string) error {
+		v, err := time.ParseDuration(s)
+		*p = v
+		return err
+	}
+}
@@ -0,0 +1,194 @@
+package config
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+// setenv sets the variables until the returned function is called.
+func setenv(t *testing.T, env map[string]string) func() {
+	t.Helper()
+
+	for k, v := range env {
+		if err := os.Setenv(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return func() {
+		for k := range env {
+			os.Unsetenv(k)
+		}
+	}
+}
+
+func TestLoadShippedConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		// err is part of the error, empty if the config loads.
+		err string
+	}{
+		{"key from the environment", map[string]string{"ILEAN_AUTH_KEY": testKey}, ""},
+		{"unsigned from the environment", map[string]string{"ILEAN_AUTH_UNSIGNED": "true"}, ""},
+		{"no key", nil, "ILEAN_AUTH_KEY"},
+		{"empty key", map[string]string{"ILEAN_AUTH_KEY": ""}, "ILEAN_AUTH_KEY"},
+		{"bad key", map[string]string{"ILEAN_AUTH_KEY": "abc"}, "auth.key"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setenv(t, tt.env)()
+
+			c, err := LoadConfig("pi.conf")
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("load: %v, want an error about %s", err, tt.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("load: %v", err)
+			}
+
+			if c.Serial != 12345 || c.Auth.Key != tt.env["ILEAN_AUTH_KEY"] {
+				t.Errorf("loaded serial %d and key %q", c.Serial, c.Auth.Key)
+			}
+		})
+	}
+}
+
+func TestParsePushed(t *testing.T) {
+	agent := Default()
+	agent.Auth.Key = testKey
+	agent.Policy.File = "/opt/config/policy.yaml"
+
+	tests := []struct {
+		name string
+		yaml string
+		// err is part of the error, empty if the config is taken.
+		err string
+	}{
+		{"settings", "serial: 7\nhealth:\n  interval: 1m\n", ""},
+		{"auth", "serial: 7\nauth:\n  unsigned: true\n", "auth is set on the agent only"},
+		{"update", "serial: 7\nupdate:\n  grace: 1m\n", "update is set on the agent only"},
+		{"policy", "serial: 7\npolicy:\n  file: \"\"\n", "policy is set on the agent only"},
+		{"invalid", "serial: 7\nhealth:\n  interval: 0s\n", "health.interval"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, base := range []Config{agent, Unknown()} {
+				c, err := ParsePushed([]byte(tt.yaml), base)
+				if tt.err != "" {
+					if err == nil || !strings.Contains(err.Error(), tt.err) {
+						t.Fatalf("parse: %v, want an error about %s", err, tt.err)
+					}
+					continue
+				}
+
+				if err != nil {
+					t.Fatalf("parse: %v", err)
+				}
+
+				if c.Serial != 7 || c.Auth != base.Auth || c.Update != base.Update || c.Policy != base.Policy {
+					t.Errorf("parsed %+v, want the agent only sections of %+v", c, base)
+				}
+			}
+		})
+	}
+}
+
+func TestParseWithEnv(t *testing.T) {
+	const file = "serial: 7\ndevice:\n  port: /dev/ttyS1\nauth:\n  unsigned: true\n"
+
+	tests := []struct {
+		name  string
+		env   map[string]string
+		check func(c Config) bool
+		// err is part of the error, empty if the config is taken.
+		err string
+	}{
+		{
+			name:  "file only",
+			check: func(c Config) bool { return c.Serial == 7 && c.Device.Port == "/dev/ttyS1" },
+		},
+		{
+			name:  "serial",
+			env:   map[string]string{"ILEAN_SERIAL": "9"},
+			check: func(c Config) bool { return c.Serial == 9 },
+		},
+		{
+			name: "connection",
+			env: map[string]string{
+				"ILEAN_UPSTREAM_URL":     "wss://example.com/ws",
+				"ILEAN_DEVICE_PORT":      "/dev/ttyUSB0",
+				"ILEAN_DEVICE_BAUD_RATE": "19200",
+				"ILEAN_BACKOFF_INITIAL":  "2s",
+			},
+			check: func(c Config) bool {
+				return c.Upstream.URL == "wss://example.com/ws" && c.Device.Port == "/dev/ttyUSB0" &&
+					c.Device.BaudRate == 19200 && c.Backoff.Initial == 2*time.Second
+			},
+		},
+		{
+			name: "addresses",
+			env:  map[string]string{"ILEAN_DEVICE_ADDRESSES": "101, 102"},
+			check: func(c Config) bool {
+				return len(c.Device.Buses) == 2 && c.Device.Buses[0].Address == 101 && c.Device.Buses[1].Address == 102
+			},
+		},
+		{
+			name: "bad number",
+			env:  map[string]string{"ILEAN_DEVICE_BAUD_RATE": "fast"},
+			err:  "device.baud_rate (from ILEAN_DEVICE_BAUD_RATE)",
+		},
+		{
+			name: "bad address",
+			env:  map[string]string{"ILEAN_DEVICE_ADDRESSES": "101,x"},
+			err:  "device.buses (from ILEAN_DEVICE_ADDRESSES)",
+		},
+		{
+			name: "bad duration",
+			env:  map[string]string{"ILEAN_BACKOFF_MAX": "10"},
+			err:  "backoff.max (from ILEAN_BACKOFF_MAX)",
+		},
+		{
+			name: "invalid value",
+			env:  map[string]string{"ILEAN_DEVICE_DATA_BITS": "9"},
+			err:  "device.data_bits",
+		},
+		{
+			name: "duplicate address",
+			env:  map[string]string{"ILEAN_DEVICE_ADDRESSES": "101,101"},
+			err:  "device.buses[1].address",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setenv(t, tt.env)()
+
+			c, err := ParseWithEnv([]byte(file))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("parse: %v, want an error about %s", err, tt.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+
+			if !tt.check(c) {
+				t.Errorf("parsed %+v", c)
+			}
+		})
+	}
+}
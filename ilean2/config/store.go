@@ -0,0 +1,228 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	prevExt       = ".prev"
+	trialExt      = ".trial"
+	rolledBackExt = ".rolledback"
+)
+
+// Store keeps the config file of the agent for remote updates. The config
+// in use before an update is kept as <path>.prev and <path>.trial marks an
+// update that has not proven to work yet. A rollback restores the previous
+// file and leaves <path>.rolledback for the agent to report.
+//
+// The file is replaced with the YAML as pushed with its version set and the
+// AgentOnly sections of the file, comments are not kept.
+type Store struct {
+	path string
+}
+
+func NewStore(path string) *Store {
+	return &Store{path: path}
+}
+
+func (s *Store) Path() string {
+	return s.path
+}
+
+// Update replaces the config with raw, setting its version and keeping the
+// AgentOnly sections of the current file, and puts the new version on
+// trial.
+func (s *Store) Update(raw []byte, version int) error {
+	current, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("read config: %w", err)
+	}
+
+	if err := writeFileAtomic(s.path+prevExt, current); err != nil {
+		return fmt.Errorf("save previous config: %w", err)
+	}
+
+	raw, err = pushedFile(raw, current, version)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(s.path, raw); err != nil {
+		return fmt.Errorf("save config: %w", err)
+	}
+
+	if err := writeFileAtomic(s.path+trialExt, []byte(strconv.Itoa(version))); err != nil {
+		return fmt.Errorf("save trial marker: %w", err)
+	}
+
+	err = os.Remove(s.path + rolledBackExt)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// Trial returns the version on trial, if any.
+func (s *Store) Trial() (int, bool) {
+	raw, err := ioutil.ReadFile(s.path + trialExt)
+	if err != nil {
+		return 0, false
+	}
+
+	version, err := strconv.Atoi(strings.TrimSpace(string(raw)))
+	if err != nil {
+		return 0, false
+	}
+
+	return version, true
+}
+
+// Confirm ends the trial, the config stays.
+func (s *Store) Confirm() error {
+	err := os.Remove(s.path + trialExt)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// Rollback restores the previous config instead of the one on trial.
+func (s *Store) Rollback(reason string) error {
+	version, ok := s.Trial()
+	if !ok {
+		return errors.New("no config on trial")
+	}
+
+	previous, err := ioutil.ReadFile(s.path + prevExt)
+	if err != nil {
+		return fmt.Errorf("read previous config: %w", err)
+	}
+
+	if err := writeFileAtomic(s.path, previous); err != nil {
+		return fmt.Errorf("restore config: %w", err)
+	}
+
+	marker := fmt.Sprintf("%d %s", version, strings.ReplaceAll(reason, "\n", " "))
+	if err := writeFileAtomic(s.path+rolledBackExt, []byte(marker)); err != nil {
+		return fmt.Errorf("save rollback marker: %w", err)
+	}
+
+	return s.Confirm()
+}
+
+// RolledBack returns the version of the last rollback and why it happened,
+// it is kept until a newer version is applied.
+func (s *Store) RolledBack() (int, string, bool) {
+	raw, err := ioutil.ReadFile(s.path + rolledBackExt)
+	if err != nil {
+		return 0, "", false
+	}
+
+	fields := strings.SplitN(strings.TrimSpace(string(raw)), " ", 2)
+
+	version, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, "", false
+	}
+
+	reason := ""
+	if len(fields) == 2 {
+		reason = fields[1]
+	}
+
+	return version, reason, true
+}
+
+// pushedFile is the pushed config raw with the version set and the
+// AgentOnly sections of the current file, a version raw has is replaced.
+func pushedFile(raw, current []byte, version int) ([]byte, error) {
+	var fields, currentFields yaml.MapSlice
+	if err := yaml.Unmarshal(raw, &fields); err != nil {
+		return nil, fmt.Errorf("parse config: %w", err)
+	}
+
+	if err := yaml.Unmarshal(current, &currentFields); err != nil {
+		return nil, fmt.Errorf("parse current config: %w", err)
+	}
+
+	kept := fields[:0]
+	for _, field := range fields {
+		if key, ok := field.Key.(string); ok && (key == "version" || agentOnly(key)) {
+			continue
+		}
+		kept = append(kept, field)
+	}
+
+	for _, field := range currentFields {
+		if key, ok := field.Key.(string); ok && agentOnly(key) {
+			kept = append(kept, field)
+		}
+	}
+	kept = append(kept, yaml.MapItem{Key: "version", Value: version})
+
+	return yaml.Marshal(kept)
+}
+
+func agentOnly(section string) bool {
+	for _, s := range AgentOnly {
+		if s == section {
+			return true
+		}
+	}
+
+	return false
+}
+
+// writeFileAtomic replaces the file so that a crash leaves either the old
+// or the new content.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	// the config holds the key of the device
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	return nil
+}
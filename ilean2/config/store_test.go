@@ -0,0 +1,52 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStoreUpdateKeepsAgentOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "pi.conf")
+	current := "serial: 7\nauth:\n  key: " + testKey + "\npolicy:\n  file: /opt/config/policy.yaml\nversion: 1\n"
+	if err := ioutil.WriteFile(path, []byte(current), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewStore(path)
+	if err := store.Update([]byte("serial: 7\nhealth:\n  interval: 1m\n"), 2); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	if c.Version != 2 || c.Health.Interval.Minutes() != 1 || c.Auth.Key != testKey || c.Policy.File != "/opt/config/policy.yaml" {
+		t.Errorf("loaded %+v, want version 2 with the pushed health and the kept auth and policy", c)
+	}
+
+	if version, ok := store.Trial(); !ok || version != 2 {
+		t.Errorf("trial %d %v, want version 2", version, ok)
+	}
+
+	if err := store.Rollback("links down"); err != nil {
+		t.Fatalf("rollback: %v", err)
+	}
+
+	if raw, err := ioutil.ReadFile(path); err != nil || string(raw) != current {
+		t.Errorf("restored %q, want %q", raw, current)
+	}
+
+	if version, reason, ok := store.RolledBack(); !ok || version != 2 || reason != "links down" {
+		t.Errorf("rolled back %d %q %v", version, reason, ok)
+	}
+}
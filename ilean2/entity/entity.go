@@ -3,6 +3,8 @@ package entity
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"time"
 )
 
 const (
@@ -12,20 +14,28 @@ const (
 	DataModuleVentIn
 )
 
+// Target addresses a controller: the Pi by its serial number and, when
+// several controllers share its RS-485 bus, one of them by bus address.
+// Without a bus address the command goes to the first controller.
+type Target struct {
+	SerialNumber int   `json:"serial_number" validate:"required"`
+	BusAddress   int32 `json:"bus_address,omitempty" validate:"gte=0"`
+}
+
 type CommandTemperature struct {
-	SerialNumber int     `json:"serial_number" validate:"required"`
-	Temperature  float32 `json:"temperature" validate:"required"`
-	Zone         int     `json:"zone" validate:"required"`
+	Target
+	Temperature float32 `json:"temperature" validate:"required"`
+	Zone        int     `json:"zone" validate:"required"`
 }
 
 type CommandTemperatureBySensor struct {
-	SerialNumber int `json:"serial_number" validate:"required"`
-	Type         int `json:"type" validate:"required"`
-	Zone         int `json:"zone" validate:"required"`
+	Target
+	Type int `json:"type" validate:"required"`
+	Zone int `json:"zone" validate:"required"`
 }
 
 type CommandDataVentModule struct {
-	SerialNumber                           int   `json:"serial_number" validate:"required"`
+	Target
 	Zone                                   int16 `json:"zone"  validate:"required"`
 	VentSpeed                              int16 `json:"vent_speed" validate:"required"`
 	Delta                                  uint8 `json:"delta"`
@@ -36,7 +46,7 @@ type CommandDataVentModule struct {
 }
 
 type CommandDataVentModuleForAll struct {
-	SerialNumber                           int   `json:"serial_number" validate:"required"`
+	Target
 	Delta                                  uint8 `json:"delta" validate:"required"`
 	TypeRegulation                         uint8 `json:"type_regulation" validate:"required"`
 	IntervalTimeVentilationDampers         uint8 `json:"interval_time_ventilation_dampers" validate:"required"`
@@ -44,15 +54,15 @@ type CommandDataVentModuleForAll struct {
 }
 
 type CommandDataVentByZone struct {
-	SerialNumber int   `json:"serial_number" validate:"required"`
-	Zone         int16 `json:"zone"  validate:"required"`
+	Target
+	Zone int16 `json:"zone"  validate:"required"`
 }
 
 type CommandHysteresisOnHumidityModule struct {
-	SerialNumber int     `json:"serial_number" validate:"required"`
-	Zone         int32   `json:"zone"`
-	Humidity     float32 `json:"humidity"`
-	Hysteresis   uint8   `json:"hysteresis"`
+	Target
+	Zone       int32   `json:"zone"`
+	Humidity   float32 `json:"humidity"`
+	Hysteresis uint8   `json:"hysteresis"`
 }
 
 //func (c *CommandDataVentModule) Converter() DataVentModule {
@@ -68,6 +78,309 @@ type CommandHysteresisOnHumidityModule struct {
 //	}
 //}
 
+// CommandAck is sent by the agent to report the progress of a command with
+// an ID.
+const CommandAck = 100
+
+const (
+	AckSent      = "sent"
+	AckDelivered = "delivered"
+	AckWritten   = "written"
+	AckConfirmed = "device_acked"
+	AckFailed    = "failed"
+)
+
+type Ack struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Final reports whether no more acks follow for the command.
+func (a Ack) Final() bool {
+	return a.Status == AckConfirmed || a.Status == AckFailed
+}
+
+// CommandHealth is sent by the agent every health interval.
+const CommandHealth = 101
+
+// Health is the state of an agent and of the serial line to its
+// controllers.
+type Health struct {
+	Version          string `json:"version"`
+	UptimeSec        int64  `json:"uptime_sec"`
+	BytesRead        uint64 `json:"bytes_read"`
+	BytesWritten     uint64 `json:"bytes_written"`
+	Frames           uint64 `json:"frames"`
+	CRCFailures      uint64 `json:"crc_failures"`
+	Resyncs          uint64 `json:"resyncs"`
+	SocketReconnects uint64 `json:"socket_reconnects"`
+	DeviceReconnects uint64 `json:"device_reconnects"`
+	// SinceLastFrameSec is -1 until the first frame is read.
+	SinceLastFrameSec int64 `json:"since_last_frame_sec"`
+}
+
+// HealthReport is the latest health the server got from an agent.
+type HealthReport struct {
+	Health
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// CommandConfig carries the desired agent config from the server,
+// CommandConfigStatus reports back what the agent did with it.
+const (
+	CommandConfig       = 102
+	CommandConfigStatus = 103
+)
+
+const (
+	ConfigApplied = "applied"
+	// ConfigRestarting is reported before the agent restarts to apply
+	// changes that can not be applied while it runs, applied follows.
+	ConfigRestarting = "restarting"
+	ConfigRejected   = "rejected"
+	// ConfigRolledBack means the agent could not reconnect with the config
+	// and went back to the previous one.
+	ConfigRolledBack = "rolled_back"
+)
+
+// AgentConfig is a version of the agent config file, the version is
+// assigned by the server and only grows.
+type AgentConfig struct {
+	Version int    `json:"version"`
+	Config  string `json:"config"`
+}
+
+type ConfigStatus struct {
+	Version int    `json:"version"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ConfigState is the config the server wants an agent to run and what the
+// agent reported last.
+type ConfigState struct {
+	Desired    *AgentConfig  `json:"desired,omitempty"`
+	Reported   *ConfigStatus `json:"reported,omitempty"`
+	ReportedAt time.Time     `json:"reported_at"`
+}
+
+// CommandRelease announces the agent release the server wants agents to
+// run, CommandUpdateStatus reports back how installing it went.
+const (
+	CommandRelease      = 104
+	CommandUpdateStatus = 105
+)
+
+const (
+	UpdateInstalling = "installing"
+	// UpdateRestarting is reported before the agent restarts into the new
+	// binary, applied follows once it reports healthy.
+	UpdateRestarting = "restarting"
+	UpdateApplied    = "applied"
+	UpdateRejected   = "rejected"
+	UpdateFailed     = "failed"
+	// UpdateRolledBack means the new binary did not report healthy in time
+	// and the previous one runs again.
+	UpdateRolledBack = "rolled_back"
+)
+
+// Release is an agent binary the agent downloads from URL. Signature is the
+// base64 ed25519 signature of the version and checksum by the release key,
+// the server only passes it on.
+type Release struct {
+	Version   string `json:"version" validate:"required"`
+	URL       string `json:"url,omitempty"`
+	SHA256    string `json:"sha256" validate:"required,len=64,hexadecimal"`
+	Signature string `json:"signature" validate:"required,base64"`
+}
+
+type UpdateStatus struct {
+	Version string `json:"version"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+}
+
+// UpdateState is the release the server announces and what an agent
+// reported last about installing it.
+type UpdateState struct {
+	Release    *Release      `json:"release,omitempty"`
+	Reported   *UpdateStatus `json:"reported,omitempty"`
+	ReportedAt time.Time     `json:"reported_at"`
+}
+
+// CommandSchedule carries the weekly schedule from the server,
+// CommandScheduleStatus reports back whether the agent stored it and
+// CommandScheduleReport lists what the agent did by the schedule while it
+// was offline.
+const (
+	CommandSchedule       = 106
+	CommandScheduleStatus = 107
+	CommandScheduleReport = 108
+)
+
+const (
+	ScheduleApplied  = "applied"
+	ScheduleRejected = "rejected"
+)
+
+// Schedule is the weekly plan of the controllers of an agent, the agent
+// follows it on its own once it lost the server for a while. The version is
+// assigned by the server and only grows.
+type Schedule struct {
+	Version int             `json:"version"`
+	Entries []ScheduleEntry `json:"entries" validate:"dive"`
+}
+
+// ScheduleEntry is a settings command the agent writes every week on Day at
+// Time of its local clock. Command is 1 for a temperature or 3 or 4 for the
+// ventilation module, Data is the body the command endpoint takes for it.
+type ScheduleEntry struct {
+	// Day counts from Sunday, 0, as time.Weekday does.
+	Day int `json:"day" validate:"gte=0,lte=6"`
+	// Time is "15:04".
+	Time    string          `json:"time" validate:"required"`
+	Command int             `json:"command" validate:"oneof=1 3 4"`
+	Data    json.RawMessage `json:"data" validate:"required"`
+}
+
+// Minute returns the time of the entry in minutes since midnight.
+func (e ScheduleEntry) Minute() (int, error) {
+	t, err := time.Parse("15:04", e.Time)
+	if err != nil {
+		return 0, fmt.Errorf("time %q is not HH:MM", e.Time)
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+type ScheduleStatus struct {
+	Version int    `json:"version"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ScheduledAction is an entry the agent wrote while it was offline and how
+// the controller took it, Status is the final ack.
+type ScheduledAction struct {
+	ScheduleEntry
+	At     time.Time `json:"at"`
+	Status string    `json:"status"`
+	Error  string    `json:"error,omitempty"`
+}
+
+type ScheduleReport struct {
+	Version int               `json:"version"`
+	Actions []ScheduledAction `json:"actions"`
+}
+
+// ScheduleState is the schedule the server wants an agent to follow, what
+// the agent reported last and the actions it took by it.
+type ScheduleState struct {
+	Desired    *Schedule         `json:"desired,omitempty"`
+	Reported   *ScheduleStatus   `json:"reported,omitempty"`
+	ReportedAt time.Time         `json:"reported_at"`
+	Actions    []ScheduledAction `json:"actions,omitempty"`
+}
+
+// CommandDeviceStatus is sent by the agent when a controller on its bus
+// falls silent and when it talks again.
+const CommandDeviceStatus = 109
+
+const (
+	DeviceSilent     = "silent"
+	DeviceResponding = "responding"
+)
+
+type DeviceStatus struct {
+	BusAddress int32  `json:"bus_address"`
+	Status     string `json:"status"`
+	// LastSeen is when the controller sent anything last, zero if it never
+	// did since the agent started.
+	LastSeen time.Time `json:"last_seen"`
+	// Late lists the commands the controller is overdue with.
+	Late []int `json:"late,omitempty"`
+}
+
+// DeviceState is what the server knows about a controller of an agent, the
+// values of its zones are stale while it is silent.
+type DeviceState struct {
+	DeviceStatus
+	Zones      []int32   `json:"zones"`
+	Stale      bool      `json:"stale"`
+	ReportedAt time.Time `json:"reported_at"`
+}
+
+// CommandSnapshot is sent to a mobile client right after it connects with
+// the last message of each kind the agent sent, the app shows them until
+// fresh ones come.
+const CommandSnapshot = 110
+
+// CachedMessage is a message of the agent as mobile clients got it. At is
+// when the agent read it from the controller, or when the server got it.
+type CachedMessage struct {
+	Message json.RawMessage `json:"message"`
+	At      time.Time       `json:"at"`
+	// Stale is set when the agent is not connected, the controller is
+	// silent or the telemetry is old.
+	Stale bool `json:"stale"`
+}
+
+type Snapshot struct {
+	SerialNumber int             `json:"serial_number"`
+	Connected    bool            `json:"connected"`
+	At           time.Time       `json:"at"`
+	Messages     []CachedMessage `json:"messages"`
+}
+
+// ZoneSettings are the settings of a zone of a controller, settings that
+// are not known are left out. TypeRegulation is as the controllers report
+// it, one less than the type command 2 writes.
+type ZoneSettings struct {
+	Zone             int32    `json:"zone"`
+	Setpoint         *float32 `json:"setpoint,omitempty"`
+	TypeRegulation   *uint8   `json:"type_regulation,omitempty"`
+	VentSpeed        *int16   `json:"vent_speed,omitempty"`
+	HumiditySetpoint *float32 `json:"humidity_setpoint,omitempty"`
+	Hysteresis       *uint8   `json:"hysteresis,omitempty"`
+}
+
+// ModuleSettings are the settings of the ventilation module of a
+// controller.
+type ModuleSettings struct {
+	Delta                                  uint8 `json:"delta"`
+	TypeRegulation                         uint8 `json:"type_regulation"`
+	IntervalTimeVentilationDampers         uint8 `json:"interval_time_ventilation_dampers"`
+	VentilationPeriodAfterCO2ReductionTime uint8 `json:"ventilation_period_after_co_2_reduction_time"`
+}
+
+// ControllerSettings are the settings of a controller on the bus of an
+// agent. Bus address 0 is the first controller of the agent.
+type ControllerSettings struct {
+	BusAddress int32           `json:"bus_address"`
+	Module     *ModuleSettings `json:"module,omitempty"`
+	Zones      []ZoneSettings  `json:"zones,omitempty"`
+	UpdatedAt  time.Time       `json:"updated_at"`
+}
+
+// Shadow is what the settings commands want the controllers of an agent
+// set to, what they reported from their tables and the desired settings
+// they do not report yet.
+type Shadow struct {
+	SerialNumber int                  `json:"serial_number"`
+	Desired      []ControllerSettings `json:"desired"`
+	Reported     []ControllerSettings `json:"reported"`
+	Delta        []ControllerSettings `json:"delta"`
+}
+
+// MobileCredential is what a mobile client greets the server with, it is
+// issued when the app is paired with the device. Key is hex.
+type MobileCredential struct {
+	SerialNumber int    `json:"serial_number"`
+	Client       string `json:"client" validate:"required,max=64"`
+	Key          string `json:"key,omitempty"`
+}
+
 type Response struct {
 	Status  int         `json:"status"`
 	Message string      `json:"message,omitempty"`
@@ -126,8 +439,16 @@ func (c *DataVentModule) GetType() int {
 }
 
 type Command struct {
-	TypeCommand int             `json:"command,omitempty"`
-	Data        json.RawMessage `json:"data,omitempty"`
+	TypeCommand int    `json:"command,omitempty"`
+	ID          string `json:"id,omitempty"`
+	// BusAddress is the controller on the agent's bus the command is for or
+	// the telemetry came from, telemetry the agent can not attribute to one
+	// controller comes without it.
+	BusAddress int32 `json:"bus_address,omitempty"`
+	// Timestamp is when the agent read the data from the controller, in
+	// unix milliseconds. Buffered telemetry arrives with its original time.
+	Timestamp int64           `json:"timestamp,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
 }
 
 func NewCommand(msg interface{}, types int) (*Command, error) {
@@ -149,23 +470,47 @@ func NewCommand(msg interface{}, types int) (*Command, error) {
 			typeCommand = 7
 		case DataCommandHumidityModule:
 			typeCommand = 8
+		case []DataCommandHumidityModule:
+			typeCommand = 8
+		case Ack:
+			typeCommand = CommandAck
+		case Health:
+			typeCommand = CommandHealth
+		case ConfigStatus:
+			typeCommand = CommandConfigStatus
+		case UpdateStatus:
+			typeCommand = CommandUpdateStatus
+		case ScheduleStatus:
+			typeCommand = CommandScheduleStatus
+		case ScheduleReport:
+			typeCommand = CommandScheduleReport
+		case DeviceStatus:
+			typeCommand = CommandDeviceStatus
 		default:
 			return nil, errors.New("not found command")
 		}
 	case 2: //входящие в устройство команды
 		switch msg.(type) {
-		case CommandTemperature:
+		case CommandTemperature, *CommandTemperature:
 			typeCommand = 1 //2.1
-		case CommandTemperatureBySensor:
+		case CommandTemperatureBySensor, *CommandTemperatureBySensor:
 			typeCommand = 2 // 2.2
-		case CommandDataVentModule:
+		case CommandDataVentModule, *CommandDataVentModule:
 			typeCommand = 3 // 4
-		case CommandDataVentByZone:
+		case CommandDataVentByZone, *CommandDataVentByZone:
 			typeCommand = 6
-		case CommandDataVentModuleForAll:
+		case CommandDataVentModuleForAll, *CommandDataVentModuleForAll:
 			typeCommand = 5
-		case CommandHysteresisOnHumidityModule:
+		case CommandHysteresisOnHumidityModule, *CommandHysteresisOnHumidityModule:
 			typeCommand = 9
+		case AgentConfig:
+			typeCommand = CommandConfig
+		case Release:
+			typeCommand = CommandRelease
+		case Schedule:
+			typeCommand = CommandSchedule
+		case Snapshot:
+			typeCommand = CommandSnapshot
 		default:
 			return nil, errors.New("not found command")
 		}
@@ -179,8 +524,8 @@ func NewCommand(msg interface{}, types int) (*Command, error) {
 	}
 
 	return &Command{
-		typeCommand,
-		data}, nil
+		TypeCommand: typeCommand,
+		Data:        data}, nil
 }
 
 //func (c *Command) MarshalJSON() ([]byte, error)  {
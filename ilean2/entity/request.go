@@ -0,0 +1,44 @@
+package entity
+
+import "math"
+
+// Request is the body of a settings command of the REST API.
+type Request interface {
+	GetTarget() Target
+}
+
+func (t Target) GetTarget() Target {
+	return t
+}
+
+// NewRequest returns an empty request to decode the body of command n into,
+// ok is false for unknown commands.
+func NewRequest(n int) (req Request, ok bool) {
+	switch n {
+	case 1:
+		return &CommandTemperature{}, true
+	case 2:
+		return &CommandTemperatureBySensor{}, true
+	case 3, 4:
+		return &CommandDataVentModule{}, true
+	case 5:
+		return &CommandDataVentModuleForAll{}, true
+	case 6:
+		return &CommandDataVentByZone{}, true
+	case 9:
+		return &CommandHysteresisOnHumidityModule{}, true
+	default:
+		return nil, false
+	}
+}
+
+// SetDefaults marks the values the client left out, the controller keeps
+// its current setting for them.
+func (c *CommandHysteresisOnHumidityModule) SetDefaults() {
+	if c.Humidity == 0.0 {
+		c.Humidity = math.MaxFloat32
+	}
+	if c.Hysteresis == 0 {
+		c.Hysteresis = math.MaxUint8
+	}
+}
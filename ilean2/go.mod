@@ -3,11 +3,15 @@ module iLean
 go 1.15
 
 require (
+	github.com/eclipse/paho.mqtt.golang v1.3.5
 	github.com/gin-gonic/gin v1.7.4
 	github.com/go-playground/validator/v10 v10.4.1
+	github.com/gofrs/uuid v4.0.0+incompatible
 	github.com/googollee/go-socket.io v1.6.1
 	github.com/gorilla/websocket v1.4.2
 	github.com/jacobsa/go-serial v0.0.0-20180131005756-15cf729a72d4
+	github.com/lib/pq v1.10.9
 	github.com/sirupsen/logrus v1.8.1
+	golang.org/x/net v0.0.0-20200625001655-4c5254603344
 	gopkg.in/yaml.v2 v2.2.8
 )
@@ -0,0 +1,24 @@
+package protocol
+
+import "testing"
+
+func TestCRC16(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want uint16
+	}{
+		{"empty", nil, 0xFFFF},
+		{"check value", []byte("123456789"), 0x29B1},
+		{"single byte", []byte{0x00}, 0xE1F0},
+		{"initial value cancelled", []byte{0xFF, 0xFF}, 0x0000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CRC16(tt.data); got != tt.want {
+				t.Errorf("CRC16(% x) = %04x, want %04x", tt.data, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// CRCError is returned for a frame whose checksum does not match, the frame
+// is dropped and decoding continues with the next call.
+type CRCError struct {
+	Frame    *Frame
+	Expected uint16
+}
+
+func (e *CRCError) Error() string {
+	return fmt.Sprintf("crc mismatch for command %d from %d: got %04x, expected %04x",
+		e.Frame.Command, e.Frame.Address, e.Frame.CRC, e.Expected)
+}
+
+// DecoderStats describes what the decoder had to throw away.
+type DecoderStats struct {
+	Frames       uint64
+	CRCErrors    uint64
+	Resyncs      uint64
+	SkippedBytes uint64
+}
+
+// Decoder reads frames from a byte stream. Bytes that do not start a valid
+// frame are skipped until the next preamble.
+type Decoder struct {
+	r       *bufio.Reader
+	stats   DecoderStats
+	syncing bool
+	// trailer is set after a table frame, the controller sends one more
+	// byte after their CRC.
+	trailer bool
+
+	match  func(buf []byte) int
+	handle func(msg []byte)
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{
+		r: bufio.NewReaderSize(r, len(Preamble)+lengthSize+MaxLength+crcSize),
+	}
+}
+
+// Share lets controllers of another protocol answer on the same line.
+// Before a frame is looked for, match is called with the buffered bytes: it
+// returns the length of a message of the other protocol at their start, 0
+// if there is none or -1 if it needs more bytes to tell. Matched messages
+// are passed to handle instead of being skipped.
+func (d *Decoder) Share(match func(buf []byte) int, handle func(msg []byte)) {
+	d.match = match
+	d.handle = handle
+}
+
+// Decode blocks until the next complete frame is read.
+func (d *Decoder) Decode() (*Frame, error) {
+	if d.trailer {
+		d.dropTrailer()
+	}
+
+	for {
+		if d.match != nil {
+			shared, err := d.shared()
+			if err != nil {
+				return nil, err
+			}
+
+			if shared {
+				continue
+			}
+		}
+
+		head, err := d.r.Peek(len(Preamble) + lengthSize)
+		if err != nil {
+			return nil, d.eof(err, len(head))
+		}
+
+		if !bytes.Equal(head[:len(Preamble)], Preamble) {
+			d.skip()
+			continue
+		}
+
+		length := binary.LittleEndian.Uint16(head[len(Preamble):])
+		if length < headerSize || length > MaxLength {
+			d.skip()
+			continue
+		}
+
+		raw, err := d.r.Peek(len(Preamble) + lengthSize + int(length) + crcSize)
+		if err != nil {
+			return nil, d.eof(err, len(raw))
+		}
+
+		frame := d.parse(raw)
+
+		if expected := frame.Checksum(); frame.CRC != expected {
+			d.stats.CRCErrors++
+			d.skip()
+
+			return nil, &CRCError{Frame: frame, Expected: expected}
+		}
+
+		d.r.Discard(len(raw))
+		d.stats.Frames++
+		d.syncing = false
+
+		switch frame.Command {
+		case CommandSetpointTable, CommandVentTable, CommandHumidityTable:
+			d.trailer = true
+		}
+
+		return frame, nil
+	}
+}
+
+// shared passes a message of the other protocol at the start of the buffer
+// to handle.
+func (d *Decoder) shared() (bool, error) {
+	for size := 1; size <= d.r.Size(); size++ {
+		buf, err := d.r.Peek(size)
+		if err != nil {
+			return false, d.eof(err, len(buf))
+		}
+
+		n := d.match(buf)
+		if n == 0 {
+			return false, nil
+		}
+
+		if n > 0 {
+			msg := append([]byte(nil), buf[:n]...)
+			d.r.Discard(n)
+			d.syncing = false
+			d.handle(msg)
+
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// dropTrailer drops the byte a table frame ends with unless a preamble
+// follows right away, it is neither skipped nor a resync. Errors are left
+// for the next read to report.
+func (d *Decoder) dropTrailer() {
+	buf, _ := d.r.Peek(len(Preamble))
+	if len(buf) == 0 {
+		return
+	}
+
+	d.trailer = false
+	if !bytes.HasPrefix(Preamble, buf) {
+		d.r.Discard(1)
+	}
+}
+
+// Stats returns counters collected since the decoder was created.
+func (d *Decoder) Stats() DecoderStats {
+	return d.stats
+}
+
+func (d *Decoder) parse(raw []byte) *Frame {
+	body := raw[len(Preamble)+lengthSize : len(raw)-crcSize]
+
+	frame := &Frame{
+		Length:  binary.LittleEndian.Uint16(raw[len(Preamble):]),
+		Address: int32(binary.LittleEndian.Uint32(body)),
+		Command: body[4],
+		Payload: append([]byte(nil), body[headerSize:]...),
+		CRC:     binary.LittleEndian.Uint16(raw[len(raw)-crcSize:]),
+	}
+
+	return frame
+}
+
+// skip drops one byte, every run of skipped bytes counts as one resync.
+func (d *Decoder) skip() {
+	d.r.Discard(1)
+	d.stats.SkippedBytes++
+
+	if !d.syncing {
+		d.syncing = true
+		d.stats.Resyncs++
+	}
+}
+
+// eof keeps io.EOF for a clean end of stream and reports a frame cut in the
+// middle as io.ErrUnexpectedEOF.
+func (d *Decoder) eof(err error, buffered int) error {
+	if err == io.EOF && buffered > 0 {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
@@ -0,0 +1,237 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func encode(t *testing.T, frames ...*Frame) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	for _, f := range frames {
+		if err := enc.Encode(f); err != nil {
+			t.Fatalf("encode %v: %v", f, err)
+		}
+	}
+
+	return buf.Bytes()
+}
+
+func telemetry(t *testing.T, zone int32) *Frame {
+	t.Helper()
+
+	payload, err := Marshal(Telemetry{TempAir: 21.5, HumidityAir: 40, TempFloor: 20, CO2: 600})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewFrame(zone, CommandTelemetry, payload)
+}
+
+func setpointTable(t *testing.T, address int32) *Frame {
+	t.Helper()
+
+	rows := make([]SetpointRow, SetpointTableRows)
+	rows[0] = SetpointRow{Zone: 1, Setpoint: 23, TypeRegulation: 1}
+
+	payload, err := Marshal(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewFrame(address, CommandSetpointTable, payload)
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame func(t *testing.T) *Frame
+	}{
+		{"telemetry", func(t *testing.T) *Frame { return telemetry(t, 3) }},
+		{"setpoint table", func(t *testing.T) *Frame { return setpointTable(t, 101) }},
+		{"empty payload", func(t *testing.T) *Frame { return NewFrame(101, CommandSetVentByZone, nil) }},
+		{"negative address", func(t *testing.T) *Frame { return NewFrame(-1, CommandVentModule, []byte{1, 2, 3}) }},
+		{"max length", func(t *testing.T) *Frame {
+			return NewFrame(101, CommandSetTemperature, bytes.Repeat([]byte{0x55}, MaxLength-headerSize))
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := tt.frame(t)
+
+			dec := NewDecoder(bytes.NewReader(encode(t, want)))
+
+			got, err := dec.Decode()
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("decoded %v, want %v", got, want)
+			}
+
+			if _, err := dec.Decode(); err != io.EOF {
+				t.Errorf("decode after the frame: %v, want io.EOF", err)
+			}
+
+			if stats := dec.Stats(); stats != (DecoderStats{Frames: 1}) {
+				t.Errorf("stats %+v", stats)
+			}
+		})
+	}
+}
+
+func TestEncodeFillsCRC(t *testing.T) {
+	frame := telemetry(t, 1)
+	frame.CRC = 0
+
+	raw := encode(t, frame)
+
+	crc := uint16(raw[len(raw)-2]) | uint16(raw[len(raw)-1])<<8
+	if want := CRC16(raw[len(Preamble) : len(raw)-crcSize]); crc != want {
+		t.Errorf("crc %04x, want %04x", crc, want)
+	}
+}
+
+func TestDecodeResync(t *testing.T) {
+	tests := []struct {
+		name    string
+		garbage []byte
+	}{
+		{"noise", []byte{0x01, 0x02, 0x03}},
+		{"partial preamble", []byte{0x55, 0xAA, 0x55}},
+		{"length too large", append(append([]byte(nil), Preamble...), 0xFF, 0xFF)},
+		{"length too small", append(append([]byte(nil), Preamble...), headerSize-1, 0x00)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := telemetry(t, 1)
+			stream := append(append([]byte(nil), tt.garbage...), encode(t, want)...)
+
+			dec := NewDecoder(bytes.NewReader(stream))
+
+			got, err := dec.Decode()
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("decoded %v, want %v", got, want)
+			}
+
+			wantStats := DecoderStats{Frames: 1, Resyncs: 1, SkippedBytes: uint64(len(tt.garbage))}
+			if stats := dec.Stats(); stats != wantStats {
+				t.Errorf("stats %+v, want %+v", stats, wantStats)
+			}
+		})
+	}
+}
+
+func TestDecodeCRCError(t *testing.T) {
+	bad := encode(t, telemetry(t, 1))
+	bad[len(bad)-1] ^= 0xFF
+
+	good := telemetry(t, 2)
+	dec := NewDecoder(bytes.NewReader(append(bad, encode(t, good)...)))
+
+	_, err := dec.Decode()
+
+	var crcErr *CRCError
+	if !errors.As(err, &crcErr) {
+		t.Fatalf("decode: %v, want a *CRCError", err)
+	}
+
+	if crcErr.Frame.Address != 1 || crcErr.Expected != crcErr.Frame.Checksum() || crcErr.Frame.CRC == crcErr.Expected {
+		t.Errorf("crc error %v", crcErr)
+	}
+
+	got, err := dec.Decode()
+	if err != nil {
+		t.Fatalf("decode after the bad frame: %v", err)
+	}
+
+	if !reflect.DeepEqual(got, good) {
+		t.Errorf("decoded %v, want %v", got, good)
+	}
+
+	want := DecoderStats{Frames: 1, CRCErrors: 1, Resyncs: 1, SkippedBytes: uint64(len(bad))}
+	if stats := dec.Stats(); stats != want {
+		t.Errorf("stats %+v, want %+v", stats, want)
+	}
+}
+
+func TestDecodeTableTrailer(t *testing.T) {
+	table := setpointTable(t, 101)
+	next := telemetry(t, 1)
+
+	tests := []struct {
+		name   string
+		stream []byte
+		frames int
+	}{
+		{"trailer", concat(encode(t, table), []byte{0x00}, encode(t, next)), 2},
+		{"trailer like a preamble byte", concat(encode(t, table), []byte{0x55}, encode(t, next)), 2},
+		{"no trailer", encode(t, table, next), 2},
+		{"trailer at the end", concat(encode(t, table), []byte{0x00}), 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dec := NewDecoder(bytes.NewReader(tt.stream))
+
+			for i := 0; i < tt.frames; i++ {
+				if _, err := dec.Decode(); err != nil {
+					t.Fatalf("decode frame %d: %v", i, err)
+				}
+			}
+
+			if _, err := dec.Decode(); err != io.EOF {
+				t.Errorf("decode at the end: %v, want io.EOF", err)
+			}
+
+			if stats := dec.Stats(); stats != (DecoderStats{Frames: uint64(tt.frames)}) {
+				t.Errorf("stats %+v", stats)
+			}
+		})
+	}
+}
+
+func TestDecodeEOF(t *testing.T) {
+	raw := encode(t, telemetry(t, 1))
+
+	tests := []struct {
+		name   string
+		stream []byte
+		want   error
+	}{
+		{"empty", nil, io.EOF},
+		{"cut in the header", raw[:len(Preamble)+1], io.ErrUnexpectedEOF},
+		{"cut in the payload", raw[:len(raw)-3], io.ErrUnexpectedEOF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewDecoder(bytes.NewReader(tt.stream)).Decode()
+			if err != tt.want {
+				t.Errorf("decode: %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func concat(parts ...[]byte) []byte {
+	var out []byte
+	for _, part := range parts {
+		out = append(out, part...)
+	}
+
+	return out
+}
@@ -0,0 +1,27 @@
+package protocol
+
+import "io"
+
+// Encoder writes frames to the controller.
+type Encoder struct {
+	w io.Writer
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode fills in the CRC and writes the whole frame with a single Write
+// call so frames from concurrent writers never interleave on the line.
+func (e *Encoder) Encode(f *Frame) error {
+	f.CRC = f.Checksum()
+
+	raw, err := f.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	_, err = e.w.Write(raw)
+
+	return err
+}
@@ -0,0 +1,100 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Preamble opens every frame on the UART line.
+var Preamble = []byte{0x55, 0xAA, 0x55, 0xAA}
+
+const (
+	// headerSize is the size of the address and command fields that are
+	// counted by the length field together with the payload.
+	headerSize = 5
+
+	lengthSize = 2
+	crcSize    = 2
+
+	// MaxLength bounds the length field, anything above is treated as garbage.
+	MaxLength = 512
+)
+
+// Commands understood by the controller.
+const (
+	CommandTelemetry      uint8 = 0
+	CommandSetpointTable  uint8 = 1
+	CommandSetTemperature uint8 = 2
+	CommandVentTable      uint8 = 3
+	CommandSetVentModule  uint8 = 4
+	CommandSetVentForAll  uint8 = 5
+	CommandSetVentByZone  uint8 = 6
+	CommandVentModule     uint8 = 7
+	CommandHumidityTable  uint8 = 8
+)
+
+// Frame is a single message exchanged with the controller:
+//
+//	55 AA 55 AA | length u16 | address i32 | command u8 | payload | crc u16
+//
+// All numbers are little endian, length counts address, command and payload.
+// The CRC covers everything between the preamble and the CRC itself.
+type Frame struct {
+	Length  uint16
+	Address int32
+	Command uint8
+	Payload []byte
+	CRC     uint16
+}
+
+// NewFrame builds a frame with the length and CRC fields filled in.
+func NewFrame(address int32, command uint8, payload []byte) *Frame {
+	frame := &Frame{
+		Length:  uint16(headerSize + len(payload)),
+		Address: address,
+		Command: command,
+		Payload: payload,
+	}
+	frame.CRC = frame.Checksum()
+
+	return frame
+}
+
+// Checksum computes the CRC the frame should carry.
+func (f *Frame) Checksum() uint16 {
+	raw := make([]byte, lengthSize+headerSize, lengthSize+headerSize+len(f.Payload))
+	binary.LittleEndian.PutUint16(raw, f.Length)
+	binary.LittleEndian.PutUint32(raw[lengthSize:], uint32(f.Address))
+	raw[lengthSize+4] = f.Command
+
+	return CRC16(append(raw, f.Payload...))
+}
+
+// MarshalBinary returns the frame as it is sent on the wire.
+func (f *Frame) MarshalBinary() ([]byte, error) {
+	if int(f.Length) != headerSize+len(f.Payload) {
+		return nil, fmt.Errorf("frame length %d does not match payload of %d bytes", f.Length, len(f.Payload))
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(Preamble)+lengthSize+int(f.Length)+crcSize))
+	buf.Write(Preamble)
+
+	for _, v := range []interface{}{f.Length, f.Address, f.Command} {
+		if err := binary.Write(buf, binary.LittleEndian, v); err != nil {
+			return nil, err
+		}
+	}
+
+	buf.Write(f.Payload)
+
+	if err := binary.Write(buf, binary.LittleEndian, f.CRC); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (f *Frame) String() string {
+	return fmt.Sprintf("frame{address: %d, command: %d, payload: % x, crc: %04x}", f.Address, f.Command, f.Payload, f.CRC)
+}
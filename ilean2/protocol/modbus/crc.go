@@ -0,0 +1,20 @@
+package modbus
+
+// CRC16 computes the CRC-16/MODBUS of b, it goes on the line low byte
+// first.
+func CRC16(b []byte) uint16 {
+	crc := uint16(0xFFFF)
+
+	for _, v := range b {
+		crc ^= uint16(v)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+
+	return crc
+}
@@ -0,0 +1,177 @@
+package modbus
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Function codes used by the agent.
+const (
+	ReadHoldingRegisters   uint8 = 0x03
+	ReadInputRegisters     uint8 = 0x04
+	WriteSingleRegister    uint8 = 0x06
+	WriteMultipleRegisters uint8 = 0x10
+
+	exceptionFlag uint8 = 0x80
+)
+
+const (
+	// MaxSlave is the highest address a slave may have on the line.
+	MaxSlave = 247
+
+	// MaxRead is how many registers one request may read.
+	MaxRead = 125
+
+	crcSize = 2
+)
+
+// Request is sent by the master, the agent, to one slave:
+//
+//	slave u8 | function u8 | data | crc u16
+//
+// Addresses and values in the data are big endian, the CRC is little endian.
+type Request struct {
+	Slave    uint8
+	Function uint8
+	Address  uint16
+	// Count is how many registers are read, writes take it from Values.
+	Count  uint16
+	Values []uint16
+}
+
+// MarshalBinary returns the request as it is sent on the wire.
+func (r Request) MarshalBinary() ([]byte, error) {
+	raw := []byte{r.Slave, r.Function}
+
+	switch r.Function {
+	case ReadHoldingRegisters, ReadInputRegisters:
+		if r.Count == 0 || r.Count > MaxRead {
+			return nil, fmt.Errorf("read of %d registers", r.Count)
+		}
+
+		raw = appendUint16(raw, r.Address, r.Count)
+	case WriteSingleRegister:
+		if len(r.Values) != 1 {
+			return nil, fmt.Errorf("single write of %d registers", len(r.Values))
+		}
+
+		raw = appendUint16(raw, r.Address, r.Values[0])
+	case WriteMultipleRegisters:
+		if len(r.Values) == 0 || len(r.Values) > MaxRead {
+			return nil, fmt.Errorf("write of %d registers", len(r.Values))
+		}
+
+		raw = appendUint16(raw, r.Address, uint16(len(r.Values)))
+		raw = append(raw, byte(2*len(r.Values)))
+		raw = appendUint16(raw, r.Values...)
+	default:
+		return nil, fmt.Errorf("unsupported function %#02x", r.Function)
+	}
+
+	crc := CRC16(raw)
+
+	return append(raw, byte(crc), byte(crc>>8)), nil
+}
+
+// Match returns the length of the response to r at the start of buf, 0 if
+// buf does not start one and -1 if more bytes are needed to tell.
+func (r Request) Match(buf []byte) int {
+	if len(buf) < 1 || buf[0] != r.Slave {
+		return 0
+	}
+
+	if len(buf) < 2 {
+		return -1
+	}
+
+	var length int
+
+	switch buf[1] {
+	case r.Function | exceptionFlag:
+		length = 3 + crcSize
+	case r.Function:
+		switch r.Function {
+		case ReadHoldingRegisters, ReadInputRegisters:
+			if len(buf) < 3 {
+				return -1
+			}
+
+			if int(buf[2]) != 2*int(r.Count) {
+				return 0
+			}
+
+			length = 3 + int(buf[2]) + crcSize
+		default:
+			length = 6 + crcSize
+		}
+	default:
+		return 0
+	}
+
+	if len(buf) < length {
+		return -1
+	}
+
+	if CRC16(buf[:length-crcSize]) != binary.LittleEndian.Uint16(buf[length-crcSize:]) {
+		return 0
+	}
+
+	return length
+}
+
+// Exception is the answer of a slave that refused a request.
+type Exception struct {
+	Function uint8
+	Code     uint8
+}
+
+func (e *Exception) Error() string {
+	return fmt.Sprintf("slave refused function %#02x with exception %d", e.Function, e.Code)
+}
+
+// ParseResponse returns the registers read by r from a response Match
+// accepted, writes return none.
+func (r Request) ParseResponse(raw []byte) ([]uint16, error) {
+	if r.Match(raw) != len(raw) {
+		return nil, fmt.Errorf("not a response to function %#02x of slave %d", r.Function, r.Slave)
+	}
+
+	if raw[1] == r.Function|exceptionFlag {
+		return nil, &Exception{Function: r.Function, Code: raw[2]}
+	}
+
+	data := raw[2 : len(raw)-crcSize]
+
+	switch r.Function {
+	case ReadHoldingRegisters, ReadInputRegisters:
+		values := make([]uint16, r.Count)
+		for i := range values {
+			values[i] = binary.BigEndian.Uint16(data[1+2*i:])
+		}
+
+		return values, nil
+	case WriteSingleRegister:
+		if binary.BigEndian.Uint16(data) != r.Address || binary.BigEndian.Uint16(data[2:]) != r.Values[0] {
+			return nil, fmt.Errorf("slave %d echoed another write", r.Slave)
+		}
+	default:
+		if binary.BigEndian.Uint16(data) != r.Address || int(binary.BigEndian.Uint16(data[2:])) != len(r.Values) {
+			return nil, fmt.Errorf("slave %d confirmed another write", r.Slave)
+		}
+	}
+
+	return nil, nil
+}
+
+func (r Request) String() string {
+	return fmt.Sprintf("modbus{slave: %d, function: %#02x, address: %d, count: %d, values: %v}",
+		r.Slave, r.Function, r.Address, r.Count, r.Values)
+}
+
+func appendUint16(b []byte, values ...uint16) []byte {
+	for _, v := range values {
+		b = append(b, byte(v>>8), byte(v))
+	}
+
+	return b
+}
@@ -0,0 +1,130 @@
+package modbus
+
+import (
+	"bytes"
+	"testing"
+)
+
+// withCRC appends the CRC the way a slave sends it.
+func withCRC(b ...byte) []byte {
+	crc := CRC16(b)
+	return append(b, byte(crc), byte(crc>>8))
+}
+
+func TestMarshalBinary(t *testing.T) {
+	tests := []struct {
+		name    string
+		request Request
+		want    []byte
+	}{
+		{
+			name:    "read holding",
+			request: Request{Slave: 1, Function: ReadHoldingRegisters, Address: 0, Count: 10},
+			want:    []byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x0a, 0xc5, 0xcd},
+		},
+		{
+			name:    "write single",
+			request: Request{Slave: 17, Function: WriteSingleRegister, Address: 1, Values: []uint16{3}},
+			want:    withCRC(0x11, 0x06, 0x00, 0x01, 0x00, 0x03),
+		},
+		{
+			name:    "write multiple",
+			request: Request{Slave: 17, Function: WriteMultipleRegisters, Address: 1, Values: []uint16{0x000a, 0x0102}},
+			want:    withCRC(0x11, 0x10, 0x00, 0x01, 0x00, 0x02, 0x04, 0x00, 0x0a, 0x01, 0x02),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.request.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("got % x, want % x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarshalBinaryInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		request Request
+	}{
+		{"read nothing", Request{Slave: 1, Function: ReadHoldingRegisters}},
+		{"read too much", Request{Slave: 1, Function: ReadInputRegisters, Count: MaxRead + 1}},
+		{"single write of two", Request{Slave: 1, Function: WriteSingleRegister, Values: []uint16{1, 2}}},
+		{"write nothing", Request{Slave: 1, Function: WriteMultipleRegisters}},
+		{"unknown function", Request{Slave: 1, Function: 0x2b}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.request.MarshalBinary(); err == nil {
+				t.Error("marshaled an invalid request")
+			}
+		})
+	}
+}
+
+func TestMatch(t *testing.T) {
+	read := Request{Slave: 1, Function: ReadHoldingRegisters, Address: 100, Count: 2}
+	response := withCRC(0x01, 0x03, 0x04, 0x00, 0xd7, 0xff, 0xff)
+
+	broken := append([]byte(nil), response...)
+	broken[len(broken)-1] ^= 0xff
+
+	tests := []struct {
+		name string
+		buf  []byte
+		want int
+	}{
+		{"response", response, len(response)},
+		{"response and more", append(append([]byte(nil), response...), 0x55, 0xaa), len(response)},
+		{"partial", response[:5], -1},
+		{"slave only", response[:1], -1},
+		{"other slave", withCRC(0x02, 0x03, 0x04, 0, 0, 0, 0), 0},
+		{"other count", withCRC(0x01, 0x03, 0x02, 0, 0), 0},
+		{"broken crc", broken, 0},
+		{"exception", withCRC(0x01, 0x83, 0x02), 5},
+		{"frame protocol", []byte{0x55, 0xaa, 0x01}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := read.Match(tt.buf); got != tt.want {
+				t.Errorf("match = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseResponse(t *testing.T) {
+	read := Request{Slave: 1, Function: ReadHoldingRegisters, Address: 100, Count: 2}
+
+	values, err := read.ParseResponse(withCRC(0x01, 0x03, 0x04, 0x00, 0xd7, 0xff, 0xff))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(values) != 2 || values[0] != 215 || values[1] != 0xffff {
+		t.Errorf("values = %v, want [215 65535]", values)
+	}
+
+	_, err = read.ParseResponse(withCRC(0x01, 0x83, 0x02))
+	if e, ok := err.(*Exception); !ok || e.Code != 2 {
+		t.Errorf("exception = %v, want code 2", err)
+	}
+
+	write := Request{Slave: 1, Function: WriteSingleRegister, Address: 100, Values: []uint16{215}}
+
+	if _, err := write.ParseResponse(withCRC(0x01, 0x06, 0x00, 0x64, 0x00, 0xd7)); err != nil {
+		t.Errorf("echo of the write: %v", err)
+	}
+
+	if _, err := write.ParseResponse(withCRC(0x01, 0x06, 0x00, 0x64, 0x00, 0xd8)); err == nil {
+		t.Error("took the echo of another value")
+	}
+}
@@ -0,0 +1,427 @@
+package modbus
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Register tables, holding registers can be written.
+const (
+	TableHolding = "holding"
+	TableInput   = "input"
+)
+
+// Register types, 32 bit values take two registers with the high word
+// first.
+const (
+	TypeUint16  = "uint16"
+	TypeInt16   = "int16"
+	TypeUint32  = "uint32"
+	TypeInt32   = "int32"
+	TypeFloat32 = "float32"
+)
+
+// Register is a value of the controller. The value is the register content
+// times Scale, e.g. a temperature kept in tenths of a degree has scale 0.1.
+type Register struct {
+	// Table is holding by default.
+	Table   string `yaml:"table"`
+	Address uint16 `yaml:"register"`
+	// Type is uint16 by default.
+	Type  string  `yaml:"type"`
+	Scale float64 `yaml:"scale"`
+}
+
+func (r *Register) table() string {
+	if r.Table == "" {
+		return TableHolding
+	}
+
+	return r.Table
+}
+
+func (r *Register) kind() string {
+	if r.Type == "" {
+		return TypeUint16
+	}
+
+	return r.Type
+}
+
+func (r *Register) scale() float64 {
+	if r.Scale == 0 {
+		return 1
+	}
+
+	return r.Scale
+}
+
+// size is how many registers the value takes.
+func (r *Register) size() int {
+	switch r.kind() {
+	case TypeUint32, TypeInt32, TypeFloat32:
+		return 2
+	}
+
+	return 1
+}
+
+func (r *Register) validate() error {
+	if r.table() != TableHolding && r.table() != TableInput {
+		return fmt.Errorf("unknown table %q", r.Table)
+	}
+
+	switch r.kind() {
+	case TypeUint16, TypeInt16, TypeUint32, TypeInt32, TypeFloat32:
+	default:
+		return fmt.Errorf("unknown type %q", r.Type)
+	}
+
+	if int(r.Address)+r.size() > math.MaxUint16+1 {
+		return fmt.Errorf("register %d is out of range", r.Address)
+	}
+
+	if r.Scale < 0 {
+		return errors.New("scale is negative")
+	}
+
+	return nil
+}
+
+// Read returns the value of the register from what was polled.
+func (r *Register) Read(values Values) (float64, bool) {
+	words := make([]uint16, r.size())
+	for i := range words {
+		word, ok := values[valueKey{table: r.table(), address: r.Address + uint16(i)}]
+		if !ok {
+			return 0, false
+		}
+
+		words[i] = word
+	}
+
+	var v float64
+
+	switch r.kind() {
+	case TypeUint16:
+		v = float64(words[0])
+	case TypeInt16:
+		v = float64(int16(words[0]))
+	case TypeUint32:
+		v = float64(uint32(words[0])<<16 | uint32(words[1]))
+	case TypeInt32:
+		v = float64(int32(uint32(words[0])<<16 | uint32(words[1])))
+	case TypeFloat32:
+		v = float64(math.Float32frombits(uint32(words[0])<<16 | uint32(words[1])))
+	}
+
+	return v * r.scale(), true
+}
+
+// Write returns the request that sets the register to value.
+func (r *Register) Write(slave uint8, value float64) (Request, error) {
+	if r.table() != TableHolding {
+		return Request{}, fmt.Errorf("%s register %d can not be written", r.table(), r.Address)
+	}
+
+	raw := value / r.scale()
+	rounded := math.Round(raw)
+
+	var words []uint16
+
+	switch r.kind() {
+	case TypeUint16:
+		if rounded < 0 || rounded > math.MaxUint16 {
+			return Request{}, fmt.Errorf("%v does not fit register %d", value, r.Address)
+		}
+
+		words = []uint16{uint16(rounded)}
+	case TypeInt16:
+		if rounded < math.MinInt16 || rounded > math.MaxInt16 {
+			return Request{}, fmt.Errorf("%v does not fit register %d", value, r.Address)
+		}
+
+		words = []uint16{uint16(int16(rounded))}
+	case TypeUint32:
+		if rounded < 0 || rounded > math.MaxUint32 {
+			return Request{}, fmt.Errorf("%v does not fit register %d", value, r.Address)
+		}
+
+		words = splitUint32(uint32(rounded))
+	case TypeInt32:
+		if rounded < math.MinInt32 || rounded > math.MaxInt32 {
+			return Request{}, fmt.Errorf("%v does not fit register %d", value, r.Address)
+		}
+
+		words = splitUint32(uint32(int32(rounded)))
+	case TypeFloat32:
+		words = splitUint32(math.Float32bits(float32(raw)))
+	}
+
+	if len(words) == 1 {
+		return Request{Slave: slave, Function: WriteSingleRegister, Address: r.Address, Values: words}, nil
+	}
+
+	return Request{Slave: slave, Function: WriteMultipleRegisters, Address: r.Address, Values: words}, nil
+}
+
+func splitUint32(v uint32) []uint16 {
+	return []uint16{uint16(v >> 16), uint16(v)}
+}
+
+// Values holds the registers read from a slave.
+type Values map[valueKey]uint16
+
+type valueKey struct {
+	table   string
+	address uint16
+}
+
+// Add stores the registers returned for a read request.
+func (v Values) Add(request Request, words []uint16) {
+	table := TableHolding
+	if request.Function == ReadInputRegisters {
+		table = TableInput
+	}
+
+	for i, word := range words {
+		v[valueKey{table: table, address: request.Address + uint16(i)}] = word
+	}
+}
+
+// Module holds the registers of the ventilation module, they match the
+// settings of commands 3, 4 and 5.
+type Module struct {
+	Delta                                  *Register `yaml:"delta"`
+	TypeRegulation                         *Register `yaml:"type_regulation"`
+	IntervalTimeVentilationDampers         *Register `yaml:"interval_time_ventilation_dampers"`
+	VentilationPeriodAfterCO2ReductionTime *Register `yaml:"ventilation_period_after_co_2_reduction_time"`
+	// Zone selects the zone the ventilation follows, it is set by command 6.
+	Zone *Register `yaml:"zone"`
+}
+
+// Zone holds the registers of one zone, values without a register are not
+// reported and commands that need them are refused.
+type Zone struct {
+	Zone        int32     `yaml:"zone"`
+	TempAir     *Register `yaml:"temp_air"`
+	HumidityAir *Register `yaml:"humidity_air"`
+	TempFloor   *Register `yaml:"temp_floor"`
+	CO2         *Register `yaml:"co2"`
+
+	Setpoint         *Register `yaml:"setpoint"`
+	TypeRegulation   *Register `yaml:"type_regulation"`
+	VentSpeed        *Register `yaml:"vent_speed"`
+	HumiditySetpoint *Register `yaml:"humidity_setpoint"`
+	Hysteresis       *Register `yaml:"hysteresis"`
+}
+
+// Map tells where a controller keeps the values the agent reports and the
+// settings the server changes.
+type Map struct {
+	// Poll is how often the registers are read.
+	Poll time.Duration `yaml:"poll"`
+	// Timeout is how long the controller has to answer a request.
+	Timeout time.Duration `yaml:"timeout"`
+	Module  Module        `yaml:"module"`
+	Zones   []Zone        `yaml:"zones"`
+}
+
+// Zone returns the registers of a zone.
+func (m *Map) Zone(zone int32) (*Zone, bool) {
+	for i := range m.Zones {
+		if m.Zones[i].Zone == zone {
+			return &m.Zones[i], true
+		}
+	}
+
+	return nil, false
+}
+
+func (m *Map) Validate() error {
+	if m.Poll <= 0 {
+		return errors.New("poll must be positive")
+	}
+
+	if m.Timeout <= 0 {
+		return errors.New("timeout must be positive")
+	}
+
+	check := func(name string, r *Register, writable bool) error {
+		if r == nil {
+			return nil
+		}
+
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+
+		if writable && r.table() != TableHolding {
+			return fmt.Errorf("%s must be a holding register", name)
+		}
+
+		return nil
+	}
+
+	module := []struct {
+		name string
+		r    *Register
+	}{
+		{"module.delta", m.Module.Delta},
+		{"module.type_regulation", m.Module.TypeRegulation},
+		{"module.interval_time_ventilation_dampers", m.Module.IntervalTimeVentilationDampers},
+		{"module.ventilation_period_after_co_2_reduction_time", m.Module.VentilationPeriodAfterCO2ReductionTime},
+		{"module.zone", m.Module.Zone},
+	}
+
+	for _, v := range module {
+		if err := check(v.name, v.r, true); err != nil {
+			return err
+		}
+	}
+
+	zones := make(map[int32]bool, len(m.Zones))
+	for i, z := range m.Zones {
+		if z.Zone < 1 {
+			return fmt.Errorf("zones[%d].zone is empty", i)
+		}
+
+		if zones[z.Zone] {
+			return fmt.Errorf("zones[%d].zone: duplicate zone %d", i, z.Zone)
+		}
+
+		zones[z.Zone] = true
+
+		registers := []struct {
+			name     string
+			r        *Register
+			writable bool
+		}{
+			{"temp_air", z.TempAir, false},
+			{"humidity_air", z.HumidityAir, false},
+			{"temp_floor", z.TempFloor, false},
+			{"co2", z.CO2, false},
+			{"setpoint", z.Setpoint, true},
+			{"type_regulation", z.TypeRegulation, true},
+			{"vent_speed", z.VentSpeed, true},
+			{"humidity_setpoint", z.HumiditySetpoint, true},
+			{"hysteresis", z.Hysteresis, true},
+		}
+
+		for _, v := range registers {
+			if err := check(fmt.Sprintf("zones[%d].%s", i, v.name), v.r, v.writable); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(m.registers()) == 0 {
+		return errors.New("no registers")
+	}
+
+	return nil
+}
+
+func (m *Map) registers() []*Register {
+	var registers []*Register
+
+	add := func(rs ...*Register) {
+		for _, r := range rs {
+			if r != nil {
+				registers = append(registers, r)
+			}
+		}
+	}
+
+	add(m.Module.Delta, m.Module.TypeRegulation, m.Module.IntervalTimeVentilationDampers,
+		m.Module.VentilationPeriodAfterCO2ReductionTime, m.Module.Zone)
+
+	for _, z := range m.Zones {
+		add(z.TempAir, z.HumidityAir, z.TempFloor, z.CO2,
+			z.Setpoint, z.TypeRegulation, z.VentSpeed, z.HumiditySetpoint, z.Hysteresis)
+	}
+
+	return registers
+}
+
+// Reads returns the requests that poll every register of the map, adjacent
+// registers of a table are read with one request.
+func (m *Map) Reads(slave uint8) []Request {
+	type span struct {
+		table      string
+		start, end int
+	}
+
+	var spans []span
+	for _, r := range m.registers() {
+		spans = append(spans, span{table: r.table(), start: int(r.Address), end: int(r.Address) + r.size()})
+	}
+
+	sort.Slice(spans, func(i, j int) bool {
+		if spans[i].table != spans[j].table {
+			return spans[i].table < spans[j].table
+		}
+
+		return spans[i].start < spans[j].start
+	})
+
+	var merged []span
+	for _, s := range spans {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			if last.table == s.table && s.start <= last.end && s.end-last.start <= MaxRead {
+				if s.end > last.end {
+					last.end = s.end
+				}
+				continue
+			}
+		}
+
+		merged = append(merged, s)
+	}
+
+	requests := make([]Request, 0, len(merged))
+	for _, s := range merged {
+		function := ReadHoldingRegisters
+		if s.table == TableInput {
+			function = ReadInputRegisters
+		}
+
+		requests = append(requests, Request{
+			Slave:    slave,
+			Function: function,
+			Address:  uint16(s.start),
+			Count:    uint16(s.end - s.start),
+		})
+	}
+
+	return requests
+}
+
+func LoadMap(path string) (*Map, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read register map %s file: %w", path, err)
+	}
+
+	m := &Map{
+		Poll:    10 * time.Second,
+		Timeout: time.Second,
+	}
+
+	if err := yaml.Unmarshal(raw, m); err != nil {
+		return nil, fmt.Errorf("YAML unmarshal register map: %w", err)
+	}
+
+	if err := m.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid register map %s: %w", path, err)
+	}
+
+	return m, nil
+}
@@ -0,0 +1,208 @@
+package modbus
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegisterWriteRead(t *testing.T) {
+	tests := []struct {
+		name     string
+		register Register
+		value    float64
+		words    []uint16
+	}{
+		{"uint16", Register{Address: 10}, 3, []uint16{3}},
+		{"scaled", Register{Address: 10, Type: TypeInt16, Scale: 0.1}, 21.5, []uint16{215}},
+		{"negative", Register{Address: 10, Type: TypeInt16, Scale: 0.1}, -5.2, []uint16{0xffcc}},
+		{"uint32", Register{Address: 10, Type: TypeUint32}, 70000, []uint16{0x0001, 0x1170}},
+		{"int32", Register{Address: 10, Type: TypeInt32}, -2, []uint16{0xffff, 0xfffe}},
+		{"float32", Register{Address: 10, Type: TypeFloat32}, 1.5, []uint16{0x3fc0, 0x0000}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := tt.register.Write(3, tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			function := WriteSingleRegister
+			if len(tt.words) > 1 {
+				function = WriteMultipleRegisters
+			}
+
+			if request.Slave != 3 || request.Function != function || request.Address != 10 {
+				t.Errorf("request = %v", request)
+			}
+
+			if len(request.Values) != len(tt.words) {
+				t.Fatalf("values = %#04x, want %#04x", request.Values, tt.words)
+			}
+			for i := range tt.words {
+				if request.Values[i] != tt.words[i] {
+					t.Fatalf("values = %#04x, want %#04x", request.Values, tt.words)
+				}
+			}
+
+			values := make(Values)
+			values.Add(Request{Function: ReadHoldingRegisters, Address: 10}, tt.words)
+
+			got, ok := tt.register.Read(values)
+			if !ok || math.Abs(got-tt.value) > 1e-9 {
+				t.Errorf("read %v %v, want %v", got, ok, tt.value)
+			}
+		})
+	}
+}
+
+func TestRegisterWriteInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		register Register
+		value    float64
+	}{
+		{"input register", Register{Table: TableInput, Address: 1}, 1},
+		{"negative uint16", Register{Address: 1}, -1},
+		{"too big uint16", Register{Address: 1}, 70000},
+		{"too big scaled", Register{Address: 1, Type: TypeInt16, Scale: 0.1}, 4000},
+		{"keep humidity", Register{Address: 1, Scale: 0.1}, math.MaxFloat32},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.register.Write(1, tt.value); err == nil {
+				t.Error("wrote an invalid value")
+			}
+		})
+	}
+}
+
+func TestRegisterReadMissing(t *testing.T) {
+	values := make(Values)
+	values.Add(Request{Function: ReadInputRegisters, Address: 10}, []uint16{1})
+
+	tests := []struct {
+		name     string
+		register Register
+		ok       bool
+	}{
+		{"input", Register{Table: TableInput, Address: 10}, true},
+		{"holding at the same address", Register{Address: 10}, false},
+		{"second word missing", Register{Table: TableInput, Address: 10, Type: TypeUint32}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := tt.register.Read(values); ok != tt.ok {
+				t.Errorf("read %v, want %v", ok, tt.ok)
+			}
+		})
+	}
+}
+
+func TestReads(t *testing.T) {
+	m := Map{
+		Module: Module{Delta: &Register{Address: 200}, TypeRegulation: &Register{Address: 201}},
+		Zones: []Zone{{
+			Zone:     1,
+			TempAir:  &Register{Table: TableInput, Address: 0},
+			CO2:      &Register{Table: TableInput, Address: 3, Type: TypeUint32},
+			Setpoint: &Register{Address: 100},
+		}},
+	}
+
+	want := []Request{
+		{Slave: 5, Function: ReadHoldingRegisters, Address: 100, Count: 1},
+		{Slave: 5, Function: ReadHoldingRegisters, Address: 200, Count: 2},
+		{Slave: 5, Function: ReadInputRegisters, Address: 0, Count: 1},
+		{Slave: 5, Function: ReadInputRegisters, Address: 3, Count: 2},
+	}
+
+	got := m.Reads(5)
+	if len(got) != len(want) {
+		t.Fatalf("reads = %v, want %v", got, want)
+	}
+
+	for i := range want {
+		if got[i].String() != want[i].String() {
+			t.Errorf("read %d = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestReadsSplitsLongSpans(t *testing.T) {
+	var zones []Zone
+	for i := 0; i < 130; i++ {
+		zones = append(zones, Zone{Zone: int32(i + 1), TempAir: &Register{Table: TableInput, Address: uint16(i)}})
+	}
+
+	reads := (&Map{Zones: zones}).Reads(1)
+	if len(reads) != 2 || reads[0].Count != MaxRead || reads[1].Address != MaxRead || reads[1].Count != 130-MaxRead {
+		t.Errorf("reads = %v, want %d registers and the rest", reads, MaxRead)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() Map {
+		return Map{
+			Poll:    time.Second,
+			Timeout: time.Second,
+			Zones:   []Zone{{Zone: 1, TempAir: &Register{Table: TableInput, Address: 0}}},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		change func(m *Map)
+		err    string
+	}{
+		{"valid", func(m *Map) {}, ""},
+		{"no poll", func(m *Map) { m.Poll = 0 }, "poll"},
+		{"no registers", func(m *Map) { m.Zones = nil }, "no registers"},
+		{"zone 0", func(m *Map) { m.Zones[0].Zone = 0 }, "zones[0].zone"},
+		{"duplicate zone", func(m *Map) { m.Zones = append(m.Zones, Zone{Zone: 1}) }, "duplicate zone 1"},
+		{"input setpoint", func(m *Map) { m.Zones[0].Setpoint = &Register{Table: TableInput} }, "zones[0].setpoint must be a holding"},
+		{"unknown type", func(m *Map) { m.Zones[0].CO2 = &Register{Type: "int8"} }, "zones[0].co2: unknown type"},
+		{"unknown table", func(m *Map) { m.Module.Delta = &Register{Table: "coil"} }, "module.delta: unknown table"},
+		{"out of range", func(m *Map) { m.Zones[0].CO2 = &Register{Address: math.MaxUint16, Type: TypeUint32} }, "out of range"},
+		{"negative scale", func(m *Map) { m.Zones[0].CO2 = &Register{Scale: -1} }, "scale"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := valid()
+			tt.change(&m)
+
+			err := m.Validate()
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("validate: %v", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("validate: %v, want an error about %s", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestLoadShippedMap(t *testing.T) {
+	m, err := LoadMap("../../config/modbus.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	z, ok := m.Zone(1)
+	if !ok || z.Setpoint == nil || z.TempAir == nil {
+		t.Fatalf("zone 1 = %+v", z)
+	}
+
+	if m.Poll != 10*time.Second || m.Timeout != time.Second {
+		t.Errorf("poll %v and timeout %v", m.Poll, m.Timeout)
+	}
+}
@@ -0,0 +1,95 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Number of rows in the tables reported by the controller.
+const (
+	SetpointTableRows = 6
+	VentTableRows     = 9
+	HumidityTableRows = 6
+)
+
+// Telemetry is the payload of command 0, the frame address holds the zone.
+type Telemetry struct {
+	TempAir     float32
+	HumidityAir float32
+	TempFloor   float32
+	CO2         int32
+}
+
+// SetpointRow is a row of command 1.
+type SetpointRow struct {
+	Zone           int32
+	Setpoint       float32
+	TypeRegulation uint8
+}
+
+// VentRow is a row of command 3.
+type VentRow struct {
+	Zone      int16
+	VentSpeed int16
+}
+
+// VentModule is the payload of command 7 and of the settings commands 4 and 5.
+type VentModule struct {
+	Zone                                   int16
+	VentSpeed                              int16
+	Delta                                  uint8
+	TypeRegulation                         uint8
+	IntervalTimeVentilationDampers         uint8
+	VentilationPeriodAfterCO2ReductionTime uint8
+}
+
+// HumidityRow is a row of command 8.
+type HumidityRow struct {
+	Zone       int32
+	Setpoint   float32
+	Hysteresis uint8
+}
+
+// Setpoint is the payload of command 2. Depending on the request it carries
+// a temperature with a regulation type or a humidity with a hysteresis.
+type Setpoint struct {
+	Zone  int32
+	Value float32
+	Extra uint8
+}
+
+// VentByZone is the payload of command 6.
+type VentByZone struct {
+	Zone int16
+}
+
+// Marshal encodes a fixed size payload struct or slice of structs.
+func Marshal(v interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	if err := binary.Write(buf, binary.LittleEndian, v); err != nil {
+		return nil, fmt.Errorf("marshal payload: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes a payload into a pointer to a fixed size struct or into a
+// preallocated slice. Trailing bytes are ignored.
+func Unmarshal(payload []byte, v interface{}) error {
+	size := binary.Size(v)
+	if size < 0 {
+		return fmt.Errorf("unmarshal payload: unsupported type %T", v)
+	}
+
+	if len(payload) < size {
+		return fmt.Errorf("unmarshal payload: need %d bytes, got %d", size, len(payload))
+	}
+
+	if err := binary.Read(bytes.NewReader(payload), binary.LittleEndian, v); err != nil {
+		return fmt.Errorf("unmarshal payload: %w", err)
+	}
+
+	return nil
+}
@@ -1,258 +1,546 @@
 package server
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"iLean/config"
 	"iLean/entity"
+	"iLean/server/socket"
+	"io"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
-	"math"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
+	"github.com/gofrs/uuid"
 )
 
 const (
 	typeCommand = 2
+
+	// maxWait caps the ?wait= parameter of the command endpoint.
+	maxWait = time.Minute
+
+	// maxConfigSize caps the body of the config endpoint.
+	maxConfigSize = 64 << 10
 )
 
+// admin lets requests through that carry the admin token as a bearer token,
+// none while it is not set.
+func (s *Server) admin(c *gin.Context) {
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+
+	if s.adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, entity.Response{Status: http.StatusUnauthorized, Message: "Status Unauthorized"})
+		return
+	}
+
+	c.Next()
+}
+
+// Controller sends a settings command to the agent. With ?wait=<duration>
+// the response is delayed until the controller confirms the command, it
+// fails or the duration runs out.
 func (s *Server) Controller(c *gin.Context) {
 	commandNum, err := strconv.Atoi(c.Param("n"))
 	if err != nil {
 		c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: "Status Bad Request"})
 		return
 	}
+
 	// settings command
-	switch commandNum {
-	case 1:
-		command := new(entity.CommandTemperature)
-		c.ShouldBindJSON(&command)
-
-		validate := validator.New()
-		err := validate.Struct(command)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: "Status Bad Request"})
-			return
-		}
+	req, ok := entity.NewRequest(commandNum)
+	if !ok {
+		c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: "Status Bad Request"})
+		return
+	}
 
-		mes, err := entity.NewCommand(*command, typeCommand)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, entity.Response{Status: http.StatusInternalServerError, Message: "Status Internal Server Error"})
-			return
-		}
+	if !bindCommand(c, req) {
+		return
+	}
 
-		dataBytes, err := json.Marshal(mes)
+	if hysteresis, ok := req.(*entity.CommandHysteresisOnHumidityModule); ok {
+		hysteresis.SetDefaults()
 
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, entity.Response{Status: http.StatusInternalServerError, Message: "Status Internal Server Error"})
-			return
-		}
+		rawRq, _ := json.Marshal(hysteresis)
+		s.log.Infof("RAW REQUEST: %s", string(rawRq))
+	}
 
-		s.socket.Send("controller", command.SerialNumber, dataBytes)
+	target := req.GetTarget()
 
-		c.JSON(http.StatusOK, entity.Response{Status: http.StatusOK, Message: "ok"})
-	case 2:
-		command := new(entity.CommandTemperatureBySensor)
+	wait, err := waitParam(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: err.Error()})
+		return
+	}
 
-		c.ShouldBindJSON(&command)
+	mes, err := entity.NewCommand(req, typeCommand)
+	if err != nil {
+		s.log.Error(err)
+		c.JSON(http.StatusInternalServerError, entity.Response{Status: http.StatusInternalServerError, Message: "Status Internal Server Error"})
+		return
+	}
 
-		validate := validator.New()
+	id, err := uuid.NewV4()
+	if err != nil {
+		s.log.Error(err)
+		c.JSON(http.StatusInternalServerError, entity.Response{Status: http.StatusInternalServerError, Message: "Status Internal Server Error"})
+		return
+	}
+	mes.ID = id.String()
+	mes.BusAddress = target.BusAddress
 
-		err := validate.Struct(command)
+	// pushed again on reconnect until the controller reports it
+	s.socket.SetDesired(target.SerialNumber, mes.ID, req)
 
-		if err != nil {
-			c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: "Status Bad Request"})
-			return
-		}
+	dataBytes, err := json.Marshal(mes)
+	if err != nil {
+		s.log.Error(err)
+		c.JSON(http.StatusInternalServerError, entity.Response{Status: http.StatusInternalServerError, Message: "Status Internal Server Error"})
+		return
+	}
 
-		mes, err := entity.NewCommand(*command, typeCommand)
-		if err != nil {
-			s.log.Error(err)
-			c.JSON(http.StatusInternalServerError, entity.Response{Status: http.StatusInternalServerError, Message: "Status Internal Server Error"})
-			return
-		}
+	if wait == 0 {
+		s.socket.Send("controller", target.SerialNumber, dataBytes)
+
+		c.JSON(http.StatusOK, entity.Response{Status: http.StatusOK, Message: "ok", Data: entity.Ack{ID: mes.ID, Status: entity.AckSent}})
+		return
+	}
+
+	acks := s.socket.Expect(mes.ID)
+	defer s.socket.Forget(mes.ID)
+
+	if s.socket.Send("controller", target.SerialNumber, dataBytes) == 0 {
+		c.JSON(http.StatusServiceUnavailable, entity.Response{Status: http.StatusServiceUnavailable, Message: "controller is not connected", Data: entity.Ack{ID: mes.ID, Status: entity.AckSent}})
+		return
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	last := entity.Ack{ID: mes.ID, Status: entity.AckSent}
 
-		dataBytes, err := json.Marshal(mes)
+	for {
+		select {
+		case ack := <-acks:
+			last = ack
+			if !ack.Final() {
+				continue
+			}
 
-		if err != nil {
-			s.log.Error(err)
-			c.JSON(http.StatusInternalServerError, entity.Response{Status: http.StatusInternalServerError, Message: "Status Internal Server Error"})
+			if ack.Status == entity.AckFailed {
+				c.JSON(http.StatusBadGateway, entity.Response{Status: http.StatusBadGateway, Message: "command failed", Data: ack})
+				return
+			}
+
+			c.JSON(http.StatusOK, entity.Response{Status: http.StatusOK, Message: "ok", Data: ack})
+			return
+		case <-timer.C:
+			c.JSON(http.StatusGatewayTimeout, entity.Response{Status: http.StatusGatewayTimeout, Message: "command is not confirmed in time", Data: last})
+			return
+		case <-c.Request.Context().Done():
 			return
 		}
+	}
+}
+
+// bindCommand decodes and validates the request body, on failure the
+// response is already written.
+func bindCommand(c *gin.Context, command interface{}) bool {
+	if err := c.ShouldBindJSON(command); err != nil {
+		c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: "Status Bad Request"})
+		return false
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(command); err != nil {
+		c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: "Status Bad Request"})
+		return false
+	}
 
-		s.socket.Send("controller", command.SerialNumber, dataBytes)
+	return true
+}
 
-		c.JSON(http.StatusOK, entity.Response{Status: http.StatusOK, Message: "ok"})
+func waitParam(c *gin.Context) (time.Duration, error) {
+	raw := c.Query("wait")
+	if raw == "" {
+		return 0, nil
+	}
 
-	case 3:
-		command := new(entity.CommandDataVentModule)
+	wait, err := time.ParseDuration(raw)
+	if err != nil || wait <= 0 {
+		return 0, errors.New("wait must be a positive duration like 5s")
+	}
 
-		c.ShouldBindJSON(&command)
+	if wait > maxWait {
+		wait = maxWait
+	}
 
-		validate := validator.New()
+	return wait, nil
+}
 
-		err := validate.Struct(command)
+// ControllerHealth returns the latest health report of the agent, clients
+// tell a silent agent by received_at.
+func (s *Server) ControllerHealth(c *gin.Context) {
+	serialNumber, err := strconv.Atoi(c.Param("serial"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: "Status Bad Request"})
+		return
+	}
 
-		if err != nil {
-			c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: "Status Bad Request"})
-			return
-		}
+	report, ok := s.socket.Health(serialNumber)
+	if !ok {
+		c.JSON(http.StatusNotFound, entity.Response{Status: http.StatusNotFound, Message: "no health report from the controller"})
+		return
+	}
 
-		mes, err := entity.NewCommand(*command, typeCommand)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, entity.Response{Status: http.StatusInternalServerError, Message: "Status Internal Server Error"})
-			return
-		}
+	c.JSON(http.StatusOK, entity.Response{Status: http.StatusOK, Message: "ok", Data: report})
+}
 
-		dataBytes, err := json.Marshal(mes)
+// ControllerConfig returns the config the agent should run and the status
+// it reported last.
+func (s *Server) ControllerConfig(c *gin.Context) {
+	serialNumber, err := strconv.Atoi(c.Param("serial"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: "Status Bad Request"})
+		return
+	}
 
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, entity.Response{Status: http.StatusInternalServerError, Message: "Status Internal Server Error"})
-			return
-		}
+	state, ok := s.socket.Config(serialNumber)
+	if !ok {
+		c.JSON(http.StatusNotFound, entity.Response{Status: http.StatusNotFound, Message: "no config for the controller"})
+		return
+	}
 
-		s.socket.Send("controller", command.SerialNumber, dataBytes)
+	c.JSON(http.StatusOK, entity.Response{Status: http.StatusOK, Message: "ok", Data: state})
+}
 
-		c.JSON(http.StatusOK, entity.Response{Status: http.StatusOK, Message: "ok"})
+// SetControllerConfig takes a pi.conf without the auth, update and policy
+// sections as the body and makes it the desired config of the agent. The
+// config is validated as the agent would, the agent reports whether it
+// applied it on the config endpoint.
+func (s *Server) SetControllerConfig(c *gin.Context) {
+	serialNumber, err := strconv.Atoi(c.Param("serial"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: "Status Bad Request"})
+		return
+	}
 
-	case 4:
-		command := new(entity.CommandDataVentModule)
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxConfigSize)
 
-		c.ShouldBindJSON(&command)
+	configYAML, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: "Status Bad Request"})
+		return
+	}
 
-		validate := validator.New()
+	// auth, update and policy stay with the agent, the server never holds
+	// its keys
+	conf, err := config.ParsePushed(configYAML, config.Unknown())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: err.Error()})
+		return
+	}
 
-		err := validate.Struct(command)
+	if conf.Serial != serialNumber {
+		c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: fmt.Sprintf("config is for serial %d", conf.Serial)})
+		return
+	}
 
-		if err != nil {
-			c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: "Status Bad Request"})
-			return
-		}
+	if conf.Version != 0 {
+		c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: "version is assigned by the server"})
+		return
+	}
 
-		mes, err := entity.NewCommand(*command, typeCommand)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, entity.Response{Status: http.StatusInternalServerError, Message: "Status Internal Server Error"})
-			return
-		}
+	desired, pushed := s.socket.SetConfig(serialNumber, string(configYAML))
 
-		dataBytes, err := json.Marshal(mes)
+	message := "ok"
+	if !pushed {
+		message = "controller is not connected, the config is pushed once it connects"
+	}
 
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, entity.Response{Status: http.StatusInternalServerError, Message: "Status Internal Server Error"})
-			return
-		}
+	c.JSON(http.StatusAccepted, entity.Response{Status: http.StatusAccepted, Message: message, Data: desired})
+}
 
-		s.socket.Send("controller", command.SerialNumber, dataBytes)
+// ControllerSchedule returns the schedule the agent should follow, the
+// status it reported last and the actions it took by the schedule while it
+// was offline.
+func (s *Server) ControllerSchedule(c *gin.Context) {
+	serialNumber, err := strconv.Atoi(c.Param("serial"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: "Status Bad Request"})
+		return
+	}
 
-		c.JSON(http.StatusOK, entity.Response{Status: http.StatusOK, Message: "ok"})
+	state, ok := s.socket.Schedule(serialNumber)
+	if !ok {
+		c.JSON(http.StatusNotFound, entity.Response{Status: http.StatusNotFound, Message: "no schedule for the controller"})
+		return
+	}
 
-	case 5:
-		command := new(entity.CommandDataVentModuleForAll)
+	c.JSON(http.StatusOK, entity.Response{Status: http.StatusOK, Message: "ok", Data: state})
+}
 
-		c.ShouldBindJSON(&command)
+// SetControllerSchedule makes the entries of the body the weekly schedule
+// the agent follows once it lost the server. The data of an entry is
+// validated as the command endpoint would.
+func (s *Server) SetControllerSchedule(c *gin.Context) {
+	serialNumber, err := strconv.Atoi(c.Param("serial"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: "Status Bad Request"})
+		return
+	}
 
-		validate := validator.New()
+	var schedule entity.Schedule
+	if !bindCommand(c, &schedule) {
+		return
+	}
 
-		err := validate.Struct(command)
+	if schedule.Version != 0 {
+		c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: "version is assigned by the server"})
+		return
+	}
 
-		if err != nil {
-			c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: "Status Bad Request"})
+	for i, entry := range schedule.Entries {
+		if err := checkScheduleEntry(entry, serialNumber); err != nil {
+			c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: fmt.Sprintf("entries[%d]: %s", i, err)})
 			return
 		}
+	}
 
-		mes, err := entity.NewCommand(*command, typeCommand)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, entity.Response{Status: http.StatusInternalServerError, Message: "Status Internal Server Error"})
-			return
-		}
+	desired, pushed := s.socket.SetSchedule(serialNumber, schedule.Entries)
 
-		dataBytes, err := json.Marshal(mes)
+	message := "ok"
+	if !pushed {
+		message = "controller is not connected, the schedule is pushed once it connects"
+	}
 
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, entity.Response{Status: http.StatusInternalServerError, Message: "Status Internal Server Error"})
-			return
-		}
+	c.JSON(http.StatusAccepted, entity.Response{Status: http.StatusAccepted, Message: message, Data: desired})
+}
 
-		s.socket.Send("controller", command.SerialNumber, dataBytes)
+func checkScheduleEntry(entry entity.ScheduleEntry, serialNumber int) error {
+	if _, err := entry.Minute(); err != nil {
+		return err
+	}
 
-		c.JSON(http.StatusOK, entity.Response{Status: http.StatusOK, Message: "ok"})
+	req, ok := entity.NewRequest(entry.Command)
+	if !ok {
+		return fmt.Errorf("unknown command %d", entry.Command)
+	}
 
-	case 6:
-		command := new(entity.CommandDataVentByZone)
+	if err := json.Unmarshal(entry.Data, req); err != nil {
+		return fmt.Errorf("bad data: %w", err)
+	}
 
-		c.ShouldBindJSON(&command)
+	if err := validator.New().Struct(req); err != nil {
+		return fmt.Errorf("bad data: %w", err)
+	}
 
-		validate := validator.New()
+	if req.GetTarget().SerialNumber != serialNumber {
+		return errors.New("data is for another serial number")
+	}
 
-		err := validate.Struct(command)
+	return nil
+}
 
-		if err != nil {
-			c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: "Status Bad Request"})
-			return
-		}
+// AnnounceRelease makes a binary under the releases dir the one every agent
+// should run. The body is what cmd/release prints, the checksum is checked
+// against the file and the signature is checked by the agents.
+func (s *Server) AnnounceRelease(c *gin.Context) {
+	var release entity.Release
+	if !bindCommand(c, &release) {
+		return
+	}
 
-		mes, err := entity.NewCommand(*command, typeCommand)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, entity.Response{Status: http.StatusInternalServerError, Message: "Status Internal Server Error"})
-			return
-		}
+	path, ok := s.releasePath(release.Version)
+	if !ok {
+		c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: "bad version"})
+		return
+	}
 
-		dataBytes, err := json.Marshal(mes)
+	sum, err := fileChecksum(path)
+	if err != nil {
+		s.log.WithError(err).Error("failed to read release")
+		c.JSON(http.StatusNotFound, entity.Response{Status: http.StatusNotFound, Message: "no binary for the version"})
+		return
+	}
 
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, entity.Response{Status: http.StatusInternalServerError, Message: "Status Internal Server Error"})
-			return
-		}
+	if !strings.EqualFold(sum, release.SHA256) {
+		c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: "checksum does not match the binary"})
+		return
+	}
 
-		s.socket.Send("controller", command.SerialNumber, dataBytes)
+	release.URL = strings.TrimSuffix(s.releases.URL, "/") + "/api/v1/agent/releases/" + release.Version
 
-		c.JSON(http.StatusOK, entity.Response{Status: http.StatusOK, Message: "ok"})
+	sent := s.socket.Announce(release)
 
-	case 9:
-		command := new(entity.CommandHysteresisOnHumidityModule)
-		c.ShouldBindJSON(&command)
+	c.JSON(http.StatusAccepted, entity.Response{Status: http.StatusAccepted, Message: fmt.Sprintf("announced to %d controllers", sent), Data: release})
+}
 
-		validate := validator.New()
+// Release returns the announced release.
+func (s *Server) Release(c *gin.Context) {
+	release, ok := s.socket.Release()
+	if !ok {
+		c.JSON(http.StatusNotFound, entity.Response{Status: http.StatusNotFound, Message: "no release announced"})
+		return
+	}
 
-		err := validate.Struct(command)
+	c.JSON(http.StatusOK, entity.Response{Status: http.StatusOK, Message: "ok", Data: release})
+}
 
-		if err != nil {
-			c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: "Status Bad Request"})
-			return
-		}
+// ReleaseBinary serves the binary agents download.
+func (s *Server) ReleaseBinary(c *gin.Context) {
+	path, ok := s.releasePath(c.Param("version"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: "bad version"})
+		return
+	}
 
-		
-		if command.Humidity == 0.0 {
-			command.Humidity = math.MaxFloat32
-		}
-		if command.Hysteresis == 0 {
-			command.Hysteresis = math.MaxUint8
-		}
+	if _, err := os.Stat(path); err != nil {
+		c.JSON(http.StatusNotFound, entity.Response{Status: http.StatusNotFound, Message: "no binary for the version"})
+		return
+	}
 
-		rawRq, _ := json.Marshal(command)
-		s.log.Infof("RAW REQUEST: %s", string(rawRq))
+	c.File(path)
+}
 
-		mes, err := entity.NewCommand(*command, typeCommand)
-		if err != nil {
-			s.log.Error(err)
-			c.JSON(http.StatusInternalServerError, entity.Response{Status: http.StatusInternalServerError, Message: "Status Internal Server Error"})
-			return
-		}
+// ControllerUpdate returns the announced release and what the agent
+// reported about installing it.
+func (s *Server) ControllerUpdate(c *gin.Context) {
+	serialNumber, err := strconv.Atoi(c.Param("serial"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: "Status Bad Request"})
+		return
+	}
 
-		dataBytes, err := json.Marshal(mes)
-		if err != nil {
-			s.log.Error(err)
-			c.JSON(http.StatusInternalServerError, entity.Response{Status: http.StatusInternalServerError, Message: "Status Internal Server Error"})
-			return
-		}
-		
-		s.log.Info(string(dataBytes))
-		s.socket.Send("controller", command.SerialNumber, dataBytes)
+	c.JSON(http.StatusOK, entity.Response{Status: http.StatusOK, Message: "ok", Data: s.socket.Update(serialNumber)})
+}
+
+// releasePath returns where the binary of the version is kept, versions
+// that are not a plain directory name are refused.
+func (s *Server) releasePath(version string) (string, bool) {
+	if version == "" || version == "." || version == ".." || strings.ContainsAny(version, "/\\ \t\r\n") {
+		return "", false
+	}
+
+	return filepath.Join(s.releases.Dir, version, "lean"), true
+}
 
-		c.JSON(http.StatusOK, entity.Response{Status: http.StatusOK, Message: "ok"})
+func fileChecksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
 
-	default:
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// ControllerDevices returns the controllers on the bus of the agent, the
+// zones each of them reported and whether the values of the zones are
+// stale because the controller is silent.
+func (s *Server) ControllerDevices(c *gin.Context) {
+	serialNumber, err := strconv.Atoi(c.Param("serial"))
+	if err != nil {
 		c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: "Status Bad Request"})
+		return
+	}
+
+	c.JSON(http.StatusOK, entity.Response{Status: http.StatusOK, Message: "ok", Data: s.socket.Devices(serialNumber)})
+}
+
+// ControllerShadow returns the settings the commands want the controllers
+// of the agent set to, what they reported and the delta between them.
+func (s *Server) ControllerShadow(c *gin.Context) {
+	serialNumber, err := strconv.Atoi(c.Param("serial"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: "Status Bad Request"})
+		return
+	}
+
+	c.JSON(http.StatusOK, entity.Response{Status: http.StatusOK, Message: "ok", Data: s.socket.Shadow(serialNumber)})
+}
+
+// ClearControllerDesired drops the desired settings of the agent, they are
+// no longer pushed on reconnect.
+func (s *Server) ClearControllerDesired(c *gin.Context) {
+	serialNumber, err := strconv.Atoi(c.Param("serial"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: "Status Bad Request"})
+		return
+	}
+
+	s.socket.ClearDesired(serialNumber)
 
+	c.JSON(http.StatusOK, entity.Response{Status: http.StatusOK, Message: "ok", Data: s.socket.Shadow(serialNumber)})
+}
+
+// PairMobile issues the key a mobile client greets the websocket with, the
+// body names the client. The key is derived from the device key, it does
+// not let the app sign commands or pose as the agent.
+func (s *Server) PairMobile(c *gin.Context) {
+	serialNumber, err := strconv.Atoi(c.Param("serial"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: "Status Bad Request"})
+		return
+	}
+
+	var credential entity.MobileCredential
+	if !bindCommand(c, &credential) {
+		return
+	}
+
+	key, err := s.socket.MobileKey(serialNumber, credential.Client)
+	if errors.Is(err, socket.ErrNoKeys) {
+		c.JSON(http.StatusServiceUnavailable, entity.Response{Status: http.StatusServiceUnavailable, Message: "device keys are not set, mobile clients greet without a key"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusNotFound, entity.Response{Status: http.StatusNotFound, Message: err.Error()})
+		return
+	}
+
+	credential.SerialNumber = serialNumber
+	credential.Key = hex.EncodeToString(key)
+
+	c.JSON(http.StatusOK, entity.Response{Status: http.StatusOK, Message: "ok", Data: credential})
+}
+
+// Compaction returns the retention, the progress of a running compaction
+// of the telemetry and the result of the last one.
+func (s *Server) Compaction(c *gin.Context) {
+	if s.compactor == nil {
+		c.JSON(http.StatusServiceUnavailable, entity.Response{Status: http.StatusServiceUnavailable, Message: "telemetry is not compacted"})
+		return
+	}
+
+	c.JSON(http.StatusOK, entity.Response{Status: http.StatusOK, Message: "ok", Data: s.compactor.Status()})
+}
+
+// Compact starts a compaction of the telemetry now.
+func (s *Server) Compact(c *gin.Context) {
+	if s.compactor == nil {
+		c.JSON(http.StatusServiceUnavailable, entity.Response{Status: http.StatusServiceUnavailable, Message: "telemetry is not compacted"})
+		return
+	}
+
+	if !s.compactor.Trigger() {
+		c.JSON(http.StatusConflict, entity.Response{Status: http.StatusConflict, Message: "compaction is running", Data: s.compactor.Status()})
+		return
 	}
 
+	c.JSON(http.StatusAccepted, entity.Response{Status: http.StatusAccepted, Message: "compaction started", Data: s.compactor.Status()})
 }
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"iLean/entity"
+	"iLean/server/storage"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// defaultPoints is how many readings downsampling keeps unless the
+	// query asks for more or fewer.
+	defaultPoints = 500
+	// maxPoints caps the points and buckets of a history.
+	maxPoints = 10000
+	// defaultSpan is the history returned without from.
+	defaultSpan = 24 * time.Hour
+	// maxSpan caps the span of a history.
+	maxSpan = 366 * 24 * time.Hour
+	// maxRawSpan is the longest span read from the raw readings, longer
+	// ones are read from a rollup.
+	maxRawSpan = 7 * 24 * time.Hour
+)
+
+// History is a metric of a zone, in buckets of Step or downsampled without
+// a step. Rollup is the step of the rollup it was read from once the raw
+// readings from From expired or the span is longer than maxRawSpan.
+type History struct {
+	SerialNumber int              `json:"serial_number"`
+	Zone         int32            `json:"zone"`
+	Metric       string           `json:"metric"`
+	From         time.Time        `json:"from"`
+	To           time.Time        `json:"to"`
+	Step         string           `json:"step,omitempty"`
+	Rollup       string           `json:"rollup,omitempty"`
+	Buckets      []storage.Bucket `json:"buckets,omitempty"`
+	Points       []storage.Point  `json:"points,omitempty"`
+}
+
+// ControllerHistory returns a metric of a zone from up to to, the last day
+// by default. With step the readings are aggregated in buckets, without it
+// they are downsampled to points readings. format=csv returns CSV.
+func (s *Server) ControllerHistory(c *gin.Context) {
+	if s.storage == nil {
+		c.JSON(http.StatusServiceUnavailable, entity.Response{Status: http.StatusServiceUnavailable, Message: "telemetry is not stored"})
+		return
+	}
+
+	serialNumber, err := strconv.Atoi(c.Param("serial"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: "Status Bad Request"})
+		return
+	}
+
+	zone, err := strconv.ParseInt(c.Param("zone"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: "Status Bad Request"})
+		return
+	}
+
+	query, step, points, err := historyParams(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: err.Error()})
+		return
+	}
+	query.SerialNumber = serialNumber
+	query.Zone = int32(zone)
+
+	history := History{
+		SerialNumber: serialNumber,
+		Zone:         query.Zone,
+		Metric:       query.Metric,
+		From:         query.From,
+		To:           query.To,
+	}
+	if step > 0 {
+		history.Step = step.String()
+	}
+
+	tier, ok := s.rollupFor(query.From, query.To, step)
+	if !ok && query.To.Sub(query.From) > maxRawSpan {
+		c.JSON(http.StatusBadRequest, entity.Response{Status: http.StatusBadRequest, Message: fmt.Sprintf("no rollup for a span longer than %v", maxRawSpan)})
+		return
+	}
+
+	if ok {
+		buckets, err := s.storage.Rollup(c.Request.Context(), tier.Step, query)
+		if err != nil {
+			s.log.WithError(err).Error("failed to read history rollup")
+			c.JSON(http.StatusInternalServerError, entity.Response{Status: http.StatusInternalServerError, Message: "Status Internal Server Error"})
+			return
+		}
+
+		history.Rollup = tier.Step.String()
+		if step > 0 {
+			history.Buckets = storage.Merge(buckets, query.From, step)
+		} else {
+			readings := make([]storage.Reading, len(buckets))
+			for i, b := range buckets {
+				readings[i] = storage.Reading{At: b.At, Value: b.Avg}
+			}
+			history.Points = storage.Downsample(readings, points)
+		}
+	} else {
+		readings, err := s.storage.Readings(c.Request.Context(), query)
+		if err != nil {
+			s.log.WithError(err).Error("failed to read history")
+			c.JSON(http.StatusInternalServerError, entity.Response{Status: http.StatusInternalServerError, Message: "Status Internal Server Error"})
+			return
+		}
+
+		if step > 0 {
+			history.Buckets = storage.Aggregate(readings, query.From, step)
+		} else {
+			history.Points = storage.Downsample(readings, points)
+		}
+	}
+
+	if c.Query("format") == "csv" {
+		s.writeHistoryCSV(c, history)
+		return
+	}
+
+	c.JSON(http.StatusOK, entity.Response{Status: http.StatusOK, Message: "ok", Data: history})
+}
+
+// historyParams reads the metric, the span, the step and the points of the
+// query string. Times are RFC 3339 or unix milliseconds.
+func historyParams(c *gin.Context) (query storage.Query, step time.Duration, points int, err error) {
+	query.Metric = c.Query("metric")
+	if !storage.IsMetric(query.Metric) {
+		return query, 0, 0, fmt.Errorf("metric must be one of %v", storage.Metrics)
+	}
+
+	query.To = time.Now().UTC()
+	if raw := c.Query("to"); raw != "" {
+		if query.To, err = parseTime(raw); err != nil {
+			return query, 0, 0, fmt.Errorf("to: %w", err)
+		}
+	}
+
+	query.From = query.To.Add(-defaultSpan)
+	if raw := c.Query("from"); raw != "" {
+		if query.From, err = parseTime(raw); err != nil {
+			return query, 0, 0, fmt.Errorf("from: %w", err)
+		}
+	}
+
+	if !query.From.Before(query.To) {
+		return query, 0, 0, errors.New("from must be before to")
+	}
+
+	if query.To.Sub(query.From) > maxSpan {
+		return query, 0, 0, fmt.Errorf("span is longer than %v", maxSpan)
+	}
+
+	if raw := c.Query("step"); raw != "" {
+		step, err = time.ParseDuration(raw)
+		if err != nil || step < time.Second {
+			return query, 0, 0, errors.New("step must be a duration of a second or more like 5m")
+		}
+
+		if query.To.Sub(query.From)/step > maxPoints {
+			return query, 0, 0, fmt.Errorf("step makes more than %d buckets", maxPoints)
+		}
+	}
+
+	points = defaultPoints
+	if raw := c.Query("points"); raw != "" {
+		points, err = strconv.Atoi(raw)
+		if err != nil || points < 3 || points > maxPoints {
+			return query, 0, 0, fmt.Errorf("points must be from 3 to %d", maxPoints)
+		}
+	}
+
+	return query, step, points, nil
+}
+
+// rollupFor returns the rollup to read a history from when the raw readings
+// from then expired or the span is longer than maxRawSpan: the one
+// with the largest step dividing the step of the history, or no larger
+// than it, and the finest one without a step. The rollup must still reach
+// back to from.
+func (s *Server) rollupFor(from, to time.Time, step time.Duration) (storage.Tier, bool) {
+	if s.compactor == nil {
+		return storage.Tier{}, false
+	}
+
+	retention := s.compactor.Retention()
+	now := time.Now()
+	if storage.Covers(retention.Raw, from, now) && to.Sub(from) <= maxRawSpan {
+		return storage.Tier{}, false
+	}
+
+	var dividing, smaller *storage.Tier
+	for i := range retention.Rollups {
+		tier := &retention.Rollups[i]
+		if !storage.Covers(tier.Keep, from, now) {
+			continue
+		}
+
+		if step == 0 {
+			return *tier, true
+		}
+
+		if tier.Step <= step {
+			smaller = tier
+			if step%tier.Step == 0 {
+				dividing = tier
+			}
+		}
+	}
+
+	switch {
+	case dividing != nil:
+		return *dividing, true
+	case smaller != nil:
+		return *smaller, true
+	}
+
+	return storage.Tier{}, false
+}
+
+func parseTime(raw string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return time.Unix(0, ms*int64(time.Millisecond)).UTC(), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return time.Time{}, errors.New("time must be RFC 3339 or unix milliseconds")
+	}
+
+	return t.UTC(), nil
+}
+
+func (s *Server) writeHistoryCSV(c *gin.Context, history History) {
+	name := fmt.Sprintf("%d-%d-%s.csv", history.SerialNumber, history.Zone, history.Metric)
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="`+name+`"`)
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	format := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+
+	if history.Step != "" {
+		w.Write([]string{"at", "min", "max", "avg", "last", "count"})
+		for _, b := range history.Buckets {
+			w.Write([]string{b.At.Format(time.RFC3339), format(b.Min), format(b.Max), format(b.Avg), format(b.Last), strconv.Itoa(b.Count)})
+		}
+	} else {
+		w.Write([]string{"at", "value"})
+		for _, p := range history.Points {
+			w.Write([]string{p.At.Format(time.RFC3339Nano), format(p.Value)})
+		}
+	}
+
+	w.Flush()
+	if err := w.Error(); err != nil {
+		s.log.WithError(err).Error("failed to write history csv")
+	}
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"iLean/server/storage"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func historyRequest(s *Server, query string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/api/v1/controllers/7/zones/1/history?"+query, nil)
+	c.Params = gin.Params{{Key: "serial", Value: "7"}, {Key: "zone", Value: "1"}}
+
+	s.ControllerHistory(c)
+
+	return w
+}
+
+func ms(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func TestControllerHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := storage.OpenFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC()
+	ctx := context.Background()
+
+	// a raw reading an hour ago and a 5m bucket of each of the last 40 days
+	err = repo.Save(ctx, []storage.Reading{{SerialNumber: 7, Zone: 1, Metric: storage.MetricTempAir, At: now.Add(-time.Hour), Value: 21}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 40; i++ {
+		at := now.Add(-time.Duration(i) * 24 * time.Hour).Truncate(5 * time.Minute)
+		day := storage.Day{SerialNumber: 7, Zone: 1, Metric: storage.MetricTempAir, At: at.Truncate(24 * time.Hour)}
+		bucket := storage.Bucket{At: at, Min: 20, Max: 22, Avg: 21, Last: 21, Count: 60}
+
+		if err := repo.SaveRollup(ctx, 5*time.Minute, day, []storage.Bucket{bucket}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	withRollups, err := storage.ParseRetention(storage.DefaultRetention)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rawOnly, err := storage.ParseRetention("raw=forever")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metric := "metric=" + storage.MetricTempAir
+
+	tests := []struct {
+		name      string
+		retention storage.Retention
+		query     string
+		status    int
+		rollup    string
+		points    int
+	}{
+		{"last day", withRollups, metric, http.StatusOK, "", 1},
+		{"last 30 days", withRollups, fmt.Sprintf("%s&from=%d", metric, ms(now.Add(-30*24*time.Hour))), http.StatusOK, "5m0s", 29},
+		{"older than the raw readings", withRollups, fmt.Sprintf("%s&from=%d&to=%d", metric, ms(now.Add(-10*24*time.Hour-time.Hour)), ms(now.Add(-9*24*time.Hour-time.Hour))), http.StatusOK, "5m0s", 1},
+		{"since 1970", withRollups, metric + "&from=0", http.StatusBadRequest, "", 0},
+		{"longer than the raw span without rollups", rawOnly, fmt.Sprintf("%s&from=%d", metric, ms(now.Add(-30*24*time.Hour))), http.StatusBadRequest, "", 0},
+		{"too many buckets", withRollups, metric + "&step=1s", http.StatusBadRequest, "", 0},
+		{"unknown metric", withRollups, "metric=x", http.StatusBadRequest, "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				log:       logrus.WithField("subsystem", "test"),
+				storage:   repo,
+				compactor: storage.NewCompactor(repo, tt.retention, time.Hour),
+			}
+
+			w := historyRequest(s, tt.query)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var response struct {
+				Data History `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+
+			if response.Data.Rollup != tt.rollup || len(response.Data.Points) != tt.points {
+				t.Errorf("rollup %q with %d points, want %q with %d", response.Data.Rollup, len(response.Data.Points), tt.rollup, tt.points)
+			}
+		})
+	}
+}
@@ -4,8 +4,10 @@ import (
 	"context"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
+	"iLean/auth"
 	"iLean/server/socket"
 	socketIO "iLean/server/socketio"
+	"iLean/server/storage"
 	"net/http"
 	"sync"
 	"time"
@@ -21,8 +23,26 @@ type Server struct {
 	stop chan struct{}
 
 	jwt_key string
+	// adminToken is the bearer token of the routes that change a controller
+	// or the server, they are refused while it is empty.
+	adminToken string
 
 	socket *socket.Hub
+
+	// storage keeps the telemetry, nil if it is not stored.
+	storage storage.Repository
+	// compactor rolls up and expires the telemetry, nil if it is kept as
+	// stored.
+	compactor *storage.Compactor
+
+	releases Releases
+}
+
+// Releases is where agent binaries are kept, <Dir>/<version>/lean, and the
+// address of the server agents download them from.
+type Releases struct {
+	Dir string
+	URL string
 }
 
 func CORSMiddleware() gin.HandlerFunc {
@@ -30,7 +50,7 @@ func CORSMiddleware() gin.HandlerFunc {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
 		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
@@ -55,8 +75,8 @@ func CORSMiddleware() gin.HandlerFunc {
 // @name Authorization
 // @BasePath /api/v1
 // @Query.collection.format multi
-func NewServer(bindAddr, jwt_key string) (*Server, error) {
-	socket, err := socket.New()
+func NewServer(bindAddr, jwt_key, adminToken string, releases Releases, keys auth.Keys, repo storage.Repository, compactor *storage.Compactor) (*Server, error) {
+	socket, err := socket.New(keys, repo)
 
 	if err != nil {
 		logrus.Fatal(err)
@@ -67,9 +87,15 @@ func NewServer(bindAddr, jwt_key string) (*Server, error) {
 	//defer socketIO.Close()
 
 	server := &Server{
-		jwt_key: jwt_key,
-		log:     logrus.WithField("subsystem", "web_server"),
-		socket:  socket,
+		jwt_key:    jwt_key,
+		adminToken: adminToken,
+		log:        logrus.WithField("subsystem", "web_server"),
+		socket:     socket,
+		storage:    repo,
+
+		compactor: compactor,
+
+		releases: releases,
 	}
 	server.stop = make(chan struct{})
 
@@ -78,9 +104,29 @@ func NewServer(bindAddr, jwt_key string) (*Server, error) {
 	router.Use(gin.Logger())
 	router.Use(CORSMiddleware())
 
+	if adminToken == "" {
+		server.log.Warn("admin token is not set, config, schedule, release and compaction changes are refused")
+	}
+
 	r := router.Group("api/v1")
 	{
 		r.POST("/controller/command/:n", server.Controller)
+		r.GET("/controllers/:serial/health", server.ControllerHealth)
+		r.GET("/controllers/:serial/config", server.ControllerConfig)
+		r.PUT("/controllers/:serial/config", server.admin, server.SetControllerConfig)
+		r.GET("/controllers/:serial/update", server.ControllerUpdate)
+		r.GET("/controllers/:serial/schedule", server.ControllerSchedule)
+		r.PUT("/controllers/:serial/schedule", server.admin, server.SetControllerSchedule)
+		r.GET("/controllers/:serial/devices", server.ControllerDevices)
+		r.GET("/controllers/:serial/shadow", server.ControllerShadow)
+		r.DELETE("/controllers/:serial/shadow/desired", server.admin, server.ClearControllerDesired)
+		r.GET("/controllers/:serial/zones/:zone/history", server.ControllerHistory)
+		r.POST("/controllers/:serial/mobile", server.admin, server.PairMobile)
+		r.GET("/admin/compaction", server.admin, server.Compaction)
+		r.POST("/admin/compaction", server.admin, server.Compact)
+		r.GET("/agent/release", server.Release)
+		r.PUT("/agent/release", server.admin, server.AnnounceRelease)
+		r.GET("/agent/releases/:version", server.ReleaseBinary)
 
 		router.GET("/socket.io/*any", gin.WrapH(socketIO))
 		router.POST("/socket.io/*any", gin.WrapH(socketIO))
@@ -91,6 +137,15 @@ func NewServer(bindAddr, jwt_key string) (*Server, error) {
 		Addr:    bindAddr,
 		Handler: router,
 	}
+	if compactor != nil {
+		server.wg.Add(1)
+
+		go func() {
+			defer server.wg.Done()
+			compactor.Run(server.stop)
+		}()
+	}
+
 	server.wg.Add(1)
 
 	go func() {
@@ -0,0 +1,180 @@
+package socket
+
+import (
+	"encoding/json"
+	"iLean/entity"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// staleAfter is how old telemetry and health may be before a snapshot
+// marks it stale, the agent sends them every few seconds.
+const staleAfter = 2 * time.Minute
+
+// cacheKey tells the messages of an agent apart: by command, controller
+// and, for the telemetry of command 1 that comes per zone, by zone.
+type cacheKey struct {
+	command    int
+	busAddress int32
+	zone       int32
+}
+
+type cachedMessage struct {
+	message []byte
+	at      time.Time
+}
+
+// agentCache is the last message of each kind an agent sent and how many
+// connections of the agent are open.
+type agentCache struct {
+	messages  map[cacheKey]cachedMessage
+	connected int
+}
+
+// remember caches the message the agent sent. Buffered telemetry older
+// than the cached message does not replace it, acks are not cached.
+func (h *Hub) remember(serialNumber int, command entity.Command, message []byte) {
+	if command.TypeCommand == entity.CommandAck {
+		return
+	}
+
+	key := cacheKey{command: command.TypeCommand, busAddress: command.BusAddress}
+	if command.TypeCommand == 1 {
+		var data entity.DataCommandTemperature
+		if err := json.Unmarshal(command.Data, &data); err != nil {
+			return
+		}
+		key.zone = data.Zone
+	}
+
+	at := time.Now()
+	if command.Timestamp > 0 {
+		at = time.Unix(0, command.Timestamp*int64(time.Millisecond))
+	}
+
+	h.cacheMutex.Lock()
+	defer h.cacheMutex.Unlock()
+
+	cache := h.agentCache(serialNumber)
+	if cached, ok := cache.messages[key]; ok && cached.at.After(at) {
+		return
+	}
+
+	cache.messages[key] = cachedMessage{message: message, at: at}
+}
+
+// agentConnected counts the open connections of the agent, up by one or
+// down by one when it is false.
+func (h *Hub) agentConnected(serialNumber int, connected bool) {
+	h.cacheMutex.Lock()
+	defer h.cacheMutex.Unlock()
+
+	cache := h.agentCache(serialNumber)
+	if connected {
+		cache.connected++
+	} else if cache.connected > 0 {
+		cache.connected--
+	}
+}
+
+// Snapshot returns the last message of each kind the agent sent, oldest
+// first. Messages are stale while the agent is not connected or their
+// controller is silent, telemetry and health also once they are older than
+// staleAfter.
+func (h *Hub) Snapshot(serialNumber int) entity.Snapshot {
+	silent := make(map[int32]bool)
+	for _, device := range h.Devices(serialNumber) {
+		silent[device.BusAddress] = device.Stale
+	}
+
+	h.cacheMutex.Lock()
+	defer h.cacheMutex.Unlock()
+
+	now := time.Now()
+	snapshot := entity.Snapshot{SerialNumber: serialNumber, At: now, Messages: []entity.CachedMessage{}}
+
+	cache, ok := h.cache[serialNumber]
+	if !ok {
+		return snapshot
+	}
+	snapshot.Connected = cache.connected > 0
+
+	keys := make([]cacheKey, 0, len(cache.messages))
+	for key := range cache.messages {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if at, bt := cache.messages[a].at, cache.messages[b].at; !at.Equal(bt) {
+			return at.Before(bt)
+		}
+		if a.command != b.command {
+			return a.command < b.command
+		}
+		if a.busAddress != b.busAddress {
+			return a.busAddress < b.busAddress
+		}
+		return a.zone < b.zone
+	})
+
+	for _, key := range keys {
+		cached := cache.messages[key]
+		stale := !snapshot.Connected || silent[key.busAddress]
+
+		switch key.command {
+		case 1, 2, 3, 7, 8, entity.CommandHealth:
+			stale = stale || now.Sub(cached.at) > staleAfter
+		}
+
+		snapshot.Messages = append(snapshot.Messages, entity.CachedMessage{
+			Message: cached.message,
+			At:      cached.at.UTC(),
+			Stale:   stale,
+		})
+	}
+
+	return snapshot
+}
+
+// registerMobile queues the snapshot of the agent for a mobile client that
+// just connected and registers the client before messages are sent again:
+// messages are cached before they are sent, so what the snapshot misses
+// reaches the client live and nothing live overtakes the snapshot.
+func (h *Hub) registerMobile(client *Client) {
+	h.clientsMutex.Lock()
+	defer h.clientsMutex.Unlock()
+
+	h.sendSnapshot(client)
+	h.clients[client] = true
+}
+
+// sendSnapshot queues the snapshot of the agent for the client.
+func (h *Hub) sendSnapshot(client *Client) {
+	command, err := entity.NewCommand(h.Snapshot(client.serialNumber), 2)
+	if err != nil {
+		logrus.WithError(err).Error("failed to build snapshot command")
+		return
+	}
+
+	data, err := json.Marshal(command)
+	if err != nil {
+		logrus.WithError(err).Error("failed to marshal snapshot command")
+		return
+	}
+
+	client.queue(data)
+}
+
+// agentCache returns the cache of the agent, the caller holds cacheMutex.
+func (h *Hub) agentCache(serialNumber int) *agentCache {
+	cache, ok := h.cache[serialNumber]
+	if !ok {
+		cache = &agentCache{messages: make(map[cacheKey]cachedMessage)}
+		h.cache[serialNumber] = cache
+	}
+
+	return cache
+}
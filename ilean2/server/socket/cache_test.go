@@ -0,0 +1,204 @@
+package socket
+
+import (
+	"encoding/json"
+	"iLean/entity"
+	"testing"
+	"time"
+)
+
+func cachedCommand(t *testing.T, typeCommand int, address int32, at time.Time, data interface{}) (entity.Command, []byte) {
+	t.Helper()
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	command := entity.Command{
+		TypeCommand: typeCommand,
+		BusAddress:  address,
+		Timestamp:   at.UnixNano() / int64(time.Millisecond),
+		Data:        raw,
+	}
+
+	message, err := json.Marshal(command)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return command, message
+}
+
+func TestSnapshotStale(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-staleAfter - time.Minute)
+
+	tests := []struct {
+		name        string
+		typeCommand int
+		address     int32
+		at          time.Time
+		data        interface{}
+		connected   bool
+		silent      bool
+		want        bool
+	}{
+		{"fresh telemetry", 1, 101, now, entity.DataCommandTemperature{Zone: 1}, true, false, false},
+		{"old telemetry", 1, 101, old, entity.DataCommandTemperature{Zone: 1}, true, false, true},
+		{"old health", entity.CommandHealth, 0, old, entity.Health{}, true, false, true},
+		{"old config status", entity.CommandConfigStatus, 0, old, entity.ConfigStatus{}, true, false, false},
+		{"agent not connected", 1, 101, now, entity.DataCommandTemperature{Zone: 1}, false, false, true},
+		{"controller silent", 1, 101, now, entity.DataCommandTemperature{Zone: 1}, true, true, true},
+		{"other controller silent", 1, 102, now, entity.DataCommandTemperature{Zone: 1}, true, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := newHub(nil, nopRepo{})
+
+			if tt.connected {
+				hub.agentConnected(testSerial, true)
+			}
+
+			hub.deviceReported(testSerial, entity.DeviceStatus{BusAddress: 101, Status: entity.DeviceResponding})
+			if tt.silent {
+				hub.deviceReported(testSerial, entity.DeviceStatus{BusAddress: 101, Status: entity.DeviceSilent})
+			}
+
+			command, message := cachedCommand(t, tt.typeCommand, tt.address, tt.at, tt.data)
+			hub.remember(testSerial, command, message)
+
+			snapshot := hub.Snapshot(testSerial)
+			if snapshot.Connected != tt.connected {
+				t.Errorf("connected = %v, want %v", snapshot.Connected, tt.connected)
+			}
+
+			if len(snapshot.Messages) != 1 {
+				t.Fatalf("got %d messages, want 1", len(snapshot.Messages))
+			}
+
+			if got := snapshot.Messages[0].Stale; got != tt.want {
+				t.Errorf("stale = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRememberKeepsNewer(t *testing.T) {
+	hub := newHub(nil, nopRepo{})
+	now := time.Now()
+
+	command, message := cachedCommand(t, 1, 101, now, entity.DataCommandTemperature{Zone: 1, TempAir: 22})
+	hub.remember(testSerial, command, message)
+
+	buffered, bufferedMessage := cachedCommand(t, 1, 101, now.Add(-time.Hour), entity.DataCommandTemperature{Zone: 1, TempAir: 18})
+	hub.remember(testSerial, buffered, bufferedMessage)
+
+	other, otherMessage := cachedCommand(t, 1, 101, now, entity.DataCommandTemperature{Zone: 2, TempAir: 20})
+	hub.remember(testSerial, other, otherMessage)
+
+	messages := hub.Snapshot(testSerial).Messages
+	if len(messages) != 2 {
+		t.Fatalf("got %d messages, want one per zone", len(messages))
+	}
+
+	for _, cached := range messages {
+		if string(cached.Message) == string(bufferedMessage) {
+			t.Error("buffered telemetry replaced newer telemetry")
+		}
+	}
+}
+
+func TestRegisterMobile(t *testing.T) {
+	hub := newHub(nil, nopRepo{})
+	agent := &Client{hub: hub, send: make(chan []byte, 4), typeClient: "controller", serialNumber: testSerial}
+
+	before := message(t, 1, entity.DataCommandTemperature{Zone: 1, TempAir: 21})
+	agent.handle(before)
+
+	app := &Client{hub: hub, send: make(chan []byte, 4), typeClient: "mobile", serialNumber: testSerial}
+	hub.registerMobile(app)
+
+	after := message(t, 1, entity.DataCommandTemperature{Zone: 2, TempAir: 22})
+	agent.handle(after)
+
+	var command entity.Command
+	if err := json.Unmarshal(<-app.send, &command); err != nil {
+		t.Fatal(err)
+	}
+
+	if command.TypeCommand != entity.CommandSnapshot {
+		t.Fatalf("first message is command %d, want the snapshot", command.TypeCommand)
+	}
+
+	var snapshot entity.Snapshot
+	if err := json.Unmarshal(command.Data, &snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(snapshot.Messages) != 1 || string(snapshot.Messages[0].Message) != string(before) {
+		t.Errorf("snapshot = %+v, want the message sent before", snapshot.Messages)
+	}
+
+	select {
+	case got := <-app.send:
+		if string(got) != string(after) {
+			t.Errorf("forwarded %s, want %s", got, after)
+		}
+	default:
+		t.Error("message sent after the snapshot is not forwarded")
+	}
+}
+
+func TestRegisterMobileWhileSending(t *testing.T) {
+	const zones = 50
+
+	hub := newHub(nil, nopRepo{})
+	agent := &Client{hub: hub, send: make(chan []byte, 4), typeClient: "controller", serialNumber: testSerial}
+	app := &Client{hub: hub, send: make(chan []byte, 2*zones), typeClient: "mobile", serialNumber: testSerial}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for zone := int32(1); zone <= zones; zone++ {
+			agent.handle(message(t, 1, entity.DataCommandTemperature{Zone: zone}))
+		}
+	}()
+
+	hub.registerMobile(app)
+	<-done
+	close(app.send)
+
+	// every message is in the snapshot or forwarded after it
+	seen := make(map[int32]bool)
+	zone := func(raw []byte) {
+		var command entity.Command
+		var data entity.DataCommandTemperature
+		if json.Unmarshal(raw, &command) != nil || json.Unmarshal(command.Data, &data) != nil {
+			t.Fatalf("bad message %s", raw)
+		}
+		seen[data.Zone] = true
+	}
+
+	var command entity.Command
+	if err := json.Unmarshal(<-app.send, &command); err != nil || command.TypeCommand != entity.CommandSnapshot {
+		t.Fatalf("first message is not the snapshot: %v", err)
+	}
+
+	var snapshot entity.Snapshot
+	if err := json.Unmarshal(command.Data, &snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cached := range snapshot.Messages {
+		zone(cached.Message)
+	}
+	for raw := range app.send {
+		zone(raw)
+	}
+
+	if len(seen) != zones {
+		t.Errorf("app got %d of %d zones", len(seen), zones)
+	}
+}
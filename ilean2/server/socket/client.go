@@ -2,6 +2,7 @@ package socket
 
 import (
 	"encoding/json"
+	"iLean/auth"
 	"iLean/entity"
 	"log"
 	"net/http"
@@ -56,6 +57,9 @@ type Client struct {
 // reads from this goroutine.
 func (c *Client) readPump() {
 	defer func() {
+		if c.typeClient == "controller" {
+			c.hub.agentConnected(c.serialNumber, false)
+		}
 		c.hub.unregister <- c
 		c.conn.Close()
 	}()
@@ -77,74 +81,202 @@ func (c *Client) readPump() {
 			break
 		}
 
-		var command entity.Command
+		c.handle(message)
+	}
+}
+
+// handle takes a message of the client. What a controller sends is
+// dispatched to the hub, stored and cached; every message goes to the
+// mobile clients of the serial number.
+func (c *Client) handle(message []byte) {
+	var command entity.Command
+
+	err := json.Unmarshal(message, &command)
+
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+
+	logrus.Info(c.serialNumber, " ", "command come ", command.TypeCommand)
+
+	// mobile clients are only relayed, what they send must not pass for
+	// the controller's telemetry, acks or reports
+	if c.typeClient == "controller" {
+		if !c.dispatch(command) {
+			return
+		}
+
+		// telemetry 1, 2, 3, 7 and 8 is kept, other messages carry none
+		c.hub.store(c.serialNumber, command)
+		c.hub.remember(c.serialNumber, command, message)
+	}
+
+	logrus.Info(c.serialNumber, " ", "before send func")
+
+	c.hub.Send("mobile", c.serialNumber, message)
+}
 
-		err = json.Unmarshal(message, &command)
+// dispatch hands a message of the controller to the hub, false if its data
+// does not decode.
+func (c *Client) dispatch(command entity.Command) bool {
+	switch command.TypeCommand {
+	case 1:
+		var dataCommandTemperature entity.DataCommandTemperature
+		err := json.Unmarshal(command.Data, &dataCommandTemperature)
 
 		if err != nil {
 			logrus.Error(err)
-			continue
+			return false
 		}
+		logrus.Info(c.serialNumber, " ", dataCommandTemperature)
 
-		logrus.Info(c.serialNumber, " ", "command come ", command.TypeCommand)
+		c.hub.zonesSeen(c.serialNumber, command.BusAddress, dataCommandTemperature.Zone)
+	case 2:
+		var dataCommandTemperatureBySensor []entity.DataCommandTemperatureBySensor
+		err := json.Unmarshal(command.Data, &dataCommandTemperatureBySensor)
 
-		switch command.TypeCommand {
-		case 1:
-			var dataCommandTemperature entity.DataCommandTemperature
-			err = json.Unmarshal(command.Data, &dataCommandTemperature)
+		if err != nil {
+			logrus.Error(err)
+			return false
+		}
+		logrus.Info(c.serialNumber, " ", dataCommandTemperatureBySensor)
 
-			if err != nil {
-				logrus.Error(err)
-				continue
-			}
-			logrus.Info(c.serialNumber, " ", dataCommandTemperature)
-		case 2:
-			var dataCommandTemperatureBySensor []entity.DataCommandTemperatureBySensor
-			err = json.Unmarshal(command.Data, &dataCommandTemperatureBySensor)
+		for _, row := range dataCommandTemperatureBySensor {
+			c.hub.zonesSeen(c.serialNumber, command.BusAddress, row.Zone)
+		}
+		c.hub.setpointsReported(c.serialNumber, command.BusAddress, dataCommandTemperatureBySensor)
+	case 3:
+		var dataVent []entity.DataVent
+		err := json.Unmarshal(command.Data, &dataVent)
 
-			if err != nil {
-				logrus.Error(err)
-				continue
-			}
-			logrus.Info(c.serialNumber, " ", dataCommandTemperatureBySensor)
-		case 3:
-			var dataVent []entity.DataVent
-			err = json.Unmarshal(command.Data, &dataVent)
+		if err != nil {
+			logrus.Error(err)
+			return false
+		}
+		logrus.Info(c.serialNumber, " ", dataVent)
 
-			if err != nil {
-				logrus.Error(err)
-				continue
-			}
-			logrus.Info(c.serialNumber, " ", dataVent)
-		case 7:
-			var dataVentModule entity.DataVentModule
-			err = json.Unmarshal(command.Data, &dataVentModule)
+		for _, row := range dataVent {
+			c.hub.zonesSeen(c.serialNumber, command.BusAddress, int32(row.Zone))
+		}
+		c.hub.ventReported(c.serialNumber, command.BusAddress, dataVent)
+	case 7:
+		var dataVentModule entity.DataVentModule
+		err := json.Unmarshal(command.Data, &dataVentModule)
 
-			if err != nil {
-				logrus.Error(err)
-				continue
-			}
-			logrus.Info(c.serialNumber, " ", dataVentModule)
-		case 8:
-			var dataCommandTemperatureBySensor []entity.DataCommandTemperatureBySensor
-			logrus.Infof("command's data: %s", string(command.Data))
-			err = json.Unmarshal(command.Data, &dataCommandTemperatureBySensor)
+		if err != nil {
+			logrus.Error(err)
+			return false
+		}
+		logrus.Info(c.serialNumber, " ", dataVentModule)
 
-			if err != nil {
-				logrus.Error(err)
-				continue
-			}
-			logrus.Info(c.serialNumber, " ", dataCommandTemperatureBySensor)
+		c.hub.moduleReported(c.serialNumber, command.BusAddress, dataVentModule)
+	case 8:
+		var dataCommandHumidityModule []entity.DataCommandHumidityModule
+		logrus.Infof("command's data: %s", string(command.Data))
+		err := json.Unmarshal(command.Data, &dataCommandHumidityModule)
+
+		if err != nil {
+			logrus.Error(err)
+			return false
+		}
+		logrus.Info(c.serialNumber, " ", dataCommandHumidityModule)
+
+		for _, row := range dataCommandHumidityModule {
+			c.hub.zonesSeen(c.serialNumber, command.BusAddress, row.Zone)
+		}
+		c.hub.humidityReported(c.serialNumber, command.BusAddress, dataCommandHumidityModule)
+
+	case entity.CommandAck:
+		var ack entity.Ack
+		err := json.Unmarshal(command.Data, &ack)
+
+		if err != nil {
+			logrus.Error(err)
+			return false
+		}
+		logrus.Info(c.serialNumber, " ", ack)
+
+		c.hub.ack(ack)
+
+	case entity.CommandHealth:
+		var health entity.Health
+		err := json.Unmarshal(command.Data, &health)
+
+		if err != nil {
+			logrus.Error(err)
+			return false
+		}
+		logrus.Info(c.serialNumber, " ", health)
+
+		c.hub.setHealth(c.serialNumber, health)
+
+	case entity.CommandConfigStatus:
+		var status entity.ConfigStatus
+		err := json.Unmarshal(command.Data, &status)
+
+		if err != nil {
+			logrus.Error(err)
+			return false
+		}
+		logrus.Info(c.serialNumber, " ", status)
+
+		c.hub.configReported(c.serialNumber, status)
+
+	case entity.CommandUpdateStatus:
+		var status entity.UpdateStatus
+		err := json.Unmarshal(command.Data, &status)
+
+		if err != nil {
+			logrus.Error(err)
+			return false
+		}
+		logrus.Info(c.serialNumber, " ", status)
+
+		c.hub.updateReported(c.serialNumber, status)
 
-		default:
-			logrus.Error("not found command for unmarshaling command")
+	case entity.CommandScheduleStatus:
+		var status entity.ScheduleStatus
+		err := json.Unmarshal(command.Data, &status)
+
+		if err != nil {
+			logrus.Error(err)
+			return false
+		}
+		logrus.Info(c.serialNumber, " ", status)
+
+		c.hub.scheduleReported(c.serialNumber, status)
+
+	case entity.CommandScheduleReport:
+		var report entity.ScheduleReport
+		err := json.Unmarshal(command.Data, &report)
+
+		if err != nil {
+			logrus.Error(err)
+			return false
 		}
+		logrus.Info(c.serialNumber, " ", len(report.Actions), " scheduled actions")
+
+		c.hub.scheduleActions(c.serialNumber, report)
+
+	case entity.CommandDeviceStatus:
+		var status entity.DeviceStatus
+		err := json.Unmarshal(command.Data, &status)
 
-		logrus.Info(c.serialNumber, " ", "before send func")
+		if err != nil {
+			logrus.Error(err)
+			return false
+		}
+		logrus.Info(c.serialNumber, " ", status)
 
-		c.hub.Send("mobile", c.serialNumber, message)
+		// mobile clients get the status as well and grey the zones out
+		c.hub.deviceReported(c.serialNumber, status)
 
+	default:
+		logrus.Error("not found command for unmarshaling command")
 	}
+
+	return true
 }
 
 // writePump pumps messages from the hub to the websocket connection.
@@ -153,44 +285,45 @@ func (c *Client) readPump() {
 // application ensures that there is at most one writer to a connection by
 // executing all writes from this goroutine.
 func (c *Client) writePump() {
-	//ticker := time.NewTicker(pingPeriod)
-	//defer func() {
-	//	ticker.Stop()
-	//	c.conn.Close()
-	//}()
-	//for {
-	//	select {
-	//	case message, ok := <-c.send:
-	//		c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-	//		if !ok {
-	//			// The hub closed the channel.
-	//			c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-	//			return
-	//		}
-	//
-	//		w, err := c.conn.NextWriter(websocket.TextMessage)
-	//		if err != nil {
-	//			return
-	//		}
-	//		w.Write(message)
-	//
-	//		// Add queued chat messages to the current websocket message.
-	//		n := len(c.send)
-	//		for i := 0; i < n; i++ {
-	//			w.Write(newline)
-	//			w.Write(<-c.send)
-	//		}
-	//
-	//		if err := w.Close(); err != nil {
-	//			return
-	//		}
-	//	case <-ticker.C:
-	//		c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-	//		if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-	//			return
-	//		}
-	//	}
-	//}
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+	for {
+		select {
+		case message, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				// The hub closed the channel.
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+
+			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				logrus.Error(err)
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// queue hands the message to writePump, false if the send buffer is full.
+// The send channel must stay open meanwhile: the client is not registered
+// yet or the caller holds the read lock of clientsMutex.
+func (c *Client) queue(message []byte) bool {
+	select {
+	case c.send <- message:
+		return true
+	default:
+		logrus.WithField(c.typeClient, c.serialNumber).Warn("send buffer is full, message dropped")
+		return false
+	}
 }
 
 // serveWs handles websocket requests from the peer.
@@ -206,10 +339,7 @@ func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var greet struct {
-		SerialNumber int    `json:"serial_number"`
-		TypeClient   string `json:"type_client"`
-	}
+	var greet auth.Greet
 
 	_, message, err := conn.ReadMessage()
 	if err != nil {
@@ -228,16 +358,37 @@ func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if greet.SerialNumber < 1 && (greet.TypeClient != "controller" || greet.TypeClient != "mobile") {
+	if greet.SerialNumber < 1 || (greet.TypeClient != "controller" && greet.TypeClient != "mobile") {
 		if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 			log.Printf("error: %v", err)
 		}
 		return
 	}
 
+	if err := hub.identify(greet); err != nil {
+		logrus.WithError(err).WithField(greet.TypeClient, greet.SerialNumber).Warn("greeting rejected")
+		conn.WriteMessage(websocket.TextMessage, []byte("unauthorized"))
+		conn.Close()
+		return
+	}
+
 	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256), serialNumber: greet.SerialNumber, typeClient: greet.TypeClient}
 
-	client.hub.register <- client
+	// queued before the client is registered, so the reply to the greeting
+	// goes out ahead of any message of the hub
+	client.queue([]byte("ok"))
+
+	if client.typeClient == "controller" {
+		hub.announceTo(client)
+		// settings written while the agent was away
+		hub.pushShadow(client)
+
+		client.hub.register <- client
+		hub.agentConnected(client.serialNumber, true)
+	} else {
+		// the app shows the last known state until fresh messages come
+		hub.registerMobile(client)
+	}
 
 	logrus.Info("okkkkkk")
 
@@ -245,10 +396,4 @@ func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	// new goroutines.
 	go client.writePump()
 	go client.readPump()
-
-	err = conn.WriteMessage(websocket.TextMessage, []byte("ok"))
-
-	if err != nil {
-		logrus.Error(err)
-	}
 }
@@ -0,0 +1,102 @@
+package socket
+
+import (
+	"encoding/json"
+	"iLean/entity"
+	"iLean/server/storage"
+	"testing"
+)
+
+// nopRepo takes the place of a repository, readings are only queued while
+// persist is not running.
+type nopRepo struct {
+	storage.Repository
+}
+
+func message(t *testing.T, typeCommand int, data interface{}) []byte {
+	t.Helper()
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message, err := json.Marshal(entity.Command{TypeCommand: typeCommand, BusAddress: 101, Data: raw})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return message
+}
+
+func TestHandle(t *testing.T) {
+	telemetry := message(t, 1, entity.DataCommandTemperature{Zone: 1, TempAir: 21})
+	health := message(t, entity.CommandHealth, entity.Health{})
+
+	tests := []struct {
+		name       string
+		typeClient string
+		// kept is whether the messages are stored and cached.
+		kept bool
+	}{
+		{"controller", "controller", true},
+		{"mobile", "mobile", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := newHub(nil, nopRepo{})
+
+			app := &Client{hub: hub, send: make(chan []byte, 4), typeClient: "mobile", serialNumber: testSerial}
+			hub.clients[app] = true
+
+			sender := &Client{hub: hub, send: make(chan []byte, 4), typeClient: tt.typeClient, serialNumber: testSerial}
+			sender.handle(telemetry)
+			sender.handle(health)
+
+			for _, want := range [][]byte{telemetry, health} {
+				select {
+				case got := <-app.send:
+					if string(got) != string(want) {
+						t.Errorf("forwarded %s, want %s", got, want)
+					}
+				default:
+					t.Fatalf("%s is not forwarded to the app", want)
+				}
+			}
+
+			if stored := len(hub.readings) > 0; stored != tt.kept {
+				t.Errorf("telemetry stored %v, want %v", stored, tt.kept)
+			}
+
+			if cached := len(hub.Snapshot(testSerial).Messages) > 0; cached != tt.kept {
+				t.Errorf("messages cached %v, want %v", cached, tt.kept)
+			}
+
+			if _, ok := hub.Health(testSerial); ok != tt.kept {
+				t.Errorf("health taken %v, want %v", ok, tt.kept)
+			}
+		})
+	}
+}
+
+func TestHealthLatest(t *testing.T) {
+	hub := newHub(nil, nopRepo{})
+	agent := &Client{hub: hub, send: make(chan []byte, 4), typeClient: "controller", serialNumber: testSerial}
+
+	if _, ok := hub.Health(testSerial); ok {
+		t.Fatal("health before any report")
+	}
+
+	agent.handle(message(t, entity.CommandHealth, entity.Health{Version: "v1.0.0", Frames: 1}))
+	agent.handle(message(t, entity.CommandHealth, entity.Health{Version: "v1.0.0", Frames: 9}))
+
+	report, ok := hub.Health(testSerial)
+	if !ok {
+		t.Fatal("no health report")
+	}
+
+	if report.Frames != 9 || report.Version != "v1.0.0" || report.ReceivedAt.IsZero() {
+		t.Errorf("report = %+v, want the latest one", report)
+	}
+}
@@ -1,15 +1,28 @@
 package socket
 
 import (
-	"github.com/gorilla/websocket"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iLean/auth"
+	"iLean/entity"
+	"iLean/server/storage"
+	"sort"
+	"sync"
+	"time"
+
 	"github.com/sirupsen/logrus"
 )
 
 // Hub maintains the set of active clients and broadcasts messages to the
 // clients.
 type Hub struct {
-	// Registered clients.
-	clients map[*Client]bool
+	// Registered clients, changed by run only. A client's send channel is
+	// closed under the write lock, so it is safe to queue to under the read
+	// lock.
+	clientsMutex sync.RWMutex
+	clients      map[*Client]bool
 
 	// Inbound messages from the clients.
 	broadcast chan []byte
@@ -19,14 +32,75 @@ type Hub struct {
 
 	// Unregister requests from clients.
 	unregister chan *Client
+
+	// Keys of the controllers by serial number, nil if commands are not
+	// signed. greets rejects replayed greetings.
+	keys   auth.Keys
+	greets *auth.Replay
+
+	// repo stores the telemetry of the controllers, readings queues it for
+	// persist. Nil if telemetry is not stored.
+	repo     storage.Repository
+	readings chan []storage.Reading
+
+	// Waiters for command acks by command id.
+	acksMutex sync.Mutex
+	acks      map[string]chan entity.Ack
+
+	// Latest health report by controller serial number.
+	healthMutex sync.Mutex
+	health      map[int]entity.HealthReport
+
+	// Desired agent config and the status the agent reported last by
+	// controller serial number.
+	configMutex sync.Mutex
+	configs     map[int]entity.ConfigState
+
+	// Release announced to every agent and the update status each agent
+	// reported last by controller serial number.
+	releaseMutex sync.Mutex
+	release      *entity.Release
+	updates      map[int]entity.UpdateState
+
+	// Desired schedule, the status the agent reported last and the actions
+	// it took by the schedule by controller serial number.
+	scheduleMutex sync.Mutex
+	schedules     map[int]entity.ScheduleState
+
+	// What is known about each controller on the bus of an agent by
+	// controller serial number and bus address.
+	devicesMutex sync.Mutex
+	devices      map[int]map[int32]*entity.DeviceState
+
+	// Desired and reported settings of the controllers by controller
+	// serial number.
+	shadowMutex sync.Mutex
+	shadows     map[int]*shadow
+
+	// Last message of each kind and the open connections by controller
+	// serial number, mobile clients get them when they connect.
+	cacheMutex sync.Mutex
+	cache      map[int]*agentCache
 }
 
-func newHub() *Hub {
+func newHub(keys auth.Keys, repo storage.Repository) *Hub {
 	return &Hub{
+		keys:       keys,
+		repo:       repo,
+		readings:   make(chan []storage.Reading, readingsBuffer),
+		greets:     auth.NewReplay(greetWindow),
 		broadcast:  make(chan []byte),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 		clients:    make(map[*Client]bool),
+		acks:       make(map[string]chan entity.Ack),
+		health:     make(map[int]entity.HealthReport),
+		configs:    make(map[int]entity.ConfigState),
+		updates:    make(map[int]entity.UpdateState),
+		schedules:  make(map[int]entity.ScheduleState),
+		devices:    make(map[int]map[int32]*entity.DeviceState),
+		shadows:    make(map[int]*shadow),
+		cache:      make(map[int]*agentCache),
 	}
 }
 
@@ -35,18 +109,23 @@ func (h *Hub) run() {
 	for {
 		select {
 		case client := <-h.register:
+			h.clientsMutex.Lock()
 			h.clients[client] = true
+			count := len(h.clients)
+			h.clientsMutex.Unlock()
 
-			logrus.Info(len(h.clients))
+			logrus.Info(count)
 
 		case client := <-h.unregister:
+			h.clientsMutex.Lock()
 			if _, ok := h.clients[client]; ok {
 				delete(h.clients, client)
 				close(client.send)
 			}
+			h.clientsMutex.Unlock()
 
 		case message := <-h.broadcast:
-
+			h.clientsMutex.Lock()
 			for client := range h.clients {
 				select {
 				case client.send <- message:
@@ -55,11 +134,25 @@ func (h *Hub) run() {
 					delete(h.clients, client)
 				}
 			}
+			h.clientsMutex.Unlock()
 		}
 	}
 }
 
-func (h *Hub) Send(typeClient string, serialNumber int, message []byte) {
+// Send queues the message to every client of the type with the serial
+// number and returns how many clients it was queued to.
+func (h *Hub) Send(typeClient string, serialNumber int, message []byte) int {
+	sent := 0
+
+	if typeClient == "controller" {
+		sealed, err := h.seal(serialNumber, message)
+		if err != nil {
+			logrus.WithError(err).WithField("controller", serialNumber).Error("failed to sign command")
+			return 0
+		}
+
+		message = sealed
+	}
 
 	//logrus.Info("send ")
 	//
@@ -69,13 +162,14 @@ func (h *Hub) Send(typeClient string, serialNumber int, message []byte) {
 	//	logrus.Info("failed to marshal")
 	//}
 
+	h.clientsMutex.RLock()
+	defer h.clientsMutex.RUnlock()
+
 	for client := range h.clients {
 
 		if client.typeClient == typeClient && client.serialNumber == serialNumber {
-			err := client.conn.WriteMessage(websocket.TextMessage, message)
-
-			if err != nil {
-				logrus.Error(err)
+			if client.queue(message) {
+				sent++
 			}
 
 			logrus.WithField(typeClient, serialNumber).Info("send messages")
@@ -91,9 +185,530 @@ func (h *Hub) Send(typeClient string, serialNumber int, message []byte) {
 		//	delete(h.clients, client)
 		//}
 	}
+
+	return sent
 }
 
 func (h *Hub) GetCountClient() int {
+	h.clientsMutex.RLock()
+	defer h.clientsMutex.RUnlock()
 
 	return len(h.clients)
 }
+
+// Expect returns a channel receiving the acks of the command until Forget
+// is called.
+func (h *Hub) Expect(id string) <-chan entity.Ack {
+	acks := make(chan entity.Ack, 4)
+
+	h.acksMutex.Lock()
+	h.acks[id] = acks
+	h.acksMutex.Unlock()
+
+	return acks
+}
+
+func (h *Hub) Forget(id string) {
+	h.acksMutex.Lock()
+	delete(h.acks, id)
+	h.acksMutex.Unlock()
+}
+
+func (h *Hub) ack(ack entity.Ack) {
+	switch ack.Status {
+	case entity.AckFailed:
+		h.shadowFailed(ack.ID)
+	case entity.AckConfirmed:
+		h.shadowConfirmed(ack.ID)
+	}
+
+	h.acksMutex.Lock()
+	defer h.acksMutex.Unlock()
+
+	acks, ok := h.acks[ack.ID]
+	if !ok {
+		return
+	}
+
+	select {
+	case acks <- ack:
+	default:
+		logrus.WithField("id", ack.ID).Warn("ack dropped, waiter is not reading")
+	}
+}
+
+// Health returns the latest health report of the controller.
+func (h *Hub) Health(serialNumber int) (entity.HealthReport, bool) {
+	h.healthMutex.Lock()
+	defer h.healthMutex.Unlock()
+
+	report, ok := h.health[serialNumber]
+	return report, ok
+}
+
+func (h *Hub) setHealth(serialNumber int, health entity.Health) {
+	h.healthMutex.Lock()
+	defer h.healthMutex.Unlock()
+
+	h.health[serialNumber] = entity.HealthReport{Health: health, ReceivedAt: time.Now()}
+}
+
+// Config returns the desired config of the agent and what it reported.
+func (h *Hub) Config(serialNumber int) (entity.ConfigState, bool) {
+	h.configMutex.Lock()
+	defer h.configMutex.Unlock()
+
+	state, ok := h.configs[serialNumber]
+	return state, ok
+}
+
+// SetConfig makes the YAML the desired config of the agent under the next
+// version and pushes it if the agent is connected, otherwise it is pushed
+// once the agent reports an older version.
+func (h *Hub) SetConfig(serialNumber int, configYAML string) (entity.AgentConfig, bool) {
+	h.configMutex.Lock()
+
+	state := h.configs[serialNumber]
+
+	version := 0
+	if state.Desired != nil {
+		version = state.Desired.Version
+	}
+	if state.Reported != nil && state.Reported.Version > version {
+		version = state.Reported.Version
+	}
+
+	desired := entity.AgentConfig{Version: version + 1, Config: configYAML}
+	state.Desired = &desired
+	h.configs[serialNumber] = state
+
+	h.configMutex.Unlock()
+
+	return desired, h.pushConfig(serialNumber, desired)
+}
+
+// configReported stores the status and pushes the desired config when the
+// agent runs an older one. A version the agent rejected or rolled back is
+// not pushed again, it takes a new version.
+func (h *Hub) configReported(serialNumber int, status entity.ConfigStatus) {
+	h.configMutex.Lock()
+
+	state := h.configs[serialNumber]
+	state.Reported = &status
+	state.ReportedAt = time.Now()
+	h.configs[serialNumber] = state
+
+	desired := state.Desired
+
+	h.configMutex.Unlock()
+
+	if desired != nil && desired.Version > status.Version {
+		h.pushConfig(serialNumber, *desired)
+	}
+}
+
+func (h *Hub) pushConfig(serialNumber int, desired entity.AgentConfig) bool {
+	command, err := entity.NewCommand(desired, 2)
+	if err != nil {
+		logrus.WithError(err).Error("failed to build config command")
+		return false
+	}
+
+	data, err := json.Marshal(command)
+	if err != nil {
+		logrus.WithError(err).Error("failed to marshal config command")
+		return false
+	}
+
+	logrus.WithField("controller", serialNumber).WithField("version", desired.Version).Info("push config")
+
+	return h.Send("controller", serialNumber, data) > 0
+}
+
+// Announce makes the release the one every agent should run and sends it to
+// the connected agents, the others get it when they connect. It returns
+// how many agents got it.
+func (h *Hub) Announce(release entity.Release) int {
+	h.releaseMutex.Lock()
+	h.release = &release
+	h.releaseMutex.Unlock()
+
+	data, err := releaseCommand(release)
+	if err != nil {
+		logrus.WithError(err).Error("failed to build release command")
+		return 0
+	}
+
+	h.clientsMutex.RLock()
+	defer h.clientsMutex.RUnlock()
+
+	sent := 0
+	for client := range h.clients {
+		if client.typeClient != "controller" {
+			continue
+		}
+
+		sealed, err := h.seal(client.serialNumber, data)
+		if err != nil {
+			logrus.WithError(err).WithField("controller", client.serialNumber).Error("failed to sign release command")
+			continue
+		}
+
+		if client.queue(sealed) {
+			sent++
+		}
+	}
+
+	return sent
+}
+
+// Release returns the announced release.
+func (h *Hub) Release() (entity.Release, bool) {
+	h.releaseMutex.Lock()
+	defer h.releaseMutex.Unlock()
+
+	if h.release == nil {
+		return entity.Release{}, false
+	}
+
+	return *h.release, true
+}
+
+// Update returns the announced release and what the agent reported about
+// installing it.
+func (h *Hub) Update(serialNumber int) entity.UpdateState {
+	h.releaseMutex.Lock()
+	defer h.releaseMutex.Unlock()
+
+	state := h.updates[serialNumber]
+	state.Release = h.release
+
+	return state
+}
+
+func (h *Hub) updateReported(serialNumber int, status entity.UpdateStatus) {
+	h.releaseMutex.Lock()
+	defer h.releaseMutex.Unlock()
+
+	h.updates[serialNumber] = entity.UpdateState{Reported: &status, ReportedAt: time.Now()}
+}
+
+// announceTo queues the announced release to an agent that just connected,
+// before it is registered.
+func (h *Hub) announceTo(client *Client) {
+	release, ok := h.Release()
+	if !ok {
+		return
+	}
+
+	data, err := releaseCommand(release)
+	if err != nil {
+		logrus.WithError(err).Error("failed to build release command")
+		return
+	}
+
+	data, err = h.seal(client.serialNumber, data)
+	if err != nil {
+		logrus.WithError(err).Error("failed to sign release command")
+		return
+	}
+
+	client.queue(data)
+}
+
+// seal signs a command for the agent with the serial number, commands go
+// out as they are while the keys are off.
+func (h *Hub) seal(serialNumber int, message []byte) ([]byte, error) {
+	if h.keys == nil {
+		return message, nil
+	}
+
+	key, ok := h.keys[serialNumber]
+	if !ok {
+		return nil, fmt.Errorf("no key for controller %d", serialNumber)
+	}
+
+	var command entity.Command
+	if err := json.Unmarshal(message, &command); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal command: %w", err)
+	}
+
+	signed, err := auth.SignCommand(key, serialNumber, command)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(signed)
+}
+
+// identify checks that a greeting of a controller comes from the holder of
+// the key of its serial number and one of a mobile client from the holder
+// of a key issued by MobileKey, mobile clients get the telemetry and the
+// snapshots. Any greeting is taken while the keys are off.
+func (h *Hub) identify(greet auth.Greet) error {
+	if h.keys == nil {
+		return nil
+	}
+
+	key, ok := h.keys[greet.SerialNumber]
+	if !ok {
+		return fmt.Errorf("no key for controller %d", greet.SerialNumber)
+	}
+
+	switch {
+	case greet.TypeClient == "mobile" && greet.Client != "":
+		key = auth.MobileKey(key, greet.SerialNumber, greet.Client)
+	case greet.TypeClient == "mobile":
+		return errors.New("mobile greeting does not name the client")
+	case greet.Client != "":
+		return errors.New("controller greeting names a client")
+	}
+
+	if err := auth.VerifyGreet(key, greet); err != nil {
+		return err
+	}
+
+	return h.greets.Check(greet.Timestamp, greet.Nonce, time.Now())
+}
+
+// ErrNoKeys is returned for mobile keys while the device keys are off.
+var ErrNoKeys = errors.New("device keys are not set")
+
+// MobileKey issues the key the mobile client with the name greets with.
+func (h *Hub) MobileKey(serialNumber int, client string) (auth.Key, error) {
+	if h.keys == nil {
+		return nil, ErrNoKeys
+	}
+
+	key, ok := h.keys[serialNumber]
+	if !ok {
+		return nil, fmt.Errorf("no key for controller %d", serialNumber)
+	}
+
+	return auth.MobileKey(key, serialNumber, client), nil
+}
+
+func releaseCommand(release entity.Release) ([]byte, error) {
+	command, err := entity.NewCommand(release, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(command)
+}
+
+// saveTimeout bounds storing a batch of readings.
+const saveTimeout = 30 * time.Second
+
+// readingsBuffer is how many telemetry messages wait to be stored before
+// new ones are dropped.
+const readingsBuffer = 1024
+
+// store queues the readings in the telemetry for persist.
+func (h *Hub) store(serialNumber int, command entity.Command) {
+	if h.repo == nil {
+		return
+	}
+
+	readings, err := storage.FromCommand(serialNumber, command)
+	if err != nil {
+		logrus.WithError(err).Error("failed to read telemetry")
+		return
+	}
+
+	if len(readings) == 0 {
+		return
+	}
+
+	select {
+	case h.readings <- readings:
+	default:
+		logrus.WithField("controller", serialNumber).Warn("telemetry dropped, storage is behind")
+	}
+}
+
+// persist saves queued readings, what queued up while a save ran is saved
+// at once.
+func (h *Hub) persist() {
+	for readings := range h.readings {
+		for more := true; more; {
+			select {
+			case next := <-h.readings:
+				readings = append(readings, next...)
+			default:
+				more = false
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), saveTimeout)
+		err := h.repo.Save(ctx, readings)
+		cancel()
+
+		if err != nil {
+			logrus.WithError(err).WithField("readings", len(readings)).Error("failed to store telemetry")
+		}
+	}
+}
+
+// greetWindow is how far the stamp of a greeting may be from now.
+const greetWindow = 2 * time.Minute
+
+// maxScheduledActions caps the actions kept per agent, the oldest are
+// dropped.
+const maxScheduledActions = 100
+
+// Schedule returns the desired schedule of the agent, what it reported and
+// the actions it took by the schedule.
+func (h *Hub) Schedule(serialNumber int) (entity.ScheduleState, bool) {
+	h.scheduleMutex.Lock()
+	defer h.scheduleMutex.Unlock()
+
+	state, ok := h.schedules[serialNumber]
+	return state, ok
+}
+
+// SetSchedule makes the entries the desired schedule of the agent under the
+// next version and pushes it if the agent is connected, otherwise it is
+// pushed once the agent reports an older version.
+func (h *Hub) SetSchedule(serialNumber int, entries []entity.ScheduleEntry) (entity.Schedule, bool) {
+	h.scheduleMutex.Lock()
+
+	state := h.schedules[serialNumber]
+
+	version := 0
+	if state.Desired != nil {
+		version = state.Desired.Version
+	}
+	if state.Reported != nil && state.Reported.Version > version {
+		version = state.Reported.Version
+	}
+
+	desired := entity.Schedule{Version: version + 1, Entries: entries}
+	state.Desired = &desired
+	h.schedules[serialNumber] = state
+
+	h.scheduleMutex.Unlock()
+
+	return desired, h.pushSchedule(serialNumber, desired)
+}
+
+// scheduleReported stores the status and pushes the desired schedule when
+// the agent has an older one. A version the agent rejected is not pushed
+// again.
+func (h *Hub) scheduleReported(serialNumber int, status entity.ScheduleStatus) {
+	h.scheduleMutex.Lock()
+
+	state := h.schedules[serialNumber]
+	state.Reported = &status
+	state.ReportedAt = time.Now()
+	h.schedules[serialNumber] = state
+
+	desired := state.Desired
+
+	h.scheduleMutex.Unlock()
+
+	if desired != nil && desired.Version > status.Version {
+		h.pushSchedule(serialNumber, *desired)
+	}
+}
+
+// scheduleActions keeps the actions the agent took while it was offline.
+func (h *Hub) scheduleActions(serialNumber int, report entity.ScheduleReport) {
+	h.scheduleMutex.Lock()
+	defer h.scheduleMutex.Unlock()
+
+	state := h.schedules[serialNumber]
+	state.Actions = append(state.Actions, report.Actions...)
+	if n := len(state.Actions) - maxScheduledActions; n > 0 {
+		state.Actions = append([]entity.ScheduledAction(nil), state.Actions[n:]...)
+	}
+	h.schedules[serialNumber] = state
+}
+
+func (h *Hub) pushSchedule(serialNumber int, desired entity.Schedule) bool {
+	command, err := entity.NewCommand(desired, 2)
+	if err != nil {
+		logrus.WithError(err).Error("failed to build schedule command")
+		return false
+	}
+
+	data, err := json.Marshal(command)
+	if err != nil {
+		logrus.WithError(err).Error("failed to marshal schedule command")
+		return false
+	}
+
+	logrus.WithField("controller", serialNumber).WithField("version", desired.Version).Info("push schedule")
+
+	return h.Send("controller", serialNumber, data) > 0
+}
+
+// Devices returns the controllers on the bus of the agent with the zones
+// they reported, the values of the zones of a silent controller are stale.
+func (h *Hub) Devices(serialNumber int) []entity.DeviceState {
+	h.devicesMutex.Lock()
+	defer h.devicesMutex.Unlock()
+
+	states := make([]entity.DeviceState, 0, len(h.devices[serialNumber]))
+	for _, state := range h.devices[serialNumber] {
+		state := *state
+		state.Zones = append([]int32(nil), state.Zones...)
+		states = append(states, state)
+	}
+
+	sort.Slice(states, func(i, j int) bool { return states[i].BusAddress < states[j].BusAddress })
+
+	return states
+}
+
+// device returns the state of the controller, the caller holds
+// devicesMutex.
+func (h *Hub) device(serialNumber int, address int32) *entity.DeviceState {
+	devices, ok := h.devices[serialNumber]
+	if !ok {
+		devices = make(map[int32]*entity.DeviceState)
+		h.devices[serialNumber] = devices
+	}
+
+	state, ok := devices[address]
+	if !ok {
+		state = &entity.DeviceState{DeviceStatus: entity.DeviceStatus{BusAddress: address}}
+		devices[address] = state
+	}
+
+	return state
+}
+
+// deviceReported stores whether the controller fell silent or talks again.
+func (h *Hub) deviceReported(serialNumber int, status entity.DeviceStatus) {
+	h.devicesMutex.Lock()
+	defer h.devicesMutex.Unlock()
+
+	state := h.device(serialNumber, status.BusAddress)
+	state.DeviceStatus = status
+	state.Stale = status.Status == entity.DeviceSilent
+	state.ReportedAt = time.Now()
+}
+
+// zonesSeen learns the zones of the controller from its telemetry.
+func (h *Hub) zonesSeen(serialNumber int, address int32, zones ...int32) {
+	h.devicesMutex.Lock()
+	defer h.devicesMutex.Unlock()
+
+	state := h.device(serialNumber, address)
+
+	for _, zone := range zones {
+		if zone <= 0 {
+			continue
+		}
+
+		i := sort.Search(len(state.Zones), func(i int) bool { return state.Zones[i] >= zone })
+		if i < len(state.Zones) && state.Zones[i] == zone {
+			continue
+		}
+
+		state.Zones = append(state.Zones, 0)
+		copy(state.Zones[i+1:], state.Zones[i:])
+		state.Zones[i] = zone
+	}
+}
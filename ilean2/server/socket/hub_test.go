@@ -0,0 +1,46 @@
+package socket
+
+import (
+	"iLean/auth"
+	"strings"
+	"testing"
+)
+
+const testSerial = 12345
+
+var testKey = auth.Key(strings.Repeat("k", 16))
+
+func TestIdentify(t *testing.T) {
+	mobileKey := auth.MobileKey(testKey, testSerial, "phone")
+
+	tests := []struct {
+		name    string
+		key     auth.Key
+		greet   auth.Greet
+		wantErr bool
+	}{
+		{"controller", testKey, auth.Greet{SerialNumber: testSerial, TypeClient: "controller"}, false},
+		{"mobile", mobileKey, auth.Greet{SerialNumber: testSerial, TypeClient: "mobile", Client: "phone"}, false},
+		{"mobile with the device key", testKey, auth.Greet{SerialNumber: testSerial, TypeClient: "mobile", Client: "phone"}, true},
+		{"mobile as another client", mobileKey, auth.Greet{SerialNumber: testSerial, TypeClient: "mobile", Client: "tablet"}, true},
+		{"mobile without a client", testKey, auth.Greet{SerialNumber: testSerial, TypeClient: "mobile"}, true},
+		{"mobile posing as the controller", mobileKey, auth.Greet{SerialNumber: testSerial, TypeClient: "controller"}, true},
+		{"controller naming a client", testKey, auth.Greet{SerialNumber: testSerial, TypeClient: "controller", Client: "phone"}, true},
+		{"unknown serial", testKey, auth.Greet{SerialNumber: testSerial + 1, TypeClient: "controller"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := newHub(auth.Keys{testSerial: testKey}, nil)
+
+			greet := tt.greet
+			if err := auth.SignGreet(tt.key, &greet); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := hub.identify(greet); (err != nil) != tt.wantErr {
+				t.Errorf("identify: %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
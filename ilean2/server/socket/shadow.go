@@ -0,0 +1,760 @@
+package socket
+
+import (
+	"encoding/json"
+	"iLean/entity"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// Settings of a zone a command writes, the module settings of a controller
+// are written together.
+const (
+	settingSetpoint   = "setpoint"
+	settingRegulation = "type_regulation"
+	settingVentSpeed  = "vent_speed"
+	settingHumidity   = "humidity"
+	settingModule     = "module"
+)
+
+// setpointTolerance is how far a reported setpoint may be from the desired
+// one, the controller keeps tenths of a degree.
+const setpointTolerance = 0.05
+
+// desiredTTL is how long a desired setting is pushed to an agent that does
+// not come back, a controller offline for longer is set up on site.
+const desiredTTL = 24 * time.Hour
+
+// shadowSetting is a desired setting of a zone of a controller, or its
+// module settings in zone 0.
+type shadowSetting struct {
+	busAddress int32
+	zone       int32
+	setting    string
+}
+
+type controllerShadow struct {
+	module    *entity.ModuleSettings
+	zones     map[int32]*entity.ZoneSettings
+	updatedAt time.Time
+}
+
+func (c *controllerShadow) zone(zone int32) *entity.ZoneSettings {
+	settings, ok := c.zones[zone]
+	if !ok {
+		settings = &entity.ZoneSettings{Zone: zone}
+		c.zones[zone] = settings
+	}
+
+	return settings
+}
+
+func (c *controllerShadow) empty() bool {
+	return c.module == nil && len(c.zones) == 0
+}
+
+// desiredWrite is the command that wrote a desired setting.
+type desiredWrite struct {
+	id string
+	at time.Time
+	// confirmed is set once the controller acked the command, a later
+	// report of another value is a change on the controller panel.
+	confirmed bool
+}
+
+// shadow holds the settings of the controllers of an agent by bus address.
+// Desired settings are dropped once a controller reports them, reports
+// another value after confirming the command or after desiredTTL, a later
+// change on the controller panel is not undone.
+type shadow struct {
+	desired  map[int32]*controllerShadow
+	reported map[int32]*controllerShadow
+	// writes of the desired settings, a failed ack drops what its command
+	// wrote.
+	writes map[shadowSetting]desiredWrite
+	// waiting holds the controllers whose vent speeds are pushed once they
+	// report the module settings the vent command carries along.
+	waiting map[int32]bool
+}
+
+// desiredCommand is a settings command pushed to reconcile the settings.
+type desiredCommand struct {
+	request  entity.Request
+	settings []shadowSetting
+}
+
+// Shadow returns the settings the commands want the controllers of the
+// agent set to, what they reported and the delta between them.
+func (h *Hub) Shadow(serialNumber int) entity.Shadow {
+	h.shadowMutex.Lock()
+	defer h.shadowMutex.Unlock()
+
+	doc := entity.Shadow{
+		SerialNumber: serialNumber,
+		Desired:      []entity.ControllerSettings{},
+		Reported:     []entity.ControllerSettings{},
+		Delta:        []entity.ControllerSettings{},
+	}
+
+	sh, ok := h.shadows[serialNumber]
+	if !ok {
+		return doc
+	}
+	sh.expire(time.Now())
+
+	for address, desired := range sh.desired {
+		doc.Desired = append(doc.Desired, controllerSettings(address, desired))
+
+		if delta := sh.delta(address); !delta.empty() {
+			doc.Delta = append(doc.Delta, controllerSettings(address, delta))
+		}
+	}
+
+	for address, reported := range sh.reported {
+		doc.Reported = append(doc.Reported, controllerSettings(address, reported))
+	}
+
+	for _, list := range [][]entity.ControllerSettings{doc.Desired, doc.Reported, doc.Delta} {
+		sort.Slice(list, func(i, j int) bool { return list[i].BusAddress < list[j].BusAddress })
+	}
+
+	return doc
+}
+
+// ClearDesired drops the desired settings of the agent, nothing is pushed
+// on reconnect.
+func (h *Hub) ClearDesired(serialNumber int) {
+	h.shadowMutex.Lock()
+	defer h.shadowMutex.Unlock()
+
+	if sh, ok := h.shadows[serialNumber]; ok {
+		sh.desired = make(map[int32]*controllerShadow)
+		sh.writes = make(map[shadowSetting]desiredWrite)
+		sh.waiting = make(map[int32]bool)
+	}
+}
+
+// SetDesired makes the settings the command with the id writes desired.
+// They are pushed again when the agent reconnects until the controller
+// reports them.
+func (h *Hub) SetDesired(serialNumber int, id string, req entity.Request) {
+	h.shadowMutex.Lock()
+	defer h.shadowMutex.Unlock()
+
+	sh := h.shadow(serialNumber)
+	address := req.GetTarget().BusAddress
+	now := time.Now()
+
+	desired := controllerOf(sh.desired, address)
+	desired.updatedAt = now
+
+	write := func(zone int32, setting string, set func(z *entity.ZoneSettings)) {
+		set(desired.zone(zone))
+		sh.writes[shadowSetting{address, zone, setting}] = desiredWrite{id: id, at: now}
+	}
+
+	setModule := func(module entity.ModuleSettings) {
+		desired.module = &module
+		sh.writes[shadowSetting{address, 0, settingModule}] = desiredWrite{id: id, at: now}
+	}
+
+	switch data := req.(type) {
+	case *entity.CommandTemperature:
+		write(int32(data.Zone), settingSetpoint, func(z *entity.ZoneSettings) {
+			value := data.Temperature
+			z.Setpoint = &value
+		})
+	case *entity.CommandTemperatureBySensor:
+		// the controllers report the type one less than command 2 writes it
+		write(int32(data.Zone), settingRegulation, func(z *entity.ZoneSettings) {
+			value := uint8(data.Type - 1)
+			z.TypeRegulation = &value
+		})
+	case *entity.CommandDataVentModule:
+		// the module settings for all zones carry no zone and speed
+		if !data.ForAll {
+			write(int32(data.Zone), settingVentSpeed, func(z *entity.ZoneSettings) {
+				value := data.VentSpeed
+				z.VentSpeed = &value
+			})
+		}
+
+		setModule(entity.ModuleSettings{
+			Delta:                                  data.Delta,
+			TypeRegulation:                         data.TypeRegulation,
+			IntervalTimeVentilationDampers:         data.IntervalTimeVentilationDampers,
+			VentilationPeriodAfterCO2ReductionTime: data.VentilationPeriodAfterCO2ReductionTime,
+		})
+	case *entity.CommandDataVentModuleForAll:
+		setModule(entity.ModuleSettings{
+			Delta:                                  data.Delta,
+			TypeRegulation:                         data.TypeRegulation,
+			IntervalTimeVentilationDampers:         data.IntervalTimeVentilationDampers,
+			VentilationPeriodAfterCO2ReductionTime: data.VentilationPeriodAfterCO2ReductionTime,
+		})
+	case *entity.CommandHysteresisOnHumidityModule:
+		// the highest values keep the current setting of the controller
+		if data.Humidity == math.MaxFloat32 && data.Hysteresis == math.MaxUint8 {
+			break
+		}
+
+		write(data.Zone, settingHumidity, func(z *entity.ZoneSettings) {
+			if data.Humidity != math.MaxFloat32 {
+				value := data.Humidity
+				z.HumiditySetpoint = &value
+			}
+			if data.Hysteresis != math.MaxUint8 {
+				value := data.Hysteresis
+				z.Hysteresis = &value
+			}
+		})
+	}
+
+	if desired.empty() {
+		delete(sh.desired, address)
+	}
+
+	sh.resolve()
+}
+
+// shadowFailed drops the desired settings the failed command wrote, they
+// are not pushed again.
+func (h *Hub) shadowFailed(id string) {
+	h.shadowMutex.Lock()
+	defer h.shadowMutex.Unlock()
+
+	for _, sh := range h.shadows {
+		for setting, write := range sh.writes {
+			if write.id == id {
+				sh.drop(setting)
+			}
+		}
+	}
+}
+
+// shadowConfirmed marks the desired settings the command wrote as written
+// on the controller.
+func (h *Hub) shadowConfirmed(id string) {
+	h.shadowMutex.Lock()
+	defer h.shadowMutex.Unlock()
+
+	for _, sh := range h.shadows {
+		for setting, write := range sh.writes {
+			if write.id == id {
+				write.confirmed = true
+				sh.writes[setting] = write
+			}
+		}
+	}
+}
+
+// setpointsReported stores the setpoints and regulation types of the table
+// of command 2.
+func (h *Hub) setpointsReported(serialNumber int, address int32, rows []entity.DataCommandTemperatureBySensor) {
+	h.settingsReported(serialNumber, address, []string{settingSetpoint, settingRegulation}, func(c *controllerShadow) {
+		for _, row := range rows {
+			if row.Zone <= 0 {
+				continue
+			}
+
+			z := c.zone(row.Zone)
+			setpoint, regulation := row.SetpointValueTemp, row.TypeRegulation
+			z.Setpoint, z.TypeRegulation = &setpoint, &regulation
+		}
+	})
+}
+
+// ventReported stores the vent speeds of the table of command 3.
+func (h *Hub) ventReported(serialNumber int, address int32, rows []entity.DataVent) {
+	h.settingsReported(serialNumber, address, []string{settingVentSpeed}, func(c *controllerShadow) {
+		for _, row := range rows {
+			if row.Zone <= 0 {
+				continue
+			}
+
+			speed := row.VentSpeed
+			c.zone(int32(row.Zone)).VentSpeed = &speed
+		}
+	})
+}
+
+// moduleReported stores the module settings of command 7 and pushes the
+// vent speeds that waited for them.
+func (h *Hub) moduleReported(serialNumber int, address int32, module entity.DataVentModule) {
+	h.settingsReported(serialNumber, address, []string{settingModule}, func(c *controllerShadow) {
+		c.module = &entity.ModuleSettings{
+			Delta:                                  module.Delta,
+			TypeRegulation:                         module.TypeRegulation,
+			IntervalTimeVentilationDampers:         module.IntervalTimeVentilationDampers,
+			VentilationPeriodAfterCO2ReductionTime: module.VentilationPeriodAfterCO2ReductionTime,
+		}
+
+		if module.Zone > 0 {
+			speed := module.VentSpeed
+			c.zone(int32(module.Zone)).VentSpeed = &speed
+		}
+	})
+
+	h.shadowMutex.Lock()
+	sh := h.shadow(serialNumber)
+	waiting := sh.waiting[address]
+	delete(sh.waiting, address)
+	var commands []desiredCommand
+	if waiting {
+		commands = sh.commands(serialNumber, address, settingVentSpeed)
+	}
+	h.shadowMutex.Unlock()
+
+	for _, command := range commands {
+		data, err := h.desiredMessage(command)
+		if err != nil {
+			logrus.WithError(err).Error("failed to build desired settings command")
+			continue
+		}
+
+		h.Send("controller", serialNumber, data)
+	}
+}
+
+// humidityReported stores the humidity setpoints and hystereses of the
+// table of command 8.
+func (h *Hub) humidityReported(serialNumber int, address int32, rows []entity.DataCommandHumidityModule) {
+	h.settingsReported(serialNumber, address, []string{settingHumidity}, func(c *controllerShadow) {
+		for _, row := range rows {
+			if row.Zone <= 0 {
+				continue
+			}
+
+			z := c.zone(row.Zone)
+			setpoint, hysteresis := row.Setpoint, row.Hysteresis
+			z.HumiditySetpoint, z.Hysteresis = &setpoint, &hysteresis
+		}
+	})
+}
+
+// settingsReported updates the reported settings of the controller and
+// drops the desired settings it reports, settings lists the settings the
+// report carries.
+func (h *Hub) settingsReported(serialNumber int, address int32, settings []string, update func(c *controllerShadow)) {
+	h.shadowMutex.Lock()
+	defer h.shadowMutex.Unlock()
+
+	sh := h.shadow(serialNumber)
+
+	reported := controllerOf(sh.reported, address)
+	update(reported)
+	reported.updatedAt = time.Now()
+
+	sh.resolve()
+	sh.reconcile(address, settings)
+	sh.expire(time.Now())
+}
+
+// pushShadow queues the commands of the desired settings the controllers
+// of the agent do not report to the agent that just connected, before it is
+// registered.
+func (h *Hub) pushShadow(client *Client) {
+	h.shadowMutex.Lock()
+	sh, ok := h.shadows[client.serialNumber]
+	var commands []desiredCommand
+	if ok {
+		sh.expire(time.Now())
+		for address := range sh.desired {
+			commands = append(commands, sh.commands(client.serialNumber, address, "")...)
+		}
+	}
+	h.shadowMutex.Unlock()
+
+	if len(commands) == 0 {
+		return
+	}
+
+	logrus.WithField("controller", client.serialNumber).WithField("commands", len(commands)).Info("push desired settings")
+
+	for _, command := range commands {
+		data, err := h.desiredMessage(command)
+		if err != nil {
+			logrus.WithError(err).Error("failed to build desired settings command")
+			continue
+		}
+
+		data, err = h.seal(client.serialNumber, data)
+		if err != nil {
+			logrus.WithError(err).Error("failed to sign desired settings command")
+			return
+		}
+
+		if !client.queue(data) {
+			return
+		}
+	}
+}
+
+// desiredMessage builds the command under a new id, which the settings it
+// carries are tracked by from now on.
+func (h *Hub) desiredMessage(command desiredCommand) ([]byte, error) {
+	message, err := entity.NewCommand(command.request, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	message.ID = id.String()
+	message.BusAddress = command.request.GetTarget().BusAddress
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+
+	h.shadowMutex.Lock()
+	if sh, ok := h.shadows[command.request.GetTarget().SerialNumber]; ok {
+		for _, setting := range command.settings {
+			if write, ok := sh.writes[setting]; ok {
+				write.id, write.confirmed = message.ID, false
+				sh.writes[setting] = write
+			}
+		}
+	}
+	h.shadowMutex.Unlock()
+
+	return data, nil
+}
+
+// shadow returns the shadow of the agent, the caller holds shadowMutex.
+func (h *Hub) shadow(serialNumber int) *shadow {
+	sh, ok := h.shadows[serialNumber]
+	if !ok {
+		sh = &shadow{
+			desired:  make(map[int32]*controllerShadow),
+			reported: make(map[int32]*controllerShadow),
+			writes:   make(map[shadowSetting]desiredWrite),
+			waiting:  make(map[int32]bool),
+		}
+		h.shadows[serialNumber] = sh
+	}
+
+	return sh
+}
+
+func controllerOf(controllers map[int32]*controllerShadow, address int32) *controllerShadow {
+	c, ok := controllers[address]
+	if !ok {
+		c = &controllerShadow{zones: make(map[int32]*entity.ZoneSettings)}
+		controllers[address] = c
+	}
+
+	return c
+}
+
+// resolve moves the settings desired for the first controller, bus address
+// 0, to the controller of the agent once it is the only one reporting.
+func (sh *shadow) resolve() {
+	first, ok := sh.desired[0]
+	if !ok || len(sh.reported) != 1 {
+		return
+	}
+
+	var address int32
+	for address = range sh.reported {
+	}
+	if address == 0 {
+		return
+	}
+
+	desired := controllerOf(sh.desired, address)
+	if first.module != nil {
+		desired.module = first.module
+	}
+	for zone, settings := range first.zones {
+		merge(desired.zone(zone), settings)
+	}
+	if first.updatedAt.After(desired.updatedAt) {
+		desired.updatedAt = first.updatedAt
+	}
+	delete(sh.desired, 0)
+
+	for setting, write := range sh.writes {
+		if setting.busAddress == 0 {
+			delete(sh.writes, setting)
+			setting.busAddress = address
+			sh.writes[setting] = write
+		}
+	}
+
+	if sh.waiting[0] {
+		delete(sh.waiting, 0)
+		sh.waiting[address] = true
+	}
+}
+
+// reconcile drops the desired settings of the controller it reports and
+// those of the reported settings it confirmed and reports another value of.
+func (sh *shadow) reconcile(address int32, reported []string) {
+	desired, ok := sh.desired[address]
+	if !ok {
+		return
+	}
+
+	delta := sh.delta(address)
+
+	if delta.module == nil && desired.module != nil {
+		sh.drop(shadowSetting{address, 0, settingModule})
+	}
+
+	for zone, settings := range desired.zones {
+		d := delta.zones[zone]
+		if d == nil {
+			d = &entity.ZoneSettings{Zone: zone}
+		}
+
+		if settings.Setpoint != nil && d.Setpoint == nil {
+			sh.drop(shadowSetting{address, zone, settingSetpoint})
+		}
+		if settings.TypeRegulation != nil && d.TypeRegulation == nil {
+			sh.drop(shadowSetting{address, zone, settingRegulation})
+		}
+		if settings.VentSpeed != nil && d.VentSpeed == nil {
+			sh.drop(shadowSetting{address, zone, settingVentSpeed})
+		}
+
+		// a humidity command may set one of the two
+		if settings.HumiditySetpoint != nil && d.HumiditySetpoint == nil {
+			settings.HumiditySetpoint = nil
+		}
+		if settings.Hysteresis != nil && d.Hysteresis == nil {
+			settings.Hysteresis = nil
+		}
+		if settings.HumiditySetpoint == nil && settings.Hysteresis == nil {
+			sh.drop(shadowSetting{address, zone, settingHumidity})
+		}
+	}
+
+	for setting, write := range sh.writes {
+		if setting.busAddress == address && write.confirmed && contains(reported, setting.setting) {
+			sh.drop(setting)
+		}
+	}
+}
+
+// expire drops the desired settings written more than desiredTTL ago.
+func (sh *shadow) expire(now time.Time) {
+	for setting, write := range sh.writes {
+		if now.Sub(write.at) > desiredTTL {
+			sh.drop(setting)
+		}
+	}
+}
+
+// drop removes a desired setting.
+func (sh *shadow) drop(setting shadowSetting) {
+	delete(sh.writes, setting)
+
+	desired, ok := sh.desired[setting.busAddress]
+	if !ok {
+		return
+	}
+
+	if setting.setting == settingModule {
+		desired.module = nil
+	} else if z, ok := desired.zones[setting.zone]; ok {
+		switch setting.setting {
+		case settingSetpoint:
+			z.Setpoint = nil
+		case settingRegulation:
+			z.TypeRegulation = nil
+		case settingVentSpeed:
+			z.VentSpeed = nil
+		case settingHumidity:
+			z.HumiditySetpoint, z.Hysteresis = nil, nil
+		}
+
+		if zoneEmpty(z) {
+			delete(desired.zones, setting.zone)
+		}
+	}
+
+	if desired.empty() {
+		delete(sh.desired, setting.busAddress)
+	}
+}
+
+// delta returns the desired settings of the controller it does not report.
+func (sh *shadow) delta(address int32) *controllerShadow {
+	delta := &controllerShadow{zones: make(map[int32]*entity.ZoneSettings)}
+
+	desired, ok := sh.desired[address]
+	if !ok {
+		return delta
+	}
+	delta.updatedAt = desired.updatedAt
+
+	reported, ok := sh.reported[address]
+	if !ok {
+		reported = &controllerShadow{zones: make(map[int32]*entity.ZoneSettings)}
+	}
+
+	if desired.module != nil && (reported.module == nil || *reported.module != *desired.module) {
+		delta.module = desired.module
+	}
+
+	for zone, settings := range desired.zones {
+		r, ok := reported.zones[zone]
+		if !ok {
+			r = &entity.ZoneSettings{Zone: zone}
+		}
+
+		d := entity.ZoneSettings{Zone: zone}
+		if settings.Setpoint != nil && (r.Setpoint == nil || math.Abs(float64(*settings.Setpoint-*r.Setpoint)) > setpointTolerance) {
+			d.Setpoint = settings.Setpoint
+		}
+		if settings.TypeRegulation != nil && (r.TypeRegulation == nil || *settings.TypeRegulation != *r.TypeRegulation) {
+			d.TypeRegulation = settings.TypeRegulation
+		}
+		if settings.VentSpeed != nil && (r.VentSpeed == nil || *settings.VentSpeed != *r.VentSpeed) {
+			d.VentSpeed = settings.VentSpeed
+		}
+		if settings.HumiditySetpoint != nil && (r.HumiditySetpoint == nil || math.Abs(float64(*settings.HumiditySetpoint-*r.HumiditySetpoint)) > setpointTolerance) {
+			d.HumiditySetpoint = settings.HumiditySetpoint
+		}
+		if settings.Hysteresis != nil && (r.Hysteresis == nil || *settings.Hysteresis != *r.Hysteresis) {
+			d.Hysteresis = settings.Hysteresis
+		}
+
+		if !zoneEmpty(&d) {
+			delta.zones[zone] = &d
+		}
+	}
+
+	return delta
+}
+
+// commands returns the settings commands that write the delta of the
+// controller, only those of the setting unless it is empty. A vent speed
+// waits for the module settings when they are not known.
+func (sh *shadow) commands(serialNumber int, address int32, only string) []desiredCommand {
+	delta := sh.delta(address)
+	target := entity.Target{SerialNumber: serialNumber, BusAddress: address}
+
+	var commands []desiredCommand
+	add := func(request entity.Request, zone int32, setting string) {
+		if only == "" || only == setting {
+			commands = append(commands, desiredCommand{request: request, settings: []shadowSetting{{address, zone, setting}}})
+		}
+	}
+
+	module := delta.module
+	if module != nil {
+		add(&entity.CommandDataVentModuleForAll{
+			Target:                                 target,
+			Delta:                                  module.Delta,
+			TypeRegulation:                         module.TypeRegulation,
+			IntervalTimeVentilationDampers:         module.IntervalTimeVentilationDampers,
+			VentilationPeriodAfterCO2ReductionTime: module.VentilationPeriodAfterCO2ReductionTime,
+		}, 0, settingModule)
+	} else if reported, ok := sh.reported[address]; ok {
+		module = reported.module
+	}
+
+	zones := make([]int32, 0, len(delta.zones))
+	for zone := range delta.zones {
+		zones = append(zones, zone)
+	}
+	sort.Slice(zones, func(i, j int) bool { return zones[i] < zones[j] })
+
+	for _, zone := range zones {
+		d := delta.zones[zone]
+
+		if d.Setpoint != nil {
+			add(&entity.CommandTemperature{Target: target, Temperature: *d.Setpoint, Zone: int(zone)}, zone, settingSetpoint)
+		}
+		if d.TypeRegulation != nil {
+			add(&entity.CommandTemperatureBySensor{Target: target, Type: int(*d.TypeRegulation) + 1, Zone: int(zone)}, zone, settingRegulation)
+		}
+		if d.VentSpeed != nil {
+			if module == nil {
+				sh.waiting[address] = true
+			} else {
+				add(&entity.CommandDataVentModule{
+					Target:                                 target,
+					Zone:                                   int16(zone),
+					VentSpeed:                              *d.VentSpeed,
+					Delta:                                  module.Delta,
+					TypeRegulation:                         module.TypeRegulation,
+					IntervalTimeVentilationDampers:         module.IntervalTimeVentilationDampers,
+					VentilationPeriodAfterCO2ReductionTime: module.VentilationPeriodAfterCO2ReductionTime,
+				}, zone, settingVentSpeed)
+			}
+		}
+		if d.HumiditySetpoint != nil || d.Hysteresis != nil {
+			// the highest values keep the current setting of the controller
+			humidity := &entity.CommandHysteresisOnHumidityModule{Target: target, Zone: zone, Humidity: math.MaxFloat32, Hysteresis: math.MaxUint8}
+			if d.HumiditySetpoint != nil {
+				humidity.Humidity = *d.HumiditySetpoint
+			}
+			if d.Hysteresis != nil {
+				humidity.Hysteresis = *d.Hysteresis
+			}
+			add(humidity, zone, settingHumidity)
+		}
+	}
+
+	return commands
+}
+
+func controllerSettings(address int32, c *controllerShadow) entity.ControllerSettings {
+	settings := entity.ControllerSettings{BusAddress: address, UpdatedAt: c.updatedAt}
+
+	if c.module != nil {
+		module := *c.module
+		settings.Module = &module
+	}
+
+	for _, z := range c.zones {
+		settings.Zones = append(settings.Zones, *z)
+	}
+	sort.Slice(settings.Zones, func(i, j int) bool { return settings.Zones[i].Zone < settings.Zones[j].Zone })
+
+	return settings
+}
+
+// merge sets the settings of to that from has.
+func merge(to, from *entity.ZoneSettings) {
+	if from.Setpoint != nil {
+		to.Setpoint = from.Setpoint
+	}
+	if from.TypeRegulation != nil {
+		to.TypeRegulation = from.TypeRegulation
+	}
+	if from.VentSpeed != nil {
+		to.VentSpeed = from.VentSpeed
+	}
+	if from.HumiditySetpoint != nil {
+		to.HumiditySetpoint = from.HumiditySetpoint
+	}
+	if from.Hysteresis != nil {
+		to.Hysteresis = from.Hysteresis
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+func zoneEmpty(z *entity.ZoneSettings) bool {
+	return z.Setpoint == nil && z.TypeRegulation == nil && z.VentSpeed == nil &&
+		z.HumiditySetpoint == nil && z.Hysteresis == nil
+}
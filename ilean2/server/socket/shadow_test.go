@@ -0,0 +1,151 @@
+package socket
+
+import (
+	"iLean/entity"
+	"testing"
+	"time"
+)
+
+const testAddress = 101
+
+func setpointRow(setpoint float32, regulation uint8) []entity.DataCommandTemperatureBySensor {
+	return []entity.DataCommandTemperatureBySensor{{Zone: 1, SetpointValueTemp: setpoint, TypeRegulation: regulation}}
+}
+
+func TestReconcile(t *testing.T) {
+	target := entity.Target{SerialNumber: testSerial, BusAddress: testAddress}
+	setpoint := &entity.CommandTemperature{Target: target, Temperature: 22, Zone: 1}
+	regulation := &entity.CommandTemperatureBySensor{Target: target, Type: 2, Zone: 1}
+
+	tests := []struct {
+		name    string
+		request entity.Request
+		// confirmed is whether the controller acks the command before it
+		// reports.
+		confirmed bool
+		report    func(h *Hub)
+		desired   bool
+	}{
+		{
+			name:    "setpoint reported",
+			request: setpoint,
+			report:  func(h *Hub) { h.setpointsReported(testSerial, testAddress, setpointRow(22.04, 0)) },
+		},
+		{
+			name:    "setpoint not written yet",
+			request: setpoint,
+			report:  func(h *Hub) { h.setpointsReported(testSerial, testAddress, setpointRow(21, 0)) },
+			desired: true,
+		},
+		{
+			name:      "setpoint changed on the panel",
+			request:   setpoint,
+			confirmed: true,
+			report:    func(h *Hub) { h.setpointsReported(testSerial, testAddress, setpointRow(21, 0)) },
+		},
+		{
+			name:      "other table after confirmation",
+			request:   setpoint,
+			confirmed: true,
+			report: func(h *Hub) {
+				h.ventReported(testSerial, testAddress, []entity.DataVent{{Zone: 1, VentSpeed: 2}})
+			},
+			desired: true,
+		},
+		{
+			name:    "regulation reported one less",
+			request: regulation,
+			report:  func(h *Hub) { h.setpointsReported(testSerial, testAddress, setpointRow(22, 1)) },
+		},
+		{
+			name:    "regulation not written yet",
+			request: regulation,
+			report:  func(h *Hub) { h.setpointsReported(testSerial, testAddress, setpointRow(22, 2)) },
+			desired: true,
+		},
+		{
+			name:    "humidity partly reported",
+			request: &entity.CommandHysteresisOnHumidityModule{Target: target, Zone: 1, Humidity: 45, Hysteresis: 5},
+			report: func(h *Hub) {
+				h.humidityReported(testSerial, testAddress, []entity.DataCommandHumidityModule{{Zone: 1, Setpoint: 45, Hysteresis: 3}})
+			},
+			desired: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := newHub(nil, nopRepo{})
+			hub.SetDesired(testSerial, "id", tt.request)
+
+			if tt.confirmed {
+				hub.ack(entity.Ack{ID: "id", Status: entity.AckConfirmed})
+			}
+
+			tt.report(hub)
+
+			doc := hub.Shadow(testSerial)
+			if desired := len(doc.Desired) > 0; desired != tt.desired {
+				t.Errorf("desired %v, want %v: %+v", desired, tt.desired, doc.Desired)
+			}
+			if delta := len(doc.Delta) > 0; delta != tt.desired {
+				t.Errorf("delta %v, want %v: %+v", delta, tt.desired, doc.Delta)
+			}
+		})
+	}
+}
+
+func TestShadowFailed(t *testing.T) {
+	hub := newHub(nil, nopRepo{})
+	target := entity.Target{SerialNumber: testSerial, BusAddress: testAddress}
+
+	hub.SetDesired(testSerial, "failed", &entity.CommandTemperature{Target: target, Temperature: 22, Zone: 1})
+	hub.SetDesired(testSerial, "sent", &entity.CommandTemperature{Target: target, Temperature: 20, Zone: 2})
+	hub.ack(entity.Ack{ID: "failed", Status: entity.AckFailed})
+
+	desired := hub.Shadow(testSerial).Desired
+	if len(desired) != 1 || len(desired[0].Zones) != 1 || desired[0].Zones[0].Zone != 2 {
+		t.Errorf("desired = %+v, want zone 2 only", desired)
+	}
+}
+
+func TestShadowExpire(t *testing.T) {
+	hub := newHub(nil, nopRepo{})
+	target := entity.Target{SerialNumber: testSerial, BusAddress: testAddress}
+
+	hub.SetDesired(testSerial, "old", &entity.CommandTemperature{Target: target, Temperature: 22, Zone: 1})
+	hub.SetDesired(testSerial, "new", &entity.CommandTemperature{Target: target, Temperature: 20, Zone: 2})
+
+	sh := hub.shadows[testSerial]
+	setting := shadowSetting{testAddress, 1, settingSetpoint}
+	write := sh.writes[setting]
+	write.at = time.Now().Add(-desiredTTL - time.Minute)
+	sh.writes[setting] = write
+
+	desired := hub.Shadow(testSerial).Desired
+	if len(desired) != 1 || len(desired[0].Zones) != 1 || desired[0].Zones[0].Zone != 2 {
+		t.Errorf("desired = %+v, want zone 2 only", desired)
+	}
+}
+
+func TestShadowCommands(t *testing.T) {
+	hub := newHub(nil, nopRepo{})
+	target := entity.Target{SerialNumber: testSerial, BusAddress: testAddress}
+
+	hub.SetDesired(testSerial, "id", &entity.CommandTemperatureBySensor{Target: target, Type: 2, Zone: 1})
+	hub.setpointsReported(testSerial, testAddress, setpointRow(22, 0))
+
+	commands := hub.shadows[testSerial].commands(testSerial, testAddress, "")
+	if len(commands) != 1 {
+		t.Fatalf("got %d commands, want 1", len(commands))
+	}
+
+	command, ok := commands[0].request.(*entity.CommandTemperatureBySensor)
+	if !ok {
+		t.Fatalf("got %T, want *entity.CommandTemperatureBySensor", commands[0].request)
+	}
+
+	if command.Type != 2 || command.Zone != 1 || command.BusAddress != testAddress {
+		t.Errorf("command = %+v, want type 2 of zone 1 at %d", command, testAddress)
+	}
+}
@@ -3,6 +3,8 @@ package socket
 import (
 	"flag"
 	"github.com/sirupsen/logrus"
+	"iLean/auth"
+	"iLean/server/storage"
 	"net/http"
 	"time"
 )
@@ -10,12 +12,18 @@ import (
 var addr = flag.String("addr", ":63240", "http service address")
 
 
-func New() (*Hub, error)  {
+// New starts the websocket server, commands to the controllers are signed
+// with keys unless it is nil. Telemetry is stored in repo unless it is nil.
+func New(keys auth.Keys, repo storage.Repository) (*Hub, error)  {
 
 	flag.Parse()
-	hub := newHub()
+	hub := newHub(keys, repo)
 	go hub.run()
 
+	if repo != nil {
+		go hub.persist()
+	}
+
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		serveWs(hub, w, r)
 	})
@@ -0,0 +1,251 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultCompactionInterval is how often the compaction runs unless set.
+const DefaultCompactionInterval = 10 * time.Minute
+
+// changedOverlap goes back from the start of the last run when looking for
+// changed days, saves are committed a while after they start.
+const changedOverlap = time.Minute
+
+// CompactionStatus is the progress of a running compaction and the result
+// of the last one.
+type CompactionStatus struct {
+	Retention string `json:"retention"`
+	Interval  string `json:"interval"`
+	Running   bool   `json:"running"`
+	// Done of Total days are rolled up by the running compaction.
+	Done  int `json:"done"`
+	Total int `json:"total"`
+	Runs  int `json:"runs"`
+
+	LastStarted  time.Time `json:"last_started"`
+	LastFinished time.Time `json:"last_finished"`
+	LastDuration string    `json:"last_duration,omitempty"`
+	LastError    string    `json:"last_error,omitempty"`
+	// DaysRolledUp and the files or rows expired by the last run.
+	DaysRolledUp   int       `json:"days_rolled_up"`
+	RawExpired     int64     `json:"raw_expired"`
+	RollupsExpired int64     `json:"rollups_expired"`
+	NextRun        time.Time `json:"next_run"`
+}
+
+// Compactor rolls up the days with new readings into the buckets of each
+// tier of the retention, then deletes what expired. Only days changed
+// since the last successful run are rolled up again, all days with raw
+// readings after a restart.
+type Compactor struct {
+	repo      Repository
+	retention Retention
+	interval  time.Duration
+	log       *logrus.Entry
+
+	trigger chan struct{}
+
+	mutex  sync.Mutex
+	status CompactionStatus
+	// since is when the last successful run started.
+	since time.Time
+}
+
+func NewCompactor(repo Repository, retention Retention, interval time.Duration) *Compactor {
+	return &Compactor{
+		repo:      repo,
+		retention: retention,
+		interval:  interval,
+		log:       logrus.WithField("subsystem", "compactor"),
+		trigger:   make(chan struct{}, 1),
+		status: CompactionStatus{
+			Retention: retention.String(),
+			Interval:  interval.String(),
+		},
+	}
+}
+
+// Run compacts at start, every interval and when triggered until stop is
+// closed.
+func (c *Compactor) Run(stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	for {
+		if err := c.Compact(ctx); err != nil && ctx.Err() == nil {
+			c.log.WithError(err).Error("failed to compact telemetry")
+		}
+
+		timer := time.NewTimer(c.interval)
+
+		c.mutex.Lock()
+		c.status.NextRun = time.Now().Add(c.interval)
+		c.mutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-c.trigger:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// Trigger runs the compaction now, false if it is running already.
+func (c *Compactor) Trigger() bool {
+	c.mutex.Lock()
+	running := c.status.Running
+	c.mutex.Unlock()
+
+	if running {
+		return false
+	}
+
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+
+	return true
+}
+
+func (c *Compactor) Retention() Retention {
+	return c.retention
+}
+
+func (c *Compactor) Status() CompactionStatus {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.status
+}
+
+// Compact rolls up the changed days and deletes the expired readings and
+// buckets. Days are rolled up before their readings expire.
+func (c *Compactor) Compact(ctx context.Context) (err error) {
+	started := time.Now()
+
+	c.mutex.Lock()
+	since := c.since
+	if !since.IsZero() {
+		since = since.Add(-changedOverlap)
+	}
+	c.status.Running = true
+	c.status.Done, c.status.Total = 0, 0
+	c.status.LastStarted = started
+	c.mutex.Unlock()
+
+	var rolledUp int
+	var rawExpired, rollupsExpired int64
+
+	defer func() {
+		finished := time.Now()
+
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+
+		c.status.Running = false
+		c.status.Runs++
+		c.status.LastFinished = finished
+		c.status.LastDuration = finished.Sub(started).String()
+		c.status.DaysRolledUp = rolledUp
+		c.status.RawExpired = rawExpired
+		c.status.RollupsExpired = rollupsExpired
+		c.status.LastError = ""
+		if err != nil {
+			c.status.LastError = err.Error()
+			return
+		}
+
+		c.since = started
+	}()
+
+	days, err := c.repo.Changed(ctx, since)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	c.status.Total = len(days)
+	c.mutex.Unlock()
+
+	for _, day := range days {
+		if err := c.rollUp(ctx, day, started); err != nil {
+			return err
+		}
+		rolledUp++
+
+		c.mutex.Lock()
+		c.status.Done = rolledUp
+		c.mutex.Unlock()
+	}
+
+	if c.retention.Raw > 0 {
+		if rawExpired, err = c.repo.Expire(ctx, 0, started.Add(-c.retention.Raw)); err != nil {
+			return err
+		}
+	}
+
+	for _, tier := range c.retention.Rollups {
+		if tier.Keep == 0 {
+			continue
+		}
+
+		deleted, err := c.repo.Expire(ctx, tier.Step, started.Add(-tier.Keep))
+		rollupsExpired += deleted
+		if err != nil {
+			return err
+		}
+	}
+
+	if rolledUp > 0 || rawExpired > 0 || rollupsExpired > 0 {
+		c.log.WithFields(logrus.Fields{
+			"days":            rolledUp,
+			"raw_expired":     rawExpired,
+			"rollups_expired": rollupsExpired,
+		}).Info("compacted telemetry")
+	}
+
+	return nil
+}
+
+// rollUp rebuilds the buckets of the day for the tiers that keep it.
+func (c *Compactor) rollUp(ctx context.Context, day Day, now time.Time) error {
+	end := day.At.Add(24 * time.Hour)
+
+	readings, err := c.repo.Readings(ctx, Query{
+		SerialNumber: day.SerialNumber,
+		Zone:         day.Zone,
+		Metric:       day.Metric,
+		From:         day.At,
+		To:           end,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, tier := range c.retention.Rollups {
+		if !Covers(tier.Keep, end, now) {
+			continue
+		}
+
+		if err := c.repo.SaveRollup(ctx, tier.Step, day, Aggregate(readings, day.At, tier.Step)); err != nil {
+			return fmt.Errorf("failed to roll up %d/%d/%s %s: %w",
+				day.SerialNumber, day.Zone, day.Metric, day.At.Format(dayLayout), err)
+		}
+	}
+
+	return nil
+}
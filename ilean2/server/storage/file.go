@@ -0,0 +1,395 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dayLayout names the file of a day.
+const dayLayout = "2006-01-02"
+
+// File keeps readings in CSV files of unix milliseconds and values, a file
+// per series and UTC day: <dir>/raw/<serial>/<zone>/<metric>/<day>.csv.
+// Rollups are kept alike in <dir>/rollup/<step>/..., with the minimum, the
+// maximum, the average, the last value and the count of each bucket. Whole
+// days expire.
+type File struct {
+	dir string
+
+	mutex sync.Mutex
+}
+
+func OpenFile(dir string) (*File, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "raw"), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create storage dir: %w", err)
+	}
+
+	return &File{dir: dir}, nil
+}
+
+func (f *File) Save(ctx context.Context, readings []Reading) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	lines := make(map[string][]byte)
+	for _, r := range readings {
+		path := f.dayPath(r.SerialNumber, r.Zone, r.Metric, r.At)
+		lines[path] = append(lines[path], formatLine(r.At, r.Value)...)
+	}
+
+	for path, data := range lines {
+		if err := appendFile(path, data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *File) Readings(ctx context.Context, query Query) ([]Reading, error) {
+	// the metric names a directory
+	if !IsMetric(query.Metric) {
+		return nil, fmt.Errorf("unknown metric %q", query.Metric)
+	}
+
+	var readings []Reading
+
+	// the lock is taken a day at a time, saves go on between the days
+	for day := query.From.UTC().Truncate(24 * time.Hour); day.Before(query.To); day = day.Add(24 * time.Hour) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		path := f.dayPath(query.SerialNumber, query.Zone, query.Metric, day)
+
+		f.mutex.Lock()
+		err := readFile(path, func(at time.Time, value float64) {
+			if at.Before(query.From) || !at.Before(query.To) {
+				return
+			}
+
+			readings = append(readings, Reading{
+				SerialNumber: query.SerialNumber,
+				Zone:         query.Zone,
+				Metric:       query.Metric,
+				At:           at,
+				Value:        value,
+			})
+		})
+		f.mutex.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// buffered telemetry is appended after newer readings
+	sort.SliceStable(readings, func(i, j int) bool { return readings[i].At.Before(readings[j].At) })
+
+	return readings, nil
+}
+
+// Changed returns the days of the files written since then.
+func (f *File) Changed(ctx context.Context, since time.Time) ([]Day, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var days []Day
+
+	root := filepath.Join(f.dir, "raw")
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if info.IsDir() || info.ModTime().Before(since) {
+			return nil
+		}
+
+		if day, ok := parseDayPath(root, path); ok {
+			days = append(days, day)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk storage dir: %w", err)
+	}
+
+	return days, nil
+}
+
+// SaveRollup writes the file of the buckets of the day and renames it over
+// the one built before.
+func (f *File) SaveRollup(ctx context.Context, step time.Duration, day Day, buckets []Bucket) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var data []byte
+	for _, b := range buckets {
+		data = append(data, formatBucket(b)...)
+	}
+
+	path := f.rollupPath(step, day.SerialNumber, day.Zone, day.Metric, day.At)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create rollup dir: %w", err)
+	}
+
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("failed to write rollup file: %w", err)
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to replace rollup file: %w", err)
+	}
+
+	return nil
+}
+
+func (f *File) Rollup(ctx context.Context, step time.Duration, query Query) ([]Bucket, error) {
+	if !IsMetric(query.Metric) {
+		return nil, fmt.Errorf("unknown metric %q", query.Metric)
+	}
+
+	var buckets []Bucket
+
+	for day := query.From.UTC().Truncate(24 * time.Hour); day.Before(query.To); day = day.Add(24 * time.Hour) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		path := f.rollupPath(step, query.SerialNumber, query.Zone, query.Metric, day)
+
+		f.mutex.Lock()
+		err := readRollupFile(path, func(b Bucket) {
+			if !b.At.Before(query.From) && b.At.Before(query.To) {
+				buckets = append(buckets, b)
+			}
+		})
+		f.mutex.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return buckets, nil
+}
+
+// Expire deletes the files of the days that ended before then.
+func (f *File) Expire(ctx context.Context, step time.Duration, before time.Time) (int64, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	root := filepath.Join(f.dir, "raw")
+	if step != 0 {
+		root = filepath.Join(f.dir, "rollup", formatDuration(step))
+	}
+
+	var deleted int64
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		day, ok := parseDayPath(root, path)
+		if !ok || day.At.Add(24*time.Hour).After(before) {
+			return nil
+		}
+
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		deleted++
+
+		return nil
+	})
+	if err != nil {
+		return deleted, fmt.Errorf("failed to expire files: %w", err)
+	}
+
+	return deleted, nil
+}
+
+func (f *File) Close() error {
+	return nil
+}
+
+func (f *File) dayPath(serialNumber int, zone int32, metric string, at time.Time) string {
+	return filepath.Join(f.dir, "raw",
+		strconv.Itoa(serialNumber),
+		strconv.Itoa(int(zone)),
+		metric,
+		at.UTC().Format(dayLayout)+".csv")
+}
+
+func (f *File) rollupPath(step time.Duration, serialNumber int, zone int32, metric string, at time.Time) string {
+	return filepath.Join(f.dir, "rollup", formatDuration(step),
+		strconv.Itoa(serialNumber),
+		strconv.Itoa(int(zone)),
+		metric,
+		at.UTC().Format(dayLayout)+".csv")
+}
+
+// parseDayPath reads the day of the file <root>/<serial>/<zone>/<metric>/<day>.csv.
+func parseDayPath(root, path string) (Day, bool) {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return Day{}, false
+	}
+
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if len(parts) != 4 || !strings.HasSuffix(parts[3], ".csv") {
+		return Day{}, false
+	}
+
+	serialNumber, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return Day{}, false
+	}
+
+	zone, err := strconv.ParseInt(parts[1], 10, 32)
+	if err != nil {
+		return Day{}, false
+	}
+
+	at, err := time.Parse(dayLayout, strings.TrimSuffix(parts[3], ".csv"))
+	if err != nil {
+		return Day{}, false
+	}
+
+	return Day{SerialNumber: serialNumber, Zone: int32(zone), Metric: parts[2], At: at}, true
+}
+
+func formatLine(at time.Time, value float64) []byte {
+	ms := at.UnixNano() / int64(time.Millisecond)
+
+	return []byte(strconv.FormatInt(ms, 10) + "," + strconv.FormatFloat(value, 'f', -1, 64) + "\n")
+}
+
+func appendFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create series dir: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open series file: %w", err)
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write series file: %w", err)
+	}
+
+	return file.Close()
+}
+
+func formatBucket(b Bucket) []byte {
+	ms := b.At.UnixNano() / int64(time.Millisecond)
+	format := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+
+	return []byte(strings.Join([]string{
+		strconv.FormatInt(ms, 10), format(b.Min), format(b.Max), format(b.Avg), format(b.Last), strconv.Itoa(b.Count),
+	}, ",") + "\n")
+}
+
+// readFile calls fn with each line of the file, a missing file has none. A
+// torn last line of a crash is skipped.
+func readFile(path string, fn func(at time.Time, value float64)) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open series file: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ",", 2)
+		if len(fields) != 2 {
+			continue
+		}
+
+		ms, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			continue
+		}
+
+		fn(time.Unix(0, ms*int64(time.Millisecond)).UTC(), value)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read series file: %w", err)
+	}
+
+	return nil
+}
+
+// readRollupFile calls fn with each bucket of the file, a missing file has
+// none.
+func readRollupFile(path string, fn func(b Bucket)) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read rollup file: %w", err)
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(line, ",")
+		if len(fields) != 6 {
+			continue
+		}
+
+		var values [4]float64
+		ms, err := strconv.ParseInt(fields[0], 10, 64)
+		for i := range values {
+			if err == nil {
+				values[i], err = strconv.ParseFloat(fields[i+1], 64)
+			}
+		}
+		count, countErr := strconv.Atoi(fields[5])
+		if err != nil || countErr != nil {
+			continue
+		}
+
+		fn(Bucket{
+			At:    time.Unix(0, ms*int64(time.Millisecond)).UTC(),
+			Min:   values[0],
+			Max:   values[1],
+			Avg:   values[2],
+			Last:  values[3],
+			Count: count,
+		})
+	}
+
+	return nil
+}
@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"math"
+	"time"
+)
+
+// Bucket aggregates the readings from At for the step of the query.
+type Bucket struct {
+	At    time.Time `json:"at"`
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+	Avg   float64   `json:"avg"`
+	Last  float64   `json:"last"`
+	Count int       `json:"count"`
+}
+
+// Point is a reading kept by downsampling.
+type Point struct {
+	At    time.Time `json:"at"`
+	Value float64   `json:"value"`
+}
+
+// Aggregate puts the readings, oldest first, into buckets of step starting
+// at from. Buckets without readings are left out.
+func Aggregate(readings []Reading, from time.Time, step time.Duration) []Bucket {
+	var buckets []Bucket
+
+	for _, r := range readings {
+		at := from.Add(r.At.Sub(from) / step * step)
+
+		if n := len(buckets); n > 0 && buckets[n-1].At.Equal(at) {
+			b := &buckets[n-1]
+			b.Min = math.Min(b.Min, r.Value)
+			b.Max = math.Max(b.Max, r.Value)
+			// Avg holds the sum until the bucket is done
+			b.Avg += r.Value
+			b.Last = r.Value
+			b.Count++
+			continue
+		}
+
+		buckets = append(buckets, Bucket{At: at, Min: r.Value, Max: r.Value, Avg: r.Value, Last: r.Value, Count: 1})
+	}
+
+	for i := range buckets {
+		buckets[i].Avg /= float64(buckets[i].Count)
+	}
+
+	return buckets
+}
+
+// Merge puts the buckets of a rollup, oldest first, into buckets of step
+// starting at from.
+func Merge(buckets []Bucket, from time.Time, step time.Duration) []Bucket {
+	var merged []Bucket
+
+	for _, b := range buckets {
+		at := from.Add(b.At.Sub(from) / step * step)
+
+		if n := len(merged); n > 0 && merged[n-1].At.Equal(at) {
+			m := &merged[n-1]
+			m.Min = math.Min(m.Min, b.Min)
+			m.Max = math.Max(m.Max, b.Max)
+			// Avg holds the sum until the bucket is done
+			m.Avg += b.Avg * float64(b.Count)
+			m.Last = b.Last
+			m.Count += b.Count
+			continue
+		}
+
+		b.Avg *= float64(b.Count)
+		b.At = at
+		merged = append(merged, b)
+	}
+
+	for i := range merged {
+		merged[i].Avg /= float64(merged[i].Count)
+	}
+
+	return merged
+}
+
+// Downsample keeps threshold of the readings, oldest first, with the
+// largest-triangle-three-buckets algorithm: the first and the last reading
+// and from each bucket between the one spanning the largest triangle with
+// the reading kept before and the average of the next bucket. All readings
+// are kept when there are no more than threshold.
+func Downsample(readings []Reading, threshold int) []Point {
+	if threshold < 3 || len(readings) <= threshold {
+		points := make([]Point, len(readings))
+		for i, r := range readings {
+			points[i] = Point{At: r.At, Value: r.Value}
+		}
+
+		return points
+	}
+
+	x := func(i int) float64 { return float64(readings[i].At.UnixNano()) / float64(time.Millisecond) }
+	y := func(i int) float64 { return readings[i].Value }
+
+	points := make([]Point, 0, threshold)
+	points = append(points, Point{At: readings[0].At, Value: readings[0].Value})
+
+	every := float64(len(readings)-2) / float64(threshold-2)
+	a := 0
+
+	for i := 0; i < threshold-2; i++ {
+		// the average of the next bucket
+		avgStart := int(float64(i+1)*every) + 1
+		avgEnd := int(float64(i+2)*every) + 1
+		if avgEnd > len(readings) {
+			avgEnd = len(readings)
+		}
+
+		var avgX, avgY float64
+		for j := avgStart; j < avgEnd; j++ {
+			avgX += x(j)
+			avgY += y(j)
+		}
+		avgX /= float64(avgEnd - avgStart)
+		avgY /= float64(avgEnd - avgStart)
+
+		// the reading of this bucket spanning the largest triangle
+		start := int(float64(i)*every) + 1
+		end := int(float64(i+1)*every) + 1
+
+		maxArea, next := -1.0, start
+		for j := start; j < end; j++ {
+			area := math.Abs((x(a)-avgX)*(y(j)-y(a)) - (x(a)-x(j))*(avgY-y(a)))
+			if area > maxArea {
+				maxArea, next = area, j
+			}
+		}
+
+		points = append(points, Point{At: readings[next].At, Value: readings[next].Value})
+		a = next
+	}
+
+	last := len(readings) - 1
+
+	return append(points, Point{At: readings[last].At, Value: readings[last].Value})
+}
@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// series returns a reading of each value, a second apart from start.
+func series(values ...float64) []Reading {
+	readings := make([]Reading, len(values))
+	for i, v := range values {
+		readings[i] = Reading{At: start.Add(time.Duration(i) * time.Second), Value: v}
+	}
+
+	return readings
+}
+
+func TestAggregate(t *testing.T) {
+	tests := []struct {
+		name     string
+		readings []Reading
+		step     time.Duration
+		want     []Bucket
+	}{
+		{"empty", nil, time.Minute, nil},
+		{"one bucket", series(1, 3, 2), time.Minute, []Bucket{
+			{At: start, Min: 1, Max: 3, Avg: 2, Last: 2, Count: 3},
+		}},
+		{"a bucket each", series(1, 3, 2), time.Second, []Bucket{
+			{At: start, Min: 1, Max: 1, Avg: 1, Last: 1, Count: 1},
+			{At: start.Add(time.Second), Min: 3, Max: 3, Avg: 3, Last: 3, Count: 1},
+			{At: start.Add(2 * time.Second), Min: 2, Max: 2, Avg: 2, Last: 2, Count: 1},
+		}},
+		{"split on the step", series(4, 2, 6, 8), 2 * time.Second, []Bucket{
+			{At: start, Min: 2, Max: 4, Avg: 3, Last: 2, Count: 2},
+			{At: start.Add(2 * time.Second), Min: 6, Max: 8, Avg: 7, Last: 8, Count: 2},
+		}},
+		{"empty buckets left out", []Reading{
+			{At: start, Value: 1},
+			{At: start.Add(10 * time.Minute), Value: 5},
+		}, time.Minute, []Bucket{
+			{At: start, Min: 1, Max: 1, Avg: 1, Last: 1, Count: 1},
+			{At: start.Add(10 * time.Minute), Min: 5, Max: 5, Avg: 5, Last: 5, Count: 1},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Aggregate(tt.readings, start, tt.step); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	readings := series(4, 2, 6, 8, 1, 9, 3)
+
+	tests := []struct {
+		name       string
+		from, step time.Duration
+	}{
+		{"seconds into pairs", time.Second, 2 * time.Second},
+		{"seconds into one", time.Second, time.Minute},
+		{"pairs into fours", 2 * time.Second, 4 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Merge(Aggregate(readings, start, tt.from), start, tt.step)
+
+			if want := Aggregate(readings, start, tt.step); !reflect.DeepEqual(got, want) {
+				t.Errorf("merged %+v, want %+v as aggregated from the readings", got, want)
+			}
+		})
+	}
+}
+
+func TestDownsample(t *testing.T) {
+	// a flat line with a spike and a dip the downsampling has to keep
+	long := make([]float64, 1000)
+	long[300], long[700] = 50, -50
+
+	tests := []struct {
+		name      string
+		readings  []Reading
+		threshold int
+		want      int
+		// keep are values that must survive.
+		keep []float64
+	}{
+		{"empty", nil, 10, 0, nil},
+		{"under the threshold", series(1, 2, 3), 10, 3, []float64{1, 2, 3}},
+		{"at the threshold", series(1, 2, 3, 4), 4, 4, []float64{1, 2, 3, 4}},
+		{"threshold too small", series(1, 2, 3, 4), 2, 4, nil},
+		{"downsampled", series(long...), 100, 100, []float64{50, -50}},
+		{"down to three", series(long...), 3, 3, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Downsample(tt.readings, tt.threshold)
+
+			if len(got) != tt.want {
+				t.Fatalf("kept %d points, want %d", len(got), tt.want)
+			}
+
+			if len(got) == 0 {
+				return
+			}
+
+			first, last := tt.readings[0], tt.readings[len(tt.readings)-1]
+			if got[0] != (Point{At: first.At, Value: first.Value}) || got[len(got)-1] != (Point{At: last.At, Value: last.Value}) {
+				t.Errorf("first and last points %+v and %+v are not the first and last readings", got[0], got[len(got)-1])
+			}
+
+			for i := 1; i < len(got); i++ {
+				if !got[i].At.After(got[i-1].At) {
+					t.Fatalf("point %d at %v is not after %v", i, got[i].At, got[i-1].At)
+				}
+			}
+
+			for _, v := range tt.keep {
+				if !hasValue(got, v) {
+					t.Errorf("value %v is not kept", v)
+				}
+			}
+		})
+	}
+}
+
+func hasValue(points []Point, v float64) bool {
+	for _, p := range points {
+		if math.Abs(p.Value-v) < 1e-9 {
+			return true
+		}
+	}
+
+	return false
+}
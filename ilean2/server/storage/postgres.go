@@ -0,0 +1,251 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// schema is applied when the database is opened.
+const schema = `
+CREATE TABLE IF NOT EXISTS readings (
+	serial_number integer          NOT NULL,
+	zone          integer          NOT NULL,
+	metric        text             NOT NULL,
+	at            timestamptz      NOT NULL,
+	value         double precision NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS readings_series ON readings (serial_number, zone, metric, at);
+
+ALTER TABLE readings ADD COLUMN IF NOT EXISTS saved_at timestamptz NOT NULL DEFAULT now();
+
+CREATE INDEX IF NOT EXISTS readings_saved ON readings (saved_at);
+
+CREATE TABLE IF NOT EXISTS rollups (
+	step          integer          NOT NULL,
+	serial_number integer          NOT NULL,
+	zone          integer          NOT NULL,
+	metric        text             NOT NULL,
+	at            timestamptz      NOT NULL,
+	min           double precision NOT NULL,
+	max           double precision NOT NULL,
+	avg           double precision NOT NULL,
+	last          double precision NOT NULL,
+	count         integer          NOT NULL,
+	PRIMARY KEY (step, serial_number, zone, metric, at)
+);
+`
+
+// Postgres keeps readings in a PostgreSQL table and their rollups in
+// another, the step in seconds.
+type Postgres struct {
+	db *sql.DB
+}
+
+func OpenPostgres(url string) (*Postgres, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create schema: %w", err)
+	}
+
+	return &Postgres{db: db}, nil
+}
+
+// Save copies the readings in one transaction.
+func (p *Postgres) Save(ctx context.Context, readings []Reading) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("readings", "serial_number", "zone", "metric", "at", "value"))
+	if err != nil {
+		return fmt.Errorf("failed to prepare copy: %w", err)
+	}
+
+	for _, r := range readings {
+		if _, err := stmt.ExecContext(ctx, r.SerialNumber, r.Zone, r.Metric, r.At, r.Value); err != nil {
+			stmt.Close()
+			return fmt.Errorf("failed to copy reading: %w", err)
+		}
+	}
+
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return fmt.Errorf("failed to copy readings: %w", err)
+	}
+
+	if err := stmt.Close(); err != nil {
+		return fmt.Errorf("failed to copy readings: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+func (p *Postgres) Readings(ctx context.Context, query Query) ([]Reading, error) {
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT at, value FROM readings
+		WHERE serial_number = $1 AND zone = $2 AND metric = $3 AND at >= $4 AND at < $5
+		ORDER BY at`,
+		query.SerialNumber, query.Zone, query.Metric, query.From, query.To)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query readings: %w", err)
+	}
+	defer rows.Close()
+
+	var readings []Reading
+	for rows.Next() {
+		r := Reading{SerialNumber: query.SerialNumber, Zone: query.Zone, Metric: query.Metric}
+		if err := rows.Scan(&r.At, &r.Value); err != nil {
+			return nil, fmt.Errorf("failed to scan reading: %w", err)
+		}
+
+		r.At = r.At.UTC()
+		readings = append(readings, r)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read readings: %w", err)
+	}
+
+	return readings, nil
+}
+
+// Changed returns the days with rows saved since then.
+func (p *Postgres) Changed(ctx context.Context, since time.Time) ([]Day, error) {
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT DISTINCT serial_number, zone, metric, date_trunc('day', at AT TIME ZONE 'UTC')
+		FROM readings WHERE saved_at >= $1`,
+		since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query changed days: %w", err)
+	}
+	defer rows.Close()
+
+	var days []Day
+	for rows.Next() {
+		var day Day
+		if err := rows.Scan(&day.SerialNumber, &day.Zone, &day.Metric, &day.At); err != nil {
+			return nil, fmt.Errorf("failed to scan changed day: %w", err)
+		}
+
+		// a timestamp without a time zone, the UTC day
+		day.At = time.Date(day.At.Year(), day.At.Month(), day.At.Day(), 0, 0, 0, 0, time.UTC)
+		days = append(days, day)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read changed days: %w", err)
+	}
+
+	return days, nil
+}
+
+// SaveRollup deletes the buckets of the day and copies the new ones in one
+// transaction.
+func (p *Postgres) SaveRollup(ctx context.Context, step time.Duration, day Day, buckets []Bucket) error {
+	seconds := int(step / time.Second)
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM rollups
+		WHERE step = $1 AND serial_number = $2 AND zone = $3 AND metric = $4 AND at >= $5 AND at < $6`,
+		seconds, day.SerialNumber, day.Zone, day.Metric, day.At, day.At.Add(24*time.Hour))
+	if err != nil {
+		return fmt.Errorf("failed to delete rollup: %w", err)
+	}
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("rollups", "step", "serial_number", "zone", "metric", "at", "min", "max", "avg", "last", "count"))
+	if err != nil {
+		return fmt.Errorf("failed to prepare copy: %w", err)
+	}
+
+	for _, b := range buckets {
+		if _, err := stmt.ExecContext(ctx, seconds, day.SerialNumber, day.Zone, day.Metric, b.At, b.Min, b.Max, b.Avg, b.Last, b.Count); err != nil {
+			stmt.Close()
+			return fmt.Errorf("failed to copy bucket: %w", err)
+		}
+	}
+
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return fmt.Errorf("failed to copy rollup: %w", err)
+	}
+
+	if err := stmt.Close(); err != nil {
+		return fmt.Errorf("failed to copy rollup: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+func (p *Postgres) Rollup(ctx context.Context, step time.Duration, query Query) ([]Bucket, error) {
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT at, min, max, avg, last, count FROM rollups
+		WHERE step = $1 AND serial_number = $2 AND zone = $3 AND metric = $4 AND at >= $5 AND at < $6
+		ORDER BY at`,
+		int(step/time.Second), query.SerialNumber, query.Zone, query.Metric, query.From, query.To)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query rollup: %w", err)
+	}
+	defer rows.Close()
+
+	var buckets []Bucket
+	for rows.Next() {
+		var b Bucket
+		if err := rows.Scan(&b.At, &b.Min, &b.Max, &b.Avg, &b.Last, &b.Count); err != nil {
+			return nil, fmt.Errorf("failed to scan bucket: %w", err)
+		}
+
+		b.At = b.At.UTC()
+		buckets = append(buckets, b)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read rollup: %w", err)
+	}
+
+	return buckets, nil
+}
+
+func (p *Postgres) Expire(ctx context.Context, step time.Duration, before time.Time) (int64, error) {
+	var (
+		result sql.Result
+		err    error
+	)
+
+	if step == 0 {
+		result, err = p.db.ExecContext(ctx, `DELETE FROM readings WHERE at < $1`, before)
+	} else {
+		result, err = p.db.ExecContext(ctx, `DELETE FROM rollups WHERE step = $1 AND at < $2`, int(step/time.Second), before)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to expire rows: %w", err)
+	}
+
+	return result.RowsAffected()
+}
+
+func (p *Postgres) Close() error {
+	return p.db.Close()
+}
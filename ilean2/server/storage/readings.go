@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"iLean/entity"
+	"strconv"
+	"time"
+)
+
+// FromCommand returns the readings in the telemetry of the controller,
+// nil for commands that carry none. Table rows of unused zones are
+// skipped.
+func FromCommand(serialNumber int, command entity.Command) ([]Reading, error) {
+	at := time.Now()
+	if command.Timestamp > 0 {
+		// buffered telemetry keeps the time the agent read it
+		at = time.Unix(0, command.Timestamp*int64(time.Millisecond))
+	}
+
+	var readings []Reading
+	add := func(zone int32, metric string, value float64) {
+		readings = append(readings, Reading{SerialNumber: serialNumber, Zone: zone, Metric: metric, At: at, Value: value})
+	}
+
+	switch command.TypeCommand {
+	case 1:
+		var data entity.DataCommandTemperature
+		if err := json.Unmarshal(command.Data, &data); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal command temperature: %w", err)
+		}
+
+		add(data.Zone, MetricTempAir, decimal(data.TempAir))
+		add(data.Zone, MetricHumidityAir, float64(data.HumidityAir))
+		add(data.Zone, MetricTempFloor, decimal(data.Tempfloor))
+		add(data.Zone, MetricCO2, decimal(data.CO2))
+	case 2:
+		var rows []entity.DataCommandTemperatureBySensor
+		if err := json.Unmarshal(command.Data, &rows); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal setpoint table: %w", err)
+		}
+
+		for _, row := range rows {
+			if row.Zone > 0 {
+				add(row.Zone, MetricSetpoint, decimal(row.SetpointValueTemp))
+				add(row.Zone, MetricTypeRegulation, float64(row.TypeRegulation))
+			}
+		}
+	case 3:
+		var rows []entity.DataVent
+		if err := json.Unmarshal(command.Data, &rows); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal vent table: %w", err)
+		}
+
+		for _, row := range rows {
+			if row.Zone > 0 {
+				add(int32(row.Zone), MetricVentSpeed, float64(row.VentSpeed))
+			}
+		}
+	case 7:
+		var data entity.DataVentModule
+		if err := json.Unmarshal(command.Data, &data); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal vent module: %w", err)
+		}
+
+		zone := int32(data.Zone)
+		add(zone, MetricModuleDelta, float64(data.Delta))
+		add(zone, MetricModuleTypeRegulation, float64(data.TypeRegulation))
+		add(zone, MetricModuleDamperInterval, float64(data.IntervalTimeVentilationDampers))
+		add(zone, MetricModuleCO2VentPeriod, float64(data.VentilationPeriodAfterCO2ReductionTime))
+	case 8:
+		var rows []entity.DataCommandHumidityModule
+		if err := json.Unmarshal(command.Data, &rows); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal humidity table: %w", err)
+		}
+
+		for _, row := range rows {
+			if row.Zone > 0 {
+				add(row.Zone, MetricHumiditySetpoint, decimal(row.Setpoint))
+				add(row.Zone, MetricHysteresis, float64(row.Hysteresis))
+			}
+		}
+	}
+
+	return readings, nil
+}
+
+// decimal widens the value as it is written, 21.3 stays 21.3.
+func decimal(v float32) float64 {
+	f, _ := strconv.ParseFloat(strconv.FormatFloat(float64(v), 'f', -1, 32), 64)
+	return f
+}
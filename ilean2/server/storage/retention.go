@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultRetention keeps raw readings for a week, 5 minute rollups for 90
+// days and hourly rollups forever.
+const DefaultRetention = "raw=7d,5m=90d,1h=forever"
+
+const oneDay = 24 * time.Hour
+
+// Tier is a rollup of buckets of Step kept for Keep, forever if zero.
+type Tier struct {
+	Step time.Duration
+	Keep time.Duration
+}
+
+// Retention is how long raw readings and each rollup are kept. Raw
+// readings are kept forever if Raw is zero.
+type Retention struct {
+	Raw     time.Duration
+	Rollups []Tier
+}
+
+// ParseRetention reads comma separated tiers like raw=7d or 5m=90d, the
+// raw readings or the step of a rollup and how long it is kept: a
+// duration, days like 90d or forever. Rollup steps are from a minute to a
+// day and divide a day.
+func ParseRetention(s string) (Retention, error) {
+	var retention Retention
+	steps := make(map[time.Duration]bool)
+
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return Retention{}, fmt.Errorf("retention %q is not tier=keep", field)
+		}
+
+		keep, err := parseDuration(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return Retention{}, fmt.Errorf("retention %q: %w", field, err)
+		}
+
+		name := strings.TrimSpace(parts[0])
+		if name == "raw" {
+			retention.Raw = keep
+			continue
+		}
+
+		step, err := parseDuration(name)
+		if err != nil || step < time.Minute || step > oneDay || oneDay%step != 0 {
+			return Retention{}, fmt.Errorf("retention %q: rollup step must be from a minute to a day and divide a day", field)
+		}
+		if steps[step] {
+			return Retention{}, fmt.Errorf("retention %q: rollup step is repeated", field)
+		}
+		if keep != 0 && keep < step {
+			return Retention{}, fmt.Errorf("retention %q: rollup is kept for less than its step", field)
+		}
+
+		steps[step] = true
+		retention.Rollups = append(retention.Rollups, Tier{Step: step, Keep: keep})
+	}
+
+	sort.Slice(retention.Rollups, func(i, j int) bool { return retention.Rollups[i].Step < retention.Rollups[j].Step })
+
+	return retention, nil
+}
+
+func (r Retention) String() string {
+	fields := []string{"raw=" + formatKeep(r.Raw)}
+	for _, tier := range r.Rollups {
+		fields = append(fields, formatDuration(tier.Step)+"="+formatKeep(tier.Keep))
+	}
+
+	return strings.Join(fields, ",")
+}
+
+// Covers reports whether the readings or the buckets kept for keep still
+// reach back to from.
+func Covers(keep time.Duration, from, now time.Time) bool {
+	return keep == 0 || !from.Before(now.Add(-keep))
+}
+
+// parseDuration reads a time.Duration, whole days like 7d or forever,
+// which is zero.
+func parseDuration(s string) (time.Duration, error) {
+	if s == "forever" {
+		return 0, nil
+	}
+
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || days <= 0 {
+			return 0, errors.New("days must be a positive number like 7d")
+		}
+
+		return time.Duration(days) * oneDay, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, errors.New("must be a positive duration like 12h, days like 7d or forever")
+	}
+
+	return d, nil
+}
+
+func formatKeep(d time.Duration) string {
+	if d == 0 {
+		return "forever"
+	}
+
+	return formatDuration(d)
+}
+
+// formatDuration writes the duration in its largest whole unit, 5m rather
+// than 5m0s.
+func formatDuration(d time.Duration) string {
+	switch {
+	case d%oneDay == 0:
+		return strconv.Itoa(int(d/oneDay)) + "d"
+	case d%time.Hour == 0:
+		return strconv.Itoa(int(d/time.Hour)) + "h"
+	case d%time.Minute == 0:
+		return strconv.Itoa(int(d/time.Minute)) + "m"
+	}
+
+	return d.String()
+}
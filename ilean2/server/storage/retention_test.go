@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRetention(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    Retention
+		wantErr bool
+	}{
+		{spec: DefaultRetention, want: Retention{Raw: 7 * oneDay, Rollups: []Tier{
+			{Step: 5 * time.Minute, Keep: 90 * oneDay},
+			{Step: time.Hour},
+		}}},
+		{spec: "1h=forever, raw=12h, 5m=30d", want: Retention{Raw: 12 * time.Hour, Rollups: []Tier{
+			{Step: 5 * time.Minute, Keep: 30 * oneDay},
+			{Step: time.Hour},
+		}}},
+		{spec: "raw=forever", want: Retention{}},
+		{spec: "", want: Retention{}},
+		{spec: "raw", wantErr: true},
+		{spec: "raw=0d", wantErr: true},
+		{spec: "raw=-1h", wantErr: true},
+		{spec: "30s=1d", wantErr: true},
+		{spec: "7m=1d", wantErr: true},
+		{spec: "2d=forever", wantErr: true},
+		{spec: "5m=1d,5m=2d", wantErr: true},
+		{spec: "1h=30m", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := ParseRetention(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parse: %v, want error %v", err, tt.wantErr)
+			}
+
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetentionString(t *testing.T) {
+	retention, err := ParseRetention(DefaultRetention)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := retention.String(); s != DefaultRetention {
+		t.Errorf("got %q, want %q", s, DefaultRetention)
+	}
+}
@@ -0,0 +1,106 @@
+// Package storage keeps the telemetry of the controllers: zone readings,
+// setpoints, vent speeds and module settings, each a value of a metric of a
+// zone of a controller at a time.
+package storage
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// Metrics of the telemetry commands.
+const (
+	// command 1
+	MetricTempAir     = "temp_air"
+	MetricHumidityAir = "humidity_air"
+	MetricTempFloor   = "temp_floor"
+	MetricCO2         = "co2"
+	// command 2
+	MetricSetpoint       = "setpoint"
+	MetricTypeRegulation = "type_regulation"
+	// command 3
+	MetricVentSpeed = "vent_speed"
+	// command 7, the module settings
+	MetricModuleDelta          = "module_delta"
+	MetricModuleTypeRegulation = "module_type_regulation"
+	MetricModuleDamperInterval = "module_damper_interval"
+	MetricModuleCO2VentPeriod  = "module_co2_vent_period"
+	// command 8
+	MetricHumiditySetpoint = "humidity_setpoint"
+	MetricHysteresis       = "hysteresis"
+)
+
+// Metrics lists every metric stored.
+var Metrics = []string{
+	MetricTempAir, MetricHumidityAir, MetricTempFloor, MetricCO2,
+	MetricSetpoint, MetricTypeRegulation,
+	MetricVentSpeed,
+	MetricModuleDelta, MetricModuleTypeRegulation, MetricModuleDamperInterval, MetricModuleCO2VentPeriod,
+	MetricHumiditySetpoint, MetricHysteresis,
+}
+
+// IsMetric reports whether the metric is stored.
+func IsMetric(metric string) bool {
+	for _, m := range Metrics {
+		if m == metric {
+			return true
+		}
+	}
+
+	return false
+}
+
+type Reading struct {
+	SerialNumber int       `json:"serial_number"`
+	Zone         int32     `json:"zone"`
+	Metric       string    `json:"metric"`
+	At           time.Time `json:"at"`
+	Value        float64   `json:"value"`
+}
+
+// Query selects the readings of a metric of a zone from From up to To.
+type Query struct {
+	SerialNumber int
+	Zone         int32
+	Metric       string
+	From         time.Time
+	To           time.Time
+}
+
+// Day is a UTC day of the readings of a metric of a zone.
+type Day struct {
+	SerialNumber int
+	Zone         int32
+	Metric       string
+	At           time.Time
+}
+
+// Repository stores readings and their rollups, buckets of a step built by
+// the compaction.
+type Repository interface {
+	// Save stores the readings, they may come in any order.
+	Save(ctx context.Context, readings []Reading) error
+	// Readings returns the readings the query selects, oldest first.
+	Readings(ctx context.Context, query Query) ([]Reading, error)
+	// Changed returns the days with readings saved since then.
+	Changed(ctx context.Context, since time.Time) ([]Day, error)
+	// SaveRollup replaces the buckets of step of the day.
+	SaveRollup(ctx context.Context, step time.Duration, day Day, buckets []Bucket) error
+	// Rollup returns the buckets of step the query selects, oldest first.
+	Rollup(ctx context.Context, step time.Duration, query Query) ([]Bucket, error)
+	// Expire deletes the readings, or the buckets of step if it is not
+	// zero, before then. It returns how many files or rows it deleted.
+	Expire(ctx context.Context, step time.Duration, before time.Time) (int64, error)
+	Close() error
+}
+
+// Open opens the repository at the address: a postgres:// or
+// postgresql:// url, otherwise a directory of the file store.
+func Open(address string) (Repository, error) {
+	if strings.HasPrefix(address, "postgres://") || strings.HasPrefix(address, "postgresql://") {
+		return OpenPostgres(address)
+	}
+
+	return OpenFile(strings.TrimPrefix(address, "file://"))
+}
@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testRepository runs the same round trip against every repository, the
+// readings are dated 2000 to keep clear of other data in a test database.
+func testRepository(t *testing.T, repo Repository, serialNumber int) {
+	ctx := context.Background()
+	day := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	reading := func(zone int32, metric string, at time.Duration, value float64) Reading {
+		return Reading{SerialNumber: serialNumber, Zone: zone, Metric: metric, At: day.Add(at), Value: value}
+	}
+
+	// out of order, as buffered telemetry comes after newer readings
+	saved := []Reading{
+		reading(1, MetricTempAir, 2*time.Hour, 21.5),
+		reading(1, MetricTempAir, time.Hour, 20.25),
+		reading(1, MetricTempAir, 49*time.Hour, 19),
+		reading(1, MetricCO2, time.Hour, 600),
+		reading(2, MetricTempAir, time.Hour, 18),
+	}
+
+	before := time.Now().Add(-time.Minute)
+	if err := repo.Save(ctx, saved); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	query := Query{SerialNumber: serialNumber, Zone: 1, Metric: MetricTempAir, From: day, To: day.Add(72 * time.Hour)}
+
+	t.Run("readings", func(t *testing.T) {
+		tests := []struct {
+			name     string
+			from, to time.Duration
+			want     []Reading
+		}{
+			{"oldest first over days", 0, 72 * time.Hour, []Reading{saved[1], saved[0], saved[2]}},
+			{"from is included", time.Hour, 2 * time.Hour, []Reading{saved[1]}},
+			{"to is excluded", 0, time.Hour, nil},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				q := query
+				q.From, q.To = day.Add(tt.from), day.Add(tt.to)
+
+				got, err := repo.Readings(ctx, q)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("got %+v, want %+v", got, tt.want)
+				}
+			})
+		}
+	})
+
+	t.Run("changed", func(t *testing.T) {
+		days, err := repo.Changed(ctx, before)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := map[Day]bool{
+			{serialNumber, 1, MetricTempAir, day}:                     true,
+			{serialNumber, 1, MetricTempAir, day.Add(48 * time.Hour)}: true,
+			{serialNumber, 1, MetricCO2, day}:                         true,
+			{serialNumber, 2, MetricTempAir, day}:                     true,
+		}
+
+		got := make(map[Day]bool)
+		for _, d := range days {
+			if d.SerialNumber == serialNumber {
+				got[d] = true
+			}
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("changed %v, want %v", got, want)
+		}
+
+		days, err = repo.Changed(ctx, time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, d := range days {
+			if d.SerialNumber == serialNumber {
+				t.Errorf("changed %+v since a later time", d)
+			}
+		}
+	})
+
+	t.Run("rollup", func(t *testing.T) {
+		first := Day{SerialNumber: serialNumber, Zone: 1, Metric: MetricTempAir, At: day}
+		buckets := []Bucket{
+			{At: day.Add(time.Hour), Min: 20.25, Max: 20.25, Avg: 20.25, Last: 20.25, Count: 1},
+			{At: day.Add(2 * time.Hour), Min: 21.5, Max: 21.5, Avg: 21.5, Last: 21.5, Count: 1},
+		}
+
+		if err := repo.SaveRollup(ctx, time.Minute, first, buckets[:1]); err != nil {
+			t.Fatal(err)
+		}
+		// built again, it replaces the buckets of the day
+		if err := repo.SaveRollup(ctx, time.Minute, first, buckets); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := repo.Rollup(ctx, time.Minute, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, buckets) {
+			t.Errorf("rollup %+v, want %+v", got, buckets)
+		}
+
+		got, err = repo.Rollup(ctx, time.Hour, query)
+		if err != nil || len(got) != 0 {
+			t.Errorf("rollup of another step = %+v %v", got, err)
+		}
+	})
+
+	t.Run("expire", func(t *testing.T) {
+		deleted, err := repo.Expire(ctx, 0, day.Add(24*time.Hour))
+		if err != nil || deleted == 0 {
+			t.Fatalf("expire readings = %d %v", deleted, err)
+		}
+
+		got, err := repo.Readings(ctx, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, []Reading{saved[2]}) {
+			t.Errorf("left %+v, want the reading of the third day", got)
+		}
+
+		deleted, err = repo.Expire(ctx, time.Minute, day.Add(24*time.Hour))
+		if err != nil || deleted == 0 {
+			t.Fatalf("expire rollup = %d %v", deleted, err)
+		}
+
+		buckets, err := repo.Rollup(ctx, time.Minute, query)
+		if err != nil || len(buckets) != 0 {
+			t.Errorf("rollup left %+v %v", buckets, err)
+		}
+	})
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	if _, ok := repo.(*File); !ok {
+		t.Fatalf("opened %T, want the file store", repo)
+	}
+
+	testRepository(t, repo, 12345)
+
+	// the metric names a directory
+	if _, err := repo.Readings(context.Background(), Query{Metric: "../raw"}); err == nil {
+		t.Error("read an unknown metric")
+	}
+}
+
+// TestPostgres runs against the database at ILEAN_TEST_POSTGRES_URL, e.g.
+// postgres://postgres@localhost/ilean_test?sslmode=disable.
+func TestPostgres(t *testing.T) {
+	url := os.Getenv("ILEAN_TEST_POSTGRES_URL")
+	if url == "" {
+		t.Skip("ILEAN_TEST_POSTGRES_URL is not set")
+	}
+
+	repo, err := Open(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	// a serial number of its own, so runs do not see each other
+	testRepository(t, repo, int(time.Now().UnixNano()%1000000000))
+}
@@ -0,0 +1,14 @@
+package simulator
+
+import "os"
+
+// PTY is a pseudo-terminal pair, the simulator talks through Master and the
+// agent opens Path as its serial port.
+type PTY struct {
+	Master *os.File
+	Path   string
+
+	// slave stays open so reads on the master do not fail with EIO while
+	// the agent has the port closed.
+	slave *os.File
+}
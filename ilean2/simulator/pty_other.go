@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package simulator
+
+import "errors"
+
+// OpenPTY needs the pseudo-terminals of Linux.
+func OpenPTY() (*PTY, error) {
+	return nil, errors.New("pseudo-terminals are supported on linux only")
+}
+
+func (p *PTY) Close() error {
+	return p.Master.Close()
+}
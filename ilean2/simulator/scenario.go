@@ -0,0 +1,151 @@
+package simulator
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Scenario describes the emulated controller and how its zones behave.
+type Scenario struct {
+	Address  int32          `yaml:"address"`
+	Seed     int64          `yaml:"seed"`
+	Interval IntervalConfig `yaml:"interval"`
+	Noise    Noise          `yaml:"noise"`
+	// Inertia is the share of the distance to the setpoint the air
+	// temperature covers on every telemetry tick.
+	Inertia float32 `yaml:"inertia"`
+	Module  Module  `yaml:"module"`
+	Zones   []Zone  `yaml:"zones"`
+	Events  []Event `yaml:"events"`
+}
+
+type IntervalConfig struct {
+	Telemetry time.Duration `yaml:"telemetry"`
+	Tables    time.Duration `yaml:"tables"`
+}
+
+// Noise is the standard deviation added to every reading.
+type Noise struct {
+	TempAir     float32 `yaml:"temp_air"`
+	HumidityAir float32 `yaml:"humidity_air"`
+	TempFloor   float32 `yaml:"temp_floor"`
+	CO2         float32 `yaml:"co2"`
+}
+
+// Module holds the ventilation module settings reported by command 7.
+type Module struct {
+	Zone                                   int16 `yaml:"zone"`
+	VentSpeed                              int16 `yaml:"vent_speed"`
+	Delta                                  uint8 `yaml:"delta"`
+	TypeRegulation                         uint8 `yaml:"type_regulation"`
+	IntervalTimeVentilationDampers         uint8 `yaml:"interval_time_ventilation_dampers"`
+	VentilationPeriodAfterCO2ReductionTime uint8 `yaml:"ventilation_period_after_co_2_reduction_time"`
+}
+
+type Zone struct {
+	Zone             int32   `yaml:"zone"`
+	TempAir          float32 `yaml:"temp_air"`
+	HumidityAir      float32 `yaml:"humidity_air"`
+	TempFloor        float32 `yaml:"temp_floor"`
+	CO2              float32 `yaml:"co2"`
+	Setpoint         float32 `yaml:"setpoint"`
+	TypeRegulation   uint8   `yaml:"type_regulation"`
+	VentSpeed        int16   `yaml:"vent_speed"`
+	HumiditySetpoint float32 `yaml:"humidity_setpoint"`
+	Hysteresis       uint8   `yaml:"hysteresis"`
+}
+
+// Event changes a zone reading at a given time since the start.
+type Event struct {
+	At          time.Duration `yaml:"at"`
+	Zone        int32         `yaml:"zone"`
+	TempAir     *float32      `yaml:"temp_air"`
+	HumidityAir *float32      `yaml:"humidity_air"`
+	TempFloor   *float32      `yaml:"temp_floor"`
+	CO2         *float32      `yaml:"co2"`
+}
+
+// DefaultScenario is a single zone controller used when no file is given.
+func DefaultScenario() Scenario {
+	return Scenario{
+		Address: 101,
+		Seed:    1,
+		Interval: IntervalConfig{
+			Telemetry: 2 * time.Second,
+			Tables:    10 * time.Second,
+		},
+		Noise: Noise{
+			TempAir:     0.1,
+			HumidityAir: 1,
+			TempFloor:   0.1,
+			CO2:         20,
+		},
+		Inertia: 0.05,
+		Zones: []Zone{{
+			Zone:             1,
+			TempAir:          21,
+			HumidityAir:      40,
+			TempFloor:        20,
+			CO2:              600,
+			Setpoint:         23,
+			VentSpeed:        1,
+			HumiditySetpoint: 45,
+			Hysteresis:       5,
+		}},
+	}
+}
+
+func (s Scenario) Validate() error {
+	if s.Address < 1 {
+		return errors.New("address is empty")
+	}
+
+	if s.Interval.Telemetry <= 0 || s.Interval.Tables <= 0 {
+		return errors.New("interval must be positive")
+	}
+
+	if len(s.Zones) == 0 {
+		return errors.New("zones are empty")
+	}
+
+	zones := make(map[int32]bool, len(s.Zones))
+	for i, z := range s.Zones {
+		if z.Zone < 1 {
+			return fmt.Errorf("zones[%d].zone is empty", i)
+		}
+
+		zones[z.Zone] = true
+	}
+
+	for i, e := range s.Events {
+		if !zones[e.Zone] {
+			return fmt.Errorf("events[%d].zone: unknown zone %d", i, e.Zone)
+		}
+	}
+
+	return nil
+}
+
+func LoadScenario(path string) (Scenario, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Scenario{}, fmt.Errorf("read scenario %s file: %w", path, err)
+	}
+
+	s := DefaultScenario()
+	s.Zones = nil
+
+	if err := yaml.Unmarshal(raw, &s); err != nil {
+		return Scenario{}, fmt.Errorf("YAML unmarshal scenario: %w", err)
+	}
+
+	if err := s.Validate(); err != nil {
+		return Scenario{}, fmt.Errorf("invalid scenario %s: %w", path, err)
+	}
+
+	return s, nil
+}
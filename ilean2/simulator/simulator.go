@@ -0,0 +1,325 @@
+package simulator
+
+import (
+	"context"
+	"iLean/protocol"
+	"io"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Controller emulates the climate controller on the other end of the UART.
+type Controller struct {
+	scenario Scenario
+	rw       io.ReadWriter
+	encoder  *protocol.Encoder
+	rand     *rand.Rand
+	log      *logrus.Entry
+
+	mutex  sync.Mutex
+	zones  []Zone
+	module Module
+
+	writeMutex sync.Mutex
+}
+
+func New(scenario Scenario, rw io.ReadWriter) *Controller {
+	zones := make([]Zone, len(scenario.Zones))
+	copy(zones, scenario.Zones)
+
+	return &Controller{
+		scenario: scenario,
+		rw:       rw,
+		encoder:  protocol.NewEncoder(rw),
+		rand:     rand.New(rand.NewSource(scenario.Seed)),
+		log:      logrus.WithField("subsystem", "simulator"),
+		zones:    zones,
+		module:   scenario.Module,
+	}
+}
+
+// Run emits telemetry and applies settings until ctx is cancelled or the
+// line fails.
+func (c *Controller) Run(ctx context.Context) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.readLoop()
+	}()
+
+	telemetry := time.NewTicker(c.scenario.Interval.Telemetry)
+	defer telemetry.Stop()
+
+	tables := time.NewTicker(c.scenario.Interval.Tables)
+	defer tables.Stop()
+
+	for _, event := range c.scenario.Events {
+		event := event
+		timer := time.AfterFunc(event.At, func() { c.apply(event) })
+		defer timer.Stop()
+	}
+
+	if err := c.sendTables(); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errs:
+			return err
+		case <-telemetry.C:
+			if err := c.sendTelemetry(); err != nil {
+				return err
+			}
+		case <-tables.C:
+			if err := c.sendTables(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *Controller) readLoop() error {
+	decoder := protocol.NewDecoder(c.rw)
+
+	for {
+		frame, err := decoder.Decode()
+		if _, ok := err.(*protocol.CRCError); ok {
+			c.log.WithError(err).Warn("drop frame")
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		// other controllers share the bus
+		if frame.Address != c.scenario.Address {
+			continue
+		}
+
+		c.log.WithField("frame", frame).Info("received")
+
+		switch frame.Command {
+		case protocol.CommandSetTemperature, protocol.CommandSetVentModule,
+			protocol.CommandSetVentForAll, protocol.CommandSetVentByZone:
+		default:
+			continue
+		}
+
+		if err := c.handle(frame); err != nil {
+			c.log.WithError(err).WithField("frame", frame).Error("failed to apply frame")
+			continue
+		}
+
+		// the controller confirms settings by sending the frame back
+		if err := c.send(c.scenario.Address, frame.Command, frame.Payload); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *Controller) handle(frame *protocol.Frame) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	switch frame.Command {
+	case protocol.CommandSetTemperature:
+		var p protocol.Setpoint
+		if err := protocol.Unmarshal(frame.Payload, &p); err != nil {
+			return err
+		}
+
+		zone := c.zone(p.Zone)
+		if zone == nil {
+			return nil
+		}
+
+		// the same command carries a temperature, a regulation type or a
+		// humidity setpoint with hysteresis, tell them apart by the fields set
+		switch {
+		case p.Extra == 0:
+			zone.Setpoint = p.Value
+		case p.Value == 0:
+			zone.TypeRegulation = p.Extra
+		default:
+			if p.Value != math.MaxFloat32 {
+				zone.HumiditySetpoint = p.Value
+			}
+			if p.Extra != math.MaxUint8 {
+				zone.Hysteresis = p.Extra
+			}
+		}
+	case protocol.CommandSetVentModule, protocol.CommandSetVentForAll:
+		var p protocol.VentModule
+		if err := protocol.Unmarshal(frame.Payload, &p); err != nil {
+			return err
+		}
+
+		if p.Zone != 0 {
+			if zone := c.zone(int32(p.Zone)); zone != nil {
+				zone.VentSpeed = p.VentSpeed
+			}
+
+			c.module.Zone = p.Zone
+			c.module.VentSpeed = p.VentSpeed
+		}
+
+		c.module.Delta = p.Delta
+		c.module.TypeRegulation = p.TypeRegulation
+		c.module.IntervalTimeVentilationDampers = p.IntervalTimeVentilationDampers
+		c.module.VentilationPeriodAfterCO2ReductionTime = p.VentilationPeriodAfterCO2ReductionTime
+	case protocol.CommandSetVentByZone:
+		var p protocol.VentByZone
+		if err := protocol.Unmarshal(frame.Payload, &p); err != nil {
+			return err
+		}
+
+		c.module.Zone = p.Zone
+	}
+
+	return nil
+}
+
+func (c *Controller) apply(event Event) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	zone := c.zone(event.Zone)
+
+	if event.TempAir != nil {
+		zone.TempAir = *event.TempAir
+	}
+	if event.HumidityAir != nil {
+		zone.HumidityAir = *event.HumidityAir
+	}
+	if event.TempFloor != nil {
+		zone.TempFloor = *event.TempFloor
+	}
+	if event.CO2 != nil {
+		zone.CO2 = *event.CO2
+	}
+
+	c.log.WithField("event", event).Info("applied")
+}
+
+func (c *Controller) sendTelemetry() error {
+	c.mutex.Lock()
+	frames := make([]*protocol.Frame, 0, len(c.zones))
+
+	for i := range c.zones {
+		zone := &c.zones[i]
+		zone.TempAir += (zone.Setpoint - zone.TempAir) * c.scenario.Inertia
+		zone.TempFloor += (zone.Setpoint - zone.TempFloor) * c.scenario.Inertia / 2
+
+		payload, err := protocol.Marshal(protocol.Telemetry{
+			TempAir:     zone.TempAir + c.noise(c.scenario.Noise.TempAir),
+			HumidityAir: zone.HumidityAir + c.noise(c.scenario.Noise.HumidityAir),
+			TempFloor:   zone.TempFloor + c.noise(c.scenario.Noise.TempFloor),
+			CO2:         int32(zone.CO2 + c.noise(c.scenario.Noise.CO2)),
+		})
+		if err != nil {
+			c.mutex.Unlock()
+			return err
+		}
+
+		// telemetry frames carry the zone in the address field
+		frames = append(frames, protocol.NewFrame(zone.Zone, protocol.CommandTelemetry, payload))
+	}
+	c.mutex.Unlock()
+
+	for _, frame := range frames {
+		if err := c.write(frame); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *Controller) sendTables() error {
+	c.mutex.Lock()
+
+	setpoints := make([]protocol.SetpointRow, protocol.SetpointTableRows)
+	humidity := make([]protocol.HumidityRow, protocol.HumidityTableRows)
+	vents := make([]protocol.VentRow, protocol.VentTableRows)
+
+	// regulation type and hysteresis are sent shifted by one, empty rows too
+	for i := range setpoints {
+		setpoints[i].TypeRegulation = 1
+	}
+	for i := range humidity {
+		humidity[i].Hysteresis = 1
+	}
+
+	for i, zone := range c.zones {
+		if i < len(setpoints) {
+			setpoints[i] = protocol.SetpointRow{Zone: zone.Zone, Setpoint: zone.Setpoint, TypeRegulation: zone.TypeRegulation + 1}
+		}
+		if i < len(humidity) {
+			humidity[i] = protocol.HumidityRow{Zone: zone.Zone, Setpoint: zone.HumiditySetpoint, Hysteresis: zone.Hysteresis + 1}
+		}
+		if i < len(vents) {
+			vents[i] = protocol.VentRow{Zone: int16(zone.Zone), VentSpeed: zone.VentSpeed}
+		}
+	}
+
+	module := protocol.VentModule(c.module)
+	c.mutex.Unlock()
+
+	tables := []struct {
+		command uint8
+		payload interface{}
+	}{
+		{protocol.CommandSetpointTable, setpoints},
+		{protocol.CommandVentTable, vents},
+		{protocol.CommandVentModule, module},
+		{protocol.CommandHumidityTable, humidity},
+	}
+
+	for _, table := range tables {
+		payload, err := protocol.Marshal(table.payload)
+		if err != nil {
+			return err
+		}
+
+		if err := c.send(c.scenario.Address, table.command, payload); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *Controller) send(address int32, command uint8, payload []byte) error {
+	return c.write(protocol.NewFrame(address, command, payload))
+}
+
+func (c *Controller) write(frame *protocol.Frame) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	return c.encoder.Encode(frame)
+}
+
+// zone must be called with the mutex held.
+func (c *Controller) zone(id int32) *Zone {
+	for i := range c.zones {
+		if c.zones[i].Zone == id {
+			return &c.zones[i]
+		}
+	}
+
+	return nil
+}
+
+// noise must be called with the mutex held, rand.Rand is not safe for
+// concurrent use.
+func (c *Controller) noise(sigma float32) float32 {
+	return float32(c.rand.NormFloat64()) * sigma
+}